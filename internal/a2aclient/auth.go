@@ -0,0 +1,31 @@
+package a2aclient
+
+import (
+	"net/http"
+	"os"
+)
+
+// AuthHeader returns the header used to authenticate against the a2a-server,
+// as configured in the environment: A2A_AUTH_TOKEN is sent as a bearer
+// token, otherwise A2A_API_KEY is sent in A2A_API_KEY_HEADER (X-API-Key by
+// default). Both are empty when no auth is configured.
+func AuthHeader() (name, value string) {
+	if token := os.Getenv("A2A_AUTH_TOKEN"); token != "" {
+		return "Authorization", "Bearer " + token
+	}
+	if key := os.Getenv("A2A_API_KEY"); key != "" {
+		name = os.Getenv("A2A_API_KEY_HEADER")
+		if name == "" {
+			name = "X-API-Key"
+		}
+		return name, key
+	}
+	return "", ""
+}
+
+// setAuth adds the configured auth header to an outgoing request.
+func (c *Client) setAuth(req *http.Request) {
+	if c.authHeader != "" {
+		req.Header.Set(c.authHeader, c.authValue)
+	}
+}
@@ -33,6 +33,8 @@ type A2AClient interface {
 type Client struct {
 	baseURL    string
 	httpClient *http.Client
+	authHeader string
+	authValue  string
 }
 
 // New creates a new a2a-server client.
@@ -41,9 +43,12 @@ func New() (*Client, error) {
 	if port == "" {
 		return nil, fmt.Errorf("A2A_SERVER_PORT environment variable not set")
 	}
+	authHeader, authValue := AuthHeader()
 	return &Client{
 		baseURL:    fmt.Sprintf("http://localhost:%s", port),
 		httpClient: &http.Client{},
+		authHeader: authHeader,
+		authValue:  authValue,
 	}, nil
 }
 
@@ -78,7 +83,14 @@ func (c *Client) SendPrompt(contextID, prompt string) (string, error) {
 		return "", err
 	}
 
-	resp, err := c.httpClient.Post(c.baseURL, "application/json", bytes.NewBuffer(reqBody))
+	req, err := http.NewRequest("POST", c.baseURL, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.setAuth(req)
+
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -194,7 +206,14 @@ func (c *Client) SendPromptAsTask(contextID, prompt string) (string, error) {
 		return "", err
 	}
 
-	resp, err := c.httpClient.Post(c.baseURL, "application/json", bytes.NewBuffer(reqBody))
+	req, err := http.NewRequest("POST", c.baseURL, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.setAuth(req)
+
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -270,6 +289,7 @@ func (c *Client) SendPromptStream(contextID, taskID, prompt string, eventChan ch
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "text/event-stream")
+	c.setAuth(req)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -0,0 +1,46 @@
+package a2aclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthHeader(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"kind":"message","message":{"role":"agent","parts":[{"kind":"text","text":"hi"}]}}}`))
+	}))
+	defer server.Close()
+	port := server.URL[strings.LastIndex(server.URL, ":")+1:]
+
+	cases := []struct {
+		env    map[string]string
+		header string
+		want   string
+	}{
+		{map[string]string{"A2A_AUTH_TOKEN": "secret"}, "Authorization", "Bearer secret"},
+		{map[string]string{"A2A_API_KEY": "key"}, "X-API-Key", "key"},
+		{map[string]string{"A2A_API_KEY": "key", "A2A_API_KEY_HEADER": "X-Gateway-Key"}, "X-Gateway-Key", "key"},
+	}
+	for _, c := range cases {
+		t.Run(c.header, func(t *testing.T) {
+			t.Setenv("A2A_SERVER_PORT", port)
+			for k, v := range c.env {
+				t.Setenv(k, v)
+			}
+			client, err := New()
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			if _, err := client.SendPrompt("", "hello"); err != nil {
+				t.Fatalf("SendPrompt failed: %v", err)
+			}
+			if got.Get(c.header) != c.want {
+				t.Errorf("env %v: expected %s header %q, got %q", c.env, c.header, c.want, got.Get(c.header))
+			}
+		})
+	}
+}
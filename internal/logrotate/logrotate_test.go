@@ -0,0 +1,63 @@
+package logrotate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.log")
+
+	w, err := New(path, 10, 2)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer w.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	expected := map[string]string{
+		"server.log":   "fourth\n",
+		"server.log.1": "third\n",
+		"server.log.2": "second\n",
+	}
+	for name, content := range expected {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		if string(data) != content {
+			t.Errorf("Expected %s to contain %q, got %q", name, content, data)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "server.log.3")); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 rotated files to be kept")
+	}
+}
+
+func TestAppendsToExistingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.log")
+	if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatalf("Failed to write log file: %v", err)
+	}
+
+	w, err := New(path, 1024, 1)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	w.Write([]byte("new\n"))
+	w.Close()
+
+	data, _ := os.ReadFile(path)
+	if !strings.HasPrefix(string(data), "old\n") || !strings.HasSuffix(string(data), "new\n") {
+		t.Errorf("Expected new lines to be appended, got %q", data)
+	}
+}
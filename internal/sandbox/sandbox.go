@@ -0,0 +1,54 @@
+// Package sandbox confines the directories conversations and tasks work in
+// to a root directory.
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrOutsideRoot is returned for a path that doesn't resolve to the sandbox
+// root or a directory below it.
+var ErrOutsideRoot = errors.New("path is outside the sandbox root")
+
+// CheckRoot reports an error unless root is an existing directory.
+func CheckRoot(root string) error {
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return fmt.Errorf("sandbox root %q is not an existing directory", root)
+	}
+	return nil
+}
+
+// Check returns an error wrapping ErrOutsideRoot unless path, made absolute
+// and with its symlinks resolved, is root or lies below it. A path that
+// doesn't exist can't be resolved and is rejected too. An empty root allows
+// any path.
+func Check(root, path string) error {
+	if root == "" {
+		return nil
+	}
+	resolvedRoot, err := resolve(root)
+	if err != nil {
+		return fmt.Errorf("could not resolve sandbox root: %w", err)
+	}
+	resolved, err := resolve(path)
+	if err != nil {
+		return fmt.Errorf("%w: %q can't be resolved", ErrOutsideRoot, path)
+	}
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %q resolves to %s", ErrOutsideRoot, path, resolved)
+	}
+	return nil
+}
+
+func resolve(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
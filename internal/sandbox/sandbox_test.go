@@ -0,0 +1,60 @@
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	outside := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "project", "src"), 0755)
+	os.Symlink(outside, filepath.Join(root, "escape"))
+	os.Symlink(filepath.Join(root, "project"), filepath.Join(outside, "into-root"))
+
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{root, true},
+		{filepath.Join(root, "project"), true},
+		{filepath.Join(root, "project", "src"), true},
+		{filepath.Join(root, "project", "..", "project", "src"), true},
+		{filepath.Join(outside, "into-root"), true},
+		{outside, false},
+		{filepath.Join(root, ".."), false},
+		{root + "-sibling", false},
+		{filepath.Join(root, "escape"), false},
+		{filepath.Join(root, "missing"), false},
+	}
+	for _, tt := range tests {
+		err := Check(root, tt.path)
+		if tt.ok && err != nil {
+			t.Errorf("Check(%q) = %v, want nil", tt.path, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrOutsideRoot) {
+			t.Errorf("Check(%q) = %v, want ErrOutsideRoot", tt.path, err)
+		}
+	}
+
+	if err := Check("", outside); err != nil {
+		t.Errorf("Check without a root = %v, want nil", err)
+	}
+}
+
+func TestCheckSymlinkedRoot(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "real")
+	os.MkdirAll(filepath.Join(root, "work"), 0755)
+	link := filepath.Join(dir, "link")
+	os.Symlink(root, link)
+
+	if err := Check(link, filepath.Join(root, "work")); err != nil {
+		t.Errorf("Check through a symlinked root = %v, want nil", err)
+	}
+	if err := CheckRoot(filepath.Join(dir, "missing")); err == nil {
+		t.Error("CheckRoot accepted a missing directory")
+	}
+}
@@ -0,0 +1,108 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Phases of a run in progress, as reported by ActiveRuns.
+const (
+	// PhaseDataCommand covers the data_command and data_commands.
+	PhaseDataCommand = "data_command"
+	// PhaseModelCall covers waiting for the a2a-server's response.
+	PhaseModelCall = "model_call"
+	// PhasePostProcessing covers the output_command, saving the run and
+	// notifications.
+	PhasePostProcessing = "post_processing"
+)
+
+var (
+	// ErrRunNotActive is returned when cancelling a run that isn't in
+	// progress.
+	ErrRunNotActive = errors.New("run not in progress")
+	// ErrRunCancelled is the error of commands killed by CancelRun.
+	ErrRunCancelled = errors.New("run cancelled")
+)
+
+// ActiveRun describes a task run in progress.
+type ActiveRun struct {
+	RunID     string    `json:"run_id"`
+	Task      string    `json:"task"`
+	StartedAt time.Time `json:"started_at"`
+	ElapsedMs int64     `json:"elapsed_ms"`
+	Phase     string    `json:"phase"`
+}
+
+// activeRun is the registry entry of a run in progress.
+type activeRun struct {
+	ActiveRun
+	cancel context.CancelFunc
+}
+
+// startActive registers rec as in progress and returns the context its
+// commands and model call run in, cancelled by CancelRun, and a function
+// unregistering it once it finished.
+func (m *Manager) startActive(t *Task, rec *RunRecord) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	m.active[rec.ID] = &activeRun{
+		ActiveRun: ActiveRun{RunID: rec.ID, Task: t.Name, StartedAt: rec.StartedAt, Phase: PhaseDataCommand},
+		cancel:    cancel,
+	}
+	m.mu.Unlock()
+	return ctx, func() {
+		m.mu.Lock()
+		delete(m.active, rec.ID)
+		m.mu.Unlock()
+		cancel()
+	}
+}
+
+// setPhase records the phase the run entered.
+func (m *Manager) setPhase(runID, phase string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if run, ok := m.active[runID]; ok {
+		run.Phase = phase
+	}
+}
+
+// ActiveRuns lists the runs in progress, oldest first.
+func (m *Manager) ActiveRuns() []ActiveRun {
+	now := time.Now()
+	m.mu.Lock()
+	runs := make([]ActiveRun, 0, len(m.active))
+	for _, run := range m.active {
+		r := run.ActiveRun
+		r.ElapsedMs = now.Sub(r.StartedAt).Milliseconds()
+		runs = append(runs, r)
+	}
+	m.mu.Unlock()
+	sort.Slice(runs, func(i, j int) bool {
+		if !runs[i].StartedAt.Equal(runs[j].StartedAt) {
+			return runs[i].StartedAt.Before(runs[j].StartedAt)
+		}
+		return runs[i].RunID < runs[j].RunID
+	})
+	return runs
+}
+
+// CancelRun stops a run in progress, killing its commands or dropping its
+// call to the a2a-server. The run is recorded as cancelled.
+func (m *Manager) CancelRun(runID string) (ActiveRun, error) {
+	m.mu.Lock()
+	run, ok := m.active[runID]
+	if !ok {
+		m.mu.Unlock()
+		return ActiveRun{}, ErrRunNotActive
+	}
+	r := run.ActiveRun
+	m.mu.Unlock()
+	r.ElapsedMs = time.Since(r.StartedAt).Milliseconds()
+	fmt.Printf("Cancelling run %s of task '%s' during %s\n", runID, r.Task, r.Phase)
+	run.cancel()
+	return r, nil
+}
@@ -0,0 +1,101 @@
+package scheduler
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gemini-srv/internal/sandbox"
+)
+
+// shellMeta are the characters that could chain further commands onto an
+// allowed prefix, so they are refused after it.
+const shellMeta = ";&|`$<>()\\\n"
+
+// loadAllowList reads the command prefixes tasks may run, one per line.
+// Blank lines and lines starting with '#' are ignored. A relative path is
+// taken from baseDir.
+func loadAllowList(baseDir, path string) ([]string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	prefixes := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			prefixes = append(prefixes, line)
+		}
+	}
+	return prefixes, scanner.Err()
+}
+
+// commandAllowed reports whether the allow-list permits command. It must
+// either match an entry exactly or start with one and continue without
+// shell metacharacters. The entry must end there on a word boundary, so
+// "git" doesn't allow "git-anything", unless it ends with a slash and allows
+// the paths below it. Without an allow-list every command is allowed.
+func (m *Manager) commandAllowed(command string) bool {
+	if m.allowedCommands == nil {
+		return true
+	}
+	command = strings.TrimSpace(command)
+	for _, prefix := range m.allowedCommands {
+		if command == prefix {
+			return true
+		}
+		rest, ok := strings.CutPrefix(command, prefix)
+		if !ok || strings.ContainsAny(rest, shellMeta) {
+			continue
+		}
+		if strings.HasSuffix(prefix, "/") || strings.IndexAny(rest, " \t") == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckCommands checks the task's data_command, data_commands and
+// output_command against the allow-list configured with
+// TASK_COMMAND_ALLOWLIST. It returns a *ValidationError listing every
+// command that isn't allowed.
+func (m *Manager) CheckCommands(t *Task) error {
+	var errs []FieldError
+	check := func(field, command string) {
+		if strings.TrimSpace(command) != "" && !m.commandAllowed(command) {
+			errs = append(errs, FieldError{field, fmt.Sprintf("command %q is not in the allow-list", command)})
+		}
+	}
+	check("data_command", t.DataCommand)
+	check("data_argv", argvText(t.DataArgv))
+	for _, name := range t.sourceNames() {
+		src := t.DataCommands[name]
+		check("data_commands."+name+".command", src.Command)
+		check("data_commands."+name+".argv", argvText(src.Argv))
+	}
+	check("output_command", t.OutputCommand)
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// CheckContextPath checks that the task's context_path lies within the
+// sandbox root set with WithSandboxRoot. It returns a *ValidationError if it
+// doesn't.
+func (m *Manager) CheckContextPath(t *Task) error {
+	if t.ContextPath == "" {
+		return nil
+	}
+	if err := sandbox.Check(m.sandboxRoot, t.ContextPath); err != nil {
+		return &ValidationError{Errors: []FieldError{{"context_path", err.Error()}}}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// What ImportTasks does with tasks that already exist.
+const (
+	// ImportFail imports nothing if any task exists. The default.
+	ImportFail = "fail"
+	// ImportSkip keeps the existing tasks and imports the others.
+	ImportSkip = "skip"
+	// ImportOverwrite replaces the existing tasks.
+	ImportOverwrite = "overwrite"
+)
+
+// ErrInvalidConflictPolicy is returned by ImportTasks for an unknown
+// conflict policy.
+var ErrInvalidConflictPolicy = errors.New("invalid conflict policy")
+
+// ErrImportConflict is returned by ImportTasks under ImportFail when tasks in
+// the bundle already exist.
+var ErrImportConflict = errors.New("tasks already exist")
+
+// Bundle holds task definition files to move them between servers.
+type Bundle struct {
+	ExportedAt time.Time     `json:"exported_at"`
+	Tasks      []BundledTask `json:"tasks"`
+}
+
+// BundledTask is one task definition file in a Bundle.
+type BundledTask struct {
+	// Name is the definition file name, without .toml.
+	Name string `json:"name"`
+	TOML string `json:"toml"`
+}
+
+// ImportResult lists the tasks ImportTasks wrote and skipped, and how the
+// scheduler was reloaded afterwards.
+type ImportResult struct {
+	Imported []string       `json:"imported"`
+	Skipped  []string       `json:"skipped"`
+	Reload   *ReloadSummary `json:"reload"`
+}
+
+// ExportTasks returns the definition files of all tasks, sorted by name.
+func (m *Manager) ExportTasks() (*Bundle, error) {
+	files, err := os.ReadDir(m.taskDefsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read task definitions directory: %w", err)
+	}
+	bundle := &Bundle{ExportedAt: time.Now(), Tasks: []BundledTask{}}
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".toml")
+		if file.IsDir() || !ok || !ValidName(name) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(m.taskDefsPath, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		bundle.Tasks = append(bundle.Tasks, BundledTask{Name: name, TOML: string(data)})
+	}
+	sort.Slice(bundle.Tasks, func(i, j int) bool { return bundle.Tasks[i].Name < bundle.Tasks[j].Name })
+	return bundle, nil
+}
+
+// ImportTasks writes the tasks of a bundle, handling tasks that already
+// exist as onConflict says, and reloads the scheduler. Nothing is written
+// unless every task is valid; the returned *ValidationError lists the
+// problems, with fields prefixed by the task's name.
+func (m *Manager) ImportTasks(b *Bundle, onConflict string) (*ImportResult, error) {
+	switch onConflict {
+	case "":
+		onConflict = ImportFail
+	case ImportFail, ImportSkip, ImportOverwrite:
+	default:
+		return nil, fmt.Errorf("%w %q: must be %q, %q or %q", ErrInvalidConflictPolicy, onConflict, ImportFail, ImportSkip, ImportOverwrite)
+	}
+
+	var errs []FieldError
+	seen := make(map[string]bool, len(b.Tasks))
+	for _, bt := range b.Tasks {
+		field := "tasks." + bt.Name
+		if !ValidName(bt.Name) || seen[bt.Name] {
+			errs = append(errs, FieldError{field, "name must be a unique task file name"})
+			continue
+		}
+		seen[bt.Name] = true
+		var task Task
+		if err := toml.Unmarshal([]byte(bt.TOML), &task); err != nil {
+			errs = append(errs, FieldError{field, fmt.Sprintf("invalid TOML: %v", err)})
+			continue
+		}
+		if Slug(task.Name) != bt.Name {
+			errs = append(errs, FieldError{field, fmt.Sprintf("task %q must be stored as %s.toml", task.Name, Slug(task.Name))})
+		}
+		for _, err := range []error{ValidateTask(&task), m.CheckCommands(&task), m.CheckContextPath(&task)} {
+			var verr *ValidationError
+			if errors.As(err, &verr) {
+				for _, fe := range verr.Errors {
+					errs = append(errs, FieldError{field + "." + fe.Field, fe.Message})
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Errors: errs}
+	}
+
+	result := &ImportResult{Imported: []string{}, Skipped: []string{}}
+	var conflicts []string
+	for _, bt := range b.Tasks {
+		if _, err := os.Stat(filepath.Join(m.taskDefsPath, bt.Name+".toml")); err == nil {
+			conflicts = append(conflicts, bt.Name)
+		}
+	}
+	if len(conflicts) > 0 && onConflict == ImportFail {
+		return nil, fmt.Errorf("%w: %s", ErrImportConflict, strings.Join(conflicts, ", "))
+	}
+	for _, bt := range b.Tasks {
+		path := filepath.Join(m.taskDefsPath, bt.Name+".toml")
+		if _, err := os.Stat(path); err == nil && onConflict == ImportSkip {
+			result.Skipped = append(result.Skipped, bt.Name)
+			continue
+		}
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, []byte(bt.TOML), 0644); err != nil {
+			return nil, fmt.Errorf("could not write task %s: %w", bt.Name, err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return nil, fmt.Errorf("could not write task %s: %w", bt.Name, err)
+		}
+		result.Imported = append(result.Imported, bt.Name)
+	}
+	fmt.Printf("Imported %d task(s), skipped %d\n", len(result.Imported), len(result.Skipped))
+
+	summary, err := m.Reload()
+	if err != nil {
+		return nil, err
+	}
+	result.Reload = summary
+	return result, nil
+}
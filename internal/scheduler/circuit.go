@@ -0,0 +1,127 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultMaxConsecutiveFailures is how many failed runs in a row open a
+// task's circuit unless it sets max_consecutive_failures.
+const defaultMaxConsecutiveFailures = 10
+
+// CircuitState reports whether a task was disabled after failing too many
+// times in a row.
+type CircuitState struct {
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// MaxConsecutiveFailures is the number of failures that opens the
+	// circuit, 0 if it never opens.
+	MaxConsecutiveFailures int `json:"max_consecutive_failures"`
+	// Open is set while scheduled and dependent runs of the task are
+	// refused.
+	Open     bool       `json:"open"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+	// RetryAt is when an open circuit lets runs through again, for tasks
+	// with a failure_cooldown.
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+}
+
+// maxConsecutiveFailures returns the number of failed runs in a row that
+// open the task's circuit, or 0 if it never opens.
+func (t *Task) maxConsecutiveFailures() int {
+	switch {
+	case t.MaxConsecutiveFailures < 0:
+		return 0
+	case t.MaxConsecutiveFailures == 0:
+		return defaultMaxConsecutiveFailures
+	}
+	return t.MaxConsecutiveFailures
+}
+
+// circuit returns the circuit state of the task.
+func (m *Manager) circuit(t *Task) CircuitState {
+	state := CircuitState{MaxConsecutiveFailures: t.maxConsecutiveFailures()}
+	m.taskStats.mu.Lock()
+	if c, ok := m.taskStats.counters[outputDirName(t)]; ok {
+		state.ConsecutiveFailures = c.ConsecutiveFailures
+		if c.CircuitOpenedAt != nil {
+			openedAt := *c.CircuitOpenedAt
+			state.OpenedAt = &openedAt
+		}
+	}
+	m.taskStats.mu.Unlock()
+	if state.OpenedAt == nil {
+		return state
+	}
+	state.Open = true
+	if cooldown, err := time.ParseDuration(t.FailureCooldown); err == nil && cooldown > 0 {
+		retryAt := state.OpenedAt.Add(cooldown)
+		state.RetryAt = &retryAt
+		state.Open = time.Now().Before(retryAt)
+	}
+	return state
+}
+
+// circuitOpen reports whether runs of the task are refused until it is
+// enabled again.
+func (m *Manager) circuitOpen(t *Task) bool {
+	state := m.circuit(t)
+	if state.Open {
+		fmt.Printf("Task '%s' is disabled after %d consecutive failures, not running it\n", t.Name, state.ConsecutiveFailures)
+	}
+	return state.Open
+}
+
+// tripCircuit opens the task's circuit once rec, a failed run, brings its
+// consecutive failures to the task's maximum. Each further failure while
+// open, such as a run let through after the cool-down, opens it anew.
+// m.taskStats.mu must be held.
+func (m *Manager) tripCircuit(t *Task, c *taskCounters, rec *RunRecord) {
+	max := t.maxConsecutiveFailures()
+	if !rec.failed() || max == 0 || c.ConsecutiveFailures < max {
+		return
+	}
+	openedAt := rec.FinishedAt
+	c.CircuitOpenedAt = &openedAt
+	rec.CircuitOpened = true
+	fmt.Printf("Task '%s' failed %d times in a row, disabling it until it is enabled again\n", t.Name, c.ConsecutiveFailures)
+}
+
+// Circuit returns the circuit state of the named task.
+func (m *Manager) Circuit(name string) (CircuitState, error) {
+	task, err := m.loadTask(name)
+	if err != nil {
+		return CircuitState{}, err
+	}
+	return m.circuit(task), nil
+}
+
+// EnableTask closes the named task's circuit and resets its count of
+// consecutive failures, so it runs on schedule again.
+func (m *Manager) EnableTask(name string) (CircuitState, error) {
+	task, err := m.loadTask(name)
+	if err != nil {
+		return CircuitState{}, err
+	}
+	m.resetCircuit(task)
+	return m.circuit(task), nil
+}
+
+// resetCircuit closes the task's circuit and resets its count of
+// consecutive failures.
+func (m *Manager) resetCircuit(t *Task) {
+	s := m.taskStats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.counters[outputDirName(t)]
+	if !ok || (c.ConsecutiveFailures == 0 && c.CircuitOpenedAt == nil) {
+		return
+	}
+	if c.CircuitOpenedAt != nil {
+		fmt.Printf("Enabled task '%s' again\n", t.Name)
+	}
+	c.ConsecutiveFailures = 0
+	c.CircuitOpenedAt = nil
+	if err := s.save(); err != nil {
+		fmt.Printf("Error saving stats for task '%s': %v\n", t.Name, err)
+	}
+}
@@ -0,0 +1,107 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"trpc.group/trpc-go/trpc-a2a-go/protocol"
+)
+
+// A2AClient is the subset of the a2a client used by the Manager.
+type A2AClient interface {
+	StreamMessage(ctx context.Context, params protocol.SendMessageParams) (<-chan protocol.StreamingMessageEvent, error)
+}
+
+// streamPrompt streams a rendered task prompt to the a2a-server, calling
+// onChunk with each piece of response text as it arrives, until ctx is
+// cancelled. The task's model and generation parameters ride in the message
+// metadata. It returns the full response text, the model that served it and
+// how long the call took. The model is the one the a2a-server reports, or
+// the task's if it doesn't say.
+func (m *Manager) streamPrompt(ctx context.Context, t *Task, prompt string, onChunk func(string)) (string, string, time.Duration, error) {
+	m.stats.CallStarted()
+	defer m.stats.CallFinished()
+
+	startTime := time.Now()
+	params := protocol.SendMessageParams{
+		Message: protocol.Message{
+			Parts: []protocol.Part{
+				protocol.NewTextPart(prompt),
+			},
+			Metadata: t.generationMetadata(),
+		},
+	}
+	model := t.Model
+	var response strings.Builder
+	events, err := m.a2aClient.StreamMessage(ctx, params)
+	if err == nil {
+		for event := range receive(ctx, events) {
+			var text string
+			switch result := event.Result.(type) {
+			case *protocol.Message:
+				text = messageText(result)
+				if reported := reportedModel(result.Metadata); reported != "" {
+					model = reported
+				}
+			case *protocol.TaskStatusUpdateEvent:
+				if reported := reportedModel(result.Metadata); reported != "" {
+					model = reported
+				}
+				if msg := result.Status.Message; msg != nil && msg.Kind == protocol.KindMessage {
+					text = messageText(msg)
+				}
+				if result.Status.State == protocol.TaskStateFailed {
+					err = fmt.Errorf("a2a-server task failed: %s", text)
+					continue
+				}
+			}
+			if text != "" {
+				response.WriteString(text)
+				onChunk(text)
+			}
+		}
+	}
+	if err == nil && ctx.Err() != nil {
+		err = ErrRunCancelled
+	}
+	latency := time.Since(startTime)
+	m.stats.RecordCall(latency, len(prompt), response.Len())
+	return response.String(), model, latency, err
+}
+
+// receive relays events until the channel closes or ctx is cancelled, so a
+// cancelled call doesn't wait on a client that keeps its stream open.
+func receive(ctx context.Context, events <-chan protocol.StreamingMessageEvent) <-chan protocol.StreamingMessageEvent {
+	out := make(chan protocol.StreamingMessageEvent)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func messageText(msg *protocol.Message) string {
+	var text strings.Builder
+	for _, part := range msg.Parts {
+		if textPart, ok := part.(*protocol.TextPart); ok {
+			text.WriteString(textPart.Text)
+		}
+	}
+	return text.String()
+}
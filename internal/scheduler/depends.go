@@ -0,0 +1,89 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dependencyCycle returns the names along the depends_on chain that leads
+// from t back to itself, or nil if there is no such cycle. tasks maps
+// definition file names to the scheduled tasks.
+func dependencyCycle(t *Task, tasks map[string]*Task) []string {
+	start := Slug(t.Name)
+	path := []string{t.Name}
+	seen := map[string]bool{start: true}
+	for cur := t; cur.DependsOn != ""; {
+		next := Slug(cur.DependsOn)
+		if next == start {
+			return append(path, t.Name)
+		}
+		up, ok := tasks[next]
+		if !ok || seen[next] {
+			return nil
+		}
+		seen[next] = true
+		path = append(path, up.Name)
+		cur = up
+	}
+	return nil
+}
+
+// ValidateDependencies checks that scheduling t in place of the task with
+// the same name doesn't create a depends_on cycle. It returns a
+// *ValidationError naming the cycle.
+func (m *Manager) ValidateDependencies(t *Task) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.validateDependencies(t)
+}
+
+// validateDependencies is ValidateDependencies with m.mu held.
+func (m *Manager) validateDependencies(t *Task) error {
+	cycle := dependencyCycle(t, m.tasks)
+	if cycle == nil {
+		return nil
+	}
+	return &ValidationError{Errors: []FieldError{
+		{"depends_on", "dependency cycle: " + strings.Join(cycle, " -> ")},
+	}}
+}
+
+// triggerDependents starts a run of each scheduled task that depends on t,
+// passing on the response of t's successful run rec.
+func (m *Manager) triggerDependents(t *Task, rec *RunRecord) {
+	slug := Slug(t.Name)
+	var dependents []*Task
+	m.mu.Lock()
+	for _, dep := range m.tasks {
+		if dep.DependsOn != "" && Slug(dep.DependsOn) == slug {
+			dependents = append(dependents, dep)
+		}
+	}
+	m.mu.Unlock()
+	for _, dep := range dependents {
+		if m.circuitOpen(dep) {
+			continue
+		}
+		fmt.Printf("Task '%s' finished, triggering dependent task '%s'\n", t.Name, dep.Name)
+		go m.executeRun(dep, &RunRecord{ID: newRunID(), Upstream: slug + "/" + rec.ID, upstreamResponse: rec.Response})
+	}
+}
+
+// latestUpstream fills in rec's upstream details from the last successful
+// run of the task t depends on, for runs not triggered by it.
+func (m *Manager) latestUpstream(t *Task, rec *RunRecord) {
+	if t.DependsOn == "" || rec.Upstream != "" {
+		return
+	}
+	runs, err := m.Runs(Slug(t.DependsOn))
+	if err != nil {
+		return
+	}
+	for _, run := range runs {
+		if run.Status == RunStatusSuccess {
+			rec.Upstream = Slug(t.DependsOn) + "/" + run.ID
+			rec.upstreamResponse = run.Response
+			return
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package scheduler
+
+// maxDiscordContent is the most characters Discord accepts in a message.
+const maxDiscordContent = 2000
+
+// DiscordMessage is a Discord webhook payload.
+type DiscordMessage struct {
+	Content         string          `json:"content"`
+	AllowedMentions discordMentions `json:"allowed_mentions"`
+}
+
+// discordMentions with an empty Parse keeps mentions in a response, such as
+// @everyone, from pinging anyone.
+type discordMentions struct {
+	Parse []string `json:"parse"`
+}
+
+// discordMessages formats the run as Markdown, split into as many messages as
+// a long response needs.
+func discordMessages(rec *RunRecord) []DiscordMessage {
+	text := "**" + runSummary(rec) + "**"
+	if rec.Error != "" {
+		text += "\n```\n" + truncate(rec.Error, maxWebhookText) + "\n```"
+	}
+	if rec.Response != "" {
+		text += "\n" + rec.Response
+	}
+	var msgs []DiscordMessage
+	for _, chunk := range splitText(text, maxDiscordContent) {
+		msgs = append(msgs, DiscordMessage{Content: chunk, AllowedMentions: discordMentions{Parse: []string{}}})
+	}
+	return msgs
+}
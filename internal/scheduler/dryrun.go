@@ -0,0 +1,74 @@
+package scheduler
+
+import (
+	"context"
+	"strings"
+)
+
+// DryRunResult shows what a run of a task would send, without sending it.
+type DryRunResult struct {
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exit_code"`
+	// Data holds the outputs of the task's data_commands by name.
+	Data    map[string]string `json:"data,omitempty"`
+	Sources []SourceResult    `json:"sources,omitempty"`
+	Prompt  string            `json:"prompt,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// DryRun executes the named task's data commands and renders its prompt. Nothing
+// is sent to the a2a-server and no run is recorded. Command and template
+// failures are reported in the result rather than as an error. Dependent
+// tasks get the response of the last successful upstream run.
+func (m *Manager) DryRun(name string) (*DryRunResult, error) {
+	return m.DryRunWithOverrides(name, nil)
+}
+
+// DryRunWithOverrides is DryRun with the task changed by the overrides, as
+// RunWithOverrides would run it.
+func (m *Manager) DryRunWithOverrides(name string, o *RunOverrides) (*DryRunResult, error) {
+	task, err := m.overriddenTask(name, o)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, err := range []error{m.CheckCommands(task), m.CheckContextPath(task)} {
+		if err != nil {
+			return &DryRunResult{Error: err.Error()}, nil
+		}
+	}
+	ctx := context.Background()
+	res := runCommand(ctx, task, func(Event) {})
+	result := &DryRunResult{Stdout: res.Stdout, Stderr: res.Stderr, ExitCode: res.ExitCode}
+	if res.fatal(task) {
+		result.Error = "data_command failed: " + res.Err.Error()
+		return result, nil
+	}
+	input, _, err := m.limitInput(task, "data_command", res.Stdout)
+	if err != nil {
+		result.Error = "data_command failed: " + err.Error()
+		return result, nil
+	}
+	data, sources, err := m.runSources(ctx, task, func(Event) {})
+	result.Data = data
+	result.Sources = sources
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	var upstream RunRecord
+	m.latestUpstream(task, &upstream)
+	input = strings.TrimSpace(input)
+	if input == "" && !hasData(data) && upstream.upstreamResponse == "" {
+		result.Error = "data_command produced no data; a real run would be skipped"
+		return result, nil
+	}
+	prompt, err := renderPrompt(task, input, data, upstream.upstreamResponse)
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	result.Prompt = prompt
+	return result, nil
+}
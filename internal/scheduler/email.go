@@ -0,0 +1,141 @@
+package scheduler
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTPConfig holds the server task result emails are sent through.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (c SMTPConfig) addr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// wantsEmail reports whether the finished run should be emailed to the task's
+// email_to recipients.
+func (t *Task) wantsEmail(rec *RunRecord) bool {
+	if len(t.EmailTo) == 0 {
+		return false
+	}
+	if t.EmailOn == NotifyFailure {
+		return rec.failed()
+	}
+	return true
+}
+
+// emailSubject names the task, the outcome and when the run started.
+func emailSubject(rec *RunRecord) string {
+	return fmt.Sprintf("Task %s %s at %s", rec.Task, rec.Status, rec.StartedAt.Format("2006-01-02 15:04:05 MST"))
+}
+
+// emailBody is the Gemini response, or the failure details and whatever
+// output the run produced.
+func emailBody(rec *RunRecord) string {
+	var b strings.Builder
+	if rec.Status == RunStatusFailed {
+		fmt.Fprintf(&b, "Run %s failed: %s\n", rec.ID, rec.Error)
+		if rec.ExitCode != 0 {
+			fmt.Fprintf(&b, "Exit code: %d\n", rec.ExitCode)
+		}
+		if rec.Stderr != "" {
+			fmt.Fprintf(&b, "\nStderr:\n%s\n", rec.Stderr)
+		}
+		if rec.Response != "" {
+			fmt.Fprintf(&b, "\nPartial response:\n%s\n", rec.Response)
+		}
+		return b.String()
+	}
+	if rec.Status == RunStatusOutputFailed {
+		fmt.Fprintf(&b, "Run %s: %s\n\n", rec.ID, rec.Error)
+	}
+	b.WriteString(rec.Response)
+	if !strings.HasSuffix(rec.Response, "\n") {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// emailMessage builds a plaintext RFC 5322 message.
+func emailMessage(from string, to []string, subject, body string, date time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// sendEmail delivers the run to the task's recipients. The whole SMTP
+// exchange must finish within m.emailTimeout.
+func (m *Manager) sendEmail(t *Task, rec *RunRecord) error {
+	cfg := m.smtp
+	conn, err := net.DialTimeout("tcp", cfg.addr(), m.emailTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(m.emailTimeout)); err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: cfg.Host}); err != nil {
+			return err
+		}
+	}
+	if cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return err
+		}
+	}
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %w", err)
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range t.EmailTo {
+		addr, err := mail.ParseAddress(to)
+		if err != nil {
+			return fmt.Errorf("invalid recipient %q: %w", to, err)
+		}
+		if err := c.Rcpt(addr.Address); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(emailMessage(cfg.From, t.EmailTo, emailSubject(rec), emailBody(rec), time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
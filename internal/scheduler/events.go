@@ -0,0 +1,92 @@
+package scheduler
+
+import "sync"
+
+// Event types emitted while a task runs.
+const (
+	EventCommandStarted = "command_started"
+	EventOutput         = "output"
+	EventPrompt         = "prompt"
+	EventResponse       = "response"
+	EventFinished       = "finished"
+)
+
+// Event reports the progress of a task run to stream subscribers.
+type Event struct {
+	Type   string `json:"type"`
+	RunID  string `json:"run_id"`
+	Stream string `json:"stream,omitempty"` // "stdout" or "stderr" for output events
+	Source string `json:"source,omitempty"` // data_commands entry or "output_command", for command and output events
+	Text   string `json:"text,omitempty"`
+	Status string `json:"status,omitempty"` // set on finished events
+	Error  string `json:"error,omitempty"`
+}
+
+// EventSink receives the events of a single run. It may be called from
+// several goroutines at once.
+type EventSink func(Event)
+
+// subscriberBuffer is how many events a slow subscriber may lag behind
+// before further events are dropped for it.
+const subscriberBuffer = 64
+
+type subscribers struct {
+	mu   sync.Mutex
+	subs map[string]map[chan Event]struct{} // task slug -> subscriber channels
+}
+
+// Subscribe returns a channel receiving the events of every run of the named
+// task from now on, and a func to stop the subscription.
+func (m *Manager) Subscribe(name string) (<-chan Event, func(), error) {
+	task, err := m.loadTask(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	slug := Slug(task.Name)
+	ch := make(chan Event, subscriberBuffer)
+
+	m.subscribers.mu.Lock()
+	if m.subscribers.subs == nil {
+		m.subscribers.subs = make(map[string]map[chan Event]struct{})
+	}
+	if m.subscribers.subs[slug] == nil {
+		m.subscribers.subs[slug] = make(map[chan Event]struct{})
+	}
+	m.subscribers.subs[slug][ch] = struct{}{}
+	m.subscribers.mu.Unlock()
+
+	return ch, func() {
+		m.subscribers.mu.Lock()
+		defer m.subscribers.mu.Unlock()
+		delete(m.subscribers.subs[slug], ch)
+		if len(m.subscribers.subs[slug]) == 0 {
+			delete(m.subscribers.subs, slug)
+		}
+	}, nil
+}
+
+// publisher returns the sink broadcasting a task's events to its subscribers.
+func (m *Manager) publisher(t *Task) EventSink {
+	slug := Slug(t.Name)
+	return func(ev Event) {
+		m.subscribers.mu.Lock()
+		defer m.subscribers.mu.Unlock()
+		for ch := range m.subscribers.subs[slug] {
+			select {
+			case ch <- ev:
+			default:
+			}
+		}
+	}
+}
+
+// sinkWriter turns command output into output events as it is written.
+type sinkWriter struct {
+	emit   func(Event)
+	stream string
+}
+
+func (w sinkWriter) Write(p []byte) (int, error) {
+	w.emit(Event{Type: EventOutput, Stream: w.stream, Text: string(p)})
+	return len(p), nil
+}
@@ -0,0 +1,178 @@
+package scheduler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Shells a task's command strings can run in, as set in Task.Shell.
+const (
+	// ShellBash runs commands with bash -c. The default.
+	ShellBash = "bash"
+	// ShellSh runs commands with sh -c, for systems without bash such as
+	// Alpine containers.
+	ShellSh = "sh"
+)
+
+// shell returns the shell the task's command strings run in.
+func (t *Task) shell() string {
+	if t.Shell == "" {
+		return ShellBash
+	}
+	return t.Shell
+}
+
+// shellArgv returns the argv running command in the task's shell.
+func (t *Task) shellArgv(command string) []string {
+	return []string{t.shell(), "-c", command}
+}
+
+// dataArgv returns the argv of the task's data_command: its data_argv as is,
+// or its data_command run in the task's shell.
+func (t *Task) dataArgv() []string {
+	if len(t.DataArgv) > 0 {
+		return t.DataArgv
+	}
+	return t.shellArgv(t.DataCommand)
+}
+
+// dataCommandText describes the task's data_command for events and the
+// allow-list.
+func (t *Task) dataCommandText() string {
+	if len(t.DataArgv) > 0 {
+		return argvText(t.DataArgv)
+	}
+	return t.DataCommand
+}
+
+// argv returns the argv of the data source: its argv as is, or its command
+// run in the task's shell.
+func (s DataSource) argv(t *Task) []string {
+	if len(s.Argv) > 0 {
+		return s.Argv
+	}
+	return t.shellArgv(s.Command)
+}
+
+// text describes the data source's command for events and the allow-list.
+func (s DataSource) text() string {
+	if len(s.Argv) > 0 {
+		return argvText(s.Argv)
+	}
+	return s.Command
+}
+
+// argvText joins argv into a readable command line, quoting the arguments
+// that need it.
+func argvText(argv []string) string {
+	parts := make([]string, len(argv))
+	for i, arg := range argv {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\"+shellMeta) {
+			arg = strconv.Quote(arg)
+		}
+		parts[i] = arg
+	}
+	return strings.Join(parts, " ")
+}
+
+// findExecutable resolves the program a task runs the way its commands
+// will: a name with a slash relative to the task's context_path, any other
+// through the PATH the task's commands get.
+func findExecutable(t *Task, name string) (string, error) {
+	if strings.Contains(name, "/") {
+		path := name
+		if !filepath.IsAbs(path) && t.ContextPath != "" {
+			path = filepath.Join(t.ContextPath, path)
+		}
+		if err := checkExecutable(path); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+	pathEnv, ok := t.Env["PATH"]
+	if !ok {
+		pathEnv = os.Getenv("PATH")
+	}
+	for _, dir := range filepath.SplitList(pathEnv) {
+		if !filepath.IsAbs(dir) {
+			// Like exec.LookPath, don't run programs from wherever the
+			// server happens to be.
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if checkExecutable(path) == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%q not found in PATH", name)
+}
+
+// checkExecutable returns an error unless path is an executable file.
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%q not found", path)
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("%q is not executable", path)
+	}
+	return nil
+}
+
+// validateCommands checks the task's shell, that each of its data commands
+// is given either as a command string or as an argv, that the programs they
+// need, including the shell, are installed, and that its pass_env only
+// names variables tasks may be given.
+func validateCommands(t *Task) []FieldError {
+	var errs []FieldError
+	switch t.Shell {
+	case "", ShellBash, ShellSh:
+	default:
+		errs = append(errs, FieldError{"shell", fmt.Sprintf("must be %q or %q", ShellBash, ShellSh)})
+	}
+	usesShell := strings.TrimSpace(t.OutputCommand) != ""
+	checkArgv := func(field string, argv []string) {
+		if len(argv) == 0 {
+			return
+		}
+		if strings.TrimSpace(argv[0]) == "" {
+			errs = append(errs, FieldError{field, "program must not be empty"})
+			return
+		}
+		if _, err := findExecutable(t, argv[0]); err != nil {
+			errs = append(errs, FieldError{field, err.Error()})
+		}
+	}
+
+	if len(t.DataArgv) > 0 && strings.TrimSpace(t.DataCommand) != "" {
+		errs = append(errs, FieldError{"data_argv", "can't be set along with data_command"})
+	}
+	checkArgv("data_argv", t.DataArgv)
+	usesShell = usesShell || (len(t.DataArgv) == 0 && strings.TrimSpace(t.DataCommand) != "")
+	for _, name := range t.sourceNames() {
+		src := t.DataCommands[name]
+		field := "data_commands." + name
+		if len(src.Argv) > 0 && strings.TrimSpace(src.Command) != "" {
+			errs = append(errs, FieldError{field + ".argv", "can't be set along with command"})
+		}
+		checkArgv(field+".argv", src.Argv)
+		usesShell = usesShell || len(src.Argv) == 0
+	}
+
+	passable := passableEnvVars()
+	for _, name := range t.PassEnv {
+		if !passable[name] {
+			errs = append(errs, FieldError{"pass_env", fmt.Sprintf("%q is not listed in TASK_PASS_ENV", name)})
+		}
+	}
+
+	if usesShell && (t.Shell == "" || t.Shell == ShellBash || t.Shell == ShellSh) {
+		if _, err := findExecutable(t, t.shell()); err != nil {
+			errs = append(errs, FieldError{"shell", err.Error()})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,68 @@
+package scheduler
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PromptFunction documents a function available in task prompt templates.
+type PromptFunction struct {
+	Name        string `json:"name"`
+	Usage       string `json:"usage"`
+	Description string `json:"description"`
+}
+
+// PromptFunctions lists the functions promptFuncs provides.
+var PromptFunctions = []PromptFunction{
+	{"now", `{{ now "2006-01-02" }}`, "The current time in the task's timezone, in Go's time layout."},
+	{"env", `{{ env "REGION" }}`, "A variable from the task's env, or a server environment variable starting with PROMPT_ENV_PREFIX."},
+	{"trim", `{{ trim .Input }}`, "The text without leading and trailing whitespace."},
+	{"truncate", `{{ truncate .Input 4000 }}`, "At most the first n characters of the text."},
+}
+
+// promptFuncs returns the template functions for t's prompt.
+func promptFuncs(t *Task) template.FuncMap {
+	return template.FuncMap{
+		"now": func(layout string) string {
+			loc := time.Local
+			if t.Timezone != "" {
+				if l, err := time.LoadLocation(t.Timezone); err == nil {
+					loc = l
+				}
+			}
+			return time.Now().In(loc).Format(layout)
+		},
+		"env": func(name string) (string, error) {
+			return promptEnv(t, name)
+		},
+		"trim": strings.TrimSpace,
+		"truncate": func(s string, n int) string {
+			if n < 0 {
+				n = 0
+			}
+			runes := []rune(s)
+			if len(runes) <= n {
+				return s
+			}
+			return string(runes[:n])
+		},
+	}
+}
+
+// promptEnv looks a variable up in the task's env, then in the server
+// environment. Server variables must start with PROMPT_ENV_PREFIX so prompts
+// can't read secrets such as credentials; with no prefix set, only the
+// task's env is available.
+func promptEnv(t *Task, name string) (string, error) {
+	if value, ok := t.Env[name]; ok {
+		return value, nil
+	}
+	prefix := os.Getenv("PROMPT_ENV_PREFIX")
+	if prefix == "" || !strings.HasPrefix(name, prefix) {
+		return "", fmt.Errorf("env %q is not allowed: only the task's env and server variables starting with PROMPT_ENV_PREFIX can be read", name)
+	}
+	return os.Getenv(name), nil
+}
@@ -0,0 +1,60 @@
+package scheduler
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// defaultMaxInputBytes caps data command output fed to the prompt unless
+// TASK_MAX_INPUT_BYTES or the task's max_input_bytes say otherwise.
+const defaultMaxInputBytes = 1 << 20
+
+// What happens to data command output over the task's max_input_bytes, as set
+// in Task.InputOverflow.
+const (
+	// InputKeepHead keeps the start of the output. The default.
+	InputKeepHead = "keep_head"
+	// InputKeepTail keeps the end of the output, e.g. the latest log lines.
+	InputKeepTail = "keep_tail"
+	// InputFail fails the run.
+	InputFail = "fail"
+)
+
+// inputLimit returns the limit on each data command's output for the
+// task, or 0 if there is none.
+func (m *Manager) inputLimit(t *Task) int {
+	switch {
+	case t.MaxInputBytes < 0:
+		return 0
+	case t.MaxInputBytes > 0:
+		return t.MaxInputBytes
+	}
+	return m.maxInputBytes
+}
+
+// limitInput applies the task's max_input_bytes to the output of one of its
+// data commands, named source, before it reaches the prompt template. It
+// reports whether the output was cut, and fails if the task's
+// input_overflow is InputFail.
+func (m *Manager) limitInput(t *Task, source, out string) (string, bool, error) {
+	max := m.inputLimit(t)
+	if max == 0 || len(out) <= max {
+		return out, false, nil
+	}
+	if t.InputOverflow == InputFail {
+		return "", false, fmt.Errorf("output is %d bytes, over the max_input_bytes limit of %d", len(out), max)
+	}
+	fmt.Printf("Truncating %s output of task '%s' from %d to %d bytes\n", source, t.Name, len(out), max)
+	if t.InputOverflow == InputKeepTail {
+		cut := len(out) - max
+		for cut < len(out) && !utf8.RuneStart(out[cut]) {
+			cut++
+		}
+		return fmt.Sprintf("[%d bytes truncated]\n", cut) + out[cut:], true, nil
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(out[cut]) {
+		cut--
+	}
+	return out[:cut] + fmt.Sprintf("\n[%d bytes truncated]", len(out)-cut), true, nil
+}
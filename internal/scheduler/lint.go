@@ -0,0 +1,175 @@
+package scheduler
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template/parse"
+)
+
+// TemplateIssue is a problem found in a prompt template, at the position the
+// template parser reports. Column is the byte offset in the line, as
+// text/template counts it, and 0 when only the line is known.
+type TemplateIssue struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+func (i TemplateIssue) String() string {
+	if i.Column > 0 {
+		return fmt.Sprintf("line %d, column %d: %s", i.Line, i.Column, i.Message)
+	}
+	return fmt.Sprintf("line %d: %s", i.Line, i.Message)
+}
+
+// TemplateSample is the data RenderSample fills a prompt template with.
+type TemplateSample struct {
+	Input    string            `json:"input"`
+	Data     map[string]string `json:"data"`
+	Upstream string            `json:"upstream"`
+}
+
+// templateErrorRE matches the "template: prompt:LINE[:COL]: message" errors
+// of text/template.
+var templateErrorRE = regexp.MustCompile(`^template: prompt:(\d+)(?::(\d+))?: (?s)(.*)$`)
+
+// templateIssue turns a parse or execution error into an issue.
+func templateIssue(err error) TemplateIssue {
+	m := templateErrorRE.FindStringSubmatch(err.Error())
+	if m == nil {
+		return TemplateIssue{Line: 1, Message: err.Error()}
+	}
+	line, _ := strconv.Atoi(m[1])
+	col, _ := strconv.Atoi(m[2])
+	return TemplateIssue{Line: line, Column: col, Message: m[3]}
+}
+
+// LintPrompt checks the task's prompt template without running it. Besides
+// syntax errors and unknown functions, it reports the variables used that a
+// run doesn't provide: anything but .Input, .Data.<name> for the task's
+// data_commands, .Vars.<name> for the task's vars and, for dependent tasks,
+// .Upstream. Fields inside range and with blocks, where the dot changes,
+// aren't checked.
+func LintPrompt(t *Task) []TemplateIssue {
+	tmpl, err := parsePrompt(t)
+	if err != nil {
+		return []TemplateIssue{templateIssue(err)}
+	}
+	l := &linter{tree: tmpl.Tree, task: t, issues: make([]TemplateIssue, 0)}
+	if tmpl.Tree != nil {
+		l.walk(tmpl.Tree.Root, true)
+	}
+	return l.issues
+}
+
+type linter struct {
+	tree   *parse.Tree
+	task   *Task
+	issues []TemplateIssue
+}
+
+// walk checks the fields used under node. dot reports whether the dot is
+// still the prompt data there.
+func (l *linter) walk(node parse.Node, dot bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			l.walk(child, dot)
+		}
+	case *parse.ActionNode:
+		l.walk(n.Pipe, dot)
+	case *parse.TemplateNode:
+		l.walk(n.Pipe, dot)
+	case *parse.IfNode:
+		l.walk(n.Pipe, dot)
+		l.walk(n.List, dot)
+		l.walk(n.ElseList, dot)
+	case *parse.RangeNode:
+		l.walk(n.Pipe, dot)
+		l.walk(n.List, false)
+		l.walk(n.ElseList, dot)
+	case *parse.WithNode:
+		l.walk(n.Pipe, dot)
+		l.walk(n.List, false)
+		l.walk(n.ElseList, dot)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			l.walk(cmd, dot)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			l.walk(arg, dot)
+		}
+	case *parse.ChainNode:
+		l.walk(n.Node, dot)
+	case *parse.FieldNode:
+		if dot {
+			l.checkField(n, n.Ident)
+		}
+	case *parse.VariableNode:
+		// $ is always the prompt data; other variables can't be checked.
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			l.checkField(n, n.Ident[1:])
+		}
+	}
+}
+
+// checkField reports a reference to a field the prompt data doesn't have.
+func (l *linter) checkField(node parse.Node, ident []string) {
+	var msg string
+	switch ident[0] {
+	case "Input":
+	case "Upstream":
+		if l.task.DependsOn == "" {
+			msg = "undefined variable .Upstream: only tasks with depends_on receive an upstream response"
+		}
+	case "Data":
+		if len(ident) > 1 && !slices.Contains(l.task.sourceNames(), ident[1]) {
+			msg = fmt.Sprintf("undefined variable .Data.%s: the task has no data command named %q", ident[1], ident[1])
+		}
+	case "Vars":
+		if len(ident) > 1 {
+			if _, ok := l.task.Vars[ident[1]]; !ok {
+				msg = fmt.Sprintf("undefined variable .Vars.%s: the task declares no variable %q in its vars", ident[1], ident[1])
+			}
+		}
+	default:
+		msg = fmt.Sprintf("undefined variable .%s: prompts can use .Input, .Data.<name>, .Vars.<name> and .Upstream", strings.Join(ident, "."))
+	}
+	if msg == "" {
+		return
+	}
+	issue := TemplateIssue{Line: 1, Message: msg}
+	location, _ := l.tree.ErrorContext(node)
+	// location is "prompt:LINE:COL".
+	if parts := strings.Split(location, ":"); len(parts) == 3 {
+		issue.Line, _ = strconv.Atoi(parts[1])
+		issue.Column, _ = strconv.Atoi(parts[2])
+	}
+	l.issues = append(l.issues, issue)
+}
+
+// RenderSample renders the task's prompt with sample data, as a run would
+// with those command outputs.
+func RenderSample(t *Task, sample TemplateSample) (string, *TemplateIssue) {
+	tmpl, err := parsePrompt(t)
+	if err != nil {
+		issue := templateIssue(err)
+		return "", &issue
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, promptData(t, sample.Input, sample.Data, sample.Upstream)); err != nil {
+		issue := templateIssue(err)
+		return "", &issue
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,135 @@
+package scheduler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// migrateFileNames renames task definition files and output directories
+// created before both were named after Slug(task.Name), e.g. "My Task.toml"
+// with outputs under "my_task". Files whose slug is already taken are left
+// alone with a warning.
+func (m *Manager) migrateFileNames() {
+	files, err := os.ReadDir(m.taskDefsPath)
+	if err != nil {
+		fmt.Printf("Warning: could not read tasks directory for migration: %v\n", err)
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".toml") {
+			continue
+		}
+		task, err := m.parseTask(filepath.Join(m.taskDefsPath, file.Name()))
+		if err != nil {
+			continue
+		}
+		slug := Slug(task.Name)
+		if slug == "" || file.Name() == slug+".toml" {
+			continue
+		}
+		target := filepath.Join(m.taskDefsPath, slug+".toml")
+		if _, err := os.Stat(target); err == nil {
+			fmt.Printf("Warning: not renaming task file %s: %s.toml already exists\n", file.Name(), slug)
+			continue
+		}
+		if err := os.Rename(filepath.Join(m.taskDefsPath, file.Name()), target); err != nil {
+			fmt.Printf("Warning: could not rename task file %s: %v\n", file.Name(), err)
+			continue
+		}
+		fmt.Printf("Renamed task file %s to %s.toml\n", file.Name(), slug)
+	}
+
+	dirs, err := os.ReadDir(m.taskOutputPath)
+	if err != nil {
+		fmt.Printf("Warning: could not read task output directory for migration: %v\n", err)
+		return
+	}
+	for _, dir := range dirs {
+		slug := Slug(dir.Name())
+		if !dir.IsDir() || slug == "" || slug == dir.Name() {
+			continue
+		}
+		if err := mergeDir(filepath.Join(m.taskOutputPath, dir.Name()), filepath.Join(m.taskOutputPath, slug)); err != nil {
+			fmt.Printf("Warning: could not move outputs of %s: %v\n", dir.Name(), err)
+			continue
+		}
+		fmt.Printf("Moved task outputs from %s to %s\n", dir.Name(), slug)
+	}
+}
+
+// mergeDir moves the files in src into dst, creating dst if needed, and
+// removes src once it is empty. Files already present in dst are kept.
+func mergeDir(src, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		target := filepath.Join(dst, e.Name())
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		if err := os.Rename(filepath.Join(src, e.Name()), target); err != nil {
+			return err
+		}
+	}
+	return os.Remove(src)
+}
+
+// RenameTask moves the task defined in oldName.toml over to newName, once
+// its definition was saved as newName.toml: it unschedules the old entry and
+// moves its outputs, run history and stats. The caller removes the old file
+// and schedules the new one. It returns ErrRunInProgress while the task runs
+// and a *ValidationError while other tasks depend on it.
+func (m *Manager) RenameTask(oldName, newName string) error {
+	if _, err := m.loadTask(oldName); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.running[oldName]) > 0 || m.queued[oldName] != nil {
+		return ErrRunInProgress
+	}
+	var dependents []string
+	for _, t := range m.tasks {
+		if t.DependsOn != "" && Slug(t.DependsOn) == oldName {
+			dependents = append(dependents, t.Name)
+		}
+	}
+	if len(dependents) > 0 {
+		sort.Strings(dependents)
+		return &ValidationError{Errors: []FieldError{
+			{"name", fmt.Sprintf("can't change while %s depend on the task", strings.Join(dependents, ", "))},
+		}}
+	}
+
+	m.unschedule(oldName)
+	delete(m.loadErrors, oldName)
+	delete(m.lastRuns, oldName)
+	delete(m.lastRuns, newName)
+	src := filepath.Join(m.taskOutputPath, oldName)
+	if _, err := os.Stat(src); err == nil {
+		if err := mergeDir(src, filepath.Join(m.taskOutputPath, newName)); err != nil {
+			return fmt.Errorf("could not move outputs of %s: %w", oldName, err)
+		}
+	}
+
+	s := m.taskStats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.counters[oldName]; ok {
+		s.counters[newName] = c
+		delete(s.counters, oldName)
+		if err := s.save(); err != nil {
+			fmt.Printf("Error saving stats for task '%s': %v\n", newName, err)
+		}
+	}
+	fmt.Printf("Renamed task %s to %s\n", oldName, newName)
+	return nil
+}
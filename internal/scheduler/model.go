@@ -0,0 +1,55 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxTemperature is the highest temperature a task may ask for.
+const maxTemperature = 2.0
+
+// generationMetadata returns the message metadata asking the a2a-server for
+// the task's model and generation parameters, or nil if it sets none and the
+// server's defaults apply.
+func (t *Task) generationMetadata() map[string]interface{} {
+	config := make(map[string]interface{})
+	if t.Temperature != nil {
+		config["temperature"] = *t.Temperature
+	}
+	if t.MaxOutputTokens > 0 {
+		config["maxOutputTokens"] = t.MaxOutputTokens
+	}
+	if t.Model == "" && len(config) == 0 {
+		return nil
+	}
+	metadata := make(map[string]interface{})
+	if t.Model != "" {
+		metadata["model"] = t.Model
+	}
+	if len(config) > 0 {
+		metadata["generationConfig"] = config
+	}
+	return metadata
+}
+
+// reportedModel returns the model the a2a-server says answered, as the
+// "model" of an event's metadata, or "" if it doesn't say.
+func reportedModel(metadata map[string]interface{}) string {
+	model, _ := metadata["model"].(string)
+	return model
+}
+
+// validateModel checks the task's model and generation parameters.
+func validateModel(t *Task) []FieldError {
+	var errs []FieldError
+	if t.Model != "" && (strings.TrimSpace(t.Model) != t.Model || strings.ContainsAny(t.Model, " \t\n")) {
+		errs = append(errs, FieldError{"model", fmt.Sprintf("invalid model name %q", t.Model)})
+	}
+	if t.Temperature != nil && (*t.Temperature < 0 || *t.Temperature > maxTemperature) {
+		errs = append(errs, FieldError{"temperature", fmt.Sprintf("must be between 0 and %g", maxTemperature)})
+	}
+	if t.MaxOutputTokens < 0 {
+		errs = append(errs, FieldError{"max_output_tokens", "must be a number of tokens, or 0 for the model's default"})
+	}
+	return errs
+}
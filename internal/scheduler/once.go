@@ -0,0 +1,115 @@
+package scheduler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/robfig/cron/v3"
+)
+
+// onceSchedule fires a single time, at the given instant.
+type onceSchedule time.Time
+
+// Next implements cron.Schedule. Once the instant has passed it returns the
+// zero time, which cron never fires.
+func (s onceSchedule) Next(now time.Time) time.Time {
+	if at := time.Time(s); now.Before(at) {
+		return at
+	}
+	return time.Time{}
+}
+
+// validateRunAt checks the run_at and completed_at fields of a one-shot task.
+func validateRunAt(t *Task) []FieldError {
+	var errs []FieldError
+	if t.RunAt == "" {
+		if t.CompletedAt != "" {
+			errs = append(errs, FieldError{"completed_at", "only applies to tasks with run_at"})
+		}
+		return errs
+	}
+	if t.Schedule != "" {
+		errs = append(errs, FieldError{"schedule", "can't be combined with run_at"})
+	}
+	at, err := time.Parse(time.RFC3339, t.RunAt)
+	switch {
+	case err != nil:
+		errs = append(errs, FieldError{"run_at", fmt.Sprintf("invalid timestamp %q, expected RFC 3339 such as 2006-01-02T15:04:05Z", t.RunAt)})
+	case t.CompletedAt == "" && !t.RunIfPast && !at.After(time.Now()):
+		errs = append(errs, FieldError{"run_at", "is in the past; set run_if_past to run the task right away"})
+	}
+	if t.CompletedAt != "" {
+		if _, err := time.Parse(time.RFC3339, t.CompletedAt); err != nil {
+			errs = append(errs, FieldError{"completed_at", fmt.Sprintf("invalid timestamp %q", t.CompletedAt)})
+		}
+	}
+	return errs
+}
+
+// scheduleOnce registers a one-shot task under the given definition file
+// name. Completed tasks get no cron entry, and overdue ones run right away
+// if they allow it. m.mu must be held.
+func (m *Manager) scheduleOnce(name string, t *Task) error {
+	if t.CompletedAt != "" {
+		return nil
+	}
+	at, err := time.Parse(time.RFC3339, t.RunAt)
+	if err != nil {
+		return fmt.Errorf("invalid run_at %q: %v", t.RunAt, err)
+	}
+	if at.After(time.Now()) {
+		m.entries[name] = m.cron.Schedule(onceSchedule(at), cron.FuncJob(func() {
+			m.runOnce(name, t)
+		}))
+		return nil
+	}
+	if !t.RunIfPast {
+		return fmt.Errorf("run_at %s is in the past", t.RunAt)
+	}
+	fmt.Printf("Task '%s' was due at %s, running it now\n", t.Name, t.RunAt)
+	go m.runOnce(name, t)
+	return nil
+}
+
+// runOnce runs a one-shot task, then marks it completed so it never fires
+// again. While the scheduler is paused it is left for Resume.
+func (m *Manager) runOnce(name string, t *Task) {
+	if !m.fire(t) {
+		return
+	}
+	if err := m.complete(name, time.Now()); err != nil {
+		fmt.Printf("Warning: Could not mark task '%s' completed: %v\n", t.Name, err)
+	}
+}
+
+// complete sets completed_at in the named task's definition file and
+// reschedules it, dropping its cron entry.
+func (m *Manager) complete(name string, at time.Time) error {
+	task, err := m.loadTask(name)
+	if err != nil {
+		return err
+	}
+	task.CompletedAt = at.Format(time.RFC3339)
+	data, err := toml.Marshal(task)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(m.taskDefsPath, name+".toml")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fmt.Printf("Task '%s' completed its one-shot run\n", task.Name)
+	m.markFile(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unschedule(name)
+	return m.schedule(name, task)
+}
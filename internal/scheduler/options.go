@@ -0,0 +1,52 @@
+package scheduler
+
+import "time"
+
+// Option configures optional Manager behaviour.
+type Option func(*Manager)
+
+// WithLocation sets the timezone schedules are evaluated in for tasks that
+// don't set their own. Defaults to the local time zone.
+func WithLocation(loc *time.Location) Option {
+	return func(m *Manager) {
+		if loc != nil {
+			m.location = loc
+		}
+	}
+}
+
+// WithWatchInterval makes the Manager rescan the tasks directory at the given
+// interval and apply added, modified and removed task files without a
+// restart. Watching is disabled by default.
+func WithWatchInterval(d time.Duration) Option {
+	return func(m *Manager) {
+		m.watchInterval = d
+	}
+}
+
+// WithPersistentPause keeps the scheduler's paused state in a file under
+// data, so a scheduler paused with Pause stays paused after a restart.
+func WithPersistentPause(persist bool) Option {
+	return func(m *Manager) {
+		m.persistPause = persist
+	}
+}
+
+// WithSMTP sets the server task results are emailed through. Tasks with
+// email_to are not emailed without it.
+func WithSMTP(cfg SMTPConfig) Option {
+	return func(m *Manager) {
+		m.smtp = cfg
+	}
+}
+
+// WithSandboxRoot confines task context paths to root: after resolving
+// symlinks, they must be root or a directory below it. Tasks are checked
+// with CheckContextPath when created or updated and again before each run,
+// and NewManager fails if root is not an existing directory. An empty root leaves context paths
+// unrestricted.
+func WithSandboxRoot(root string) Option {
+	return func(m *Manager) {
+		m.sandboxRoot = root
+	}
+}
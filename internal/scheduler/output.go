@@ -0,0 +1,45 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// OutputResult is the outcome of running a task's output_command on the
+// model response.
+type OutputResult struct {
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout,omitempty"` // truncated to maxRecordedStderr
+	Stderr   string `json:"stderr,omitempty"` // truncated to maxRecordedStderr
+	Error    string `json:"error,omitempty"`
+}
+
+// runOutputCommand pipes the run's response into the task's output_command
+// and records the outcome. A failing command keeps the response but marks
+// the run RunStatusOutputFailed.
+func runOutputCommand(ctx context.Context, t *Task, rec *RunRecord, emit func(Event)) {
+	var timeout time.Duration
+	if t.OutputTimeout != "" {
+		timeout, _ = time.ParseDuration(t.OutputTimeout)
+	}
+	emit(Event{Type: EventCommandStarted, Source: outputSource, Text: t.OutputCommand})
+	res := runShell(ctx, t, t.OutputCommand, rec.Response, timeout, func(ev Event) {
+		ev.Source = outputSource
+		emit(ev)
+	})
+	rec.Output = &OutputResult{
+		ExitCode: res.ExitCode,
+		Stdout:   truncate(res.Stdout, maxRecordedStderr),
+		Stderr:   truncate(res.Stderr, maxRecordedStderr),
+	}
+	if res.Err != nil {
+		fmt.Printf("output_command for task '%s' failed: %v\n", t.Name, res.Err)
+		rec.Output.Error = res.Err.Error()
+		rec.Status = RunStatusOutputFailed
+		rec.Error = fmt.Sprintf("output_command failed: %v", res.Err)
+	}
+}
+
+// outputSource is the Event.Source of the output_command's events.
+const outputSource = "output_command"
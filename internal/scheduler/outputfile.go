@@ -0,0 +1,94 @@
+package scheduler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Output file formats reported by ParseOutput.
+const (
+	OutputFormatRun    = "run"    // JSON run record
+	OutputFormatLegacy = "legacy" // text file written before run records
+)
+
+// OutputHeader is the metadata of a stored task output.
+type OutputHeader struct {
+	Format     string     `json:"format"`
+	Task       string     `json:"task"`
+	RunID      string     `json:"run_id,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Status     string     `json:"status,omitempty"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	PromptHash string     `json:"prompt_hash,omitempty"`
+}
+
+// promptHash returns the PromptHash of a run that sent prompt.
+func promptHash(prompt string) string {
+	sum := sha256.Sum256([]byte(prompt))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// ParseOutput reads the header and body of a file in a task's output
+// directory: the response of a run record, or the output of the text files
+// older versions wrote. It returns false for files in neither format.
+func ParseOutput(data []byte) (*OutputHeader, string, bool) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var rec RunRecord
+		if err := json.Unmarshal(data, &rec); err != nil || rec.ID == "" {
+			return nil, "", false
+		}
+		h := &OutputHeader{
+			Format:     OutputFormatRun,
+			Task:       rec.Task,
+			RunID:      rec.ID,
+			StartedAt:  rec.StartedAt,
+			Status:     rec.Status,
+			PromptHash: rec.PromptHash,
+		}
+		if !rec.FinishedAt.IsZero() {
+			h.FinishedAt = &rec.FinishedAt
+		}
+		if rec.Status != RunStatusRunning {
+			h.ExitCode = &rec.ExitCode
+		}
+		// Records saved before prompts were hashed.
+		if h.PromptHash == "" && rec.Prompt != "" {
+			h.PromptHash = promptHash(rec.Prompt)
+		}
+		return h, rec.Response, true
+	}
+	return parseLegacyOutput(string(data))
+}
+
+// parseLegacyOutput parses the text files older versions wrote:
+//
+//	--- Task Run: NAME ---
+//	Timestamp: RFC3339
+//
+//	--- STDOUT ---
+//	OUTPUT
+func parseLegacyOutput(s string) (*OutputHeader, string, bool) {
+	first, rest, ok := strings.Cut(s, "\n")
+	if !ok || !strings.HasPrefix(first, "--- Task Run: ") || !strings.HasSuffix(first, " ---") {
+		return nil, "", false
+	}
+	h := &OutputHeader{
+		Format: OutputFormatLegacy,
+		Task:   strings.TrimSuffix(strings.TrimPrefix(first, "--- Task Run: "), " ---"),
+	}
+	header, body, ok := strings.Cut(rest, "\n--- STDOUT ---\n")
+	if !ok {
+		return nil, "", false
+	}
+	for _, line := range strings.Split(header, "\n") {
+		if v, ok := strings.CutPrefix(line, "Timestamp: "); ok {
+			h.StartedAt, _ = time.Parse(time.RFC3339, strings.TrimSpace(v))
+		}
+	}
+	return h, strings.TrimSuffix(body, "\n"), true
+}
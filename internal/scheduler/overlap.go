@@ -0,0 +1,163 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+)
+
+// Overlap policies for runs triggered while the previous run of the task is
+// still in progress.
+const (
+	// OverlapSkip records the new run as skipped. This is the default.
+	OverlapSkip = "skip"
+	// OverlapQueue starts the new run as soon as the current one finishes.
+	// Further triggers while a run is queued are coalesced into it.
+	OverlapQueue = "queue"
+	// OverlapAllow starts the new run right away.
+	OverlapAllow = "allow"
+)
+
+// queuedRun is a run waiting for the current run of its task to finish.
+type queuedRun struct {
+	task *Task
+	rec  *RunRecord
+}
+
+// applyAllowOverlap maps the deprecated AllowOverlap onto OverlapPolicy, so
+// only the policy needs checking. An explicit policy takes precedence.
+func (t *Task) applyAllowOverlap() {
+	if t.AllowOverlap && t.OverlapPolicy == "" {
+		t.OverlapPolicy = OverlapAllow
+	}
+}
+
+// overlapPolicy returns the task's effective overlap policy.
+func (t *Task) overlapPolicy() string {
+	if t.OverlapPolicy == "" {
+		return OverlapSkip
+	}
+	return t.OverlapPolicy
+}
+
+// execute triggers a scheduled run of a task and, if it can start right away,
+// runs it.
+func (m *Manager) execute(t *Task) {
+	m.executeRun(t, &RunRecord{ID: newRunID()})
+}
+
+// executeRun triggers the run described by rec and, if it can start right
+// away, runs it.
+func (m *Manager) executeRun(t *Task, rec *RunRecord) {
+	if _, start, _ := m.trigger(t, rec); start {
+		m.launch(t, rec)
+	}
+}
+
+// trigger applies the task's overlap policy to a new run, described by rec.
+// Each task is either idle, running, or running with one run queued behind
+// it. It returns the ID of the run that will serve the trigger and whether
+// rec can start now, in which case it is registered as in progress and the
+// caller must launch it. Under the skip policy a skipped run is recorded and
+// ErrRunInProgress returned. Once the Manager is stopping, nothing starts and
+// ErrStopping is returned.
+func (m *Manager) trigger(t *Task, rec *RunRecord) (string, bool, error) {
+	runID := rec.ID
+	slug := Slug(t.Name)
+	policy := t.overlapPolicy()
+	m.mu.Lock()
+	if m.stopping {
+		m.mu.Unlock()
+		fmt.Printf("Scheduler stopping, not running task '%s'\n", t.Name)
+		return runID, false, ErrStopping
+	}
+	if len(m.running[slug]) == 0 || policy == OverlapAllow {
+		m.running[slug] = append(m.running[slug], runID)
+		m.runs.Add(1)
+		m.mu.Unlock()
+		return runID, true, nil
+	}
+	if policy != OverlapQueue {
+		m.mu.Unlock()
+		m.skipRun(t, runID, "skipped: "+ErrRunInProgress.Error())
+		return runID, false, ErrRunInProgress
+	}
+	q, ok := m.queued[slug]
+	if !ok {
+		rec.Queued = true
+		m.queued[slug] = &queuedRun{task: t, rec: rec}
+		m.mu.Unlock()
+		fmt.Printf("Queued run of task '%s' until the previous run finishes\n", t.Name)
+		return runID, false, nil
+	}
+	// The queued run keeps its ID but takes the latest trigger's details,
+	// such as the upstream run of a dependent task.
+	queuedID, coalesced := q.rec.ID, q.rec.Coalesced+1
+	q.task = t
+	*q.rec = *rec
+	q.rec.ID, q.rec.Queued, q.rec.Coalesced = queuedID, true, coalesced
+	m.mu.Unlock()
+	m.skipRun(t, runID, "coalesced into queued run "+queuedID)
+	return queuedID, false, nil
+}
+
+// launch runs a task registered by trigger, then any run queued behind it.
+func (m *Manager) launch(t *Task, rec *RunRecord) {
+	defer m.runs.Done()
+	for rec != nil {
+		m.runRecord(t, rec, m.publisher(t))
+		t, rec = m.finishRun(t, rec.ID)
+	}
+}
+
+// finishRun unregisters a run. If it was the last run of the task in
+// progress and another is queued, the queued run is registered in its place
+// and returned with a record noting it was queued, unless the Manager is
+// stopping.
+func (m *Manager) finishRun(t *Task, runID string) (*Task, *RunRecord) {
+	slug := Slug(t.Name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	runs := m.running[slug]
+	for i, id := range runs {
+		if id == runID {
+			runs = append(runs[:i], runs[i+1:]...)
+			break
+		}
+	}
+	if len(runs) > 0 {
+		m.running[slug] = runs
+		return nil, nil
+	}
+	delete(m.running, slug)
+	q, ok := m.queued[slug]
+	if !ok {
+		return nil, nil
+	}
+	delete(m.queued, slug)
+	if m.stopping {
+		fmt.Printf("Scheduler stopping, dropping queued run of task '%s'\n", q.task.Name)
+		return nil, nil
+	}
+	m.running[slug] = []string{q.rec.ID}
+	return q.task, q.rec
+}
+
+// skipRun records a run that didn't start because a previous run of the task
+// is still in progress.
+func (m *Manager) skipRun(t *Task, runID, reason string) {
+	fmt.Printf("Not running task '%s': %s\n", t.Name, reason)
+	now := time.Now()
+	rec := &RunRecord{
+		ID:            runID,
+		Task:          t.Name,
+		Status:        RunStatusSkipped,
+		Error:         reason,
+		StartedAt:     now,
+		FinishedAt:    now,
+		OverlapPolicy: t.overlapPolicy(),
+	}
+	if err := m.saveRun(t, rec); err != nil {
+		fmt.Printf("Error saving output for task '%s': %v\n", t.Name, err)
+	}
+	m.recordStats(t, rec)
+}
@@ -0,0 +1,74 @@
+package scheduler
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+)
+
+// RunOverrides changes a task for a single manual run, leaving its definition
+// file as is. The run's record keeps the overrides it used.
+type RunOverrides struct {
+	// DataCommand replaces the task's data_command, or its data_argv.
+	DataCommand string `json:"data_command,omitempty"`
+	// Vars set template variables the task declares in its vars.
+	Vars map[string]string `json:"vars,omitempty"`
+}
+
+// empty reports whether the overrides change nothing.
+func (o *RunOverrides) empty() bool {
+	return o == nil || (o.DataCommand == "" && len(o.Vars) == 0)
+}
+
+// apply returns a copy of t with the overrides applied, validated like a
+// task being saved.
+func (o *RunOverrides) apply(t *Task) (*Task, error) {
+	task := *t
+	if o.DataCommand != "" {
+		task.DataCommand, task.DataArgv = o.DataCommand, nil
+	}
+	var errs []FieldError
+	if len(o.Vars) > 0 {
+		task.Vars = maps.Clone(t.Vars)
+		if task.Vars == nil {
+			task.Vars = make(map[string]string)
+		}
+		names := make([]string, 0, len(o.Vars))
+		for name := range o.Vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, ok := t.Vars[name]; !ok {
+				errs = append(errs, FieldError{"vars." + name, fmt.Sprintf("the task declares no variable %q", name)})
+				continue
+			}
+			task.Vars[name] = o.Vars[name]
+		}
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Errors: errs}
+	}
+	if err := ValidateTask(&task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// overriddenTask loads the named task and applies the overrides, if any,
+// checking the result the way a saved task is checked.
+func (m *Manager) overriddenTask(name string, o *RunOverrides) (*Task, error) {
+	task, err := m.loadTask(name)
+	if err != nil || o.empty() {
+		return task, err
+	}
+	if task, err = o.apply(task); err != nil {
+		return nil, err
+	}
+	for _, err := range []error{m.CheckCommands(task), m.CheckContextPath(task)} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return task, nil
+}
@@ -0,0 +1,124 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// SchedulerStatus describes the scheduler as a whole.
+type SchedulerStatus struct {
+	Paused   bool       `json:"paused"`
+	PausedAt *time.Time `json:"paused_at,omitempty"`
+	// Entries is the number of tasks registered with a schedule or run_at.
+	Entries int `json:"entries"`
+	// Running lists the IDs of the runs in progress by task.
+	Running map[string][]string `json:"running"`
+}
+
+// Pause stops scheduled runs from starting until Resume is called. Runs in
+// progress are left to finish, and tasks can still be run by hand. With
+// WithPersistentPause the scheduler stays paused across restarts.
+func (m *Manager) Pause() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pausedAt != nil {
+		return nil
+	}
+	now := time.Now()
+	if m.pauseFile != "" {
+		if err := os.WriteFile(m.pauseFile, []byte(now.Format(time.RFC3339)+"\n"), 0644); err != nil {
+			return fmt.Errorf("could not write pause file: %w", err)
+		}
+	}
+	m.pausedAt = &now
+	fmt.Println("Scheduler paused")
+	return nil
+}
+
+// Resume lets scheduled runs start again. One-shot tasks whose run_at
+// passed while paused run right away.
+func (m *Manager) Resume() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pausedAt == nil {
+		return nil
+	}
+	if m.pauseFile != "" {
+		if err := os.Remove(m.pauseFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("could not remove pause file: %w", err)
+		}
+	}
+	m.pausedAt = nil
+	fmt.Println("Scheduler resumed")
+	for name, t := range m.tasks {
+		if t.RunAt == "" || t.CompletedAt != "" {
+			continue
+		}
+		if at, err := time.Parse(time.RFC3339, t.RunAt); err == nil && !at.After(time.Now()) {
+			go m.runOnce(name, t)
+		}
+	}
+	return nil
+}
+
+// loadPauseFile restores the paused state saved by Pause.
+func (m *Manager) loadPauseFile() {
+	if m.pauseFile == "" {
+		return
+	}
+	data, err := os.ReadFile(m.pauseFile)
+	if err != nil {
+		return
+	}
+	pausedAt, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		pausedAt = time.Now()
+	}
+	m.pausedAt = &pausedAt
+	fmt.Printf("Scheduler paused since %s\n", pausedAt.Format(time.RFC3339))
+}
+
+// paused reports whether the scheduler is paused.
+func (m *Manager) paused() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pausedAt != nil
+}
+
+// fire starts a scheduled run of the task unless the scheduler is paused or
+// the task's circuit is open, and reports whether it did.
+func (m *Manager) fire(t *Task) bool {
+	if m.paused() {
+		fmt.Printf("Scheduler paused, skipping scheduled run of task '%s'\n", t.Name)
+		return false
+	}
+	if m.circuitOpen(t) {
+		return false
+	}
+	m.execute(t)
+	return true
+}
+
+// SchedulerStatus reports whether the scheduler is paused, how many tasks
+// are registered with it and which runs are in progress.
+func (m *Manager) SchedulerStatus() SchedulerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := SchedulerStatus{
+		Paused:  m.pausedAt != nil,
+		Entries: len(m.entries),
+		Running: make(map[string][]string, len(m.running)),
+	}
+	if m.pausedAt != nil {
+		pausedAt := *m.pausedAt
+		status.PausedAt = &pausedAt
+	}
+	for slug, runs := range m.running {
+		status.Running[slug] = append([]string(nil), runs...)
+	}
+	return status
+}
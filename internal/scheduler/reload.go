@@ -0,0 +1,106 @@
+package scheduler
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// ReloadSummary lists the task files whose cron entries changed in a Reload.
+// Errors maps file names to the reason they couldn't be (re)scheduled; as with
+// the watcher, such tasks are unscheduled and also listed as removed if they
+// had an entry.
+type ReloadSummary struct {
+	Added   []string          `json:"added"`
+	Removed []string          `json:"removed"`
+	Updated []string          `json:"updated"`
+	Errors  map[string]string `json:"errors"`
+}
+
+// readTaskFile parses and validates the named task definition file.
+func (m *Manager) readTaskFile(name string) (*Task, error) {
+	task, err := m.parseTask(filepath.Join(m.taskDefsPath, name+".toml"))
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateTask(task); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// Reload rescans the tasks directory and brings the cron entries in line with
+// it: new files are scheduled, changed ones rescheduled and entries of
+// deleted files removed. Runs in progress are not affected.
+func (m *Manager) Reload() (*ReloadSummary, error) {
+	states, err := m.scanTaskFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read task definitions directory: %w", err)
+	}
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	summary := &ReloadSummary{
+		Added:   []string{},
+		Removed: []string{},
+		Updated: []string{},
+		Errors:  map[string]string{},
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range names {
+		m.files[name] = states[name]
+		delete(m.pending, name)
+
+		task, err := m.readTaskFile(name)
+		old, scheduled := m.tasks[name]
+		if err == nil && scheduled && reflect.DeepEqual(old, task) {
+			m.recordLoad(name, nil)
+			continue
+		}
+		m.unschedule(name)
+		if err == nil {
+			err = m.schedule(name, task)
+		}
+		m.recordLoad(name, err)
+		if err != nil {
+			fmt.Printf("Warning: Unscheduled task file %s.toml: %v\n", name, err)
+			summary.Errors[name] = err.Error()
+			if scheduled {
+				m.reloads++
+				summary.Removed = append(summary.Removed, name)
+			}
+			continue
+		}
+		m.reloads++
+		if scheduled {
+			m.resetCircuit(task)
+			fmt.Printf("Rescheduled task: '%s' with schedule: '%s'\n", task.Name, task.Schedule)
+			summary.Updated = append(summary.Updated, name)
+		} else {
+			fmt.Printf("Scheduled task: '%s' with schedule: '%s'\n", task.Name, task.Schedule)
+			summary.Added = append(summary.Added, name)
+		}
+	}
+	for name := range m.tasks {
+		if _, ok := states[name]; !ok {
+			m.unschedule(name)
+			delete(m.loadErrors, name)
+			m.reloads++
+			fmt.Printf("Unscheduled removed task file %s.toml\n", name)
+			summary.Removed = append(summary.Removed, name)
+		}
+	}
+	sort.Strings(summary.Removed)
+	for name := range m.files {
+		if _, ok := states[name]; !ok {
+			delete(m.files, name)
+			delete(m.pending, name)
+		}
+	}
+	return summary, nil
+}
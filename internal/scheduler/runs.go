@@ -0,0 +1,324 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Run statuses recorded in RunRecord.Status.
+const (
+	RunStatusSuccess = "success"
+	RunStatusFailed  = "failed"
+	RunStatusSkipped = "skipped"
+	// RunStatusRunning marks the partial record of a run still in progress.
+	RunStatusRunning = "running"
+	// RunStatusOutputFailed marks a run that got a response but whose
+	// output_command failed.
+	RunStatusOutputFailed = "output_failed"
+	// RunStatusCancelled marks a run stopped by CancelRun.
+	RunStatusCancelled = "cancelled"
+)
+
+// RunRecord is the structured outcome of a single task run.
+type RunRecord struct {
+	ID         string    `json:"id"`
+	Task       string    `json:"task"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	DurationMs int64     `json:"duration_ms"`
+	ExitCode   int       `json:"exit_code"`
+	StdoutSize int       `json:"stdout_size"`
+	StderrSize int       `json:"stderr_size"`
+	Stderr     string    `json:"stderr,omitempty"` // truncated to maxRecordedStderr
+	// InputTruncated is set when the data_command's output, of StdoutSize
+	// bytes, was cut to the task's max_input_bytes.
+	InputTruncated bool `json:"input_truncated,omitempty"`
+	// Sources records the outcome of each of the task's data_commands.
+	Sources []SourceResult `json:"sources,omitempty"`
+	Prompt  string         `json:"prompt,omitempty"`
+	// PromptHash is "sha256:" and the hex digest of Prompt, to tell runs
+	// that sent the same prompt apart from those that didn't.
+	PromptHash string `json:"prompt_hash,omitempty"`
+	Response   string `json:"response,omitempty"`
+	ResponseMs int64  `json:"response_ms,omitempty"` // time spent waiting for the a2a-server
+	// Model is the model that served the response: the one the a2a-server
+	// reported, or else the task's model. Empty if neither said.
+	Model string `json:"model,omitempty"`
+	// Output records the outcome of the task's output_command.
+	Output *OutputResult `json:"output,omitempty"`
+
+	OverlapPolicy string `json:"overlap_policy,omitempty"`
+	// Queued is set on a run that waited for the previous run to finish;
+	// Coalesced counts the further triggers it absorbed while waiting.
+	Queued    bool `json:"queued,omitempty"`
+	Coalesced int  `json:"coalesced,omitempty"`
+	// CatchUp is set on a run started at startup because the task missed
+	// one or more scheduled runs while the server was down.
+	CatchUp bool `json:"catch_up,omitempty"`
+	// Overrides records how a manual run changed the task, if it did.
+	Overrides *RunOverrides `json:"overrides,omitempty"`
+	// Upstream is the "task/run ID" of the run whose response a dependent
+	// task's prompt received.
+	Upstream         string `json:"upstream,omitempty"`
+	upstreamResponse string
+
+	// WebhookError is set when the run couldn't be posted to the task's
+	// webhook_url.
+	WebhookError string `json:"webhook_error,omitempty"`
+	// EmailError is set when the run couldn't be emailed to the task's
+	// email_to recipients.
+	EmailError string `json:"email_error,omitempty"`
+	// Deliveries records the outcome of sending the run to each of the
+	// task's notification destinations.
+	Deliveries []Delivery `json:"deliveries,omitempty"`
+	// CircuitOpened is set on the failed run that disabled the task, having
+	// failed max_consecutive_failures times in a row.
+	CircuitOpened bool `json:"circuit_opened,omitempty"`
+}
+
+// Targets recorded in Delivery.Target.
+const (
+	DeliveryWebhook = "webhook"
+	DeliverySlack   = "slack"
+	DeliveryDiscord = "discord"
+	DeliveryEmail   = "email"
+)
+
+// Delivery is the outcome of sending a finished run to one destination.
+// Messages counts the messages delivered, as long responses are split for
+// chat platforms.
+type Delivery struct {
+	Target   string `json:"target"`
+	Messages int    `json:"messages"`
+	Error    string `json:"error,omitempty"`
+}
+
+// RunSummary is the compact form of a RunRecord used for run histories.
+type RunSummary struct {
+	ID         string    `json:"id"`
+	Status     string    `json:"status"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	ExitCode   int       `json:"exit_code"`
+	StdoutSize int       `json:"stdout_size"`
+	StderrSize int       `json:"stderr_size"`
+	CatchUp    bool      `json:"catch_up,omitempty"`
+}
+
+// ErrRunNotFound is returned when a task has no run with the requested ID.
+var ErrRunNotFound = errors.New("run not found")
+
+// Summary returns the compact form of the record.
+func (r *RunRecord) Summary() RunSummary {
+	return RunSummary{
+		ID:         r.ID,
+		Status:     r.Status,
+		StartedAt:  r.StartedAt,
+		DurationMs: r.DurationMs,
+		ExitCode:   r.ExitCode,
+		StdoutSize: r.StdoutSize,
+		StderrSize: r.StderrSize,
+		CatchUp:    r.CatchUp,
+	}
+}
+
+func newRunID() string {
+	return uuid.New().String()
+}
+
+// maxRecordedStderr caps how much of a data_command's stderr is kept in its
+// run record.
+const maxRecordedStderr = 16 << 10
+
+// truncate shortens s to at most max bytes, marking that it was cut.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max] + "\n[truncated]"
+}
+
+// splitText cuts s into pieces of at most max bytes, preferring to break
+// after a newline.
+func splitText(s string, max int) []string {
+	var parts []string
+	for len(s) > max {
+		cut := strings.LastIndex(s[:max], "\n") + 1
+		if cut < max/2 {
+			cut = max
+			for cut > 0 && !utf8.RuneStart(s[cut]) {
+				cut--
+			}
+		}
+		parts = append(parts, s[:cut])
+		s = s[cut:]
+	}
+	if s != "" {
+		parts = append(parts, s)
+	}
+	return parts
+}
+
+// failed reports whether anything went wrong with the run, including its
+// output_command.
+func (r *RunRecord) failed() bool {
+	return r.Status == RunStatusFailed || r.Status == RunStatusOutputFailed
+}
+
+// fail marks the run as failed with the given reason.
+func (r *RunRecord) fail(format string, args ...interface{}) {
+	r.Status = RunStatusFailed
+	r.Error = fmt.Sprintf(format, args...)
+}
+
+// outputDirName returns the name of the directory holding the task's runs,
+// which matches the name of its definition file.
+func outputDirName(t *Task) string {
+	return Slug(t.Name)
+}
+
+// saveRun writes the run record to a timestamped JSON file in the task's output directory.
+func (m *Manager) saveRun(t *Task, rec *RunRecord) error {
+	dirName := outputDirName(t)
+	m.mu.Lock()
+	m.lastRuns[dirName] = *rec
+	m.mu.Unlock()
+	if !ValidName(dirName) {
+		return fmt.Errorf("task name %q can't be used as an output directory", t.Name)
+	}
+	taskDir := filepath.Join(m.taskOutputPath, dirName)
+	if err := os.MkdirAll(taskDir, 0755); err != nil {
+		return err
+	}
+
+	ts := rec.StartedAt.Format("2006-01-02T15-04-05")
+	if len(rec.ID) >= 8 {
+		ts += "_" + rec.ID[:8]
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(taskDir, ts+".json"), data, 0644)
+}
+
+// Runs returns the recorded runs of the named task, newest first.
+func (m *Manager) Runs(name string) ([]RunRecord, error) {
+	if !ValidName(name) {
+		return nil, ErrTaskNotFound
+	}
+	files, err := os.ReadDir(filepath.Join(m.taskOutputPath, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	runs := make([]RunRecord, 0)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(m.taskOutputPath, name, file.Name()))
+		if err != nil {
+			continue
+		}
+		var rec RunRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			fmt.Printf("Warning: Skipping unreadable run record %s: %v\n", file.Name(), err)
+			continue
+		}
+		runs = append(runs, rec)
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartedAt.After(runs[j].StartedAt)
+	})
+	return runs, nil
+}
+
+// Run returns the full record of a single run of the named task.
+func (m *Manager) Run(name, runID string) (*RunRecord, error) {
+	runs, err := m.Runs(name)
+	if err != nil {
+		return nil, err
+	}
+	for i := range runs {
+		if runs[i].ID == runID {
+			return &runs[i], nil
+		}
+	}
+	return nil, ErrRunNotFound
+}
+
+// DeleteOutputs removes every stored output of the named task and returns
+// how many files were removed. It returns ErrTaskNotFound if the task has
+// never stored an output.
+func (m *Manager) DeleteOutputs(name string) (int, error) {
+	if !ValidName(name) {
+		return 0, ErrTaskNotFound
+	}
+	dir := filepath.Join(m.taskOutputPath, name)
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, ErrTaskNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	m.forgetLastRun(name)
+	removed := 0
+	for _, file := range files {
+		if !file.Type().IsRegular() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, file.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, err
+		}
+		removed++
+	}
+	fmt.Printf("Deleted %d output(s) of task '%s'\n", removed, name)
+	return removed, nil
+}
+
+// DeleteOutput removes a single stored output of the named task. filename
+// must be a plain file name in the task's output directory; ErrRunNotFound
+// is returned for anything else.
+func (m *Manager) DeleteOutput(name, filename string) error {
+	if !ValidName(name) {
+		return ErrTaskNotFound
+	}
+	if filename == "" || filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+		return ErrRunNotFound
+	}
+	path := filepath.Join(m.taskOutputPath, name, filename)
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return ErrRunNotFound
+	}
+	m.forgetLastRun(name)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted output %s of task '%s'\n", filename, name)
+	return nil
+}
+
+// forgetLastRun drops the cached last run of the task, so its status is read
+// again from the outputs left on disk.
+func (m *Manager) forgetLastRun(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.lastRuns, name)
+}
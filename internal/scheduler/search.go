@@ -0,0 +1,193 @@
+package scheduler
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaxSearchContext is the most context lines a search returns around each
+// match.
+const MaxSearchContext = 10
+
+// SearchMatch is a line of a task output matching a search.
+type SearchMatch struct {
+	Task  string `json:"task"`
+	File  string `json:"file"`
+	RunID string `json:"run_id,omitempty"`
+	// Timestamp is when the run started, or when the file was last written
+	// if it doesn't say.
+	Timestamp time.Time `json:"timestamp"`
+	// Line is the 1-based number of the matching line in the response of
+	// a run record, or in the file for other outputs.
+	Line   int      `json:"line"`
+	Text   string   `json:"text"`
+	Before []string `json:"before"`
+	After  []string `json:"after"`
+}
+
+// outputFile is a file in a task's output directory.
+type outputFile struct {
+	task    string
+	name    string
+	modTime time.Time
+}
+
+// SearchOutputs looks for query, ignoring case, in the stored outputs of the
+// named task, or of every task if name is empty, and returns up to limit
+// matching lines with contextLines lines around them. Outputs are searched
+// newest first, one file at a time. Runs still in progress are skipped. The
+// second result reports whether more matches were left out.
+func (m *Manager) SearchOutputs(name, query string, contextLines, limit int) ([]SearchMatch, bool, error) {
+	var dirs []string
+	if name != "" {
+		if !ValidName(name) {
+			return nil, false, ErrTaskNotFound
+		}
+		dirs = []string{name}
+	} else {
+		entries, err := os.ReadDir(m.taskOutputPath)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				dirs = append(dirs, entry.Name())
+			}
+		}
+	}
+
+	var files []outputFile
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(filepath.Join(m.taskOutputPath, dir))
+		if errors.Is(err, fs.ErrNotExist) && name != "" {
+			return nil, false, ErrTaskNotFound
+		}
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			if info, err := entry.Info(); err == nil {
+				files = append(files, outputFile{task: dir, name: entry.Name(), modTime: info.ModTime()})
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].modTime.Equal(files[j].modTime) {
+			return files[i].modTime.After(files[j].modTime)
+		}
+		return files[i].name > files[j].name
+	})
+
+	contextLines = min(max(contextLines, 0), MaxSearchContext)
+	query = strings.ToLower(query)
+	matches := make([]SearchMatch, 0)
+	for _, file := range files {
+		more, err := m.searchFile(file, query, contextLines, limit-len(matches), func(match SearchMatch) {
+			matches = append(matches, match)
+		})
+		if err != nil {
+			continue
+		}
+		if more {
+			return matches, true, nil
+		}
+	}
+	return matches, false, nil
+}
+
+// searchFile adds up to limit matches found in the output file and reports
+// whether there were more.
+func (m *Manager) searchFile(file outputFile, query string, contextLines, limit int, add func(SearchMatch)) (bool, error) {
+	f, err := os.Open(filepath.Join(m.taskOutputPath, file.task, file.name))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	match := SearchMatch{Task: file.task, File: file.name, Timestamp: file.modTime}
+	var text io.Reader = f
+	if strings.HasSuffix(file.name, ".json") {
+		var rec RunRecord
+		if err := json.NewDecoder(f).Decode(&rec); err != nil {
+			// Likely being written.
+			return false, err
+		}
+		if rec.Status == RunStatusRunning {
+			return false, nil
+		}
+		match.RunID, match.Timestamp = rec.ID, rec.StartedAt
+		text = strings.NewReader(rec.Response)
+	}
+	return grepLines(text, query, contextLines, limit, func(line int, before []string, s string, after []string) {
+		match.Line, match.Text, match.Before, match.After = line, s, before, after
+		add(match)
+	})
+}
+
+// grepLines passes each line of r containing query, which must be lower
+// case, to emit with up to contextLines lines before and after it. It stops
+// reading once limit matches got their context, and reports whether there
+// were more.
+func grepLines(r io.Reader, query string, contextLines, limit int, emit func(line int, before []string, text string, after []string)) (bool, error) {
+	type pendingMatch struct {
+		line   int
+		before []string
+		text   string
+		after  []string
+	}
+	var (
+		recent  []string // the last contextLines lines
+		pending []*pendingMatch
+		found   int
+		more    bool
+	)
+	flush := func(all bool) {
+		for len(pending) > 0 && (all || len(pending[0].after) == contextLines) {
+			p := pending[0]
+			emit(p.line, p.before, p.text, p.after)
+			pending = pending[1:]
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		for _, p := range pending {
+			if len(p.after) < contextLines {
+				p.after = append(p.after, line)
+			}
+		}
+		flush(false)
+		if !more && strings.Contains(strings.ToLower(line), query) {
+			if found == limit {
+				more = true
+			} else {
+				found++
+				pending = append(pending, &pendingMatch{line: n, before: append([]string{}, recent...), text: line, after: []string{}})
+				flush(false)
+			}
+		}
+		if more && len(pending) == 0 {
+			break
+		}
+		if contextLines > 0 {
+			if len(recent) == contextLines {
+				recent = recent[1:]
+			}
+			recent = append(recent, line)
+		}
+	}
+	flush(true)
+	return more, scanner.Err()
+}
@@ -0,0 +1,70 @@
+package scheduler
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Slack limits: characters in a section block and blocks in a message.
+const (
+	maxSlackSection = 3000
+	maxSlackBlocks  = 50
+)
+
+// SlackMessage is a Slack incoming webhook payload. Text is the fallback
+// shown in notifications.
+type SlackMessage struct {
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks,omitempty"`
+}
+
+type slackBlock struct {
+	Type string     `json:"type"`
+	Text *slackText `json:"text,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+var (
+	slackEscaper    = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	mdBold          = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	mdHeading       = regexp.MustCompile(`(?m)^#{1,6}\s+(.+)$`)
+	mdLink          = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^)\s]+)\)`)
+	mdFenceLanguage = regexp.MustCompile("(?m)^```[\\w+-]+$")
+)
+
+// slackMarkdown converts the Markdown Gemini responds with to Slack's mrkdwn:
+// bold, headings, links and fenced code blocks.
+func slackMarkdown(s string) string {
+	s = slackEscaper.Replace(s)
+	s = mdFenceLanguage.ReplaceAllString(s, "```")
+	s = mdBold.ReplaceAllString(s, "*$1*")
+	s = mdHeading.ReplaceAllString(s, "*$1*")
+	return mdLink.ReplaceAllString(s, "<$2|$1>")
+}
+
+// slackMessages formats the run as section blocks, split over as many
+// messages as a long response needs.
+func slackMessages(rec *RunRecord) []SlackMessage {
+	summary := runSummary(rec)
+	sections := []string{"*" + slackEscaper.Replace(summary) + "*"}
+	if rec.Error != "" {
+		sections = append(sections, splitText("```"+slackEscaper.Replace(truncate(rec.Error, maxWebhookText))+"```", maxSlackSection)...)
+	}
+	sections = append(sections, splitText(slackMarkdown(rec.Response), maxSlackSection)...)
+
+	var msgs []SlackMessage
+	for len(sections) > 0 {
+		n := min(len(sections), maxSlackBlocks)
+		msg := SlackMessage{Text: summary}
+		for _, section := range sections[:n] {
+			msg.Blocks = append(msg.Blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: section}})
+		}
+		msgs = append(msgs, msg)
+		sections = sections[n:]
+	}
+	return msgs
+}
@@ -0,0 +1,144 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DataSource is one of a task's named data_commands. Its output is available
+// to the prompt as {{.Data.<name>}}.
+type DataSource struct {
+	Command string `toml:"command" json:"command"`
+	// Argv runs a program directly, without a shell, instead of Command.
+	Argv []string `toml:"argv,omitempty" json:"argv,omitempty"`
+	// Timeout bounds the command, e.g. "30s". Empty means no limit.
+	Timeout string `toml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// What a failing data source does to the run, as set in Task.OnSourceError.
+const (
+	// SourceErrorFail fails the run. The default.
+	SourceErrorFail = "fail"
+	// SourceErrorPlaceholder substitutes an error message for the source's
+	// output and carries on.
+	SourceErrorPlaceholder = "placeholder"
+)
+
+// SourceResult is the outcome of running one of a task's data_commands.
+type SourceResult struct {
+	Name       string `json:"name"`
+	ExitCode   int    `json:"exit_code"`
+	StdoutSize int    `json:"stdout_size"`
+	// Truncated is set when the output was cut to the task's
+	// max_input_bytes.
+	Truncated bool   `json:"truncated,omitempty"`
+	Stderr    string `json:"stderr,omitempty"` // truncated to maxRecordedStderr
+	Error     string `json:"error,omitempty"`
+}
+
+// sourceNamePattern matches names usable as {{.Data.<name>}} in templates.
+var sourceNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sourceNames returns the names of the task's data_commands in the order
+// they run.
+func (t *Task) sourceNames() []string {
+	names := make([]string, 0, len(t.DataCommands))
+	for name := range t.DataCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// emptySources returns blank outputs for the task's data_commands, so that
+// templates can be checked for references to undefined sources.
+func (t *Task) emptySources() map[string]string {
+	data := make(map[string]string, len(t.DataCommands))
+	for name := range t.DataCommands {
+		data[name] = ""
+	}
+	return data
+}
+
+// validTimeout reports whether s is empty or a positive duration.
+func validTimeout(s string) bool {
+	if s == "" {
+		return true
+	}
+	d, err := time.ParseDuration(s)
+	return err == nil && d > 0
+}
+
+// validateSources checks the task's data_commands and on_source_error.
+func validateSources(t *Task) []FieldError {
+	var errs []FieldError
+	for _, name := range t.sourceNames() {
+		src := t.DataCommands[name]
+		field := "data_commands." + name
+		if !sourceNamePattern.MatchString(name) {
+			errs = append(errs, FieldError{field, "name must start with a letter or '_' and contain only letters, digits and '_'"})
+		}
+		if strings.TrimSpace(src.Command) == "" && len(src.Argv) == 0 {
+			errs = append(errs, FieldError{field + ".command", "must not be empty"})
+		}
+		if !validTimeout(src.Timeout) {
+			errs = append(errs, FieldError{field + ".timeout", fmt.Sprintf("invalid duration %q", src.Timeout)})
+		}
+	}
+	switch t.OnSourceError {
+	case "", SourceErrorFail, SourceErrorPlaceholder:
+	default:
+		errs = append(errs, FieldError{"on_source_error", fmt.Sprintf("must be %q or %q", SourceErrorFail, SourceErrorPlaceholder)})
+	}
+	return errs
+}
+
+// runSources runs the task's data_commands one after the other and returns
+// their trimmed outputs by name. A failing source fails the whole lot unless
+// the task's on_source_error is SourceErrorPlaceholder, in which case its
+// output is replaced by a note about the failure.
+func (m *Manager) runSources(ctx context.Context, t *Task, emit func(Event)) (map[string]string, []SourceResult, error) {
+	data := make(map[string]string, len(t.DataCommands))
+	var results []SourceResult
+	for _, name := range t.sourceNames() {
+		if ctx.Err() != nil {
+			return data, results, ErrRunCancelled
+		}
+		src := t.DataCommands[name]
+		var timeout time.Duration
+		if src.Timeout != "" {
+			timeout, _ = time.ParseDuration(src.Timeout)
+		}
+		emit(Event{Type: EventCommandStarted, Source: name, Text: src.text()})
+		res := runArgv(ctx, t, src.argv(t), "", timeout, func(ev Event) {
+			ev.Source = name
+			emit(ev)
+		})
+		results = append(results, SourceResult{
+			Name:       name,
+			ExitCode:   res.ExitCode,
+			StdoutSize: len(res.Stdout),
+			Stderr:     truncate(res.Stderr, maxRecordedStderr),
+		})
+		if !res.fatal(t) {
+			out, truncated, err := m.limitInput(t, "data_commands."+name, res.Stdout)
+			if err == nil {
+				data[name] = strings.TrimSpace(out)
+				results[len(results)-1].Truncated = truncated
+				continue
+			}
+			res.Err = err
+		}
+		results[len(results)-1].Error = res.Err.Error()
+		if t.OnSourceError != SourceErrorPlaceholder {
+			return data, results, fmt.Errorf("data_commands.%s failed: %w", name, res.Err)
+		}
+		fmt.Printf("data_commands.%s for task '%s' failed, using a placeholder: %v\n", name, t.Name, res.Err)
+		data[name] = fmt.Sprintf("[%s unavailable: %v]", name, res.Err)
+	}
+	return data, results, nil
+}
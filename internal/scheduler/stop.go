@@ -0,0 +1,55 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrStopping is returned when a run is triggered after Stop was called.
+var ErrStopping = errors.New("scheduler is stopping")
+
+// stopGrace bounds how long Stop waits for the runs it cancelled to record
+// their outcome.
+const stopGrace = 5 * time.Second
+
+// Stop shuts the scheduler down for a graceful exit. It stops the cron
+// scheduler and the task watcher, refuses new runs, including queued and
+// dependent ones, and waits for the runs in progress to finish and save
+// their records. If ctx ends first, the remaining runs are cancelled and
+// recorded as such, and ctx's error is returned.
+func (m *Manager) Stop(ctx context.Context) error {
+	m.mu.Lock()
+	m.stopping = true
+	inProgress := len(m.active)
+	m.mu.Unlock()
+	m.cron.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		m.runs.Wait()
+		close(done)
+	}()
+	if inProgress > 0 {
+		fmt.Printf("Waiting for %d task runs to finish\n", inProgress)
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	m.mu.Lock()
+	for _, run := range m.active {
+		fmt.Printf("Cancelling run %s of task '%s' on shutdown\n", run.RunID, run.Task)
+		run.cancel()
+	}
+	m.mu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(stopGrace):
+		fmt.Println("Warning: Task runs still in progress after shutdown")
+	}
+	return ctx.Err()
+}
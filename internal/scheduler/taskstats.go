@@ -0,0 +1,219 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// TaskStats aggregates the finished runs of a task since it first ran.
+type TaskStats struct {
+	Runs      int `json:"runs"`
+	Successes int `json:"successes"`
+	// Failures counts failed runs, including those whose output_command
+	// failed.
+	Failures int `json:"failures"`
+	Skips    int `json:"skips"`
+	// Cancellations counts runs stopped while in progress.
+	Cancellations int `json:"cancellations,omitempty"`
+	// AvgDurationMs is the average duration of the runs that weren't
+	// skipped.
+	AvgDurationMs int64 `json:"avg_duration_ms"`
+	// AvgResponseLength is the average length, in characters, of the
+	// responses received.
+	AvgResponseLength int        `json:"avg_response_length"`
+	LastError         string     `json:"last_error,omitempty"`
+	LastErrorAt       *time.Time `json:"last_error_at,omitempty"`
+}
+
+// TaskStatsSummary is the compact form of TaskStats used in task lists.
+type TaskStatsSummary struct {
+	Runs          int   `json:"runs"`
+	Failures      int   `json:"failures"`
+	AvgDurationMs int64 `json:"avg_duration_ms"`
+}
+
+// taskCounters are the running totals kept for a task in the stats file.
+type taskCounters struct {
+	Runs          int       `json:"runs"`
+	Successes     int       `json:"successes"`
+	Failures      int       `json:"failures"`
+	Skips         int       `json:"skips"`
+	Cancellations int       `json:"cancellations,omitempty"`
+	DurationMs    int64     `json:"duration_ms"`
+	Responses     int       `json:"responses"`
+	ResponseChars int64     `json:"response_chars"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorAt   time.Time `json:"last_error_at"`
+	// ConsecutiveFailures counts the failed runs since the last successful
+	// one; CircuitOpenedAt is set once they opened the task's circuit.
+	ConsecutiveFailures int        `json:"consecutive_failures,omitempty"`
+	CircuitOpenedAt     *time.Time `json:"circuit_opened_at,omitempty"`
+}
+
+// taskStats keeps the counters of all tasks in a small JSON file, so they
+// outlive both restarts and the cleanup of old run records.
+type taskStats struct {
+	mu       sync.Mutex
+	path     string
+	counters map[string]*taskCounters // output directory name -> counters
+}
+
+// add counts a finished run.
+func (c *taskCounters) add(rec *RunRecord) {
+	c.Runs++
+	switch {
+	case rec.Status == RunStatusSkipped:
+		c.Skips++
+		return
+	case rec.Status == RunStatusCancelled:
+		c.Cancellations++
+	case rec.failed():
+		c.Failures++
+		c.ConsecutiveFailures++
+		c.LastError = rec.Error
+		if rec.Error == "" && rec.Output != nil {
+			c.LastError = "output_command failed: " + rec.Output.Error
+		}
+		c.LastErrorAt = rec.FinishedAt
+		if rec.CircuitOpened {
+			openedAt := rec.FinishedAt
+			c.CircuitOpenedAt = &openedAt
+		}
+	default:
+		c.Successes++
+		c.ConsecutiveFailures = 0
+		c.CircuitOpenedAt = nil
+	}
+	c.DurationMs += rec.DurationMs
+	if rec.Response != "" {
+		c.Responses++
+		c.ResponseChars += int64(utf8.RuneCountInString(rec.Response))
+	}
+}
+
+// loadTaskStats reads the stats file. Without one, the counters are rebuilt
+// from the run records on disk.
+func (m *Manager) loadTaskStats(path string) {
+	m.taskStats = &taskStats{path: path, counters: make(map[string]*taskCounters)}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &m.taskStats.counters); err == nil {
+			return
+		}
+		fmt.Printf("Warning: Rebuilding unreadable task stats file: %v\n", err)
+		m.taskStats.counters = make(map[string]*taskCounters)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("Warning: Could not read task stats file: %v\n", err)
+		return
+	}
+	dirs, err := os.ReadDir(m.taskOutputPath)
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		runs, err := m.Runs(dir.Name())
+		if err != nil || len(runs) == 0 {
+			continue
+		}
+		c := &taskCounters{}
+		// Oldest first, so the last error is the newest one.
+		for i := len(runs) - 1; i >= 0; i-- {
+			if runs[i].Status != RunStatusRunning {
+				c.add(&runs[i])
+			}
+		}
+		m.taskStats.counters[dir.Name()] = c
+	}
+	m.taskStats.mu.Lock()
+	defer m.taskStats.mu.Unlock()
+	if err := m.taskStats.save(); err != nil {
+		fmt.Printf("Warning: Could not write task stats file: %v\n", err)
+	}
+}
+
+// save writes the stats file. s.mu must be held.
+func (s *taskStats) save() error {
+	data, err := json.Marshal(s.counters)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// recordStats counts the finished run in the task's stats, and opens the
+// task's circuit if the run was one failure too many.
+func (m *Manager) recordStats(t *Task, rec *RunRecord) {
+	s := m.taskStats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := outputDirName(t)
+	c, ok := s.counters[name]
+	if !ok {
+		c = &taskCounters{}
+		s.counters[name] = c
+	}
+	c.add(rec)
+	m.tripCircuit(t, c, rec)
+	if err := s.save(); err != nil {
+		fmt.Printf("Error saving stats for task '%s': %v\n", t.Name, err)
+	}
+}
+
+// TaskStats returns the run statistics of the named task. A task that never
+// ran has zero stats.
+func (m *Manager) TaskStats(name string) (TaskStats, error) {
+	if !ValidName(name) {
+		return TaskStats{}, ErrTaskNotFound
+	}
+	m.taskStats.mu.Lock()
+	c, ok := m.taskStats.counters[name]
+	var counters taskCounters
+	if ok {
+		counters = *c
+	}
+	m.taskStats.mu.Unlock()
+	if !ok {
+		if _, err := os.Stat(filepath.Join(m.taskDefsPath, name+".toml")); err != nil {
+			return TaskStats{}, ErrTaskNotFound
+		}
+	}
+
+	stats := TaskStats{
+		Runs:          counters.Runs,
+		Successes:     counters.Successes,
+		Failures:      counters.Failures,
+		Skips:         counters.Skips,
+		Cancellations: counters.Cancellations,
+		LastError:     counters.LastError,
+	}
+	if ran := counters.Runs - counters.Skips; ran > 0 {
+		stats.AvgDurationMs = counters.DurationMs / int64(ran)
+	}
+	if counters.Responses > 0 {
+		stats.AvgResponseLength = int(counters.ResponseChars / int64(counters.Responses))
+	}
+	if !counters.LastErrorAt.IsZero() {
+		stats.LastErrorAt = &counters.LastErrorAt
+	}
+	return stats, nil
+}
+
+// Summary returns the compact form of the stats.
+func (s TaskStats) Summary() TaskStatsSummary {
+	return TaskStatsSummary{Runs: s.Runs, Failures: s.Failures, AvgDurationMs: s.AvgDurationMs}
+}
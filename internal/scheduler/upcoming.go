@@ -0,0 +1,58 @@
+package scheduler
+
+import (
+	"sort"
+	"time"
+)
+
+// MaxUpcomingWindow is the longest window Upcoming looks ahead.
+const MaxUpcomingWindow = 7 * 24 * time.Hour
+
+// maxUpcomingRuns caps the runs Upcoming returns, so a schedule firing every
+// second can't produce a huge list.
+const maxUpcomingRuns = 1000
+
+// UpcomingRun is a scheduled run of a task.
+type UpcomingRun struct {
+	// Task is the task's definition file name, without .toml.
+	Task     string    `json:"task"`
+	FireTime time.Time `json:"fire_time"`
+}
+
+// Upcoming returns the runs due in the next window, up to MaxUpcomingWindow,
+// ordered by time. Only tasks registered with a schedule or run_at are
+// listed; dependent tasks and completed one-shots never fire on their own.
+// At most the first 1000 runs are returned.
+func (m *Manager) Upcoming(window time.Duration) []UpcomingRun {
+	window = min(window, MaxUpcomingWindow)
+	now := time.Now()
+	end := now.Add(window)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	runs := make([]UpcomingRun, 0)
+	for name, id := range m.entries {
+		sched := m.cron.Entry(id).Schedule
+		if sched == nil {
+			continue
+		}
+		next := now
+		for n := 0; n < maxUpcomingRuns; n++ {
+			next = sched.Next(next)
+			if next.IsZero() || next.After(end) {
+				break
+			}
+			runs = append(runs, UpcomingRun{Task: name, FireTime: next})
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		if !runs[i].FireTime.Equal(runs[j].FireTime) {
+			return runs[i].FireTime.Before(runs[j].FireTime)
+		}
+		return runs[i].Task < runs[j].Task
+	})
+	if len(runs) > maxUpcomingRuns {
+		runs = runs[:maxUpcomingRuns]
+	}
+	return runs
+}
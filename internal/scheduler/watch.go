@@ -0,0 +1,120 @@
+package scheduler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// fileState identifies a version of a task definition file.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// scanTaskFiles returns the state of every task definition file on disk,
+// keyed by file name without the .toml extension.
+func (m *Manager) scanTaskFiles() (map[string]fileState, error) {
+	files, err := os.ReadDir(m.taskDefsPath)
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]fileState)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".toml") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		states[strings.TrimSuffix(file.Name(), ".toml")] = fileState{modTime: info.ModTime(), size: info.Size()}
+	}
+	return states, nil
+}
+
+// markFile records the current state of a task definition file as applied,
+// so the watcher doesn't reload changes already made through the API.
+func (m *Manager) markFile(name string) {
+	info, err := os.Stat(filepath.Join(m.taskDefsPath, name+".toml"))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pending, name)
+	if err != nil {
+		delete(m.files, name)
+		return
+	}
+	m.files[name] = fileState{modTime: info.ModTime(), size: info.Size()}
+}
+
+// watch rescans the tasks directory at the given interval.
+func (m *Manager) watch(interval time.Duration) {
+	m.cron.Schedule(cron.Every(interval), cron.FuncJob(m.rescan))
+}
+
+// rescan adjusts cron entries to added, modified and removed task files. A
+// new or modified file is only applied once it looks the same on two
+// consecutive scans, so files still being written are left alone.
+func (m *Manager) rescan() {
+	states, err := m.scanTaskFiles()
+	if err != nil {
+		fmt.Printf("Warning: Failed to rescan task definitions: %v\n", err)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, state := range states {
+		if applied, ok := m.files[name]; ok && applied == state {
+			delete(m.pending, name)
+			continue
+		}
+		if pending, ok := m.pending[name]; !ok || pending != state {
+			m.pending[name] = state
+			continue
+		}
+		delete(m.pending, name)
+		m.files[name] = state
+		m.reloads++
+
+		_, wasScheduled := m.tasks[name]
+		m.unschedule(name)
+		task, err := m.readTaskFile(name)
+		if err == nil {
+			err = m.schedule(name, task)
+		}
+		m.recordLoad(name, err)
+		switch {
+		case err != nil:
+			fmt.Printf("Warning: Unscheduled task file %s.toml: %v\n", name, err)
+		case wasScheduled:
+			fmt.Printf("Rescheduled task: '%s' with schedule: '%s'\n", task.Name, task.Schedule)
+		default:
+			fmt.Printf("Scheduled task: '%s' with schedule: '%s'\n", task.Name, task.Schedule)
+		}
+	}
+	for name := range m.files {
+		if _, ok := states[name]; ok {
+			continue
+		}
+		delete(m.files, name)
+		delete(m.pending, name)
+		delete(m.loadErrors, name)
+		if _, ok := m.tasks[name]; ok {
+			m.unschedule(name)
+			m.reloads++
+			fmt.Printf("Unscheduled removed task file %s.toml\n", name)
+		}
+	}
+}
+
+// Reloads returns how many task file changes the watcher has applied.
+func (m *Manager) Reloads() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reloads
+}
@@ -0,0 +1,169 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Values of Task.NotifyOn.
+const (
+	NotifyAlways  = "always"
+	NotifyFailure = "failure"
+)
+
+// maxWebhookText caps the response or error included in a webhook payload.
+const maxWebhookText = 2000
+
+// WebhookPayload is the JSON body posted to a task's webhook_url. Text makes
+// it usable as a Slack incoming webhook message.
+type WebhookPayload struct {
+	Text       string `json:"text"`
+	Task       string `json:"task"`
+	RunID      string `json:"run_id"`
+	Status     string `json:"status"`
+	DurationMs int64  `json:"duration_ms"`
+	Response   string `json:"response,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// wantsNotification reports whether the finished run should be posted to the
+// task's webhooks.
+func (t *Task) wantsNotification(rec *RunRecord) bool {
+	if t.WebhookURL == "" && t.SlackWebhook == "" && t.DiscordWebhook == "" {
+		return false
+	}
+	if t.NotifyOn == NotifyFailure {
+		return rec.failed()
+	}
+	return true
+}
+
+// destination sends a finished run somewhere and reports how many messages
+// it took.
+type destination struct {
+	target string
+	send   func(rec *RunRecord) (int, error)
+}
+
+// destinations lists where the finished run should be delivered.
+func (m *Manager) destinations(t *Task, rec *RunRecord) []destination {
+	var ds []destination
+	if t.wantsNotification(rec) {
+		if t.WebhookURL != "" {
+			ds = append(ds, destination{DeliveryWebhook, func(rec *RunRecord) (int, error) {
+				return 1, m.postWithRetry(t.WebhookURL, webhookPayload(rec))
+			}})
+		}
+		if t.SlackWebhook != "" {
+			ds = append(ds, destination{DeliverySlack, func(rec *RunRecord) (int, error) {
+				return postAll(m, t.SlackWebhook, slackMessages(rec))
+			}})
+		}
+		if t.DiscordWebhook != "" {
+			ds = append(ds, destination{DeliveryDiscord, func(rec *RunRecord) (int, error) {
+				return postAll(m, t.DiscordWebhook, discordMessages(rec))
+			}})
+		}
+	}
+	if t.wantsEmail(rec) {
+		if m.smtp.Host == "" {
+			fmt.Printf("Warning: task '%s' has email_to set but SMTP is not configured\n", t.Name)
+		} else {
+			ds = append(ds, destination{DeliveryEmail, func(rec *RunRecord) (int, error) {
+				return 1, m.sendEmail(t, rec)
+			}})
+		}
+	}
+	return ds
+}
+
+// notify delivers the finished run to the task's webhooks and email
+// recipients in the background, retrying each webhook request once. The
+// outcome of each delivery is added to the run record.
+func (m *Manager) notify(t *Task, rec RunRecord) {
+	ds := m.destinations(t, &rec)
+	if len(ds) == 0 {
+		return
+	}
+	go func() {
+		for _, d := range ds {
+			n, err := d.send(&rec)
+			delivery := Delivery{Target: d.target, Messages: n}
+			if err != nil {
+				fmt.Printf("Error delivering task '%s' to %s: %v\n", t.Name, d.target, err)
+				delivery.Error = err.Error()
+				switch d.target {
+				case DeliveryWebhook:
+					rec.WebhookError = delivery.Error
+				case DeliveryEmail:
+					rec.EmailError = delivery.Error
+				}
+			}
+			rec.Deliveries = append(rec.Deliveries, delivery)
+		}
+		if err := m.saveRun(t, &rec); err != nil {
+			fmt.Printf("Error saving output for task '%s': %v\n", t.Name, err)
+		}
+	}()
+}
+
+// runSummary is the one-line outcome of a run used by all notifications.
+func runSummary(rec *RunRecord) string {
+	return fmt.Sprintf("Task %s %s in %.1fs", rec.Task, rec.Status, float64(rec.DurationMs)/1000)
+}
+
+func webhookPayload(rec *RunRecord) WebhookPayload {
+	text := runSummary(rec)
+	if rec.Error != "" {
+		text += ": " + truncate(rec.Error, maxWebhookText)
+	}
+	return WebhookPayload{
+		Text:       text,
+		Task:       rec.Task,
+		RunID:      rec.ID,
+		Status:     rec.Status,
+		DurationMs: rec.DurationMs,
+		Response:   truncate(rec.Response, maxWebhookText),
+		Error:      truncate(rec.Error, maxWebhookText),
+	}
+}
+
+// postAll posts the messages in order, stopping at the first one that can't
+// be delivered. It returns how many were delivered.
+func postAll[T any](m *Manager, url string, msgs []T) (int, error) {
+	for i, msg := range msgs {
+		if err := m.postWithRetry(url, msg); err != nil {
+			return i, fmt.Errorf("message %d of %d: %w", i+1, len(msgs), err)
+		}
+	}
+	return len(msgs), nil
+}
+
+// postWithRetry posts payload as JSON, retrying once after
+// m.webhookRetryDelay.
+func (m *Manager) postWithRetry(url string, payload interface{}) error {
+	err := m.postWebhook(url, payload)
+	if err != nil {
+		time.Sleep(m.webhookRetryDelay)
+		err = m.postWebhook(url, payload)
+	}
+	return err
+}
+
+func (m *Manager) postWebhook(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := m.webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
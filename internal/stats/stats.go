@@ -2,43 +2,130 @@ package stats
 
 import (
 	"log"
+	"math/rand/v2"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// cacheLineSize pads each shard so shards don't share a cache line.
+const cacheLineSize = 64
+
+// Stats counts the calls made to the backends. Recording is safe for
+// concurrent use and nearly lock-free: the totals are atomic counters, and
+// latency samples go to one of several lock-striped shards that
+// TotalLatency and Get add up.
 type Stats struct {
-	mu            sync.Mutex
-	TotalCalls    int           `json:"total_calls"`
-	TotalLatency  time.Duration `json:"total_latency"`
-	TotalCharsIn  int           `json:"total_chars_in"`
-	TotalCharsOut int           `json:"total_chars_out"`
+	TotalCalls    atomic.Int64
+	TotalCharsIn  atomic.Int64
+	TotalCharsOut atomic.Int64
+	InFlight      atomic.Int64
+	CacheHits     atomic.Int64
+	// StreamChars and StreamTime add up the responses and durations, in
+	// nanoseconds, of streamed prompts.
+	StreamChars atomic.Int64
+	StreamTime  atomic.Int64
+	shards      []shard
+}
+
+// shard holds part of the latency samples.
+type shard struct {
+	mu      sync.Mutex
+	latency time.Duration
+	_       [cacheLineSize]byte
 }
 
-func New() *Stats {
-	return &Stats{}
+// Option configures Stats.
+type Option func(*Stats)
+
+// WithShards sets the number of shards latency samples are spread over.
+// The default, 0, uses one per CPU.
+func WithShards(n int) Option {
+	return func(s *Stats) {
+		if n > 0 {
+			s.shards = make([]shard, n)
+		}
+	}
+}
+
+func New(opts ...Option) *Stats {
+	s := &Stats{}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.shards == nil {
+		s.shards = make([]shard, runtime.GOMAXPROCS(0))
+	}
+	return s
 }
 
 func (s *Stats) RecordCall(latency time.Duration, charsIn, charsOut int) {
 	log.Printf("Recording call: latency=%v, charsIn=%d, charsOut=%d\n", latency, charsIn, charsOut)
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.TotalCalls++
-	s.TotalLatency += latency
-	s.TotalCharsIn += charsIn
-	s.TotalCharsOut += charsOut
+	// Pick a shard at random, spreading concurrent writers over them.
+	sh := &s.shards[rand.N(len(s.shards))]
+	sh.mu.Lock()
+	sh.latency += latency
+	sh.mu.Unlock()
+	s.TotalCalls.Add(1)
+	s.TotalCharsIn.Add(int64(charsIn))
+	s.TotalCharsOut.Add(int64(charsOut))
+}
+
+// TotalLatency adds up the latency of all recorded calls.
+func (s *Stats) TotalLatency() time.Duration {
+	var total time.Duration
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		total += sh.latency
+		sh.mu.Unlock()
+	}
+	return total
+}
+
+// CallStarted marks a backend call as in flight.
+func (s *Stats) CallStarted() {
+	s.InFlight.Add(1)
+}
+
+// CallFinished marks an in-flight backend call as done.
+func (s *Stats) CallFinished() {
+	s.InFlight.Add(-1)
+}
+
+// RecordCacheHit counts a prompt answered from the response cache.
+func (s *Stats) RecordCacheHit() {
+	s.CacheHits.Add(1)
+}
+
+// RecordThroughput adds a streamed response of chars characters that took
+// elapsed to generate.
+func (s *Stats) RecordThroughput(chars int, elapsed time.Duration) {
+	s.StreamChars.Add(int64(chars))
+	s.StreamTime.Add(int64(elapsed))
 }
 
 func (s *Stats) Get() map[string]interface{} {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	calls := s.TotalCalls.Load()
+	latency := s.TotalLatency()
+	streamChars := s.StreamChars.Load()
+	streamTime := time.Duration(s.StreamTime.Load())
 	avgLatency := int64(0)
-	if s.TotalCalls > 0 {
-		avgLatency = s.TotalLatency.Milliseconds() / int64(s.TotalCalls)
+	if calls > 0 {
+		avgLatency = latency.Milliseconds() / calls
+	}
+	charsPerSec := 0.0
+	if streamTime > 0 {
+		charsPerSec = float64(streamChars) / streamTime.Seconds()
 	}
 	return map[string]interface{}{
-		"total_calls":     s.TotalCalls,
-		"avg_latency_ms":  avgLatency,
-		"total_chars_in":  s.TotalCharsIn,
-		"total_chars_out": s.TotalCharsOut,
+		"total_calls":          int(calls),
+		"avg_latency_ms":       avgLatency,
+		"total_chars_in":       int(s.TotalCharsIn.Load()),
+		"total_chars_out":      int(s.TotalCharsOut.Load()),
+		"in_flight":            int(s.InFlight.Load()),
+		"cache_hits":           int(s.CacheHits.Load()),
+		"stream_chars_per_sec": charsPerSec,
 	}
 }
@@ -0,0 +1,196 @@
+// Package templates stores reusable conversation prompts with variables.
+package templates
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// ErrNotFound is returned for a template that doesn't exist.
+var ErrNotFound = errors.New("template not found")
+
+// ErrExists is returned when creating a template whose name is taken.
+var ErrExists = errors.New("template already exists")
+
+// ErrInvalid is wrapped by the errors Validate returns.
+var ErrInvalid = errors.New("invalid template")
+
+// Template is a prompt stored as data/templates/<name>.toml. The prompt is a
+// Go template over the variables given when it is used, e.g. {{.language}}.
+type Template struct {
+	Name        string `toml:"name" json:"name"`
+	Description string `toml:"description,omitempty" json:"description,omitempty"`
+	Prompt      string `toml:"prompt" json:"prompt"`
+}
+
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ValidName reports whether name can be used as a template file name.
+func ValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+// Validate checks that a template can be saved.
+func Validate(t *Template) error {
+	if !ValidName(t.Name) {
+		return fmt.Errorf("%w: name %q may only contain lowercase letters, digits, '-' and '_'", ErrInvalid, t.Name)
+	}
+	if strings.TrimSpace(t.Prompt) == "" {
+		return fmt.Errorf("%w: prompt must not be empty", ErrInvalid)
+	}
+	if _, err := t.parse(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return nil
+}
+
+func (t *Template) parse() (*template.Template, error) {
+	return template.New(t.Name).Option("missingkey=error").Parse(t.Prompt)
+}
+
+// Render fills the template's prompt with vars. Referencing a variable that
+// isn't given is an error.
+func (t *Template) Render(vars map[string]string) (string, error) {
+	tmpl, err := t.parse()
+	if err != nil {
+		return "", fmt.Errorf("invalid prompt template: %w", err)
+	}
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("could not render template %s: %w", t.Name, err)
+	}
+	return b.String(), nil
+}
+
+// Store keeps templates as TOML files in a directory.
+type Store struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewStore creates a store under baseDir/data/templates.
+func NewStore(baseDir string) (*Store, error) {
+	dir := filepath.Join(baseDir, "data/templates")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create templates directory: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) path(name string) string {
+	return filepath.Join(s.dir, name+".toml")
+}
+
+// List returns all templates, sorted by name. Files that can't be read are
+// skipped with a warning.
+func (s *Store) List() ([]Template, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read templates directory: %w", err)
+	}
+	templates := make([]Template, 0, len(files))
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".toml")
+		if file.IsDir() || !ok {
+			continue
+		}
+		t, err := s.Get(name)
+		if err != nil {
+			fmt.Printf("Warning: skipping template %s: %v\n", file.Name(), err)
+			continue
+		}
+		templates = append(templates, *t)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+// Get reads the named template.
+func (s *Store) Get(name string) (*Template, error) {
+	if !ValidName(name) {
+		return nil, ErrNotFound
+	}
+	data, err := os.ReadFile(s.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t Template
+	if err := toml.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("could not decode template %s: %w", name, err)
+	}
+	t.Name = name
+	return &t, nil
+}
+
+// Create saves a new template, failing with ErrExists if the name is taken.
+func (s *Store) Create(t *Template) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(s.path(t.Name)); err == nil {
+		return ErrExists
+	}
+	return s.write(t)
+}
+
+// Update replaces an existing template, failing with ErrNotFound if there is
+// none by that name.
+func (s *Store) Update(t *Template) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(s.path(t.Name)); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return s.write(t)
+}
+
+// write saves the template through a temporary file, so readers never see a
+// partly written one.
+func (s *Store) write(t *Template) error {
+	if err := Validate(t); err != nil {
+		return err
+	}
+	data, err := toml.Marshal(t)
+	if err != nil {
+		return err
+	}
+	tmp := s.path(t.Name) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("could not write template file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path(t.Name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not write template file: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the named template.
+func (s *Store) Delete(name string) error {
+	if !ValidName(name) {
+		return ErrNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
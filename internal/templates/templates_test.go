@@ -0,0 +1,84 @@
+package templates
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	baseDir := "test_templates_data"
+	defer os.RemoveAll(baseDir)
+	store, err := NewStore(baseDir)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+
+	review := &Template{Name: "review", Description: "Code review", Prompt: "Review this {{.language}} code:\n{{.code}}"}
+	if err := store.Create(review); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := store.Create(review); !errors.Is(err, ErrExists) {
+		t.Errorf("Expected ErrExists creating a template twice, got %v", err)
+	}
+	for _, bad := range []*Template{
+		{Name: "../escape", Prompt: "hi"},
+		{Name: "empty", Prompt: " "},
+		{Name: "broken", Prompt: "{{.unclosed"},
+	} {
+		if err := store.Create(bad); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+
+	got, err := store.Get("review")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if *got != *review {
+		t.Errorf("Expected %+v, got %+v", review, got)
+	}
+
+	review.Description = "Strict code review"
+	if err := store.Update(review); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := store.Update(&Template{Name: "missing", Prompt: "hi"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound updating a missing template, got %v", err)
+	}
+	if err := store.Create(&Template{Name: "greet", Prompt: "Hello"}); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	list, err := store.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(list) != 2 || list[0].Name != "greet" || list[1].Description != "Strict code review" {
+		t.Errorf("Unexpected template list %+v", list)
+	}
+
+	if err := store.Delete("greet"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := store.Get("greet"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+	if err := store.Delete("greet"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound deleting twice, got %v", err)
+	}
+}
+
+func TestRender(t *testing.T) {
+	tmpl := &Template{Name: "review", Prompt: "Review this {{.language}} code:\n{{.code}}"}
+	got, err := tmpl.Render(map[string]string{"language": "Go", "code": "func main() {}"})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	if want := "Review this Go code:\nfunc main() {}"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if _, err := tmpl.Render(map[string]string{"language": "Go"}); err == nil {
+		t.Error("Expected an error for a missing variable")
+	}
+}
@@ -1,26 +1,43 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"gemini-srv/internal/a2aclient"
+	"gemini-srv/internal/logrotate"
 	"gemini-srv/internal/scheduler"
 	"gemini-srv/internal/stats"
+	"gemini-srv/internal/templates"
+	"gemini-srv/internal/tracing"
 	"gemini-srv/session"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
 	"github.com/pelletier/go-toml/v2"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"trpc.group/trpc-go/trpc-a2a-go/client"
 	"trpc.group/trpc-go/trpc-a2a-go/protocol"
 )
@@ -28,18 +45,278 @@ import (
 var (
 	sessionManager   *session.Manager
 	schedulerManager *scheduler.Manager
+	templateStore    *templates.Store
 	statsManager     *stats.Stats
 	executableDir    string
+	logOutput        = io.Writer(os.Stdout)
 	upgrader         = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		CheckOrigin: checkOrigin,
+		// Lets browser clients authenticate with the "token" subprotocol.
+		Subprotocols: []string{"token"},
 	}
 )
 
-// (Auth and logging middleware remain the same)
+// backend is an a2a-server conversations can be routed to.
+type backend struct {
+	Name  string `toml:"name" json:"name"`
+	URL   string `toml:"url" json:"url"`
+	Model string `toml:"model" json:"model"`
+}
+
+const (
+	// defaultBackendName names the backend at A2A_SERVER_URL when no
+	// BACKENDS_FILE is configured.
+	defaultBackendName = "default"
+	defaultModel       = "gemini-2.5-pro"
+)
+
+// backends are the configured a2a-servers; the first one is the default.
+var backends = []backend{{Name: defaultBackendName, Model: defaultModel}}
+
+// loadBackends reads the [[backend]] tables of the TOML file at path. Without
+// a path the only backend is the one at serverURL.
+func loadBackends(path, serverURL string) ([]backend, error) {
+	if path == "" {
+		if serverURL == "" {
+			return nil, errors.New("A2A_SERVER_URL environment variable not set")
+		}
+		return []backend{{Name: defaultBackendName, URL: serverURL, Model: defaultModel}}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Backends []backend `toml:"backend"`
+	}
+	if err := toml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Backends) == 0 {
+		return nil, fmt.Errorf("%s defines no [[backend]]", path)
+	}
+	seen := make(map[string]bool)
+	for i := range config.Backends {
+		b := &config.Backends[i]
+		if b.Name == "" || b.URL == "" {
+			return nil, fmt.Errorf("backend %d needs a name and a url", i+1)
+		}
+		if seen[b.Name] {
+			return nil, fmt.Errorf("duplicate backend %q", b.Name)
+		}
+		seen[b.Name] = true
+		if b.Model == "" {
+			b.Model = defaultModel
+		}
+	}
+	return config.Backends, nil
+}
+
+// findBackend returns the backend with the given name, or the default one
+// for an empty name.
+func findBackend(name string) (backend, bool) {
+	if name == "" {
+		return backends[0], true
+	}
+	for _, b := range backends {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return backend{}, false
+}
+
+// selectedBackend returns the backend named by the "backend" query
+// parameter, or used by the conversation in the "conversation" one. It
+// writes an error response and returns false if there is none.
+func selectedBackend(w http.ResponseWriter, r *http.Request) (backend, bool) {
+	name := r.URL.Query().Get("backend")
+	if id := r.URL.Query().Get("conversation"); id != "" && name == "" {
+		if !checkConversationID(w, id) {
+			return backend{}, false
+		}
+		s, err := sessionManager.AcquireSession(id)
+		if err != nil {
+			http.Error(w, "Conversation not found", http.StatusNotFound)
+			return backend{}, false
+		}
+		name = s.Backend
+	}
+	b, ok := findBackend(name)
+	if !ok {
+		http.Error(w, "Unknown backend", http.StatusNotFound)
+	}
+	return b, ok
+}
+
+// allowedOrigins are the origins allowed to make cross-origin requests and to
+// open WebSockets. Configured with ALLOWED_ORIGINS; "*" allows any origin.
+var allowedOrigins []string
+
+// parseAllowedOrigins parses a comma-separated list of origins such as
+// "https://example.com".
+func parseAllowedOrigins(s string) []string {
+	var origins []string
+	for _, origin := range strings.Split(s, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+// originAllowed reports whether origin is in allowedOrigins.
+func originAllowed(origin string) bool {
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin validates the Origin of a WebSocket handshake against
+// allowedOrigins. Without an allow-list only same-origin requests, and
+// clients that send no Origin at all, are accepted.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(allowedOrigins) > 0 {
+		return originAllowed(origin)
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// trustedProxies are the networks whose forwarding headers are believed when
+// resolving the client IP. Configured with TRUSTED_PROXIES.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or bare IPs.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			if ip := net.ParseIP(part); ip != nil && ip.To4() != nil {
+				part += "/32"
+			} else {
+				part += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", part, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made the request. The
+// X-Forwarded-For and X-Real-IP headers are only honoured when the direct peer
+// is a trusted proxy; otherwise the peer address is used as is.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !isTrustedProxy(peer) {
+		return peer
+	}
+
+	// Walk X-Forwarded-For from the right, skipping our own proxies; the first
+	// untrusted hop is the client.
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			if !isTrustedProxy(ip) || i == 0 {
+				return ip
+			}
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip
+	}
+	return peer
+}
+
+// isLoopbackRequest reports whether the request comes from a loopback address.
+// Forwarding headers only count when sent by a trusted proxy, so a remote
+// client can't claim to be local.
+func isLoopbackRequest(r *http.Request) bool {
+	ip := clientIP(r)
+	return ip != nil && ip.IsLoopback()
+}
+
+// webSocketToken returns the auth token of a WebSocket handshake, passed
+// either as ?token=... or as the subprotocol pair "token, <value>", since
+// browsers can't set an Authorization header on WebSocket requests.
+func webSocketToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	protocols := websocket.Subprotocols(r)
+	if len(protocols) == 2 && protocols[0] == "token" {
+		return protocols[1]
+	}
+	return ""
+}
+
+// webSocketRoute reports whether path is one of the WebSocket streams,
+// /api/v1/conversations/{id}/prompt/stream and /api/v1/tasks/{name}/stream.
+func webSocketRoute(path string) bool {
+	parts := strings.Split(strings.TrimPrefix(path, "/api/v1/"), "/")
+	switch {
+	case len(parts) == 4 && parts[0] == "conversations" && parts[2] == "prompt" && parts[3] == "stream":
+		return true
+	case len(parts) == 3 && parts[0] == "tasks" && parts[2] == "stream":
+		return true
+	}
+	return false
+}
+
+// validWebSocketToken reports whether r is a WebSocket handshake on one of
+// the stream routes carrying the token configured in GEMINI_SRV_WS_TOKEN.
+// The upgrade headers are up to the client, so the token is never accepted
+// on other routes.
+func validWebSocketToken(r *http.Request) bool {
+	want := os.Getenv("GEMINI_SRV_WS_TOKEN")
+	if want == "" || r.Method != http.MethodGet || !webSocketRoute(r.URL.Path) || !websocket.IsWebSocketUpgrade(r) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(webSocketToken(r)), []byte(want)) == 1
+}
+
 func basicAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if os.Getenv("AUTH_DISABLE_LOCALHOST") == "true" && isLoopbackRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if validWebSocketToken(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
 		user := os.Getenv("GEMINI_SRV_USER")
 		pass := os.Getenv("GEMINI_SRV_PASS")
 		if user == "" || pass == "" {
@@ -65,19 +342,42 @@ func basicAuth(next http.Handler) http.Handler {
 	})
 }
 
+// redactedURL hides the WebSocket auth token so it doesn't end up in the logs.
+func redactedURL(u *url.URL) string {
+	q := u.Query()
+	if q.Get("token") == "" {
+		return u.String()
+	}
+	q.Set("token", "REDACTED")
+	redacted := *u
+	redacted.RawQuery = q.Encode()
+	return redacted.String()
+}
+
 func httpBasicsLogger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if len(allowedOrigins) == 0 {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if origin := r.Header.Get("Origin"); origin != "" && originAllowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
 		w.Header().Set("Cross-Origin-Opener-Policy", "same-origin")
 		w.Header().Set("Cross-Origin-Embedder-Policy", "require-corp")
-		fmt.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+		fmt.Fprintf(logOutput, "%s %s %s %s\n", time.Now().Format(time.RFC3339), clientIP(r), r.Method, redactedURL(r.URL))
 		next.ServeHTTP(w, r)
 	})
 }
 
 // (API handlers remain the same)
 func listConversationsHandler(w http.ResponseWriter, r *http.Request) {
-	conversations, err := sessionManager.ListConversations()
+	var conversations []session.ConversationInfo
+	var err error
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		conversations, err = sessionManager.ListConversationsByTag(tag)
+	} else {
+		conversations, err = sessionManager.ListConversations()
+	}
 	if err != nil {
 		http.Error(w, "Failed to list conversations", http.StatusInternalServerError)
 		return
@@ -91,7 +391,10 @@ func listConversationsHandler(w http.ResponseWriter, r *http.Request) {
 
 func createConversationHandler(w http.ResponseWriter, r *http.Request) {
 	var reqBody struct {
-		ContextPath string `json:"context_path"`
+		ContextPath    string `json:"context_path"`
+		UserLabel      string `json:"user_label"`
+		AssistantLabel string `json:"assistant_label"`
+		Backend        string `json:"backend"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil && err != io.EOF {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -103,7 +406,13 @@ func createConversationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	sessionID := id.String()
-	s, err := sessionManager.CreateSession(sessionID, reqBody.ContextPath)
+	s, err := sessionManager.CreateSession(sessionID, reqBody.ContextPath,
+		session.WithLabels(reqBody.UserLabel, reqBody.AssistantLabel),
+		session.WithBackend(reqBody.Backend))
+	if errors.Is(err, session.ErrUnknownBackend) || errors.Is(err, session.ErrOutsideSandbox) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
@@ -113,19 +422,121 @@ func createConversationHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(s)
 }
 
+func importConversationHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	s, err := sessionManager.ImportSession(data)
+	if errors.Is(err, session.ErrInvalidImport) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to import conversation", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
 func getConversationHandler(w http.ResponseWriter, r *http.Request) {
 	id := strings.TrimPrefix(r.URL.Path, "/api/v1/conversations/")
+	if !checkConversationID(w, id) {
+		return
+	}
 	s, err := sessionManager.AcquireSession(id)
 	if err != nil {
 		http.Error(w, "Conversation not found", http.StatusNotFound)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(s)
+	json.NewEncoder(w).Encode(struct {
+		*session.Session
+		// QueueDepth counts the prompts running or waiting their turn.
+		QueueDepth int `json:"queue_depth"`
+	}{s, sessionManager.QueueDepth(id)})
+}
+
+// getHistoryHandler returns a page of a conversation's history:
+// ?limit= turns from ?offset=, counted from the oldest turn. Without an
+// offset it returns the latest turns, so clients can load older ones as
+// needed.
+func getHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/conversations/"), "/history")
+	if !checkConversationID(w, id) {
+		return
+	}
+	query := r.URL.Query()
+	limit := defaultHistoryLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxHistoryLimit)
+	}
+	offset := -limit
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	turns, total, err := sessionManager.GetHistoryPage(id, offset, limit)
+	if err != nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	if offset < 0 {
+		offset = max(total+offset, 0)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Turns  []session.Turn `json:"turns"`
+		Offset int            `json:"offset"`
+		Total  int            `json:"total"`
+	}{turns, offset, total})
+}
+
+// wantsPlainText reports whether the client asked for a bare text response,
+// either with ?format=text or an Accept header preferring text/plain. JSON
+// stays the default.
+func wantsPlainText(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "text", "plain":
+		return true
+	case "json":
+		return false
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") && !strings.Contains(accept, "application/json")
+}
+
+// requestID returns the caller's X-Request-Id, or a fresh one if none was sent.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	return uuid.New().String()
 }
 
 func postPromptHandler(w http.ResponseWriter, r *http.Request) {
 	id := strings.Split(r.URL.Path, "/")[4]
+	if !checkConversationID(w, id) {
+		return
+	}
+	reqID := requestID(r)
+	w.Header().Set("X-Request-Id", reqID)
+	ctx, span := tracing.Tracer().Start(r.Context(), "postPromptHandler",
+		trace.WithAttributes(attribute.String("request.id", reqID), attribute.String("session.id", id)))
+	defer span.End()
+
 	s, err := sessionManager.AcquireSession(id)
 	if err != nil {
 		http.Error(w, "Conversation not found", http.StatusNotFound)
@@ -134,32 +545,127 @@ func postPromptHandler(w http.ResponseWriter, r *http.Request) {
 	var reqBody struct {
 		Prompt string `json:"prompt"`
 		AsTask bool   `json:"as_task"`
+		Cache  bool   `json:"cache"`
+		// Extract names a post-processor, such as "json", that keeps only
+		// a code block of the response.
+		Extract string `json:"extract"`
+		// Template names a stored template to render with Variables
+		// instead of sending Prompt.
+		Template  string            `json:"template"`
+		Variables map[string]string `json:"variables"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if reqBody.Template != "" {
+		if reqBody.Prompt != "" {
+			http.Error(w, "Send either a prompt or a template, not both", http.StatusBadRequest)
+			return
+		}
+		tmpl, err := templateStore.Get(reqBody.Template)
+		if errors.Is(err, templates.ErrNotFound) {
+			http.Error(w, "Template not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load template", http.StatusInternalServerError)
+			return
+		}
+		if reqBody.Prompt, err = tmpl.Render(reqBody.Variables); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if reqBody.Cache {
+		ctx = session.WithCache(ctx)
+	}
+	if reqBody.Extract != "" {
+		if !session.ValidExtract(reqBody.Extract) {
+			http.Error(w, fmt.Sprintf("Invalid extract %q: must be %q or %q", reqBody.Extract, session.ExtractJSON, session.ExtractCode), http.StatusBadRequest)
+			return
+		}
+		if reqBody.AsTask {
+			http.Error(w, "extract is not supported with as_task", http.StatusBadRequest)
+			return
+		}
+		ctx = session.WithExtract(ctx, reqBody.Extract)
+	}
 
 	if reqBody.AsTask {
-		taskID, err := sessionManager.RunPromptAsTask(s, reqBody.Prompt)
+		taskID, err := sessionManager.RunPromptAsTask(ctx, s, reqBody.Prompt)
+		if errors.Is(err, session.ErrBusy) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if errors.Is(err, session.ErrHistoryFull) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, session.ErrTimeout) {
+			writeTimeoutError(w, sessionManager.PromptTimeout())
+			return
+		}
 		if err != nil {
 			fmt.Printf("Error running prompt as task for session %s: %v\n", id, err)
 			http.Error(w, "Failed to run prompt as task", http.StatusInternalServerError)
 			return
 		}
+		if wantsPlainText(r) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, taskID)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"task_id": taskID})
 	} else {
-		response, err := sessionManager.RunPrompt(s, reqBody.Prompt)
+		response, err := sessionManager.RunPrompt(ctx, s, reqBody.Prompt)
+		if errors.Is(err, session.ErrBusy) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if errors.Is(err, session.ErrHistoryFull) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, session.ErrEmptyResponse) {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if errors.Is(err, session.ErrTimeout) {
+			writeTimeoutError(w, sessionManager.PromptTimeout())
+			return
+		}
 		if err != nil {
 			fmt.Printf("Error running prompt for session %s: %v\n", id, err)
 		}
+		if wantsPlainText(r) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, response)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"response": response})
 	}
 }
 
+// writeTimeoutError tells the client the a2a-server didn't answer within
+// timeout, with a 504 Gateway Timeout.
+func writeTimeoutError(w http.ResponseWriter, timeout time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGatewayTimeout)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":           fmt.Sprintf("the a2a-server did not respond within %v", timeout),
+		"timeout":         timeout.String(),
+		"timeout_seconds": timeout.Seconds(),
+	})
+}
+
 func postPromptStreamHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Split(r.URL.Path, "/")[4]
+	if !checkConversationID(w, id) {
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
@@ -167,7 +673,6 @@ func postPromptStreamHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	id := strings.Split(r.URL.Path, "/")[4]
 	s, err := sessionManager.AcquireSession(id)
 	if err != nil {
 		log.Println(err)
@@ -182,16 +687,40 @@ func postPromptStreamHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	prompt := string(p)
 
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go readStreamControl(conn, cancel)
+
+	writer := newStreamWriter(conn, cancel)
+	defer writer.close()
+
+	if r.URL.Query().Get("raw") != "true" {
+		deltaChan := make(chan session.DeltaEvent)
+		go sessionManager.StreamDeltas(ctx, s, prompt, deltaChan)
+		for delta := range deltaChan {
+			// Keep draining so StreamDeltas can finish and save the
+			// partial response even if the client is gone.
+			writer.send(delta, delta.Type == session.DeltaTypeDelta || delta.Type == session.DeltaTypeStats)
+		}
+		return
+	}
+
+	// Tell the client generation started before the first token arrives.
+	ctx = session.WithStreamStart(ctx, func() {
+		writer.send(map[string]string{"kind": "start"}, false)
+	})
+
 	log.Println("Creating event channel in postPromptStreamHandler")
 	eventChan := make(chan protocol.StreamingMessageEvent)
 
+	var streamErr error
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		log.Println("Starting goroutine to call RunPromptStream")
-		if err := sessionManager.RunPromptStream(s, prompt, eventChan); err != nil {
-			log.Printf("Error from RunPromptStream: %v\n", err)
+		if streamErr = sessionManager.RunPromptStream(ctx, s, prompt, eventChan); streamErr != nil {
+			log.Printf("Error from RunPromptStream: %v\n", streamErr)
 		}
 		log.Println("RunPromptStream finished")
 		close(eventChan)
@@ -205,86 +734,1233 @@ func postPromptStreamHandler(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 		log.Printf("Relaying event to websocket: %s\n", out)
-		if err := conn.WriteJSON(event); err != nil {
-			log.Printf("Error writing to websocket: %v\n", err)
-			return
-		}
+		writer.send(event, true)
 	}
 	log.Println("Event channel closed in postPromptStreamHandler.")
 	wg.Wait()
-}
 
-func deleteConversationHandler(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/v1/conversations/")
-	if err := sessionManager.DeleteSession(id); err != nil {
-		http.Error(w, "Failed to delete session", http.StatusInternalServerError)
-		return
+	if streamErr != nil {
+		writer.send(map[string]string{"kind": "error", "text": streamErr.Error()}, false)
 	}
-	w.WriteHeader(http.StatusNoContent)
+	writer.send(map[string]string{"kind": "end"}, false)
 }
 
-func listTasksHandler(w http.ResponseWriter, r *http.Request) {
-	tasksPath := filepath.Join(executableDir, "data/tasks")
-	files, err := os.ReadDir(tasksPath)
+// promptEventsHandler streams the response to the prompt in ?prompt= as
+// server-sent events, each numbered with a monotonic id. A client that
+// reconnects with a Last-Event-ID header, as EventSource does, resumes the
+// conversation's latest response after that event instead of sending the
+// prompt again; 204 No Content tells it there is nothing left to resume.
+func promptEventsHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Split(r.URL.Path, "/")[4]
+	if !checkConversationID(w, id) {
+		return
+	}
+	s, err := sessionManager.AcquireSession(id)
 	if err != nil {
-		http.Error(w, "Failed to read tasks directory", http.StatusInternalServerError)
+		http.Error(w, "Conversation not found", http.StatusNotFound)
 		return
 	}
-	tasks := make([]string, 0)
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".toml") {
-			tasks = append(tasks, strings.TrimSuffix(file.Name(), ".toml"))
-		}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(tasks)
-}
 
-func getTaskLogsHandler(w http.ResponseWriter, r *http.Request) {
-	taskName := strings.Split(r.URL.Path, "/")[4]
-	logDir := filepath.Join(executableDir, "data/task_outputs", taskName)
-	files, err := os.ReadDir(logDir)
-	if err != nil {
-		http.Error(w, "Logs not found for task", http.StatusNotFound)
-		return
+	var es *session.EventStream
+	after := 0
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if after, err = strconv.Atoi(v); err != nil || after < 0 {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		if es = sessionManager.EventStream(s.ID); es == nil || es.Over(after) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	} else {
+		prompt := r.URL.Query().Get("prompt")
+		if prompt == "" {
+			http.Error(w, "Missing prompt", http.StatusBadRequest)
+			return
+		}
+		// The response keeps being received for a client that reconnects.
+		es = sessionManager.StartEventStream(context.WithoutCancel(r.Context()), s, prompt)
 	}
-	var logs []string
-	for _, file := range files {
-		if !file.IsDir() {
-			content, err := os.ReadFile(filepath.Join(logDir, file.Name()))
-			if err == nil {
-				logs = append(logs, string(content))
-			}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	err = es.Follow(r.Context(), after, func(ev session.NumberedEvent) error {
+		data, err := json.Marshal(ev.DeltaEvent)
+		if err != nil {
+			return err
 		}
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", ev.ID, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("Error streaming events for session %s: %v\n", s.ID, err)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(logs)
 }
 
-func getTaskDetailsHandler(w http.ResponseWriter, r *http.Request) {
-	taskName := strings.TrimPrefix(r.URL.Path, "/api/v1/tasks/")
-	taskPath := filepath.Join(executableDir, "data/tasks", taskName+".toml")
+// streamBuffer configures how streamed responses are relayed to WebSocket
+// clients: up to size events are buffered for a slow client, after which
+// further events are dropped if drop is set, or otherwise hold up the stream
+// until there is room. A client that takes longer than writeTimeout to accept
+// a single write is disconnected.
+var streamBuffer = struct {
+	size         int
+	drop         bool
+	writeTimeout time.Duration
+}{size: 64, writeTimeout: 10 * time.Second}
 
-	data, err := os.ReadFile(taskPath)
-	if err != nil {
-		http.Error(w, "Task not found", http.StatusNotFound)
-		return
-	}
+// jsonConn is the part of a *websocket.Conn a streamWriter writes to.
+type jsonConn interface {
+	WriteJSON(v interface{}) error
+	SetWriteDeadline(t time.Time) error
+}
 
-	var task scheduler.Task
-	if err := toml.Unmarshal(data, &task); err != nil {
-		http.Error(w, "Failed to parse task file", http.StatusInternalServerError)
-		return
-	}
+// streamWriter relays events to a WebSocket client from its own goroutine,
+// through a buffer of streamBuffer.size events, so that a slow client does
+// not stall the a2a-server stream feeding it.
+type streamWriter struct {
+	conn    jsonConn
+	events  chan interface{}
+	failed  chan struct{} // closed when a write fails
+	done    chan struct{} // closed when the writer goroutine exits
+	cancel  context.CancelFunc
+	err     error
+	dropped int
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(task)
+// newStreamWriter starts writing to conn. cancel is called if a write fails,
+// to stop the stream producing events nobody will receive.
+func newStreamWriter(conn jsonConn, cancel context.CancelFunc) *streamWriter {
+	w := &streamWriter{
+		conn:   conn,
+		events: make(chan interface{}, streamBuffer.size),
+		failed: make(chan struct{}),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	go w.run()
+	return w
 }
 
-func deleteTaskHandler(w http.ResponseWriter, r *http.Request) {
+func (w *streamWriter) run() {
+	defer close(w.done)
+	for v := range w.events {
+		if w.err != nil {
+			continue
+		}
+		if streamBuffer.writeTimeout > 0 {
+			w.conn.SetWriteDeadline(time.Now().Add(streamBuffer.writeTimeout))
+		}
+		if err := w.conn.WriteJSON(v); err != nil {
+			log.Printf("Error writing to websocket: %v\n", err)
+			w.err = err
+			close(w.failed)
+			w.cancel()
+		}
+	}
+}
+
+// send queues v for the client. Events that may be dropped are discarded when
+// the buffer is full and streamBuffer.drop is set; others wait for room. It
+// returns false once writing to the client has failed.
+func (w *streamWriter) send(v interface{}, droppable bool) bool {
+	select {
+	case <-w.failed:
+		return false
+	default:
+	}
+	if droppable && streamBuffer.drop {
+		select {
+		case w.events <- v:
+		default:
+			if w.dropped == 0 {
+				log.Println("Websocket client is too slow, dropping stream events")
+			}
+			w.dropped++
+		}
+		return true
+	}
+	select {
+	case w.events <- v:
+		return true
+	case <-w.failed:
+		return false
+	}
+}
+
+// close flushes the buffered events and waits for the writer to finish. It
+// returns the error that stopped the writer, if any.
+func (w *streamWriter) close() error {
+	close(w.events)
+	<-w.done
+	if w.dropped > 0 {
+		log.Printf("Dropped %d stream events for a slow websocket client\n", w.dropped)
+	}
+	return w.err
+}
+
+// readStreamControl reads control messages sent by the client while a response
+// is streaming, cancelling the stream on {"action":"stop"} or when the client
+// goes away.
+func readStreamControl(conn *websocket.Conn, cancel context.CancelFunc) {
+	defer cancel()
+	for {
+		var control struct {
+			Action string `json:"action"`
+		}
+		if err := conn.ReadJSON(&control); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				continue
+			}
+			return
+		}
+		if control.Action == "stop" {
+			log.Println("Stop requested by the client")
+			return
+		}
+	}
+}
+
+func clearConversationHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/conversations/"), "/clear")
+	if !checkConversationID(w, id) {
+		return
+	}
+	err := sessionManager.ClearHistory(id)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to clear conversation", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func updateConversationHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/conversations/")
+	if !checkConversationID(w, id) {
+		return
+	}
+	var reqBody struct {
+		Name             *string `json:"name"`
+		WorkingDirectory *string `json:"working_directory"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if reqBody.Name != nil && strings.TrimSpace(*reqBody.Name) == "" {
+		http.Error(w, "Name must not be empty", http.StatusBadRequest)
+		return
+	}
+	if _, err := sessionManager.AcquireSession(id); err != nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	if reqBody.WorkingDirectory != nil {
+		err := sessionManager.SetWorkingDirectory(id, *reqBody.WorkingDirectory)
+		if errors.Is(err, session.ErrInvalidWorkingDirectory) || errors.Is(err, session.ErrOutsideSandbox) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to update conversation", http.StatusInternalServerError)
+			return
+		}
+	}
+	if reqBody.Name != nil {
+		if err := sessionManager.Rename(id, strings.TrimSpace(*reqBody.Name)); err != nil {
+			http.Error(w, "Failed to update conversation", http.StatusInternalServerError)
+			return
+		}
+	}
+	getConversationHandler(w, r)
+}
+
+// pinConversationHandler sets a conversation's pinned flag to the body's
+// "pinned", or toggles it without one, and responds with the new value.
+func pinConversationHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/conversations/"), "/pin")
+	if !checkConversationID(w, id) {
+		return
+	}
+	s, err := sessionManager.AcquireSession(id)
+	if err != nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	var reqBody struct {
+		Pinned *bool `json:"pinned"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	pinned := !s.Pinned
+	if reqBody.Pinned != nil {
+		pinned = *reqBody.Pinned
+	}
+	if err := sessionManager.SetPinned(id, pinned); err != nil {
+		http.Error(w, "Failed to update conversation", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"pinned": pinned})
+}
+
+// conversationTagsHandler replaces (PUT) or adds to (POST) a conversation's
+// tags with those in the body, or removes the tag named in the path
+// (DELETE /tags/{tag}), and responds with the resulting tags.
+func conversationTagsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/conversations/"), "/")
+	id := parts[0]
+	if !checkConversationID(w, id) {
+		return
+	}
+	if _, err := sessionManager.AcquireSession(id); err != nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+	var tags []string
+	var err error
+	switch {
+	case r.Method == http.MethodDelete && len(parts) == 3:
+		tags, err = sessionManager.RemoveTags(id, parts[2])
+	case (r.Method == http.MethodPut || r.Method == http.MethodPost) && len(parts) == 2:
+		var reqBody struct {
+			Tags []string `json:"tags"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || reqBody.Tags == nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPut {
+			tags, err = sessionManager.SetTags(id, reqBody.Tags)
+		} else {
+			tags, err = sessionManager.AddTags(id, reqBody.Tags...)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if errors.Is(err, session.ErrInvalidTag) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update tags", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"tags": tags})
+}
+
+func deleteConversationHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/conversations/")
+	if !checkConversationID(w, id) {
+		return
+	}
+	if err := sessionManager.DeleteSession(id); err != nil {
+		http.Error(w, "Failed to delete session", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := templateStore.List()
+	if err != nil {
+		http.Error(w, "Failed to list templates", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// writeTemplateError reports a failed template store operation.
+func writeTemplateError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, templates.ErrInvalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, templates.ErrNotFound):
+		http.Error(w, "Template not found", http.StatusNotFound)
+	case errors.Is(err, templates.ErrExists):
+		http.Error(w, "Template already exists", http.StatusConflict)
+	default:
+		http.Error(w, "Failed to save template", http.StatusInternalServerError)
+	}
+}
+
+func createTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	var tmpl templates.Template
+	if err := json.NewDecoder(r.Body).Decode(&tmpl); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := templateStore.Create(&tmpl); err != nil {
+		writeTemplateError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tmpl)
+}
+
+func getTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/templates/")
+	tmpl, err := templateStore.Get(name)
+	if err != nil {
+		writeTemplateError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tmpl)
+}
+
+func updateTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	var tmpl templates.Template
+	if err := json.NewDecoder(r.Body).Decode(&tmpl); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	tmpl.Name = strings.TrimPrefix(r.URL.Path, "/api/v1/templates/")
+	if err := templateStore.Update(&tmpl); err != nil {
+		writeTemplateError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tmpl)
+}
+
+func deleteTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/templates/")
+	if err := templateStore.Delete(name); err != nil {
+		writeTemplateError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// taskSummary is a task as returned by the list endpoint.
+type taskSummary struct {
+	Name string `json:"name"`
+	scheduler.TaskStatus
+	Stats *scheduler.TaskStatsSummary `json:"stats,omitempty"`
+}
+
+// taskDetails is a task definition together with its scheduling status.
+type taskDetails struct {
+	scheduler.Task
+	scheduler.TaskStatus
+	// TemplateFunctions documents the functions the prompt can use.
+	TemplateFunctions []scheduler.PromptFunction `json:"template_functions"`
+}
+
+func listTasksHandler(w http.ResponseWriter, r *http.Request) {
+	tasksPath := filepath.Join(executableDir, "data/tasks")
+	files, err := os.ReadDir(tasksPath)
+	if err != nil {
+		http.Error(w, "Failed to read tasks directory", http.StatusInternalServerError)
+		return
+	}
+	tasks := make([]taskSummary, 0)
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".toml") {
+			name := strings.TrimSuffix(file.Name(), ".toml")
+			status, _ := schedulerManager.Status(name)
+			summary := taskSummary{Name: name, TaskStatus: status}
+			if stats, err := schedulerManager.TaskStats(name); err == nil {
+				s := stats.Summary()
+				summary.Stats = &s
+			}
+			tasks = append(tasks, summary)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tasks)
+}
+
+// checkConversationID rejects conversation IDs that aren't safe to use as file
+// names with 400.
+func checkConversationID(w http.ResponseWriter, id string) bool {
+	if !session.ValidID(id) {
+		http.Error(w, "Invalid conversation id", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// checkTaskName rejects task names from the URL that aren't plain slugs, so
+// they can't be used to reach files outside the data directory. It writes a
+// 400 response and returns false for invalid names.
+func checkTaskName(w http.ResponseWriter, name string) bool {
+	if !scheduler.ValidName(name) {
+		http.Error(w, "Invalid task name", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeValidationError reports an invalid task definition as 422 with the
+// list of offending fields.
+func writeValidationError(w http.ResponseWriter, err error) {
+	var verr *scheduler.ValidationError
+	if !errors.As(err, &verr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(verr)
+}
+
+func createTaskHandler(w http.ResponseWriter, r *http.Request) {
+	var task scheduler.Task
+	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := scheduler.ValidateTask(&task); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	if err := schedulerManager.ValidateDependencies(&task); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	if err := schedulerManager.CheckCommands(&task); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	if err := schedulerManager.CheckContextPath(&task); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	data, err := toml.Marshal(task)
+	if err != nil {
+		http.Error(w, "Failed to marshal task to TOML", http.StatusInternalServerError)
+		return
+	}
+
+	taskName := scheduler.Slug(task.Name)
+	taskPath := filepath.Join(executableDir, "data/tasks", taskName+".toml")
+	file, err := os.OpenFile(taskPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		http.Error(w, "Task already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to write task file", http.StatusInternalServerError)
+		return
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(taskPath)
+		http.Error(w, "Failed to write task file", http.StatusInternalServerError)
+		return
+	}
+
+	if err := schedulerManager.AddTask(&task); err != nil {
+		fmt.Printf("Error scheduling task %s: %v\n", taskName, err)
+		os.Remove(taskPath)
+		http.Error(w, "Failed to schedule task", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"name": taskName})
+}
+
+const (
+	defaultTaskLogsLimit = 50
+	maxTaskLogsLimit     = 500
+	defaultTaskRunsLimit = 20
+	maxTaskRunsLimit     = 500
+	defaultFailuresLimit = 50
+	maxFailuresLimit     = 1000
+	defaultHistoryLimit  = 50
+	maxHistoryLimit      = 500
+	defaultSearchLimit   = 50
+	maxSearchLimit       = 500
+	defaultSearchContext = 2
+)
+
+// taskLog is a single task output file as returned by the logs endpoint.
+type taskLog struct {
+	Filename  string    `json:"filename"`
+	Timestamp time.Time `json:"timestamp"`
+	Content   string    `json:"content"`
+	// Header and Body are set for the files ParseOutput recognizes: run
+	// records and legacy text outputs.
+	Header *scheduler.OutputHeader `json:"header,omitempty"`
+	Body   *string                 `json:"body,omitempty"`
+}
+
+func getTaskLogsHandler(w http.ResponseWriter, r *http.Request) {
+	taskName := strings.Split(r.URL.Path, "/")[4]
+	if !checkTaskName(w, taskName) {
+		return
+	}
+	logDir := filepath.Join(executableDir, "data/task_outputs", taskName)
+
+	query := r.URL.Query()
+	limit, offset := defaultTaskLogsLimit, 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxTaskLogsLimit)
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	if query.Get("latest") == "true" {
+		limit, offset = 1, 0
+	}
+
+	files, err := os.ReadDir(logDir)
+	if err != nil {
+		http.Error(w, "Logs not found for task", http.StatusNotFound)
+		return
+	}
+	var entries []os.FileInfo
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		info, err := file.Info()
+		if err == nil {
+			entries = append(entries, info)
+		}
+	}
+	// Newest first; output files are named after their timestamp.
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].ModTime().Equal(entries[j].ModTime()) {
+			return entries[i].ModTime().After(entries[j].ModTime())
+		}
+		return entries[i].Name() > entries[j].Name()
+	})
+
+	logs := make([]taskLog, 0)
+	for i := offset; i < len(entries) && len(logs) < limit; i++ {
+		content, err := os.ReadFile(filepath.Join(logDir, entries[i].Name()))
+		if err != nil {
+			continue
+		}
+		entry := taskLog{
+			Filename:  entries[i].Name(),
+			Timestamp: entries[i].ModTime(),
+			Content:   string(content),
+		}
+		if header, body, ok := scheduler.ParseOutput(content); ok {
+			entry.Header, entry.Body = header, &body
+		}
+		logs = append(logs, entry)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logs)
+}
+
+// searchTaskOutputsHandler finds a query in the stored outputs of the task
+// named in the path, or of all tasks for /api/v1/task-outputs/search.
+func searchTaskOutputsHandler(w http.ResponseWriter, r *http.Request) {
+	var taskName string
+	if strings.HasPrefix(r.URL.Path, "/api/v1/tasks/") {
+		taskName = strings.Split(r.URL.Path, "/")[4]
+		if !checkTaskName(w, taskName) {
+			return
+		}
+	}
+	query := r.URL.Query()
+	q := query.Get("q")
+	if strings.TrimSpace(q) == "" {
+		http.Error(w, "Missing query", http.StatusBadRequest)
+		return
+	}
+	limit, contextLines := defaultSearchLimit, defaultSearchContext
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSearchLimit)
+	}
+	if v := query.Get("context"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > scheduler.MaxSearchContext {
+			http.Error(w, fmt.Sprintf("Invalid context: must be 0 to %d lines", scheduler.MaxSearchContext), http.StatusBadRequest)
+			return
+		}
+		contextLines = n
+	}
+
+	matches, truncated, err := schedulerManager.SearchOutputs(taskName, q, contextLines, limit)
+	if errors.Is(err, scheduler.ErrTaskNotFound) {
+		http.Error(w, "Logs not found for task", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to search task outputs", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"matches":   matches,
+		"truncated": truncated,
+	})
+}
+
+func getTaskLogFileHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if !checkTaskName(w, parts[4]) {
+		return
+	}
+	if len(parts) != 7 {
+		http.Error(w, "Log file not found", http.StatusNotFound)
+		return
+	}
+	taskName, filename := parts[4], parts[6]
+	if filename == "" || filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+		http.Error(w, "Invalid log file name", http.StatusBadRequest)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(executableDir, "data/task_outputs", taskName, filename))
+	if err != nil {
+		http.Error(w, "Log file not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "Log file not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.URL.Query().Get("download") == "true" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	}
+	http.ServeContent(w, r, filename, info.ModTime(), file)
+}
+
+// deleteTaskLogsHandler removes all of a task's outputs. A task that never
+// stored an output is a 404.
+func deleteTaskLogsHandler(w http.ResponseWriter, r *http.Request) {
+	taskName := strings.Split(r.URL.Path, "/")[4]
+	if !checkTaskName(w, taskName) {
+		return
+	}
+	removed, err := schedulerManager.DeleteOutputs(taskName)
+	if errors.Is(err, scheduler.ErrTaskNotFound) {
+		http.Error(w, "Logs not found for task", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not delete logs of task %s: %v", taskName, err)
+		http.Error(w, "Failed to delete logs", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+}
+
+func deleteTaskLogFileHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if !checkTaskName(w, parts[4]) {
+		return
+	}
+	if len(parts) != 7 {
+		http.Error(w, "Log file not found", http.StatusNotFound)
+		return
+	}
+	taskName, filename := parts[4], parts[6]
+	if filename == "" || filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+		http.Error(w, "Invalid log file name", http.StatusBadRequest)
+		return
+	}
+	if err := schedulerManager.DeleteOutput(taskName, filename); err != nil {
+		if errors.Is(err, scheduler.ErrRunNotFound) || errors.Is(err, scheduler.ErrTaskNotFound) {
+			http.Error(w, "Log file not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Could not delete log %s of task %s: %v", filename, taskName, err)
+		http.Error(w, "Failed to delete log file", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"removed": 1})
+}
+
+func getTaskRunsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	taskName := strings.Split(r.URL.Path, "/")[4]
+	if !checkTaskName(w, taskName) {
+		return
+	}
+	limit := defaultTaskRunsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxTaskRunsLimit)
+	}
+
+	runs, err := schedulerManager.Runs(taskName)
+	if errors.Is(err, scheduler.ErrTaskNotFound) {
+		http.Error(w, "Runs not found for task", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read task runs", http.StatusInternalServerError)
+		return
+	}
+	history := make([]scheduler.RunSummary, 0, min(len(runs), limit))
+	for i := 0; i < len(runs) && i < limit; i++ {
+		history = append(history, runs[i].Summary())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+func getTaskStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	taskName := strings.Split(r.URL.Path, "/")[4]
+	if !checkTaskName(w, taskName) {
+		return
+	}
+	stats, err := schedulerManager.TaskStats(taskName)
+	if err != nil {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// enableTaskHandler re-enables a task disabled after repeated failures and
+// resets its count of consecutive failures.
+func enableTaskHandler(w http.ResponseWriter, r *http.Request) {
+	taskName := strings.Split(r.URL.Path, "/")[4]
+	if !checkTaskName(w, taskName) {
+		return
+	}
+	circuit, err := schedulerManager.EnableTask(taskName)
+	if errors.Is(err, scheduler.ErrTaskNotFound) {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load task", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(circuit)
+}
+
+func getTaskRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	if !checkTaskName(w, parts[4]) {
+		return
+	}
+	if len(parts) != 7 {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return
+	}
+	taskName, runID := parts[4], parts[6]
+
+	run, err := schedulerManager.Run(taskName, runID)
+	if errors.Is(err, scheduler.ErrTaskNotFound) || errors.Is(err, scheduler.ErrRunNotFound) {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read task run", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// getFailuresHandler lists the most recent failed a2a-server calls, newest
+// first.
+func getFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	limit := defaultFailuresLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxFailuresLimit)
+	}
+	failures, err := sessionManager.Failures(limit)
+	if err != nil {
+		fmt.Printf("Error reading failures: %v\n", err)
+		http.Error(w, "Failed to read failures", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(failures)
+}
+
+// pauseSchedulerHandler pauses or, with resume set, resumes the scheduler
+// and responds with its status.
+func pauseSchedulerHandler(w http.ResponseWriter, r *http.Request, resume bool) {
+	pause := schedulerManager.Pause
+	if resume {
+		pause = schedulerManager.Resume
+	}
+	if err := pause(); err != nil {
+		fmt.Printf("Error pausing or resuming scheduler: %v\n", err)
+		http.Error(w, "Failed to change scheduler state", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedulerManager.SchedulerStatus())
+}
+
+// upcomingRunsHandler lists the scheduled runs of all tasks over the next
+// ?hours= (24 by default, at most a week), ordered by time.
+func upcomingRunsHandler(w http.ResponseWriter, r *http.Request) {
+	hours := 24
+	if v := r.URL.Query().Get("hours"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid hours", http.StatusBadRequest)
+			return
+		}
+		hours = n
+	}
+	window := min(time.Duration(hours)*time.Hour, scheduler.MaxUpcomingWindow)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedulerManager.Upcoming(window))
+}
+
+// cancelRunHandler stops the task run in progress named in the path,
+// /api/v1/scheduler/running/{run_id}/cancel.
+func cancelRunHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 7 || parts[6] != "cancel" {
+		http.NotFound(w, r)
+		return
+	}
+	run, err := schedulerManager.CancelRun(parts[5])
+	if errors.Is(err, scheduler.ErrRunNotActive) {
+		http.Error(w, "Run not in progress", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(run)
+}
+
+// validateTemplateHandler lints the prompt template of the task in the body
+// and, given a "sample", renders it with the sample's input, data and
+// upstream response. The task needs no other fields, but its data_commands
+// and depends_on decide which variables the prompt may use.
+func validateTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	var reqBody struct {
+		scheduler.Task
+		Sample *scheduler.TemplateSample `json:"sample"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	resp := struct {
+		Valid    bool                      `json:"valid"`
+		Issues   []scheduler.TemplateIssue `json:"issues"`
+		Rendered *string                   `json:"rendered,omitempty"`
+	}{Issues: scheduler.LintPrompt(&reqBody.Task)}
+	if reqBody.Sample != nil && len(resp.Issues) == 0 {
+		rendered, issue := scheduler.RenderSample(&reqBody.Task, *reqBody.Sample)
+		if issue != nil {
+			resp.Issues = append(resp.Issues, *issue)
+		} else {
+			resp.Rendered = &rendered
+		}
+	}
+	resp.Valid = len(resp.Issues) == 0
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// exportTasksHandler returns every task definition file as a JSON bundle.
+func exportTasksHandler(w http.ResponseWriter, r *http.Request) {
+	bundle, err := schedulerManager.ExportTasks()
+	if err != nil {
+		fmt.Printf("Error exporting tasks: %v\n", err)
+		http.Error(w, "Failed to export tasks", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="tasks-%s.json"`, bundle.ExportedAt.Format("20060102-150405")))
+	json.NewEncoder(w).Encode(bundle)
+}
+
+// importTasksHandler writes the tasks of a bundle made by exportTasksHandler.
+// ?on_conflict= decides what happens to tasks that already exist.
+func importTasksHandler(w http.ResponseWriter, r *http.Request) {
+	var bundle scheduler.Bundle
+	if err := json.NewDecoder(r.Body).Decode(&bundle); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	result, err := schedulerManager.ImportTasks(&bundle, r.URL.Query().Get("on_conflict"))
+	var verr *scheduler.ValidationError
+	switch {
+	case errors.As(err, &verr):
+		writeValidationError(w, err)
+		return
+	case errors.Is(err, scheduler.ErrImportConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, scheduler.ErrInvalidConflictPolicy):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		fmt.Printf("Error importing tasks: %v\n", err)
+		http.Error(w, "Failed to import tasks", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func reloadSchedulerHandler(w http.ResponseWriter, r *http.Request) {
+	summary, err := schedulerManager.Reload()
+	if err != nil {
+		fmt.Printf("Error reloading scheduler: %v\n", err)
+		http.Error(w, "Failed to reload tasks", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+func dryRunTaskHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	taskName := strings.Split(r.URL.Path, "/")[4]
+	if !checkTaskName(w, taskName) {
+		return
+	}
+	result, err := schedulerManager.DryRun(taskName)
+	if errors.Is(err, scheduler.ErrTaskNotFound) {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load task", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func taskStreamHandler(w http.ResponseWriter, r *http.Request) {
+	taskName := strings.Split(r.URL.Path, "/")[4]
+	if !checkTaskName(w, taskName) {
+		return
+	}
+	events, unsubscribe, err := schedulerManager.Subscribe(taskName)
+	if errors.Is(err, scheduler.ErrTaskNotFound) {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load task", http.StatusInternalServerError)
+		return
+	}
+	defer unsubscribe()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go readStreamControl(conn, cancel)
+
+	for {
+		select {
+		case ev := <-events:
+			if streamBuffer.writeTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(streamBuffer.writeTimeout))
+			}
+			if err := conn.WriteJSON(ev); err != nil {
+				log.Println("write:", err)
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func runTaskHandler(w http.ResponseWriter, r *http.Request) {
+	taskName := strings.Split(r.URL.Path, "/")[4]
+	if !checkTaskName(w, taskName) {
+		return
+	}
+	running, err := schedulerManager.RunningRuns(taskName)
+	if errors.Is(err, scheduler.ErrTaskNotFound) {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load task", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"running": len(running) > 0,
+			"run_ids": running,
+		})
+	case http.MethodPost:
+		// An optional body changes the task for this run only.
+		var body struct {
+			scheduler.RunOverrides
+			DryRun bool `json:"dry_run"`
+		}
+		if r.Body != nil {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		var verr *scheduler.ValidationError
+		if body.DryRun {
+			result, err := schedulerManager.DryRunWithOverrides(taskName, &body.RunOverrides)
+			if errors.As(err, &verr) {
+				writeValidationError(w, err)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Failed to load task", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+		runID, err := schedulerManager.RunWithOverrides(taskName, &body.RunOverrides)
+		if errors.As(err, &verr) {
+			writeValidationError(w, err)
+			return
+		}
+		if errors.Is(err, scheduler.ErrRunInProgress) {
+			http.Error(w, "Task is already running", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, scheduler.ErrStopping) {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to start task", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"run_id":          runID,
+			"already_running": len(running) > 0,
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func getTaskDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	taskName := strings.TrimPrefix(r.URL.Path, "/api/v1/tasks/")
+	if !checkTaskName(w, taskName) {
+		return
+	}
+	taskPath := filepath.Join(executableDir, "data/tasks", taskName+".toml")
+
+	data, err := os.ReadFile(taskPath)
+	if err != nil {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	var task scheduler.Task
+	if err := toml.Unmarshal(data, &task); err != nil {
+		http.Error(w, "Failed to parse task file", http.StatusInternalServerError)
+		return
+	}
+	status, err := schedulerManager.Status(taskName)
+	if err != nil {
+		fmt.Printf("Error getting status of task %s: %v\n", taskName, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(taskDetails{Task: task, TaskStatus: status, TemplateFunctions: scheduler.PromptFunctions})
+}
+
+func deleteTaskHandler(w http.ResponseWriter, r *http.Request) {
 	taskName := strings.TrimPrefix(r.URL.Path, "/api/v1/tasks/")
+	if !checkTaskName(w, taskName) {
+		return
+	}
 	taskPath := filepath.Join(executableDir, "data/tasks", taskName+".toml")
 
+	if err := schedulerManager.RemoveTask(taskName); err != nil {
+		if errors.Is(err, scheduler.ErrTaskNotFound) {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		// An unreadable file was never scheduled; deleting it is still fine.
+		log.Printf("Could not unschedule task %s: %v", taskName, err)
+	}
+
 	if err := os.Remove(taskPath); err != nil {
 		http.Error(w, "Failed to delete task", http.StatusInternalServerError)
 		return
@@ -295,6 +1971,9 @@ func deleteTaskHandler(w http.ResponseWriter, r *http.Request) {
 
 func updateTaskHandler(w http.ResponseWriter, r *http.Request) {
 	taskName := strings.TrimPrefix(r.URL.Path, "/api/v1/tasks/")
+	if !checkTaskName(w, taskName) {
+		return
+	}
 	taskPath := filepath.Join(executableDir, "data/tasks", taskName+".toml")
 
 	var task scheduler.Task
@@ -302,21 +1981,102 @@ func updateTaskHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if err := scheduler.ValidateTask(&task); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	if err := schedulerManager.ValidateDependencies(&task); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	if err := schedulerManager.CheckCommands(&task); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	if err := schedulerManager.CheckContextPath(&task); err != nil {
+		writeValidationError(w, err)
+		return
+	}
 
 	data, err := toml.Marshal(task)
 	if err != nil {
 		http.Error(w, "Failed to marshal task to TOML", http.StatusInternalServerError)
 		return
 	}
+	// The file name and output directory both derive from the task name, so
+	// a new name moves them.
+	if newName := scheduler.Slug(task.Name); newName != taskName {
+		renameTask(w, taskName, newName, &task, data)
+		return
+	}
 
-	if err := os.WriteFile(taskPath, data, 0644); err != nil {
+	// The file is only put in place once the task could be scheduled, so a
+	// task that can't be isn't loaded again on restart.
+	tmp := taskPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
 		http.Error(w, "Failed to write task file", http.StatusInternalServerError)
 		return
 	}
+	err = schedulerManager.ReplaceTask(taskName, &task, func() error {
+		return os.Rename(tmp, taskPath)
+	})
+	if err != nil {
+		os.Remove(tmp)
+		fmt.Printf("Error rescheduling task %s: %v\n", taskName, err)
+		http.Error(w, "Failed to schedule task: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// renameTask saves an updated task under its new name's file, moves its
+// outputs and stats along and removes the old file, responding with the new
+// name. As with an update, the new file is only put in place once the task
+// could be scheduled under the new name.
+func renameTask(w http.ResponseWriter, oldName, newName string, task *scheduler.Task, data []byte) {
+	tasksDir := filepath.Join(executableDir, "data/tasks")
+	newPath := filepath.Join(tasksDir, newName+".toml")
+	if _, err := os.Stat(newPath); err == nil {
+		http.Error(w, "Task already exists", http.StatusConflict)
+		return
+	}
+	tmp := newPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		http.Error(w, "Failed to write task file", http.StatusInternalServerError)
+		return
+	}
+
+	var renameErr error
+	err := schedulerManager.ReplaceTask(newName, task, func() error {
+		if renameErr = schedulerManager.RenameTask(oldName, newName); renameErr != nil {
+			return renameErr
+		}
+		return os.Rename(tmp, newPath)
+	})
+	if err != nil {
+		os.Remove(tmp)
+		switch {
+		case errors.Is(renameErr, scheduler.ErrTaskNotFound):
+			http.Error(w, "Task not found", http.StatusNotFound)
+		case errors.Is(renameErr, scheduler.ErrRunInProgress):
+			http.Error(w, "Task can't be renamed while it runs", http.StatusConflict)
+		case renameErr != nil:
+			writeValidationError(w, renameErr)
+		default:
+			fmt.Printf("Error scheduling task %s: %v\n", newName, err)
+			http.Error(w, "Failed to schedule task: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := os.Remove(filepath.Join(tasksDir, oldName+".toml")); err != nil {
+		fmt.Printf("Error removing task file %s.toml: %v\n", oldName, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"name": newName})
+}
+
 func main() {
 	var err error
 	executable, err := os.Executable()
@@ -329,23 +2089,203 @@ func main() {
 		log.Println("Warning: .env file not found.")
 	}
 
-	a2aServerURL := os.Getenv("A2A_SERVER_URL")
-	if a2aServerURL == "" {
-		log.Fatal("A2A_SERVER_URL environment variable not set")
+	if err := setupLogFile(); err != nil {
+		log.Fatal("Error setting up log file:", err)
 	}
 
-	a2aClient, err := client.NewA2AClient(a2aServerURL, client.WithTimeout(5*time.Minute))
+	backendsFile := os.Getenv("BACKENDS_FILE")
+	if backendsFile != "" && !filepath.IsAbs(backendsFile) {
+		backendsFile = filepath.Join(executableDir, backendsFile)
+	}
+	if backends, err = loadBackends(backendsFile, os.Getenv("A2A_SERVER_URL")); err != nil {
+		log.Fatal("Error loading backends:", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background())
 	if err != nil {
-		log.Fatal("Error creating a2a client:", err)
+		log.Fatal("Error setting up tracing:", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	if v := os.Getenv("A2A_TIMEOUT"); v != "" {
+		if a2aTimeout, err = time.ParseDuration(v); err != nil || a2aTimeout <= 0 {
+			log.Fatal("Invalid A2A_TIMEOUT:", v)
+		}
+	}
+
+	var a2aClient *client.A2AClient
+	backendClients := make(map[string]session.A2AClient)
+	for i, b := range backends {
+		c, err := newA2AClient(b.URL)
+		if err != nil {
+			log.Fatalf("Error creating a2a client for backend %s: %v", b.Name, err)
+		}
+		if i == 0 {
+			a2aClient = c
+		}
+		backendClients[b.Name] = c
+	}
+
+	var statsOpts []stats.Option
+	if v := os.Getenv("STATS_SHARDS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatal("Invalid STATS_SHARDS:", v)
+		}
+		statsOpts = append(statsOpts, stats.WithShards(n))
+	}
+	statsManager = stats.New(statsOpts...)
+
+	maxConcurrent, err := strconv.Atoi(os.Getenv("A2A_MAX_CONCURRENT"))
+	if err != nil && os.Getenv("A2A_MAX_CONCURRENT") != "" {
+		log.Fatal("Invalid A2A_MAX_CONCURRENT:", err)
+	}
+	rejectWhenBusy := os.Getenv("A2A_REJECT_WHEN_BUSY") == "true"
+	retryOnEmpty := os.Getenv("A2A_RETRY_ON_EMPTY") != "false"
+	maxHistory, err := strconv.Atoi(os.Getenv("MAX_HISTORY"))
+	if err != nil && os.Getenv("MAX_HISTORY") != "" {
+		log.Fatal("Invalid MAX_HISTORY:", err)
+	}
+	autoCompact := os.Getenv("HISTORY_AUTO_COMPACT") == "true"
+	namingTurns, err := strconv.Atoi(os.Getenv("CONVERSATION_NAMING_TURNS"))
+	if err != nil && os.Getenv("CONVERSATION_NAMING_TURNS") != "" {
+		log.Fatal("Invalid CONVERSATION_NAMING_TURNS:", err)
+	}
+	maxResponseBytes, err := strconv.Atoi(os.Getenv("MAX_RESPONSE_BYTES"))
+	if err != nil && os.Getenv("MAX_RESPONSE_BYTES") != "" {
+		log.Fatal("Invalid MAX_RESPONSE_BYTES:", err)
+	}
+	cacheSize, err := strconv.Atoi(os.Getenv("RESPONSE_CACHE_SIZE"))
+	if err != nil && os.Getenv("RESPONSE_CACHE_SIZE") != "" {
+		log.Fatal("Invalid RESPONSE_CACHE_SIZE:", err)
+	}
+	cacheTTL := time.Hour
+	if v := os.Getenv("RESPONSE_CACHE_TTL"); v != "" {
+		if cacheTTL, err = time.ParseDuration(v); err != nil {
+			log.Fatal("Invalid RESPONSE_CACHE_TTL:", err)
+		}
+	}
+	cacheAll := os.Getenv("RESPONSE_CACHE_ALL") == "true"
+	streamReconnects := -1
+	if v := os.Getenv("A2A_STREAM_RECONNECTS"); v != "" {
+		if streamReconnects, err = strconv.Atoi(v); err != nil {
+			log.Fatal("Invalid A2A_STREAM_RECONNECTS:", err)
+		}
+	}
+	maxFailures := -1
+	if v := os.Getenv("FAILURES_MAX_RECORDS"); v != "" {
+		if maxFailures, err = strconv.Atoi(v); err != nil || maxFailures < 0 {
+			log.Fatal("Invalid FAILURES_MAX_RECORDS:", v)
+		}
+	}
+	failuresTTL := time.Duration(-1)
+	if v := os.Getenv("FAILURES_TTL"); v != "" {
+		if failuresTTL, err = time.ParseDuration(v); err != nil || failuresTTL < 0 {
+			log.Fatal("Invalid FAILURES_TTL:", v)
+		}
+	}
+	saveRetries := -1
+	if v := os.Getenv("SESSION_SAVE_RETRIES"); v != "" {
+		if saveRetries, err = strconv.Atoi(v); err != nil {
+			log.Fatal("Invalid SESSION_SAVE_RETRIES:", err)
+		}
+	}
+
+	var sessionFileMode os.FileMode
+	if v := os.Getenv("SESSION_FILE_MODE"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || mode == 0 || mode > 0777 {
+			log.Fatal("Invalid SESSION_FILE_MODE:", v)
+		}
+		sessionFileMode = os.FileMode(mode)
+	}
+
+	if v := os.Getenv("STREAM_BUFFER_SIZE"); v != "" {
+		if streamBuffer.size, err = strconv.Atoi(v); err != nil || streamBuffer.size < 0 {
+			log.Fatal("Invalid STREAM_BUFFER_SIZE:", v)
+		}
+	}
+	streamBuffer.drop = os.Getenv("STREAM_DROP_WHEN_FULL") == "true"
+	if v := os.Getenv("STREAM_WRITE_TIMEOUT"); v != "" {
+		if streamBuffer.writeTimeout, err = time.ParseDuration(v); err != nil {
+			log.Fatal("Invalid STREAM_WRITE_TIMEOUT:", err)
+		}
 	}
 
-	statsManager = stats.New()
+	trustedProxies, err = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
+	allowedOrigins = parseAllowedOrigins(os.Getenv("ALLOWED_ORIGINS"))
 
-	sessionManager, err = session.NewManager(executableDir, a2aClient, statsManager)
+	sessionManager, err = session.NewManager(executableDir, a2aClient, statsManager,
+		session.WithMaxConcurrent(maxConcurrent, rejectWhenBusy),
+		session.WithRetryOnEmpty(retryOnEmpty),
+		session.WithMaxHistory(maxHistory, autoCompact),
+		session.WithMaxResponseSize(maxResponseBytes),
+		session.WithPromptTimeout(a2aTimeout),
+		session.WithSaveRetry(saveRetries, 0),
+		session.WithSessionFiles(os.Getenv("SESSION_SHARDING") == "true", sessionFileMode),
+		session.WithFailureRetention(maxFailures, failuresTTL),
+		session.WithResponseCache(cacheSize, cacheTTL, cacheAll),
+		session.WithDefaultWorkingDir(os.Getenv("DEFAULT_CONTEXT_PATH")),
+		session.WithSandboxRoot(os.Getenv("SANDBOX_ROOT")),
+		session.WithLLMNaming(os.Getenv("GENERATE_CONVERSATION_NAMES") == "true"),
+		session.WithNamingAfter(namingTurns),
+		session.WithStreamReconnects(streamReconnects),
+		session.WithHistoryLabels(os.Getenv("HISTORY_USER_LABEL"), os.Getenv("HISTORY_ASSISTANT_LABEL")),
+		session.WithBackends(backendClients))
 	if err != nil {
 		log.Fatal("Error creating session manager:", err)
 	}
-	schedulerManager, err = scheduler.NewManager(executableDir)
+	templateStore, err = templates.NewStore(executableDir)
+	if err != nil {
+		log.Fatal("Error creating template store:", err)
+	}
+	if err := sessionManager.WatchTasks(15 * time.Second); err != nil {
+		log.Fatal("Error watching pending tasks:", err)
+	}
+	var schedulerOpts []scheduler.Option
+	if tz := os.Getenv("TZ"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Fatal("Invalid TZ:", err)
+		}
+		schedulerOpts = append(schedulerOpts, scheduler.WithLocation(loc))
+	}
+	if v := os.Getenv("TASKS_WATCH_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatal("Invalid TASKS_WATCH_INTERVAL:", err)
+		}
+		schedulerOpts = append(schedulerOpts, scheduler.WithWatchInterval(interval))
+	}
+	schedulerOpts = append(schedulerOpts, scheduler.WithSandboxRoot(os.Getenv("SANDBOX_ROOT")))
+	schedulerOpts = append(schedulerOpts, scheduler.WithPersistentPause(os.Getenv("SCHEDULER_PERSIST_PAUSE") == "true"))
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		cfg := scheduler.SMTPConfig{
+			Host:     host,
+			Port:     587,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+		}
+		if v := os.Getenv("SMTP_PORT"); v != "" {
+			port, err := strconv.Atoi(v)
+			if err != nil || port <= 0 {
+				log.Fatal("Invalid SMTP_PORT:", v)
+			}
+			cfg.Port = port
+		}
+		if cfg.From == "" {
+			cfg.From = cfg.Username
+		}
+		if _, err := mail.ParseAddress(cfg.From); err != nil {
+			log.Fatal("Invalid SMTP_FROM:", err)
+		}
+		schedulerOpts = append(schedulerOpts, scheduler.WithSMTP(cfg))
+	}
+	schedulerManager, err = scheduler.NewManager(executableDir, a2aClient, statsManager, schedulerOpts...)
 	if err != nil {
 		log.Fatal("Error creating scheduler manager:", err)
 	}
@@ -356,11 +2296,87 @@ func main() {
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
 	http.Handle("/api/", setupRouter())
 
+	shutdownTimeout := 30 * time.Second
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		if shutdownTimeout, err = time.ParseDuration(v); err != nil || shutdownTimeout <= 0 {
+			log.Fatal("Invalid SHUTDOWN_TIMEOUT:", v)
+		}
+	}
+
 	port := ":7123"
-	fmt.Println("Starting server on ", port)
-	if err := http.ListenAndServe(port, nil); err != nil {
-		log.Fatal("Error starting server:", err)
+	server := &http.Server{Addr: port}
+	go func() {
+		fmt.Println("Starting server on ", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Error starting server:", err)
+		}
+	}()
+
+	// On SIGINT or SIGTERM, stop taking requests and let task runs in
+	// progress finish and save their outcome.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	fmt.Println("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Printf("Error shutting down server: %v\n", err)
+	}
+	if err := schedulerManager.Stop(ctx); err != nil {
+		fmt.Printf("Task runs didn't finish within %v: %v\n", shutdownTimeout, err)
+	}
+}
+
+// a2aTimeout bounds each request to the a2a-server. Set with A2A_TIMEOUT.
+var a2aTimeout = 5 * time.Minute
+
+// newA2AClient creates the client used to talk to the a2a-server, with
+// tracing and the auth header configured in the environment.
+func newA2AClient(serverURL string) (*client.A2AClient, error) {
+	opts := []client.Option{
+		client.WithHTTPClient(&http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}),
+	}
+	if name, value := a2aclient.AuthHeader(); name != "" {
+		opts = append(opts, client.WithAPIKeyAuth(value, name))
 	}
+	opts = append(opts, client.WithTimeout(a2aTimeout))
+	return client.NewA2AClient(serverURL, opts...)
+}
+
+// setupLogFile redirects the server logs to a size-rotated file when LOG_FILE
+// is set. Otherwise logs keep going to stdout.
+func setupLogFile() error {
+	path := os.Getenv("LOG_FILE")
+	if path == "" {
+		return nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(executableDir, path)
+	}
+	maxSizeMB, maxFiles := 10, 5
+	if v := os.Getenv("LOG_MAX_SIZE_MB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid LOG_MAX_SIZE_MB: %w", err)
+		}
+		maxSizeMB = n
+	}
+	if v := os.Getenv("LOG_MAX_FILES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid LOG_MAX_FILES: %w", err)
+		}
+		maxFiles = n
+	}
+	w, err := logrotate.New(path, int64(maxSizeMB)*1024*1024, maxFiles)
+	if err != nil {
+		return err
+	}
+	logOutput = w
+	log.SetOutput(w)
+	log.Printf("Logging to %s (max %d MB, %d rotated files)\n", path, maxSizeMB, maxFiles)
+	return nil
 }
 
 func setupRouter() http.Handler {
@@ -376,6 +2392,13 @@ func setupRouter() http.Handler {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
+	apiV1.HandleFunc("/api/v1/conversations/import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		importConversationHandler(w, r)
+	})
 	apiV1.HandleFunc("/api/v1/conversations/", func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(r.URL.Path, "/prompt") {
 			if r.Method == http.MethodPost {
@@ -385,44 +2408,257 @@ func setupRouter() http.Handler {
 			}
 			return
 		}
+		if strings.HasSuffix(r.URL.Path, "/clear") {
+			if r.Method == http.MethodPost {
+				clearConversationHandler(w, r)
+			} else {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+			return
+		}
 		if strings.HasSuffix(r.URL.Path, "/prompt/stream") {
 			httpBasicsLogger(basicAuth(http.HandlerFunc(postPromptStreamHandler))).ServeHTTP(w, r)
 			return
 		}
+		if strings.HasSuffix(r.URL.Path, "/prompt/events") {
+			if r.Method == http.MethodGet {
+				promptEventsHandler(w, r)
+			} else {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/history") {
+			if r.Method == http.MethodGet {
+				getHistoryHandler(w, r)
+			} else {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/pin") {
+			if r.Method == http.MethodPost {
+				pinConversationHandler(w, r)
+			} else {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/tags") || strings.Contains(r.URL.Path, "/tags/") {
+			conversationTagsHandler(w, r)
+			return
+		}
 		switch r.Method {
 		case http.MethodGet:
 			getConversationHandler(w, r)
+		case http.MethodPatch:
+			updateConversationHandler(w, r)
 		case http.MethodDelete:
 			deleteConversationHandler(w, r)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
-	apiV1.HandleFunc("/api/v1/tasks", listTasksHandler)
-	apiV1.HandleFunc("/api/v1/tasks/", func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasSuffix(r.URL.Path, "/logs") {
-			getTaskLogsHandler(w, r)
-			return
+	apiV1.HandleFunc("/api/v1/templates", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listTemplatesHandler(w, r)
+		case http.MethodPost:
+			createTemplateHandler(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
+	})
+	apiV1.HandleFunc("/api/v1/templates/", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			getTaskDetailsHandler(w, r)
-		case http.MethodDelete:
-			deleteTaskHandler(w, r)
+			getTemplateHandler(w, r)
 		case http.MethodPut:
-			updateTaskHandler(w, r)
+			updateTemplateHandler(w, r)
+		case http.MethodDelete:
+			deleteTemplateHandler(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	apiV1.HandleFunc("/api/v1/tasks", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listTasksHandler(w, r)
+		case http.MethodPost:
+			createTaskHandler(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	apiV1.HandleFunc("/api/v1/tasks/validate-template", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		validateTemplateHandler(w, r)
+	})
+	apiV1.HandleFunc("/api/v1/tasks/export", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		exportTasksHandler(w, r)
+	})
+	apiV1.HandleFunc("/api/v1/tasks/import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		importTasksHandler(w, r)
+	})
+	apiV1.HandleFunc("/api/v1/tasks/", func(w http.ResponseWriter, r *http.Request) {
+		// Paths are /api/v1/tasks/{name} or /api/v1/tasks/{name}/{sub}/...,
+		// split on the escaped path so an encoded slash stays in the name.
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), "/api/v1/tasks/"), "/", 3)
+		if len(parts) == 1 {
+			switch r.Method {
+			case http.MethodGet:
+				getTaskDetailsHandler(w, r)
+			case http.MethodDelete:
+				deleteTaskHandler(w, r)
+			case http.MethodPut:
+				updateTaskHandler(w, r)
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+			return
+		}
+		sub, nested := parts[1], len(parts) == 3
+		switch {
+		case sub == "logs" && !nested:
+			if r.Method == http.MethodDelete {
+				deleteTaskLogsHandler(w, r)
+				return
+			}
+			getTaskLogsHandler(w, r)
+		case sub == "logs" && parts[2] == "search":
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			searchTaskOutputsHandler(w, r)
+		case sub == "logs":
+			if r.Method == http.MethodDelete {
+				deleteTaskLogFileHandler(w, r)
+				return
+			}
+			getTaskLogFileHandler(w, r)
+		case sub == "stats" && !nested:
+			getTaskStatsHandler(w, r)
+		case sub == "runs" && !nested:
+			getTaskRunsHandler(w, r)
+		case sub == "runs":
+			getTaskRunHandler(w, r)
+		case sub == "run" && !nested:
+			runTaskHandler(w, r)
+		case sub == "stream" && !nested:
+			taskStreamHandler(w, r)
+		case sub == "dry-run" && !nested:
+			dryRunTaskHandler(w, r)
+		case sub == "enable" && !nested:
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			enableTaskHandler(w, r)
 		default:
+			http.NotFound(w, r)
+		}
+	})
+	apiV1.HandleFunc("/api/v1/task-outputs/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		searchTaskOutputsHandler(w, r)
+	})
+	apiV1.HandleFunc("/api/v1/scheduler/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		reloadSchedulerHandler(w, r)
+	})
+	for _, action := range []string{"pause", "resume"} {
+		resume := action == "resume"
+		apiV1.HandleFunc("/api/v1/scheduler/"+action, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			pauseSchedulerHandler(w, r, resume)
+		})
+	}
+	apiV1.HandleFunc("/api/v1/scheduler/upcoming", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		upcomingRunsHandler(w, r)
+	})
+	apiV1.HandleFunc("/api/v1/scheduler/running", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(schedulerManager.ActiveRuns())
+	})
+	apiV1.HandleFunc("/api/v1/scheduler/running/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cancelRunHandler(w, r)
+	})
+	apiV1.HandleFunc("/api/v1/scheduler/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(schedulerManager.SchedulerStatus())
+	})
+
+	apiV1.HandleFunc("/api/v1/failures", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
+		getFailuresHandler(w, r)
 	})
+
 	apiV1.HandleFunc("/api/v1/model", func(w http.ResponseWriter, r *http.Request) {
+		b, ok := selectedBackend(w, r)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"model": b.Model, "backend": b.Name})
+	})
+
+	apiV1.HandleFunc("/api/v1/agent", func(w http.ResponseWriter, r *http.Request) {
+		b, ok := selectedBackend(w, r)
+		if !ok {
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"model": "gemini-2.5-pro"})
+		json.NewEncoder(w).Encode(b)
 	})
 
 	apiV1.HandleFunc("/api/v1/stats", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(statsManager.Get())
+		stats := statsManager.Get()
+		if schedulerManager != nil {
+			stats["task_reloads"] = schedulerManager.Reloads()
+		}
+		json.NewEncoder(w).Encode(stats)
 	})
 
 	return httpBasicsLogger(basicAuth(apiV1))
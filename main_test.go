@@ -1,37 +1,92 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"gemini-srv/internal/a2aclient"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gemini-srv/internal/scheduler"
 	"gemini-srv/internal/stats"
+	"gemini-srv/internal/templates"
 	"gemini-srv/session"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"trpc.group/trpc-go/trpc-a2a-go/protocol"
 )
 
-type mockA2AClient struct{}
+type mockA2AClient struct {
+	streamErr error
+	chunks    []string
+	delay     time.Duration
+}
+
+func (c *mockA2AClient) SendMessage(ctx context.Context, params protocol.SendMessageParams) (*protocol.MessageResult, error) {
+	if params.Configuration != nil {
+		return &protocol.MessageResult{Result: protocol.NewTask("mock-task-id", *params.Message.ContextID)}, nil
+	}
+	select {
+	case <-time.After(c.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	text := protocol.NewTextPart("mock response")
+	msg := protocol.NewMessage(protocol.MessageRoleAgent, []protocol.Part{&text})
+	return &protocol.MessageResult{Result: &msg}, nil
+}
 
-func (c *mockA2AClient) SendPrompt(prompt string) (string, error) {
-	return "mock response", nil
+func (c *mockA2AClient) StreamMessage(ctx context.Context, params protocol.SendMessageParams) (<-chan protocol.StreamingMessageEvent, error) {
+	if c.streamErr != nil {
+		return nil, c.streamErr
+	}
+	chunks := c.chunks
+	if chunks == nil {
+		chunks = []string{"mock response"}
+	}
+	events := make(chan protocol.StreamingMessageEvent)
+	go func() {
+		defer close(events)
+		for i, chunk := range chunks {
+			text := protocol.NewTextPart(chunk)
+			msg := protocol.NewMessage(protocol.MessageRoleAgent, []protocol.Part{&text})
+			status := protocol.TaskStatus{State: protocol.TaskStateWorking, Message: &msg}
+			update := protocol.NewTaskStatusUpdateEvent("mock-task-id", "mock-context-id", status, i == len(chunks)-1)
+			select {
+			case events <- protocol.StreamingMessageEvent{Result: &update}:
+			case <-ctx.Done():
+				return
+			}
+			time.Sleep(c.delay)
+		}
+	}()
+	return events, nil
 }
 
-func (c *mockA2AClient) SendPromptAsTask(prompt string) (string, error) {
-	return "mock-task-id", nil
+func (c *mockA2AClient) GetTasks(ctx context.Context, params protocol.TaskQueryParams) (*protocol.Task, error) {
+	task := protocol.NewTask(params.ID, "mock-context-id")
+	task.Status.State = protocol.TaskStateCompleted
+	return task, nil
 }
 
-func (c *mockA2AClient) SendPromptStream(prompt string, eventChan chan<- a2aclient.StreamEvent) error {
-	defer close(eventChan)
-	eventChan <- a2aclient.StreamEvent{Kind: "text", Text: "mock response"}
-	return nil
+func (c *mockA2AClient) ResubscribeTask(ctx context.Context, params protocol.TaskIDParams) (<-chan protocol.StreamingMessageEvent, error) {
+	events := make(chan protocol.StreamingMessageEvent)
+	close(events)
+	return events, nil
 }
 
-var _ a2aclient.A2AClient = &mockA2AClient{}
+var _ session.A2AClient = &mockA2AClient{}
 
 func TestModelHandler(t *testing.T) {
 	os.Setenv("GEMINI_SRV_USER", "test")
@@ -52,13 +107,162 @@ func TestModelHandler(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	expected := `{"model":"gemini-2.5-pro"}`
+	expected := `{"backend":"default","model":"gemini-2.5-pro"}`
 	if strings.TrimSpace(rr.Body.String()) != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			rr.Body.String(), expected)
 	}
 }
 
+func TestBackendSelection(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	os.MkdirAll(filepath.Join(executableDir, "data/conversations"), 0755)
+	defer os.RemoveAll(filepath.Join(executableDir, "data/conversations"))
+
+	path := filepath.Join(t.TempDir(), "backends.toml")
+	os.WriteFile(path, []byte(`
+[[backend]]
+name = "pro"
+url = "http://localhost:41242"
+
+[[backend]]
+name = "flash"
+url = "http://localhost:41243"
+model = "gemini-2.5-flash"
+`), 0644)
+	loaded, err := loadBackends(path, "")
+	if err != nil {
+		t.Fatalf("loadBackends failed: %v", err)
+	}
+	if len(loaded) != 2 || loaded[0].Model != defaultModel || loaded[1].Model != "gemini-2.5-flash" {
+		t.Fatalf("unexpected backends: %+v", loaded)
+	}
+	saved := backends
+	backends = loaded
+	defer func() { backends = saved }()
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New(),
+		session.WithBackends(map[string]session.A2AClient{"pro": &mockA2AClient{}, "flash": &mockA2AClient{}}))
+	router := setupRouter()
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.SetBasicAuth("test", "test")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do("POST", "/api/v1/conversations", `{"backend":"missing"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("creating a conversation on an unknown backend: got status %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	rr := do("POST", "/api/v1/conversations", `{"backend":"flash"}`)
+	var created session.Session
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil || created.Backend != "flash" {
+		t.Fatalf("expected a conversation on the flash backend, got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	cases := []struct {
+		url  string
+		want string
+	}{
+		{"/api/v1/model", `{"backend":"pro","model":"gemini-2.5-pro"}`},
+		{"/api/v1/model?backend=flash", `{"backend":"flash","model":"gemini-2.5-flash"}`},
+		{"/api/v1/model?conversation=" + created.ID, `{"backend":"flash","model":"gemini-2.5-flash"}`},
+		{"/api/v1/agent?conversation=" + created.ID, `{"name":"flash","url":"http://localhost:41243","model":"gemini-2.5-flash"}`},
+	}
+	for _, c := range cases {
+		rr := do("GET", c.url, "")
+		if got := strings.TrimSpace(rr.Body.String()); rr.Code != http.StatusOK || got != c.want {
+			t.Errorf("GET %s: got %v %s want %s", c.url, rr.Code, got, c.want)
+		}
+	}
+	if rr := do("GET", "/api/v1/agent?backend=missing", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown backend: got status %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestAuthDisableLocalhost(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	os.Setenv("AUTH_DISABLE_LOCALHOST", "true")
+	defer os.Unsetenv("AUTH_DISABLE_LOCALHOST")
+	executableDir, _ = os.Getwd()
+	router := setupRouter()
+
+	cases := []struct {
+		remoteAddr string
+		forwarded  string
+		want       int
+	}{
+		{"127.0.0.1:5000", "", http.StatusOK},
+		{"[::1]:5000", "", http.StatusOK},
+		{"203.0.113.7:5000", "", http.StatusUnauthorized},
+		{"203.0.113.7:5000", "127.0.0.1", http.StatusUnauthorized},
+		{"10.0.0.1:5000", "127.0.0.1", http.StatusOK},
+	}
+	trustedProxies, _ = parseTrustedProxies("10.0.0.1")
+	defer func() { trustedProxies = nil }()
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "/api/v1/model", nil)
+		req.RemoteAddr = c.remoteAddr
+		if c.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != c.want {
+			t.Errorf("%s (X-Forwarded-For %q): got status %v want %v",
+				c.remoteAddr, c.forwarded, rr.Code, c.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	var err error
+	trustedProxies, err = parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { trustedProxies = nil }()
+
+	cases := []struct {
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		want       string
+	}{
+		// Untrusted peers can't override their address.
+		{"203.0.113.7:5000", "198.51.100.1", "", "203.0.113.7"},
+		{"203.0.113.7:5000", "", "198.51.100.1", "203.0.113.7"},
+		// Trusted proxies are believed, skipping our own hops.
+		{"10.1.2.3:5000", "198.51.100.1", "", "198.51.100.1"},
+		{"192.168.1.1:5000", "198.51.100.1, 10.0.0.5", "", "198.51.100.1"},
+		{"10.1.2.3:5000", "127.0.0.1, 198.51.100.1", "", "198.51.100.1"},
+		{"10.1.2.3:5000", "", "198.51.100.1", "198.51.100.1"},
+		{"10.1.2.3:5000", "", "", "10.1.2.3"},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remoteAddr
+		if c.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if c.realIP != "" {
+			req.Header.Set("X-Real-IP", c.realIP)
+		}
+		if got := clientIP(req).String(); got != c.want {
+			t.Errorf("clientIP(%s, XFF %q, X-Real-IP %q) = %s, want %s",
+				c.remoteAddr, c.forwarded, c.realIP, got, c.want)
+		}
+	}
+
+	if _, err := parseTrustedProxies("not-an-ip"); err == nil {
+		t.Errorf("expected an invalid proxy to be rejected")
+	}
+}
+
 func TestStatsHandler(t *testing.T) {
 	os.Setenv("GEMINI_SRV_USER", "test")
 	os.Setenv("GEMINI_SRV_PASS", "test")
@@ -79,7 +283,7 @@ func TestStatsHandler(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	expected := `{"avg_latency_ms":0,"total_calls":0,"total_chars_in":0,"total_chars_out":0}`
+	expected := `{"avg_latency_ms":0,"cache_hits":0,"in_flight":0,"stream_chars_per_sec":0,"total_calls":0,"total_chars_in":0,"total_chars_out":0}`
 	if strings.TrimSpace(rr.Body.String()) != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			rr.Body.String(), expected)
@@ -140,7 +344,7 @@ func TestCreateConversationHandler(t *testing.T) {
 	}
 }
 
-func TestGetConversationHandler(t *testing.T) {
+func TestImportConversationHandler(t *testing.T) {
 	os.Setenv("GEMINI_SRV_USER", "test")
 	os.Setenv("GEMINI_SRV_PASS", "test")
 	executableDir, _ = os.Getwd()
@@ -149,8 +353,9 @@ func TestGetConversationHandler(t *testing.T) {
 	os.MkdirAll(testDir, 0755)
 	router := setupRouter()
 	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
-	sessionManager.CreateSession("test-session", "")
-	req, err := http.NewRequest("GET", "/api/v1/conversations/test-session", nil)
+
+	body := `{"id":"imported","name":"Old chat","history":["User: hi","Gemini: hello"]}`
+	req, err := http.NewRequest("POST", "/api/v1/conversations/import", bytes.NewBuffer([]byte(body)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -159,19 +364,26 @@ func TestGetConversationHandler(t *testing.T) {
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 
-	if status := rr.Code; status != http.StatusOK {
+	if status := rr.Code; status != http.StatusCreated {
 		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusOK)
+			status, http.StatusCreated)
+	}
+	if _, err := os.Stat(filepath.Join(testDir, "imported.json")); err != nil {
+		t.Errorf("imported conversation was not saved: %v", err)
 	}
 
-	expected := `{"id":"test-session","name":"New Conversation","history":[],"last_access":"`
-	if !strings.HasPrefix(rr.Body.String(), expected) {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			rr.Body.String(), expected)
+	req, _ = http.NewRequest("POST", "/api/v1/conversations/import", bytes.NewBuffer([]byte(`{"history":`)))
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
 	}
 }
 
-func TestPostPromptHandler(t *testing.T) {
+func TestGetConversationHandler(t *testing.T) {
 	os.Setenv("GEMINI_SRV_USER", "test")
 	os.Setenv("GEMINI_SRV_PASS", "test")
 	executableDir, _ = os.Getwd()
@@ -181,7 +393,7 @@ func TestPostPromptHandler(t *testing.T) {
 	router := setupRouter()
 	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
 	sessionManager.CreateSession("test-session", "")
-	req, err := http.NewRequest("POST", "/api/v1/conversations/test-session/prompt", bytes.NewBuffer([]byte(`{"prompt": "test prompt"}`)))
+	req, err := http.NewRequest("GET", "/api/v1/conversations/test-session", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -195,14 +407,17 @@ func TestPostPromptHandler(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	expected := `{"response":"mock response"}`
-	if strings.TrimSpace(rr.Body.String()) != expected {
+	expected := `{"id":"test-session","name":"New Conversation","history":[],"last_access":"`
+	if !strings.HasPrefix(rr.Body.String(), expected) {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			rr.Body.String(), expected)
 	}
+	if !strings.Contains(rr.Body.String(), `"queue_depth":0`) {
+		t.Errorf("handler returned no queue depth: got %v", rr.Body.String())
+	}
 }
 
-func TestPostPromptHandlerAsTask(t *testing.T) {
+func TestPostPromptHandler(t *testing.T) {
 	os.Setenv("GEMINI_SRV_USER", "test")
 	os.Setenv("GEMINI_SRV_PASS", "test")
 	executableDir, _ = os.Getwd()
@@ -212,7 +427,7 @@ func TestPostPromptHandlerAsTask(t *testing.T) {
 	router := setupRouter()
 	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
 	sessionManager.CreateSession("test-session", "")
-	req, err := http.NewRequest("POST", "/api/v1/conversations/test-session/prompt", bytes.NewBuffer([]byte(`{"prompt": "test prompt", "as_task": true}`)))
+	req, err := http.NewRequest("POST", "/api/v1/conversations/test-session/prompt", bytes.NewBuffer([]byte(`{"prompt": "test prompt"}`)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -226,14 +441,14 @@ func TestPostPromptHandlerAsTask(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	expected := `{"task_id":"mock-task-id"}`
+	expected := `{"response":"mock response"}`
 	if strings.TrimSpace(rr.Body.String()) != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			rr.Body.String(), expected)
 	}
 }
 
-func TestDeleteConversationHandler(t *testing.T) {
+func TestPostPromptHandlerExtract(t *testing.T) {
 	os.Setenv("GEMINI_SRV_USER", "test")
 	os.Setenv("GEMINI_SRV_PASS", "test")
 	executableDir, _ = os.Getwd()
@@ -243,61 +458,206 @@ func TestDeleteConversationHandler(t *testing.T) {
 	router := setupRouter()
 	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
 	sessionManager.CreateSession("test-session", "")
-	req, err := http.NewRequest("DELETE", "/api/v1/conversations/test-session", nil)
-	if err != nil {
-		t.Fatal(err)
+
+	for _, body := range []string{
+		`{"prompt": "test prompt", "extract": "yaml"}`,
+		`{"prompt": "test prompt", "extract": "json", "as_task": true}`,
+	} {
+		req, _ := http.NewRequest("POST", "/api/v1/conversations/test-session/prompt", strings.NewReader(body))
+		req.SetBasicAuth("test", "test")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", body, rr.Code, http.StatusBadRequest)
+		}
 	}
-	req.SetBasicAuth("test", "test")
 
+	// An unfenced response comes back unchanged.
+	req, _ := http.NewRequest("POST", "/api/v1/conversations/test-session/prompt", strings.NewReader(`{"prompt": "test prompt", "extract": "json"}`))
+	req.SetBasicAuth("test", "test")
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"response":"mock response"}` {
+		t.Errorf("handler returned %v %v", rr.Code, rr.Body.String())
+	}
+}
 
-	if status := rr.Code; status != http.StatusNoContent {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusNoContent)
+func TestTemplateHandlers(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	os.RemoveAll(filepath.Join(executableDir, "data/templates"))
+	testDir := filepath.Join(executableDir, "data/conversations")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	router := setupRouter()
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	sessionManager.CreateSession("test-session", "")
+	templateStore, _ = templates.NewStore(executableDir)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("test", "test")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{"POST", "/api/v1/templates", `{"name": "explain", "prompt": "Explain {{.topic}} to a {{.audience}}."}`, http.StatusCreated},
+		{"POST", "/api/v1/templates", `{"name": "explain", "prompt": "again"}`, http.StatusConflict},
+		{"POST", "/api/v1/templates", `{"name": "Bad Name", "prompt": "hi"}`, http.StatusBadRequest},
+		{"PUT", "/api/v1/templates/explain", `{"description": "Explainer", "prompt": "Explain {{.topic}} to a {{.audience}}, briefly."}`, http.StatusOK},
+		{"PUT", "/api/v1/templates/missing", `{"prompt": "hi"}`, http.StatusNotFound},
+		{"GET", "/api/v1/templates/explain", "", http.StatusOK},
+		{"POST", "/api/v1/templates", `{"name": "old", "prompt": "hi"}`, http.StatusCreated},
+		{"DELETE", "/api/v1/templates/old", "", http.StatusNoContent},
+		{"DELETE", "/api/v1/templates/old", "", http.StatusNotFound},
+	} {
+		if rr := do(c.method, c.path, c.body); rr.Code != c.want {
+			t.Errorf("%s %s: got status %v want %v (%s)", c.method, c.path, rr.Code, c.want, rr.Body.String())
+		}
+	}
+
+	rr := do("GET", "/api/v1/templates", "")
+	expected := `[{"name":"explain","description":"Explainer","prompt":"Explain {{.topic}} to a {{.audience}}, briefly."}]`
+	if strings.TrimSpace(rr.Body.String()) != expected {
+		t.Errorf("list returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+
+	rr = do("POST", "/api/v1/conversations/test-session/prompt", `{"template": "explain", "variables": {"topic": "DNS", "audience": "child"}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("prompt with template: got status %v want %v (%s)", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	s, _ := sessionManager.AcquireSession("test-session")
+	if len(s.History) != 2 || s.History[0] != (session.Turn{Role: session.RoleUser, Text: "Explain DNS to a child, briefly."}) {
+		t.Errorf("expected the rendered template in the history, got %v", s.History)
+	}
+
+	for _, body := range []string{
+		`{"template": "explain", "variables": {"topic": "DNS"}}`,
+		`{"template": "explain", "prompt": "hi"}`,
+	} {
+		if rr := do("POST", "/api/v1/conversations/test-session/prompt", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("prompt %s: got status %v want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+	if rr := do("POST", "/api/v1/conversations/test-session/prompt", `{"template": "missing"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("prompt with a missing template: got status %v want %v", rr.Code, http.StatusNotFound)
 	}
 }
 
-func TestListTasksHandler(t *testing.T) {
+func TestPostPromptHandlerTimeout(t *testing.T) {
 	os.Setenv("GEMINI_SRV_USER", "test")
 	os.Setenv("GEMINI_SRV_PASS", "test")
 	executableDir, _ = os.Getwd()
-	testDir := filepath.Join(executableDir, "data/tasks")
+	testDir := filepath.Join(executableDir, "data/conversations")
 	os.RemoveAll(testDir)
 	os.MkdirAll(testDir, 0755)
+	os.RemoveAll(filepath.Join(executableDir, "data/failures"))
 	router := setupRouter()
-	req, err := http.NewRequest("GET", "/api/v1/tasks", nil)
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{delay: time.Second}, stats.New(),
+		session.WithPromptTimeout(50*time.Millisecond))
+	sessionManager.CreateSession("test-session", "")
+	req, err := http.NewRequest("POST", "/api/v1/conversations/test-session/prompt", strings.NewReader(`{"prompt": "test prompt"}`))
 	if err != nil {
 		t.Fatal(err)
 	}
 	req.SetBasicAuth("test", "test")
 
+	start := time.Now()
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
 
-	if status := rr.Code; status != http.StatusOK {
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the request to give up after the timeout, took %v", elapsed)
+	}
+	if status := rr.Code; status != http.StatusGatewayTimeout {
 		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusOK)
+			status, http.StatusGatewayTimeout)
 	}
-
-	expected := `[]`
+	expected := `{"error":"the a2a-server did not respond within 50ms","timeout":"50ms","timeout_seconds":0.05}`
 	if strings.TrimSpace(rr.Body.String()) != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			rr.Body.String(), expected)
 	}
+	s, _ := sessionManager.AcquireSession("test-session")
+	if len(s.History) != 0 {
+		t.Errorf("expected nothing stored for a timed out prompt, got %v", s.History)
+	}
+
+	// The timed out prompt is in the failure log.
+	req, _ = http.NewRequest("GET", "/api/v1/failures", nil)
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var failures []session.Failure
+	if err := json.NewDecoder(rr.Body).Decode(&failures); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected the failure log, got %v: %v", rr.Code, err)
+	}
+	if len(failures) != 1 || failures[0].SessionID != "test-session" || failures[0].Prompt != "test prompt" {
+		t.Errorf("expected the timed out prompt in the failure log, got %+v", failures)
+	}
 }
 
-func TestGetTaskDetailsHandler(t *testing.T) {
+func TestPostPromptHandlerPlainText(t *testing.T) {
 	os.Setenv("GEMINI_SRV_USER", "test")
 	os.Setenv("GEMINI_SRV_PASS", "test")
 	executableDir, _ = os.Getwd()
-	testDir := filepath.Join(executableDir, "data/tasks")
+	testDir := filepath.Join(executableDir, "data/conversations")
 	os.RemoveAll(testDir)
 	os.MkdirAll(testDir, 0755)
-	taskFile := filepath.Join(testDir, "test-task.toml")
-	os.WriteFile(taskFile, []byte(`name = "Test Task"`), 0644)
 	router := setupRouter()
-	req, err := http.NewRequest("GET", "/api/v1/tasks/test-task", nil)
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	sessionManager.CreateSession("test-session", "")
+
+	for _, c := range []struct{ url, accept string }{
+		{"/api/v1/conversations/test-session/prompt", "text/plain"},
+		{"/api/v1/conversations/test-session/prompt?format=text", ""},
+	} {
+		req, err := http.NewRequest("POST", c.url, bytes.NewBuffer([]byte(`{"prompt": "test prompt"}`)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("test", "test")
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v",
+				status, http.StatusOK)
+		}
+		if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("handler returned wrong content type: got %v", ct)
+		}
+		if rr.Body.String() != "mock response" {
+			t.Errorf("handler returned unexpected body: got %q want %q",
+				rr.Body.String(), "mock response")
+		}
+	}
+}
+
+func TestPostPromptHandlerAsTask(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/conversations")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	router := setupRouter()
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	sessionManager.CreateSession("test-session", "")
+	req, err := http.NewRequest("POST", "/api/v1/conversations/test-session/prompt", bytes.NewBuffer([]byte(`{"prompt": "test prompt", "as_task": true}`)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -311,24 +671,24 @@ func TestGetTaskDetailsHandler(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	expected := `{"Name":"Test Task","Description":"","Schedule":"","ContextPath":"","DataCommand":"","Prompt":""}`
+	expected := `{"task_id":"mock-task-id"}`
 	if strings.TrimSpace(rr.Body.String()) != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			rr.Body.String(), expected)
 	}
 }
 
-func TestDeleteTaskHandler(t *testing.T) {
+func TestDeleteConversationHandler(t *testing.T) {
 	os.Setenv("GEMINI_SRV_USER", "test")
 	os.Setenv("GEMINI_SRV_PASS", "test")
 	executableDir, _ = os.Getwd()
-	testDir := filepath.Join(executableDir, "data/tasks")
+	testDir := filepath.Join(executableDir, "data/conversations")
 	os.RemoveAll(testDir)
 	os.MkdirAll(testDir, 0755)
-	taskFile := filepath.Join(testDir, "test-task.toml")
-	os.WriteFile(taskFile, []byte(`name = "Test Task"`), 0644)
 	router := setupRouter()
-	req, err := http.NewRequest("DELETE", "/api/v1/tasks/test-task", nil)
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	sessionManager.CreateSession("test-session", "")
+	req, err := http.NewRequest("DELETE", "/api/v1/conversations/test-session", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -343,42 +703,196 @@ func TestDeleteTaskHandler(t *testing.T) {
 	}
 }
 
-func TestUpdateTaskHandler(t *testing.T) {
+func TestConversationTagsHandler(t *testing.T) {
 	os.Setenv("GEMINI_SRV_USER", "test")
 	os.Setenv("GEMINI_SRV_PASS", "test")
 	executableDir, _ = os.Getwd()
-	testDir := filepath.Join(executableDir, "data/tasks")
+	testDir := filepath.Join(executableDir, "data/conversations")
 	os.RemoveAll(testDir)
 	os.MkdirAll(testDir, 0755)
-	taskFile := filepath.Join(testDir, "test-task.toml")
-	os.WriteFile(taskFile, []byte(`name = "Test Task"`), 0644)
 	router := setupRouter()
-	req, err := http.NewRequest("PUT", "/api/v1/tasks/test-task", bytes.NewBuffer([]byte(`{"name":"Test Task","description":"new description"}`)))
-	if err != nil {
-		t.Fatal(err)
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	sessionManager.CreateSession("tagged", "")
+	sessionManager.CreateSession("untagged", "")
+
+	tests := []struct {
+		method, url, body string
+		want              int
+		wantBody          string
+	}{
+		{"PUT", "/api/v1/conversations/tagged/tags", `{"tags": ["Research"]}`, http.StatusOK, `{"tags":["research"]}`},
+		{"POST", "/api/v1/conversations/tagged/tags", `{"tags": ["work", "urgent"]}`, http.StatusOK, `{"tags":["research","urgent","work"]}`},
+		{"DELETE", "/api/v1/conversations/tagged/tags/urgent", "", http.StatusOK, `{"tags":["research","work"]}`},
+		{"POST", "/api/v1/conversations/tagged/tags", `{"tags": ["not valid"]}`, http.StatusBadRequest, ""},
+		{"POST", "/api/v1/conversations/tagged/tags", `{}`, http.StatusBadRequest, ""},
+		{"POST", "/api/v1/conversations/missing/tags", `{"tags": ["work"]}`, http.StatusNotFound, ""},
+		{"GET", "/api/v1/conversations/tagged/tags", "", http.StatusMethodNotAllowed, ""},
+		{"GET", "/api/v1/conversations?tag=work", "", http.StatusOK, `[{"id":"tagged","name":"New Conversation","tags":["research","work"],"pinned":false}]`},
+		{"GET", "/api/v1/conversations?tag=none", "", http.StatusOK, `[]`},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("test", "test")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s %s: got status %v want %v", tt.method, tt.url, rr.Code, tt.want)
+		}
+		if tt.wantBody != "" && strings.TrimSpace(rr.Body.String()) != tt.wantBody {
+			t.Errorf("%s %s: got body %v want %v", tt.method, tt.url, rr.Body.String(), tt.wantBody)
+		}
+	}
+}
+
+func TestPinConversationHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/conversations")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	router := setupRouter()
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	sessionManager.CreateSession("a-first", "")
+	sessionManager.CreateSession("b-second", "")
+
+	tests := []struct {
+		url, body string
+		want      int
+		wantBody  string
+	}{
+		{"/api/v1/conversations/b-second/pin", "", http.StatusOK, `{"pinned":true}`},
+		{"/api/v1/conversations/b-second/pin", `{"pinned": true}`, http.StatusOK, `{"pinned":true}`},
+		{"/api/v1/conversations/missing/pin", "", http.StatusNotFound, ""},
+		{"/api/v1/conversations/b-second/pin", `{"pinned": "yes"}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", tt.url, strings.NewReader(tt.body))
+		req.SetBasicAuth("test", "test")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.want || (tt.wantBody != "" && strings.TrimSpace(rr.Body.String()) != tt.wantBody) {
+			t.Errorf("POST %s %s: got %v %q, want %v %s", tt.url, tt.body, rr.Code, rr.Body.String(), tt.want, tt.wantBody)
+		}
 	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/conversations", nil)
 	req.SetBasicAuth("test", "test")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var conversations []session.ConversationInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &conversations); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if len(conversations) != 2 || conversations[0].ID != "b-second" || !conversations[0].Pinned {
+		t.Errorf("expected the pinned conversation first, got %+v", conversations)
+	}
+}
+
+func TestGetHistoryHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/conversations")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	router := setupRouter()
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	s, _ := sessionManager.CreateSession("test-session", "")
+	for i := 0; i < 5; i++ {
+		s.History = append(s.History, session.Turn{Role: session.RoleUser, Text: fmt.Sprint(i)})
+	}
 
+	tests := []struct {
+		query, want string
+		status      int
+	}{
+		{"?limit=2", `{"turns":[{"role":"user","text":"3"},{"role":"user","text":"4"}],"offset":3,"total":5}`, http.StatusOK},
+		{"?offset=1&limit=2", `{"turns":[{"role":"user","text":"1"},{"role":"user","text":"2"}],"offset":1,"total":5}`, http.StatusOK},
+		{"?offset=10", `{"turns":[],"offset":10,"total":5}`, http.StatusOK},
+		{"?limit=0", "", http.StatusBadRequest},
+		{"?offset=-1", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/api/v1/conversations/test-session/history"+tt.query, nil)
+		req.SetBasicAuth("test", "test")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.status || (tt.want != "" && strings.TrimSpace(rr.Body.String()) != tt.want) {
+			t.Errorf("%s: got %v %s, want %v %s", tt.query, rr.Code, rr.Body.String(), tt.status, tt.want)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/conversations/missing/history", nil)
+	req.SetBasicAuth("test", "test")
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing conversation, got %v", rr.Code)
+	}
+}
 
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusOK)
+func TestUpdateConversationHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/conversations")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	router := setupRouter()
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	sessionManager.CreateSession("test-session", "")
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"working_directory": "` + filepath.Join(executableDir, "missing") + `"}`, http.StatusBadRequest},
+		{`{"name": " "}`, http.StatusBadRequest},
+		{`{"name": "Renamed", "working_directory": "` + testDir + `"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("PATCH", "/api/v1/conversations/test-session", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("test", "test")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("PATCH %s: got status %v want %v", tt.body, rr.Code, tt.want)
+		}
+	}
+
+	s, err := sessionManager.AcquireSession("test-session")
+	if err != nil {
+		t.Fatalf("AcquireSession failed: %v", err)
+	}
+	if s.Name != "Renamed" || s.WorkingDirectory != testDir {
+		t.Errorf("Expected name Renamed and working directory %q, got %q and %q", testDir, s.Name, s.WorkingDirectory)
+	}
+
+	req, _ := http.NewRequest("PATCH", "/api/v1/conversations/missing", strings.NewReader(`{"name": "x"}`))
+	req.SetBasicAuth("test", "test")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("PATCH of a missing conversation: got status %v want %v", rr.Code, http.StatusNotFound)
 	}
 }
 
-func TestGetTaskLogsHandler(t *testing.T) {
+func TestListTasksHandler(t *testing.T) {
 	os.Setenv("GEMINI_SRV_USER", "test")
 	os.Setenv("GEMINI_SRV_PASS", "test")
 	executableDir, _ = os.Getwd()
-	testDir := filepath.Join(executableDir, "data/task_outputs/test-task")
+	testDir := filepath.Join(executableDir, "data/tasks")
 	os.RemoveAll(testDir)
 	os.MkdirAll(testDir, 0755)
-	logFile := filepath.Join(testDir, "test.log")
-	os.WriteFile(logFile, []byte("test log"), 0644)
 	router := setupRouter()
-	req, err := http.NewRequest("GET", "/api/v1/tasks/test-task/logs", nil)
+	req, err := http.NewRequest("GET", "/api/v1/tasks", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -392,48 +906,1844 @@ func TestGetTaskLogsHandler(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	expected := `["test log"]`
+	expected := `[]`
 	if strings.TrimSpace(rr.Body.String()) != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			rr.Body.String(), expected)
 	}
 }
 
-func TestPostPromptStreamHandler(t *testing.T) {
+func TestListTasksHandlerStatus(t *testing.T) {
 	os.Setenv("GEMINI_SRV_USER", "test")
 	os.Setenv("GEMINI_SRV_PASS", "test")
 	executableDir, _ = os.Getwd()
-	testDir := filepath.Join(executableDir, "data/conversations")
+	testDir := filepath.Join(executableDir, "data/tasks")
 	os.RemoveAll(testDir)
 	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "hourly.toml"), []byte(`name = "Hourly"
+schedule = "0 * * * *"
+data_command = "echo hi"`), 0644)
+	outDir := filepath.Join(executableDir, "data/task_outputs/hourly")
+	os.RemoveAll(outDir)
+	os.MkdirAll(outDir, 0755)
+	os.WriteFile(filepath.Join(outDir, "run.json"), []byte(`{"id":"r1","status":"failed","started_at":"2025-01-01T00:00:00Z"}`), 0644)
+	os.WriteFile(filepath.Join(testDir, "unscheduled.toml"), []byte(`name = "Unscheduled"`), 0644)
+	os.WriteFile(filepath.Join(testDir, "broken.toml"), []byte(`name = "Broken"
+schedule = "61 * * * *"
+data_command = "echo hi"`), 0644)
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
 	router := setupRouter()
-	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
-	sessionManager.CreateSession("test-session", "")
-
-	server := httptest.NewServer(router)
-	defer server.Close()
-
-	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/conversations/test-session/prompt/stream"
 
-	header := http.Header{}
-	header.Set("Authorization", "Basic dGVzdDp0ZXN0")
-
-	ws, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	req, err := http.NewRequest("GET", "/api/v1/tasks", nil)
 	if err != nil {
-		t.Fatalf("could not open websocket: %v", err)
+		t.Fatal(err)
 	}
-	defer ws.Close()
+	req.SetBasicAuth("test", "test")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var tasks []taskSummary
+	if err := json.Unmarshal(rr.Body.Bytes(), &tasks); err != nil {
+		t.Fatalf("could not decode tasks: %v", err)
+	}
+	if len(tasks) != 3 {
+		t.Fatalf("expected 3 tasks, got %+v", tasks)
+	}
+	broken, hourly, unscheduled := tasks[0], tasks[1], tasks[2]
+	if broken.NextRun != nil || !strings.Contains(broken.ScheduleError, "61") || !strings.Contains(broken.ScheduleError, "schedule") {
+		t.Errorf("expected the broken task flagged with the parser's error, got %+v", broken)
+	}
+	if hourly.ScheduleError != "" {
+		t.Errorf("expected no schedule error for a valid task, got %q", hourly.ScheduleError)
+	}
+	if unscheduled.ScheduleError == "" {
+		t.Errorf("expected the incomplete task flagged, got %+v", unscheduled)
+	}
+	if hourly.NextRun == nil || !hourly.NextRun.After(time.Now()) || hourly.NextRun.Minute() != 0 {
+		t.Errorf("expected the next run at the top of an upcoming hour, got %v", hourly.NextRun)
+	}
+	if hourly.LastStatus == nil || *hourly.LastStatus != "failed" || hourly.LastRun == nil {
+		t.Errorf("expected the last run to be reported as failed, got %+v", hourly)
+	}
+	if unscheduled.NextRun != nil || unscheduled.LastRun != nil || unscheduled.LastStatus != nil {
+		t.Errorf("expected nulls for an unscheduled task, got %+v", unscheduled)
+	}
+	os.RemoveAll(outDir)
+}
+
+func TestGetTaskDetailsHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/tasks")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	taskFile := filepath.Join(testDir, "test-task.toml")
+	os.WriteFile(taskFile, []byte(`name = "test-task"`), 0644)
+	os.RemoveAll(filepath.Join(executableDir, "data/task_outputs/test_task"))
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	router := setupRouter()
+	req, err := http.NewRequest("GET", "/api/v1/tasks/test-task", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("test", "test")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	funcs, _ := json.Marshal(scheduler.PromptFunctions)
+	expected := `{"name":"test-task","description":"","schedule":"","context_path":"","data_command":"","prompt":"","next_run":null,"last_run":null,"last_status":null,"schedule_error":"invalid task: schedule: invalid cron expression \"\": empty spec string (expected 5 fields: minute hour day-of-month month day-of-week, or a descriptor such as @hourly, or 6 fields: second minute hour day-of-month month day-of-week); data_command: must not be empty","circuit":{"consecutive_failures":0,"max_consecutive_failures":10,"open":false},"template_functions":` + string(funcs) + `}`
+	if strings.TrimSpace(rr.Body.String()) != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+}
+
+func TestCreateTaskHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/tasks")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	router := setupRouter()
+
+	body := `{"name":"My Report","schedule":"0 8 * * *","context_path":"/tmp","data_command":"echo hi","prompt":"Summarize: {{.Input}}"}`
+	req, err := http.NewRequest("POST", "/api/v1/tasks", bytes.NewBuffer([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("test", "test")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s",
+			status, http.StatusCreated, rr.Body.String())
+	}
+
+	data, err := os.ReadFile(filepath.Join(testDir, "my_report.toml"))
+	if err != nil {
+		t.Fatalf("task file was not written: %v", err)
+	}
+	if !strings.Contains(string(data), "context_path = '/tmp'") {
+		t.Errorf("task file is missing the context path: %s", data)
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/tasks", bytes.NewBuffer([]byte(body)))
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("duplicate task returned wrong status code: got %v want %v",
+			status, http.StatusConflict)
+	}
+
+	// A task that can't be scheduled, here because the scheduler still has
+	// one by that name, leaves no file behind.
+	os.Remove(filepath.Join(testDir, "my_report.toml"))
+	req, _ = http.NewRequest("POST", "/api/v1/tasks", bytes.NewBuffer([]byte(body)))
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("unschedulable task returned wrong status code: got %v want %v",
+			status, http.StatusInternalServerError)
+	}
+	if _, err := os.Stat(filepath.Join(testDir, "my_report.toml")); !os.IsNotExist(err) {
+		t.Errorf("task file was left behind: %v", err)
+	}
+}
+
+func TestCreateTaskHandlerInvalid(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/tasks")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	router := setupRouter()
+
+	for _, body := range []string{
+		`{"name":"Bad Schedule","schedule":"every tuesday-ish","data_command":"echo hi","prompt":"{{.Input}}"}`,
+		`{"name":"Bad Prompt","schedule":"* * * * *","data_command":"echo hi","prompt":"{{.Input"}`,
+		`{"name":"Typo Prompt","schedule":"* * * * *","data_command":"echo hi","prompt":"{{.Inptu}}"}`,
+		`{"name":"No Command","schedule":"* * * * *","prompt":"{{.Input}}"}`,
+		`{"name":"Export","schedule":"* * * * *","data_command":"echo hi","prompt":"{{.Input}}"}`,
+	} {
+		req, err := http.NewRequest("POST", "/api/v1/tasks", bytes.NewBuffer([]byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("test", "test")
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusUnprocessableEntity {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v",
+				body, status, http.StatusUnprocessableEntity)
+		}
+	}
+
+	files, _ := os.ReadDir(testDir)
+	if len(files) != 0 {
+		t.Errorf("Expected no task files to be written, got %d", len(files))
+	}
+}
+
+func TestValidateTemplateHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	router := setupRouter()
+
+	tests := []struct {
+		body, want string
+		status     int
+	}{
+		{`{"prompt":"Logs: {{.Data.logs}}","data_commands":{"logs":{"command":"true"}},"sample":{"data":{"logs":"all quiet"}}}`, `{"valid":true,"issues":[],"rendered":"Logs: all quiet"}`, http.StatusOK},
+		{`{"prompt":"{{.Input}}"}`, `{"valid":true,"issues":[]}`, http.StatusOK},
+		{`{"prompt":"{{if .Input}}\n{{.Inptu}}{{end}}","sample":{"input":"x"}}`, `{"valid":false,"issues":[{"line":2,"column":2,"message":"undefined variable .Inptu: prompts can use .Input, .Data.\u003cname\u003e, .Vars.\u003cname\u003e and .Upstream"}]}`, http.StatusOK},
+		{`{"prompt":"{{.Input"}`, `{"valid":false,"issues":[{"line":1,"message":"unclosed action"}]}`, http.StatusOK},
+		{`{"prompt":"{{ env \"SECRET\" }}","sample":{}}`, "", http.StatusOK},
+		{`not json`, "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "/api/v1/tasks/validate-template", strings.NewReader(tt.body))
+		req.SetBasicAuth("test", "test")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("%s: got status %v want %v", tt.body, rr.Code, tt.status)
+		}
+		if tt.want != "" && strings.TrimSpace(rr.Body.String()) != tt.want {
+			t.Errorf("%s: got body %s want %s", tt.body, rr.Body.String(), tt.want)
+		}
+		if tt.want == "" && tt.status == http.StatusOK && !strings.Contains(rr.Body.String(), `"valid":false`) {
+			t.Errorf("%s: expected the render error to be reported, got %s", tt.body, rr.Body.String())
+		}
+	}
+}
+
+func TestDeleteTaskHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/tasks")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	taskFile := filepath.Join(testDir, "test-task.toml")
+	os.WriteFile(taskFile, []byte(`name = "test-task"`), 0644)
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	router := setupRouter()
+	req, err := http.NewRequest("DELETE", "/api/v1/tasks/test-task", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("test", "test")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNoContent)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/api/v1/tasks/test-task", nil)
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+}
+
+func TestUpdateTaskHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/tasks")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	taskFile := filepath.Join(testDir, "test-task.toml")
+	os.WriteFile(taskFile, []byte(`name = "test-task"
+schedule = "0 * * * *"`), 0644)
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	router := setupRouter()
+	req, err := http.NewRequest("PUT", "/api/v1/tasks/test-task", bytes.NewBuffer([]byte(`{"name":"test-task","description":"new description","schedule":"*/5 * * * *","data_command":"echo hi"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("test", "test")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	if data, err := os.ReadFile(taskFile); err != nil || !strings.Contains(string(data), "new description") {
+		t.Errorf("task file wasn't updated: %q, %v", data, err)
+	}
+	if _, err := os.Stat(taskFile + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary task file was left behind: %v", err)
+	}
+
+	req, _ = http.NewRequest("PUT", "/api/v1/tasks/test-task", bytes.NewBuffer([]byte(`{"name":"test-task","schedule":"whenever","prompt":"{{.Inptu}}"}`)))
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusUnprocessableEntity)
+	}
+	var verr scheduler.ValidationError
+	if err := json.Unmarshal(rr.Body.Bytes(), &verr); err != nil {
+		t.Fatalf("could not decode validation errors: %v", err)
+	}
+	fields := map[string]bool{}
+	for _, fe := range verr.Errors {
+		fields[fe.Field] = true
+	}
+	if len(fields) != 3 || !fields["schedule"] || !fields["data_command"] || !fields["prompt"] {
+		t.Errorf("expected errors for schedule, data_command and prompt, got %+v", verr.Errors)
+	}
+	for _, fe := range verr.Errors {
+		if fe.Field == "schedule" && !strings.Contains(fe.Message, `"whenever"`) {
+			t.Errorf("expected the parser's message for the schedule, got %q", fe.Message)
+		}
+	}
+
+	// Renaming moves the file and the outputs to the new name.
+	outputsDir := filepath.Join(executableDir, "data/task_outputs")
+	os.RemoveAll(filepath.Join(outputsDir, "test-task"))
+	os.RemoveAll(filepath.Join(outputsDir, "renamed_task"))
+	os.MkdirAll(filepath.Join(outputsDir, "test-task"), 0755)
+	os.WriteFile(filepath.Join(outputsDir, "test-task", "old.json"), []byte(`{"id":"old","status":"success","started_at":"2025-01-01T00:00:00Z"}`), 0644)
+	req, _ = http.NewRequest("PUT", "/api/v1/tasks/test-task", bytes.NewBuffer([]byte(`{"name":"Renamed Task","schedule":"*/5 * * * *","data_command":"echo hi"}`)))
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK || !strings.Contains(rr.Body.String(), `"name":"renamed_task"`) {
+		t.Fatalf("expected the task to be renamed, got %v: %s", status, rr.Body.String())
+	}
+	if _, err := os.Stat(taskFile); !os.IsNotExist(err) {
+		t.Errorf("old task file was left behind: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(testDir, "renamed_task.toml")); err != nil || !strings.Contains(string(data), "Renamed Task") {
+		t.Errorf("renamed task file wasn't written: %q, %v", data, err)
+	}
+	if runs, err := schedulerManager.Runs("renamed_task"); err != nil || len(runs) != 1 || runs[0].ID != "old" {
+		t.Errorf("expected the runs to move with the task, got %+v, %v", runs, err)
+	}
+	if _, err := os.Stat(filepath.Join(outputsDir, "test-task")); !os.IsNotExist(err) {
+		t.Errorf("old output directory was left behind: %v", err)
+	}
+	if _, err := schedulerManager.Status("test-task"); !errors.Is(err, scheduler.ErrTaskNotFound) {
+		t.Errorf("expected the old task to be gone, got %v", err)
+	}
+	if status, err := schedulerManager.Status("renamed_task"); err != nil || status.NextRun == nil {
+		t.Errorf("expected the renamed task to be scheduled, got %+v, %v", status, err)
+	}
+
+	// The new name can't take another task's file.
+	os.WriteFile(filepath.Join(testDir, "other.toml"), []byte("name = \"other\"\nschedule = \"0 * * * *\"\ndata_command = \"echo hi\"\n"), 0644)
+	req, _ = http.NewRequest("PUT", "/api/v1/tasks/renamed_task", bytes.NewBuffer([]byte(`{"name":"other","schedule":"*/5 * * * *","data_command":"echo hi"}`)))
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("expected a conflict, got %v: %s", status, rr.Body.String())
+	}
+
+	// Nor can a task be renamed from under the tasks depending on it.
+	os.WriteFile(filepath.Join(testDir, "dependent.toml"), []byte("name = \"dependent\"\ndepends_on = \"renamed_task\"\nprompt = \"{{.Upstream}}\"\n"), 0644)
+	if err := schedulerManager.AddTask(&scheduler.Task{Name: "dependent", DependsOn: "renamed_task", Prompt: "{{.Upstream}}"}); err != nil {
+		t.Fatalf("AddTask failed: %v", err)
+	}
+	req, _ = http.NewRequest("PUT", "/api/v1/tasks/renamed_task", bytes.NewBuffer([]byte(`{"name":"Another Name","schedule":"*/5 * * * *","data_command":"echo hi"}`)))
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), `"field":"name"`) {
+		t.Errorf("expected a name validation error, got %v: %s", status, rr.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(testDir, "another_name.toml")); !os.IsNotExist(err) {
+		t.Errorf("refused rename left a task file behind: %v", err)
+	}
+}
+
+func TestTaskSubresourceNames(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/tasks")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	router := setupRouter()
+
+	for _, name := range []string{"logs", "run", "dry-run", "stats", "runs", "stream", "enable"} {
+		// New tasks can't take the name of a sub-resource.
+		body := `{"name":"` + name + `","schedule":"0 * * * *","data_command":"echo hi","prompt":"{{.Input}}"}`
+		req, _ := http.NewRequest("POST", "/api/v1/tasks", bytes.NewBuffer([]byte(body)))
+		req.SetBasicAuth("test", "test")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), `"field":"name"`) {
+			t.Errorf("creating task %q: got %v: %s", name, rr.Code, rr.Body.String())
+		}
+
+		// One left from before is still reached by its own path.
+		taskFile := filepath.Join(testDir, name+".toml")
+		os.WriteFile(taskFile, []byte("name = \""+name+"\"\n"), 0644)
+		req, _ = http.NewRequest("GET", "/api/v1/tasks/"+name, nil)
+		req.SetBasicAuth("test", "test")
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"name":"`+name+`"`) {
+			t.Errorf("getting task %q: got %v: %s", name, rr.Code, rr.Body.String())
+		}
+		req, _ = http.NewRequest("DELETE", "/api/v1/tasks/"+name, nil)
+		req.SetBasicAuth("test", "test")
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("deleting task %q: got %v: %s", name, rr.Code, rr.Body.String())
+		}
+		if _, err := os.Stat(taskFile); !os.IsNotExist(err) {
+			t.Errorf("task file %s.toml wasn't deleted: %v", name, err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/tasks/some-task/unknown", nil)
+	req.SetBasicAuth("test", "test")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown sub-resource to be a 404, got %v", rr.Code)
+	}
+
+	// Read-only sub-resources refuse other methods.
+	for _, path := range []string{"/api/v1/tasks/some-task/stats", "/api/v1/tasks/some-task/runs", "/api/v1/tasks/some-task/runs/some-run"} {
+		req, _ := http.NewRequest("DELETE", path, nil)
+		req.SetBasicAuth("test", "test")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("DELETE %s: got %v, want %v", path, rr.Code, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func TestTaskHandlersRejectTraversal(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	os.MkdirAll(filepath.Join(executableDir, "data/tasks"), 0755)
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	secret := filepath.Join(executableDir, "data/secret.toml")
+	os.WriteFile(secret, []byte(`name = "Secret"`), 0644)
+	defer os.Remove(secret)
+	router := setupRouter()
+
+	body := `{"name":"Secret","schedule":"* * * * *","data_command":"echo hi","prompt":"{{.Input}}"}`
+	for _, c := range []struct{ method, url string }{
+		{"GET", "/api/v1/tasks/..%2Fsecret"},
+		{"PUT", "/api/v1/tasks/..%2Fsecret"},
+		{"DELETE", "/api/v1/tasks/..%2Fsecret"},
+		{"DELETE", "/api/v1/tasks/..%2F..%2Fdata%2Fsecret"},
+		{"GET", "/api/v1/tasks/%2e%2e/logs"},
+		{"GET", "/api/v1/tasks/..%2Ftasks/logs"},
+		{"GET", "/api/v1/tasks/..%2Ftasks/runs"},
+		{"POST", "/api/v1/tasks/..%2Fsecret/run"},
+	} {
+		req, err := http.NewRequest(c.method, c.url, bytes.NewBuffer([]byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("test", "test")
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s %s returned wrong status code: got %v want %v",
+				c.method, c.url, status, http.StatusBadRequest)
+		}
+	}
+
+	data, err := os.ReadFile(secret)
+	if err != nil || string(data) != `name = "Secret"` {
+		t.Errorf("file outside the tasks directory was modified: %q, %v", data, err)
+	}
+}
+
+func TestConversationHandlersRejectTraversal(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	os.MkdirAll(filepath.Join(executableDir, "data/conversations"), 0755)
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	secret := filepath.Join(executableDir, "data/secret.json")
+	os.WriteFile(secret, []byte(`{"id":"secret","history":[]}`), 0644)
+	defer os.Remove(secret)
+	router := setupRouter()
+
+	for _, c := range []struct{ method, url string }{
+		{"GET", "/api/v1/conversations/..%2Fsecret"},
+		{"DELETE", "/api/v1/conversations/..%2Fsecret"},
+		{"DELETE", "/api/v1/conversations/..%2F..%2Fdata%2Fsecret"},
+		{"POST", "/api/v1/conversations/..%2Fsecret/clear"},
+		{"POST", "/api/v1/conversations/%2e%2e/prompt"},
+		{"GET", "/api/v1/conversations/secret.json"},
+	} {
+		req, err := http.NewRequest(c.method, c.url, bytes.NewBuffer([]byte(`{"prompt":"hi"}`)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("test", "test")
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s %s returned wrong status code: got %v want %v",
+				c.method, c.url, status, http.StatusBadRequest)
+		}
+	}
+
+	if _, err := os.Stat(secret); err != nil {
+		t.Errorf("file outside the conversations directory was removed: %v", err)
+	}
+}
+
+func TestRunTaskHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/tasks")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	taskFile := filepath.Join(testDir, "test-task.toml")
+	os.WriteFile(taskFile, []byte(`name = "test-task"`), 0644)
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	router := setupRouter()
+
+	req, err := http.NewRequest("POST", "/api/v1/tasks/test-task/run", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("test", "test")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusAccepted {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusAccepted)
+	}
+	if !strings.Contains(rr.Body.String(), `"run_id":"`) {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/tasks/missing-task/run", nil)
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+
+	// Overrides are checked like a saved task, and a dry run renders them.
+	os.WriteFile(filepath.Join(testDir, "vars-task.toml"), []byte("name = \"vars-task\"\nschedule = \"@daily\"\ndata_command = \"echo stored\"\nprompt = \"{{.Vars.region}}: {{.Input}}\"\n[vars]\nregion = \"eu\"\n"), 0644)
+	for _, tc := range []struct {
+		body, want string
+		status     int
+	}{
+		{`{"dry_run":true,"data_command":"echo override","vars":{"region":"us"}}`, `"prompt":"us: override"`, http.StatusOK},
+		{`{"vars":{"zone":"x"}}`, `"field":"vars.zone"`, http.StatusUnprocessableEntity},
+		{`{"vars":`, "Invalid", http.StatusBadRequest},
+	} {
+		req, _ = http.NewRequest("POST", "/api/v1/tasks/vars-task/run", strings.NewReader(tc.body))
+		req.SetBasicAuth("test", "test")
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tc.status || !strings.Contains(rr.Body.String(), tc.want) {
+			t.Errorf("POST %s: got %d %q, want %d containing %q", tc.body, rr.Code, rr.Body.String(), tc.status, tc.want)
+		}
+	}
+
+	// Let the run finish so it doesn't write into later tests' outputs.
+	for i := 0; i < 100; i++ {
+		if running, _ := schedulerManager.RunningRuns("test-task"); len(running) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGetTaskRunsHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	testDir := filepath.Join(executableDir, "data/task_outputs/test-task")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "old.json"), []byte(`{"id":"old","status":"failed","started_at":"2025-01-01T00:00:00Z"}`), 0644)
+	os.WriteFile(filepath.Join(testDir, "new.json"), []byte(`{"id":"new","status":"success","started_at":"2025-01-02T00:00:00Z","prompt":"full prompt","response":"full response"}`), 0644)
+	router := setupRouter()
+
+	req, err := http.NewRequest("GET", "/api/v1/tasks/test-task/runs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("test", "test")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	var runs []scheduler.RunSummary
+	if err := json.Unmarshal(rr.Body.Bytes(), &runs); err != nil {
+		t.Fatalf("could not decode runs: %v", err)
+	}
+	if len(runs) != 2 || runs[0].ID != "new" || runs[1].Status != scheduler.RunStatusFailed {
+		t.Errorf("handler returned unexpected runs: got %+v", runs)
+	}
+	if strings.Contains(rr.Body.String(), "full response") {
+		t.Errorf("run history should not include full run details: %s", rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/tasks/test-task/runs?limit=1", nil)
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	runs = nil
+	json.Unmarshal(rr.Body.Bytes(), &runs)
+	if len(runs) != 1 || runs[0].ID != "new" {
+		t.Errorf("handler returned unexpected runs with limit=1: got %+v", runs)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/tasks/test-task/runs/new", nil)
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var run scheduler.RunRecord
+	if err := json.Unmarshal(rr.Body.Bytes(), &run); err != nil {
+		t.Fatalf("could not decode run: %v", err)
+	}
+	if run.ID != "new" || run.Response != "full response" {
+		t.Errorf("handler returned unexpected run: got %+v", run)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/tasks/test-task/runs/missing", nil)
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code for a missing run: got %v want %v",
+			status, http.StatusNotFound)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/tasks/missing-task/runs", nil)
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+}
+
+func TestGetTaskLogsHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/task_outputs/test-task")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	logFile := filepath.Join(testDir, "test.log")
+	os.WriteFile(logFile, []byte("test log"), 0644)
+	router := setupRouter()
+	req, err := http.NewRequest("GET", "/api/v1/tasks/test-task/logs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("test", "test")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	var logs []taskLog
+	if err := json.Unmarshal(rr.Body.Bytes(), &logs); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if len(logs) != 1 || logs[0].Filename != "test.log" || logs[0].Content != "test log" || logs[0].Header != nil {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+}
+
+func TestGetTaskLogsHandlerParsesHeaders(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/task_outputs/test-task")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	defer os.RemoveAll(testDir)
+	old := time.Now().Add(-time.Hour)
+	legacy := filepath.Join(testDir, "2024-05-01T12-00-00.log")
+	os.WriteFile(legacy, []byte("--- Task Run: Test Task ---\nTimestamp: 2024-05-01T12:00:00Z\n\n--- STDOUT ---\nold output\n"), 0644)
+	os.Chtimes(legacy, old, old)
+	os.WriteFile(filepath.Join(testDir, "20240502T120000_abcdef12.json"),
+		[]byte(`{"id":"abcdef12","task":"Test Task","status":"success","started_at":"2024-05-02T12:00:00Z","finished_at":"2024-05-02T12:00:01Z","exit_code":0,"prompt_hash":"sha256:00","response":"new output"}`), 0644)
+	router := setupRouter()
+
+	req, _ := http.NewRequest("GET", "/api/v1/tasks/test-task/logs", nil)
+	req.SetBasicAuth("test", "test")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var logs []taskLog
+	if err := json.Unmarshal(rr.Body.Bytes(), &logs); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("expected 2 logs, got %v", rr.Body.String())
+	}
+	run, legacyLog := logs[0], logs[1]
+	if run.Header == nil || run.Header.Format != scheduler.OutputFormatRun || run.Header.RunID != "abcdef12" ||
+		run.Header.PromptHash != "sha256:00" || run.Body == nil || *run.Body != "new output" {
+		t.Errorf("unexpected run log: %v", rr.Body.String())
+	}
+	if legacyLog.Header == nil || legacyLog.Header.Format != scheduler.OutputFormatLegacy || legacyLog.Header.Task != "Test Task" ||
+		legacyLog.Body == nil || *legacyLog.Body != "old output" {
+		t.Errorf("unexpected legacy log: %v", rr.Body.String())
+	}
+}
+
+func TestGetTaskLogFileHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/task_outputs/test-task")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "run.json"), []byte("test log"), 0644)
+	os.WriteFile(filepath.Join(executableDir, "data/task_outputs/secret.txt"), []byte("secret"), 0644)
+	defer os.Remove(filepath.Join(executableDir, "data/task_outputs/secret.txt"))
+	router := setupRouter()
+
+	req, err := http.NewRequest("GET", "/api/v1/tasks/test-task/logs/run.json?download=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("test", "test")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	if rr.Body.String() != "test log" {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("handler returned wrong content type: got %v", ct)
+	}
+	if cl := rr.Header().Get("Content-Length"); cl != "8" {
+		t.Errorf("handler returned wrong content length: got %v", cl)
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != `attachment; filename="run.json"` {
+		t.Errorf("handler returned wrong content disposition: got %v", cd)
+	}
+
+	for url, want := range map[string]int{
+		"/api/v1/tasks/test-task/logs/missing.json":    http.StatusNotFound,
+		"/api/v1/tasks/test-task/logs/..%2Fsecret.txt": http.StatusNotFound,
+		"/api/v1/tasks/test-task/logs/%2e%2e":          http.StatusBadRequest,
+		"/api/v1/tasks/..%2Ftest-task/logs/run.json":   http.StatusBadRequest,
+		"/api/v1/tasks/test-task/logs/..%5Csecret.txt": http.StatusBadRequest,
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.SetBasicAuth("test", "test")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != want || strings.Contains(rr.Body.String(), "secret") {
+			t.Errorf("%s: got status %v and body %q, want status %v", url, rr.Code, rr.Body.String(), want)
+		}
+	}
+}
+
+func TestEnableTaskHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/tasks")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "flaky-task.toml"), []byte("name = \"flaky-task\"\nmax_consecutive_failures = 1\n"), 0644)
+	outDir := filepath.Join(executableDir, "data/task_outputs/flaky-task")
+	os.RemoveAll(outDir)
+	os.MkdirAll(outDir, 0755)
+	defer os.RemoveAll(outDir)
+	os.WriteFile(filepath.Join(outDir, "run.json"), []byte(`{"id":"r1","status":"failed","error":"boom","circuit_opened":true,"started_at":"2025-01-01T00:00:00Z","finished_at":"2025-01-01T00:00:01Z"}`), 0644)
+	os.Remove(filepath.Join(executableDir, "data/task_stats.json"))
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	router := setupRouter()
+
+	req, _ := http.NewRequest("GET", "/api/v1/tasks/flaky-task", nil)
+	req.SetBasicAuth("test", "test")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var details struct {
+		Circuit scheduler.CircuitState `json:"circuit"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &details); err != nil || !details.Circuit.Open || details.Circuit.ConsecutiveFailures != 1 {
+		t.Errorf("expected an open circuit in the task details, got %s", rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/tasks/flaky-task/enable", nil)
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	want := `{"consecutive_failures":0,"max_consecutive_failures":1,"open":false}`
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != want {
+		t.Errorf("unexpected response: %v %s", rr.Code, rr.Body.String())
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/api/v1/tasks/flaky-task/enable", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/v1/tasks/missing/enable", http.StatusNotFound},
+	} {
+		req, _ = http.NewRequest(tt.method, tt.path, nil)
+		req.SetBasicAuth("test", "test")
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("%s %s: got status %v want %v", tt.method, tt.path, rr.Code, tt.status)
+		}
+	}
+}
+
+func TestGetTaskStatsHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/tasks")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "stats-task.toml"), []byte(`name = "stats-task"`), 0644)
+	outDir := filepath.Join(executableDir, "data/task_outputs/stats-task")
+	os.RemoveAll(outDir)
+	os.MkdirAll(outDir, 0755)
+	defer os.RemoveAll(outDir)
+	os.WriteFile(filepath.Join(outDir, "run.json"), []byte(`{"id":"r1","status":"failed","error":"boom","duration_ms":300,"started_at":"2025-01-01T00:00:00Z","finished_at":"2025-01-01T00:00:01Z"}`), 0644)
+	os.Remove(filepath.Join(executableDir, "data/task_stats.json"))
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	router := setupRouter()
+
+	req, _ := http.NewRequest("GET", "/api/v1/tasks/stats-task/stats", nil)
+	req.SetBasicAuth("test", "test")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	want := `{"runs":1,"successes":0,"failures":1,"skips":0,"avg_duration_ms":300,"avg_response_length":0,"last_error":"boom","last_error_at":"2025-01-01T00:00:01Z"}`
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != want {
+		t.Errorf("unexpected response: %v %s", rr.Code, rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/tasks/missing/stats", nil)
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing task, got %v", rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/tasks", nil)
+	req.SetBasicAuth("test", "test")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var tasks []taskSummary
+	if err := json.Unmarshal(rr.Body.Bytes(), &tasks); err != nil {
+		t.Fatalf("could not decode tasks: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].Stats == nil || *tasks[0].Stats != (scheduler.TaskStatsSummary{Runs: 1, Failures: 1, AvgDurationMs: 300}) {
+		t.Errorf("expected the task list to include the stats, got %+v", tasks)
+	}
+}
+
+func TestDeleteTaskLogsHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/task_outputs/test-task")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	defer os.RemoveAll(testDir)
+	for _, name := range []string{"run-1.json", "run-2.json", "run-3.json"} {
+		os.WriteFile(filepath.Join(testDir, name), []byte("test log"), 0644)
+	}
+	os.WriteFile(filepath.Join(executableDir, "data/task_outputs/secret.txt"), []byte("secret"), 0644)
+	defer os.Remove(filepath.Join(executableDir, "data/task_outputs/secret.txt"))
+	os.RemoveAll(filepath.Join(executableDir, "data/task_outputs/never-ran"))
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	router := setupRouter()
+
+	del := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("DELETE", url, nil)
+		req.SetBasicAuth("test", "test")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for url, want := range map[string]int{
+		"/api/v1/tasks/test-task/logs/missing.json":    http.StatusNotFound,
+		"/api/v1/tasks/test-task/logs/..%2Fsecret.txt": http.StatusNotFound,
+		"/api/v1/tasks/test-task/logs/%2e%2e":          http.StatusBadRequest,
+		"/api/v1/tasks/..%2Ftest-task/logs":            http.StatusBadRequest,
+		"/api/v1/tasks/test-task/logs/..%5Csecret.txt": http.StatusBadRequest,
+		"/api/v1/tasks/never-ran/logs":                 http.StatusNotFound,
+	} {
+		if rr := del(url); rr.Code != want {
+			t.Errorf("%s: got status %v and body %q, want status %v", url, rr.Code, rr.Body.String(), want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(executableDir, "data/task_outputs/secret.txt")); err != nil {
+		t.Errorf("expected files outside the task's directory to be kept: %v", err)
+	}
+
+	rr := del("/api/v1/tasks/test-task/logs/run-1.json")
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"removed":1}` {
+		t.Errorf("unexpected response deleting one log: %v %q", rr.Code, rr.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(testDir, "run-1.json")); !os.IsNotExist(err) {
+		t.Errorf("expected run-1.json to be deleted, got %v", err)
+	}
+
+	rr = del("/api/v1/tasks/test-task/logs")
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"removed":2}` {
+		t.Errorf("unexpected response deleting all logs: %v %q", rr.Code, rr.Body.String())
+	}
+	if files, _ := os.ReadDir(testDir); len(files) != 0 {
+		t.Errorf("expected the output directory to be empty, got %d files", len(files))
+	}
+	// The directory stays, so deleting again removes nothing.
+	rr = del("/api/v1/tasks/test-task/logs")
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"removed":0}` {
+		t.Errorf("unexpected response deleting no logs: %v %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestGetTaskLogsHandlerPagination(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/task_outputs/test-task")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	base := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		logFile := filepath.Join(testDir, fmt.Sprintf("run-%d.log", i))
+		os.WriteFile(logFile, []byte(fmt.Sprintf("log %d", i)), 0644)
+		ts := base.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(logFile, ts, ts)
+	}
+	router := setupRouter()
+
+	cases := map[string][]string{
+		"":                  {"log 4", "log 3", "log 2", "log 1", "log 0"},
+		"?limit=2":          {"log 4", "log 3"},
+		"?limit=2&offset=3": {"log 1", "log 0"},
+		"?latest=true":      {"log 4"},
+		"?offset=10":        {},
+	}
+	for query, expected := range cases {
+		req, err := http.NewRequest("GET", "/api/v1/tasks/test-task/logs"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("test", "test")
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		var logs []taskLog
+		if err := json.Unmarshal(rr.Body.Bytes(), &logs); err != nil {
+			t.Fatalf("could not decode response for %q: %v", query, err)
+		}
+		var contents []string
+		for _, l := range logs {
+			contents = append(contents, l.Content)
+		}
+		if strings.Join(contents, ",") != strings.Join(expected, ",") {
+			t.Errorf("query %q: got %v want %v", query, contents, expected)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/tasks/test-task/logs?limit=abc", nil)
+	req.SetBasicAuth("test", "test")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+}
+
+func TestDryRunTaskHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/tasks")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	os.RemoveAll(filepath.Join(executableDir, "data/task_outputs"))
+	os.WriteFile(filepath.Join(testDir, "dry.toml"), []byte(`name = "Dry"
+data_command = "echo hello; echo warn >&2"
+prompt = "Data: {{.Input}}"`), 0644)
+	os.WriteFile(filepath.Join(testDir, "broken.toml"), []byte(`name = "Broken"
+data_command = "echo hello; exit 3"
+prompt = "Data: {{.Input}}"`), 0644)
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	router := setupRouter()
+
+	for _, c := range []struct {
+		name     string
+		want     scheduler.DryRunResult
+		hasError bool
+	}{
+		{"dry", scheduler.DryRunResult{Stdout: "hello\n", Stderr: "warn\n", Prompt: "Data: hello"}, false},
+		{"broken", scheduler.DryRunResult{Stdout: "hello\n", ExitCode: 3}, true},
+	} {
+		req, err := http.NewRequest("POST", "/api/v1/tasks/"+c.name+"/dry-run", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("test", "test")
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v",
+				status, http.StatusOK)
+		}
+		var got scheduler.DryRunResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("could not decode dry run result: %v", err)
+		}
+		if (got.Error != "") != c.hasError {
+			t.Errorf("%s: unexpected error in result: %+v", c.name, got)
+		}
+		got.Error = ""
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v want %+v", c.name, got, c.want)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(executableDir, "data/task_outputs/dry")); !os.IsNotExist(err) {
+		t.Errorf("dry run should not write a task output")
+	}
+}
+
+func TestTaskStreamHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/tasks")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "stream_task.toml"), []byte(`name = "Stream Task"
+schedule = "0 0 1 1 *"
+data_command = "echo hello; echo oops >&2"
+prompt = "Data: {{.Input}}"`), 0644)
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	router := setupRouter()
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/tasks/stream_task/stream"
+	header := http.Header{}
+	header.Set("Authorization", "Basic dGVzdDp0ZXN0")
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("could not open websocket: %v", err)
+	}
+	defer ws.Close()
+
+	runID, err := schedulerManager.RunNow("stream_task")
+	if err != nil {
+		t.Fatalf("RunNow failed: %v", err)
+	}
+
+	var output strings.Builder
+	var types []string
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var event scheduler.Event
+		if err := ws.ReadJSON(&event); err != nil {
+			t.Fatalf("could not read message from websocket: %v", err)
+		}
+		if event.RunID != runID {
+			t.Errorf("event has wrong run id: got %v want %v", event.RunID, runID)
+		}
+		if event.Type == scheduler.EventOutput {
+			output.WriteString(event.Stream + ":" + event.Text)
+			continue
+		}
+		types = append(types, event.Type)
+		if event.Type == scheduler.EventPrompt && event.Text != "Data: hello" {
+			t.Errorf("unexpected prompt event: %+v", event)
+		}
+		if event.Type == scheduler.EventFinished {
+			if event.Status != scheduler.RunStatusSuccess {
+				t.Errorf("expected a successful run, got %+v", event)
+			}
+			break
+		}
+	}
+	want := []string{scheduler.EventCommandStarted, scheduler.EventPrompt, scheduler.EventResponse, scheduler.EventFinished}
+	if strings.Join(types, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected event sequence: got %v want %v", types, want)
+	}
+	if !strings.Contains(output.String(), "stdout:hello") || !strings.Contains(output.String(), "stderr:oops") {
+		t.Errorf("missing command output events: %q", output.String())
+	}
+}
+
+func TestPostPromptStreamHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/conversations")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	router := setupRouter()
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	sessionManager.CreateSession("test-session", "")
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/conversations/test-session/prompt/stream"
+
+	header := http.Header{}
+	header.Set("Authorization", "Basic dGVzdDp0ZXN0")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("could not open websocket: %v", err)
+	}
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("test prompt")); err != nil {
+		t.Fatalf("could not send message over websocket: %v", err)
+	}
+
+	var event session.DeltaEvent
+	if err := ws.ReadJSON(&event); err != nil {
+		t.Fatalf("could not read message from websocket: %v", err)
+	}
+	if event.Type != session.DeltaTypeStart {
+		t.Errorf("expected start event first, got: %+v", event)
+	}
+
+	if err := ws.ReadJSON(&event); err != nil {
+		t.Fatalf("could not read message from websocket: %v", err)
+	}
+	if event.Type != session.DeltaTypeDelta || event.Text != "mock response" {
+		t.Errorf("unexpected event received: %+v", event)
+	}
+
+	if err := ws.ReadJSON(&event); err != nil {
+		t.Fatalf("could not read message from websocket: %v", err)
+	}
+	if event.Type != session.DeltaTypeStats || event.Stats == nil || event.Stats.Chars != len("mock response") {
+		t.Errorf("expected stats event, got: %+v", event)
+	}
+	for event.Type == session.DeltaTypeStats {
+		if err := ws.ReadJSON(&event); err != nil {
+			t.Fatalf("could not read message from websocket: %v", err)
+		}
+	}
+
+	if event.Type != session.DeltaTypeDone {
+		t.Errorf("expected done event, got: %+v", event)
+	}
+}
+
+func TestPostPromptStreamHandlerRaw(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/conversations")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	router := setupRouter()
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	sessionManager.CreateSession("test-session", "")
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/conversations/test-session/prompt/stream?raw=true"
+
+	header := http.Header{}
+	header.Set("Authorization", "Basic dGVzdDp0ZXN0")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("could not open websocket: %v", err)
+	}
+	defer ws.Close()
 
 	if err := ws.WriteMessage(websocket.TextMessage, []byte("test prompt")); err != nil {
 		t.Fatalf("could not send message over websocket: %v", err)
 	}
 
-	var event a2aclient.StreamEvent
-	if err := ws.ReadJSON(&event); err != nil {
-		t.Fatalf("could not read message from websocket: %v", err)
+	var events []string
+	for {
+		_, raw, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("could not read message from websocket: %v", err)
+		}
+		events = append(events, string(raw))
+		if strings.Contains(string(raw), `"kind":"end"`) {
+			break
+		}
 	}
 
-	if event.Kind != "text" || event.Text != "mock response" {
-		t.Errorf("unexpected event received: %+v", event)
+	if len(events) != 3 || !strings.Contains(events[0], `"kind":"start"`) {
+		t.Fatalf("expected start, status-update and end events, got: %q", events)
+	}
+	if !strings.Contains(events[1], `"kind":"status-update"`) || !strings.Contains(events[1], "mock response") {
+		t.Errorf("unexpected raw event received: %s", events[1])
+	}
+}
+
+func TestPostPromptStreamHandlerError(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/conversations")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	router := setupRouter()
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{streamErr: errors.New("backend unavailable")}, stats.New())
+	sessionManager.CreateSession("test-session", "")
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("Authorization", "Basic dGVzdDp0ZXN0")
+
+	for _, query := range []string{"", "?raw=true"} {
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/conversations/test-session/prompt/stream" + query
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err != nil {
+			t.Fatalf("could not open websocket: %v", err)
+		}
+
+		if err := ws.WriteMessage(websocket.TextMessage, []byte("test prompt")); err != nil {
+			t.Fatalf("could not send message over websocket: %v", err)
+		}
+
+		var event, end map[string]string
+		if err := ws.ReadJSON(&event); err != nil {
+			t.Fatalf("could not read message from websocket: %v", err)
+		}
+		if query != "" {
+			ws.ReadJSON(&end)
+		}
+		ws.Close()
+
+		if query == "" {
+			if event["type"] != session.DeltaTypeError || !strings.Contains(event["message"], "backend unavailable") {
+				t.Errorf("unexpected delta error event received: %+v", event)
+			}
+		} else if event["kind"] != "error" || !strings.Contains(event["text"], "backend unavailable") {
+			t.Errorf("unexpected raw error event received: %+v", event)
+		} else if end["kind"] != "end" {
+			t.Errorf("expected an end event after the error, got: %+v", end)
+		}
+	}
+}
+
+func TestPostPromptStreamHandlerStop(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/conversations")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	router := setupRouter()
+	client := &mockA2AClient{chunks: []string{"Hello", ", ", "world"}, delay: 100 * time.Millisecond}
+	sessionManager, _ = session.NewManager(executableDir, client, stats.New())
+	sessionManager.CreateSession("test-session", "")
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/conversations/test-session/prompt/stream"
+
+	header := http.Header{}
+	header.Set("Authorization", "Basic dGVzdDp0ZXN0")
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("could not open websocket: %v", err)
+	}
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("test prompt")); err != nil {
+		t.Fatalf("could not send message over websocket: %v", err)
+	}
+
+	var event session.DeltaEvent
+	for event.Type != session.DeltaTypeDelta {
+		if err := ws.ReadJSON(&event); err != nil {
+			t.Fatalf("could not read message from websocket: %v", err)
+		}
+	}
+	if err := ws.WriteJSON(map[string]string{"action": "stop"}); err != nil {
+		t.Fatalf("could not send stop over websocket: %v", err)
+	}
+	for event.Type == session.DeltaTypeDelta || event.Type == session.DeltaTypeStats {
+		if err := ws.ReadJSON(&event); err != nil {
+			t.Fatalf("could not read message from websocket: %v", err)
+		}
+	}
+	if event.Type != session.DeltaTypeDone {
+		t.Errorf("expected done event after stop, got: %+v", event)
+	}
+
+	s, _ := sessionManager.AcquireSession("test-session")
+	if len(s.History) != 2 || s.History[1] == (session.Turn{Role: session.RoleAssistant, Text: "Hello, world"}) {
+		t.Errorf("expected partial response in history, got: %v", s.History)
+	}
+}
+
+// sseEvent is a server-sent event read by readSSE.
+type sseEvent struct {
+	id    int
+	delta session.DeltaEvent
+}
+
+// readSSE reads server-sent events until the stream ends or stop returns
+// true for one.
+func readSSE(t *testing.T, body io.Reader, stop func(sseEvent) bool) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var ev sseEvent
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			ev.id, _ = strconv.Atoi(strings.TrimPrefix(line, "id: "))
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.delta); err != nil {
+				t.Fatalf("invalid event data %q: %v", line, err)
+			}
+		case line == "":
+			events = append(events, ev)
+			if stop(ev) {
+				return events
+			}
+			ev = sseEvent{}
+		}
+	}
+	return events
+}
+
+func TestPromptEventsResume(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/conversations")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	router := setupRouter()
+	client := &mockA2AClient{chunks: []string{"Hello", ", ", "world"}, delay: 50 * time.Millisecond}
+	sessionManager, _ = session.NewManager(executableDir, client, stats.New())
+	sessionManager.CreateSession("test-session", "")
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	eventsURL := server.URL + "/api/v1/conversations/test-session/prompt/events"
+	get := func(query, lastEventID string) *http.Response {
+		req, _ := http.NewRequest("GET", eventsURL+query, nil)
+		req.SetBasicAuth("test", "test")
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp
+	}
+
+	// Drop the connection after the first delta.
+	resp := get("?prompt=test+prompt", "")
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %d %q", resp.StatusCode, ct)
+	}
+	first := readSSE(t, resp.Body, func(ev sseEvent) bool { return ev.delta.Type == session.DeltaTypeDelta })
+	resp.Body.Close()
+	last := first[len(first)-1]
+	if last.delta.Text != "Hello" || last.id != len(first) {
+		t.Fatalf("expected events numbered from 1 up to the first delta, got %+v", first)
+	}
+
+	// Reconnecting resumes right after it, without the prompt.
+	resp = get("", strconv.Itoa(last.id))
+	rest := readSSE(t, resp.Body, func(sseEvent) bool { return false })
+	resp.Body.Close()
+	var text strings.Builder
+	for i, ev := range rest {
+		if ev.id != last.id+1+i {
+			t.Fatalf("expected monotonic ids after %d, got %+v", last.id, rest)
+		}
+		text.WriteString(ev.delta.Text)
+	}
+	if text.String() != ", world" || rest[len(rest)-1].delta.Type != session.DeltaTypeDone {
+		t.Errorf("expected the rest of the response and a done event, got %+v", rest)
+	}
+
+	// Nothing is left after the last event.
+	resp = get("", strconv.Itoa(rest[len(rest)-1].id))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected 204 once the stream is over, got %d", resp.StatusCode)
+	}
+	resp = get("", "x")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid Last-Event-ID, got %d", resp.StatusCode)
+	}
+
+	s, _ := sessionManager.AcquireSession("test-session")
+	if len(s.History) != 2 || s.History[1].Text != "Hello, world" {
+		t.Errorf("expected the full response in history, got: %v", s.History)
+	}
+}
+
+// slowConn is a WebSocket client that takes delay to accept each write,
+// failing writes that overrun the write deadline.
+type slowConn struct {
+	delay    time.Duration
+	mu       sync.Mutex
+	deadline time.Time
+	written  []interface{}
+}
+
+func (c *slowConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *slowConn) WriteJSON(v interface{}) error {
+	time.Sleep(c.delay)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.deadline.IsZero() && time.Now().After(c.deadline) {
+		return errors.New("i/o timeout")
+	}
+	c.written = append(c.written, v)
+	return nil
+}
+
+func TestStreamWriterSlowClient(t *testing.T) {
+	saved := streamBuffer
+	defer func() { streamBuffer = saved }()
+
+	// Dropping: the producer never waits for the client, and events that
+	// must arrive still do.
+	streamBuffer.size, streamBuffer.drop, streamBuffer.writeTimeout = 2, true, time.Second
+	conn := &slowConn{delay: 20 * time.Millisecond}
+	writer := newStreamWriter(conn, func() {})
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		writer.send(i, true)
+	}
+	writer.send("done", false)
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("expected the producer not to wait for a slow client, took %v", elapsed)
+	}
+	if err := writer.close(); err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+	if writer.dropped == 0 || len(conn.written)+writer.dropped != 51 {
+		t.Errorf("expected some of the 51 events to be dropped, wrote %d and dropped %d", len(conn.written), writer.dropped)
+	}
+	if last := conn.written[len(conn.written)-1]; last != "done" {
+		t.Errorf("expected the final event to be written last, got %v", last)
+	}
+
+	// Back-pressure: a stuck client fails on the write deadline, which
+	// cancels the stream and unblocks the producer.
+	streamBuffer.size, streamBuffer.drop, streamBuffer.writeTimeout = 1, false, 50*time.Millisecond
+	conn = &slowConn{delay: 200 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writer = newStreamWriter(conn, cancel)
+	sent := 0
+	for i := 0; i < 10 && writer.send(i, true); i++ {
+		sent++
+	}
+	if sent == 10 {
+		t.Error("expected send to fail once the client got stuck")
+	}
+	if ctx.Err() == nil {
+		t.Error("expected the stream to be cancelled")
+	}
+	if err := writer.close(); err == nil {
+		t.Error("expected close to report the write error")
+	}
+}
+
+func TestReloadSchedulerHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/tasks")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	os.WriteFile(filepath.Join(testDir, "new_task.toml"), []byte(`name = "new_task"
+schedule = "0 0 * * *"
+data_command = "echo hello"
+prompt = "Data: {{.Input}}"`), 0644)
+	router := setupRouter()
+
+	req, err := http.NewRequest("POST", "/api/v1/scheduler/reload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("test", "test")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	expected := `{"added":["new_task"],"removed":[],"updated":[],"errors":{}}`
+	if strings.TrimSpace(rr.Body.String()) != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+}
+
+func TestWebSocketTokenAuth(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	os.Setenv("GEMINI_SRV_WS_TOKEN", "secret")
+	defer os.Unsetenv("GEMINI_SRV_WS_TOKEN")
+	executableDir, _ = os.Getwd()
+	router := setupRouter()
+
+	testDir := filepath.Join(executableDir, "data/conversations")
+	os.RemoveAll(testDir)
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	sessionManager.CreateSession("test-session", "")
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/conversations/test-session/prompt/stream"
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL+"?token=secret", nil)
+	if err != nil {
+		t.Fatalf("could not open websocket with query token: %v", err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("test prompt")); err != nil {
+		t.Fatalf("could not send message over websocket: %v", err)
+	}
+	var event session.DeltaEvent
+	if err := ws.ReadJSON(&event); err != nil || event.Type != session.DeltaTypeStart {
+		t.Errorf("expected a start event, got %+v, %v", event, err)
+	}
+	ws.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"token", "secret"}}
+	ws, resp, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("could not open websocket with subprotocol token: %v", err)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != "token" {
+		t.Errorf("expected the token subprotocol to be selected, got %q", got)
+	}
+	ws.Close()
+
+	_, resp, err = websocket.DefaultDialer.Dial(wsURL+"?token=wrong", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a wrong token to be rejected with 401, got %v", err)
+	}
+
+	// The token is only accepted for WebSocket handshakes.
+	req, _ := http.NewRequest("GET", "/api/v1/conversations?token=secret", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected plain requests with a token to be rejected, got %v", rr.Code)
+	}
+
+	// Nor for other routes, whatever upgrade headers the client sends.
+	req, _ = http.NewRequest("DELETE", "/api/v1/conversations/test-session?token=secret", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected a spoofed upgrade with a token to be rejected, got %v", rr.Code)
+	}
+	if _, err := sessionManager.AcquireSession("test-session"); err != nil {
+		t.Errorf("expected the conversation to survive, got %v", err)
+	}
+}
+
+func TestWebSocketCheckOrigin(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	router := setupRouter()
+
+	testDir := filepath.Join(executableDir, "data/conversations")
+	os.RemoveAll(testDir)
+	sessionManager, _ = session.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	sessionManager.CreateSession("test-session", "")
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+	defer func() { allowedOrigins = nil }()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/conversations/test-session/prompt/stream"
+	for _, c := range []struct {
+		allowed []string
+		origin  string
+		ok      bool
+	}{
+		{nil, server.URL, true},
+		{nil, "http://evil.example", false},
+		{nil, "", true},
+		{[]string{"http://app.example"}, "http://app.example", true},
+		{[]string{"http://app.example"}, "http://evil.example", false},
+		{[]string{"http://app.example"}, server.URL, false},
+	} {
+		allowedOrigins = c.allowed
+		header := http.Header{}
+		header.Set("Authorization", "Basic dGVzdDp0ZXN0")
+		if c.origin != "" {
+			header.Set("Origin", c.origin)
+		}
+		ws, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if c.ok {
+			if err != nil {
+				t.Errorf("origin %q with allow-list %v: expected upgrade, got %v", c.origin, c.allowed, err)
+				continue
+			}
+			ws.Close()
+		} else if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("origin %q with allow-list %v: expected 403, got %v", c.origin, c.allowed, err)
+			if ws != nil {
+				ws.Close()
+			}
+		}
+	}
+}
+
+func TestNewA2AClientAuthHeader(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"kind":"message","messageId":"m1","role":"agent","parts":[{"kind":"text","text":"hi"}]}}`))
+	}))
+	defer server.Close()
+
+	os.Setenv("A2A_AUTH_TOKEN", "secret")
+	defer os.Unsetenv("A2A_AUTH_TOKEN")
+	c, err := newA2AClient(server.URL)
+	if err != nil {
+		t.Fatalf("newA2AClient failed: %v", err)
+	}
+	text := protocol.NewTextPart("hello")
+	params := protocol.SendMessageParams{Message: protocol.NewMessage(protocol.MessageRoleUser, []protocol.Part{&text})}
+	if _, err := c.SendMessage(context.Background(), params); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if got != "Bearer secret" {
+		t.Errorf("expected a bearer token on the a2a request, got %q", got)
+	}
+}
+
+func TestSearchTaskOutputsHandler(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/task_outputs/search-task")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	defer os.RemoveAll(testDir)
+	os.WriteFile(filepath.Join(testDir, "20240502T120000_abcdef12.json"),
+		[]byte(`{"id":"abcdef12","task":"search-task","status":"success","started_at":"2024-05-02T12:00:00Z","response":"before\nneedle found\nafter"}`), 0644)
+	os.WriteFile(filepath.Join(testDir, "20240503T120000_running1.json"),
+		[]byte(`{"id":"running1","task":"search-task","status":"running","started_at":"2024-05-03T12:00:00Z","response":"needle in progress"}`), 0644)
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	router := setupRouter()
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/api/v1/tasks/search-task/logs/search", http.StatusBadRequest},
+		{"/api/v1/tasks/search-task/logs/search?q=needle&context=11", http.StatusBadRequest},
+		{"/api/v1/tasks/search-task/logs/search?q=needle&limit=0", http.StatusBadRequest},
+		{"/api/v1/tasks/missing-task/logs/search?q=needle", http.StatusNotFound},
+		{"/api/v1/tasks/search-task/logs/search?q=NEEDLE&context=1", http.StatusOK},
+		{"/api/v1/task-outputs/search?q=needle&context=1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.path, nil)
+		req.SetBasicAuth("test", "test")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("%s: got status %v want %v: %s", tt.path, rr.Code, tt.status, rr.Body.String())
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var result struct {
+			Matches   []scheduler.SearchMatch `json:"matches"`
+			Truncated bool                    `json:"truncated"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+			t.Fatalf("could not decode response: %v", err)
+		}
+		var found *scheduler.SearchMatch
+		for i, m := range result.Matches {
+			if m.Task == "search-task" {
+				if found != nil {
+					t.Errorf("%s: expected one match in search-task, got %s", tt.path, rr.Body.String())
+				}
+				found = &result.Matches[i]
+			}
+		}
+		if found == nil || found.RunID != "abcdef12" || found.Line != 2 || found.Text != "needle found" ||
+			!reflect.DeepEqual(found.Before, []string{"before"}) || !reflect.DeepEqual(found.After, []string{"after"}) {
+			t.Errorf("%s: unexpected matches: %s", tt.path, rr.Body.String())
+		}
+	}
+}
+
+func TestRunningTasksHandlers(t *testing.T) {
+	os.Setenv("GEMINI_SRV_USER", "test")
+	os.Setenv("GEMINI_SRV_PASS", "test")
+	executableDir, _ = os.Getwd()
+	testDir := filepath.Join(executableDir, "data/tasks")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "slow-task.toml"), []byte("name = \"slow-task\"\ndata_command = \"sleep 30\"\nprompt = \"{{.Input}}\"\n"), 0644)
+	outDir := filepath.Join(executableDir, "data/task_outputs/slow-task")
+	os.RemoveAll(outDir)
+	defer os.RemoveAll(outDir)
+	schedulerManager, _ = scheduler.NewManager(executableDir, &mockA2AClient{}, stats.New())
+	router := setupRouter()
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		req.SetBasicAuth("test", "test")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do("POST", "/api/v1/scheduler/running/missing/cancel"); rr.Code != http.StatusNotFound {
+		t.Errorf("cancelling an unknown run: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	runID, err := schedulerManager.RunNow("slow-task")
+	if err != nil {
+		t.Fatalf("RunNow failed: %v", err)
+	}
+	var running []scheduler.ActiveRun
+	for deadline := time.Now().Add(5 * time.Second); len(running) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		rr := do("GET", "/api/v1/scheduler/running")
+		if err := json.Unmarshal(rr.Body.Bytes(), &running); err != nil {
+			t.Fatalf("could not decode running tasks: %v: %s", err, rr.Body.String())
+		}
 	}
-}
\ No newline at end of file
+	if len(running) != 1 || running[0].RunID != runID || running[0].Task != "slow-task" || running[0].Phase != scheduler.PhaseDataCommand {
+		t.Fatalf("unexpected running tasks: %+v", running)
+	}
+
+	if rr := do("GET", "/api/v1/scheduler/running/"+runID+"/cancel"); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET cancel: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+	if rr := do("POST", "/api/v1/scheduler/running/"+runID+"/cancel"); rr.Code != http.StatusAccepted {
+		t.Errorf("cancel: got %v want %v: %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(running) != 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		running = schedulerManager.ActiveRuns()
+	}
+	if len(running) != 0 {
+		t.Errorf("expected the run to stop, got %+v", running)
+	}
+	run, err := schedulerManager.Run("slow-task", runID)
+	if err != nil || run.Status != scheduler.RunStatusCancelled {
+		t.Errorf("expected a cancelled run, got %+v, %v", run, err)
+	}
+}
@@ -0,0 +1,107 @@
+package session
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// responseCache is a size-bounded LRU cache of a2a-server responses keyed by
+// backend and prompt. Each a2a-server runs a single model and system prompt,
+// so the two identify a response.
+type responseCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key      string
+	response string
+	expires  time.Time
+}
+
+func newResponseCache(size int, ttl time.Duration) *responseCache {
+	return &responseCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func cacheKey(backend, prompt string) string {
+	sum := sha256.Sum256([]byte(backend + "\x00" + prompt))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the backend's cached response to prompt, if there is a fresh
+// one.
+func (c *responseCache) get(backend, prompt string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[cacheKey(backend, prompt)]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, entry.key)
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	return entry.response, true
+}
+
+// put stores the backend's response to prompt, evicting the least recently
+// used entry when the cache is full.
+func (c *responseCache) put(backend, prompt, response string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey(backend, prompt)
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+	for c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, response: response, expires: time.Now().Add(c.ttl)})
+}
+
+type cacheContextKey struct{}
+
+// WithCache marks a prompt request as allowed to use the response cache.
+func WithCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheContextKey{}, true)
+}
+
+// useCache reports whether the response cache applies to a request.
+func (m *Manager) useCache(ctx context.Context) bool {
+	if m.cache == nil {
+		return false
+	}
+	enabled, _ := ctx.Value(cacheContextKey{}).(bool)
+	return enabled || m.cacheAll
+}
+
+// cachedResponse looks the prompt up in the response cache of the session's
+// backend, if the request may use it, and counts hits in the stats.
+func (m *Manager) cachedResponse(ctx context.Context, s *Session, prompt string) (string, bool) {
+	if !m.useCache(ctx) {
+		return "", false
+	}
+	response, ok := m.cache.get(s.Backend, prompt)
+	if ok {
+		m.stats.RecordCacheHit()
+	}
+	return response, ok
+}
@@ -0,0 +1,105 @@
+package session
+
+import (
+	"context"
+	"sync"
+)
+
+// NumberedEvent is a DeltaEvent with its position in an EventStream,
+// starting at 1.
+type NumberedEvent struct {
+	ID int
+	DeltaEvent
+}
+
+// EventStream keeps the delta events of a streamed response, so that a
+// client that lost its connection can resume after the last event it
+// received instead of sending the prompt again.
+type EventStream struct {
+	mu     sync.Mutex
+	events []DeltaEvent
+	done   bool
+	// wake is closed and replaced whenever an event is added or the stream
+	// ends.
+	wake chan struct{}
+}
+
+// StartEventStream runs the prompt through StreamDeltas in the background,
+// keeping its events as the session's EventStream in place of the previous
+// one. The response is received until it is complete or ctx is done, whether
+// or not a client follows it.
+func (m *Manager) StartEventStream(ctx context.Context, s *Session, prompt string) *EventStream {
+	es := &EventStream{wake: make(chan struct{})}
+	m.mu.Lock()
+	m.eventStreams[s.ID] = es
+	m.mu.Unlock()
+
+	deltaChan := make(chan DeltaEvent)
+	go m.StreamDeltas(ctx, s, prompt, deltaChan)
+	go func() {
+		for delta := range deltaChan {
+			es.add(delta)
+		}
+		es.finish()
+	}()
+	return es
+}
+
+// EventStream returns the session's latest EventStream, or nil if it has
+// none.
+func (m *Manager) EventStream(sessionID string) *EventStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.eventStreams[sessionID]
+}
+
+func (es *EventStream) add(delta DeltaEvent) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.events = append(es.events, delta)
+	close(es.wake)
+	es.wake = make(chan struct{})
+}
+
+func (es *EventStream) finish() {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.done = true
+	close(es.wake)
+}
+
+// Over reports whether the stream ended with no events after the one
+// numbered after.
+func (es *EventStream) Over(after int) bool {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.done && after >= len(es.events)
+}
+
+// Follow passes the events numbered after after to send, in order, waiting
+// for new ones until the stream ends. It returns early with ctx's error if
+// ctx is done, or with send's if it fails.
+func (es *EventStream) Follow(ctx context.Context, after int, send func(NumberedEvent) error) error {
+	next := after + 1
+	for {
+		es.mu.Lock()
+		pending := es.events[min(next-1, len(es.events)):]
+		done, wake := es.done, es.wake
+		es.mu.Unlock()
+
+		for _, delta := range pending {
+			if err := send(NumberedEvent{ID: next, DeltaEvent: delta}); err != nil {
+				return err
+			}
+			next++
+		}
+		if done {
+			return nil
+		}
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package session
+
+import (
+	"context"
+	"strings"
+)
+
+// Post-processors a prompt request can pick with WithExtract.
+const (
+	// ExtractJSON keeps the first code block fenced as json, or with no
+	// language, of the response.
+	ExtractJSON = "json"
+	// ExtractCode keeps the first code block of the response, whatever its
+	// language.
+	ExtractCode = "code"
+)
+
+// ValidExtract reports whether mode names a post-processor.
+func ValidExtract(mode string) bool {
+	return mode == ExtractJSON || mode == ExtractCode
+}
+
+type extractContextKey struct{}
+
+// WithExtract makes RunPrompt return and store only a code block of the
+// response, as picked by mode. The full response is kept in the history
+// turn's Raw. Responses without a matching block are left as they are.
+func WithExtract(ctx context.Context, mode string) context.Context {
+	return context.WithValue(ctx, extractContextKey{}, mode)
+}
+
+// extractMode returns the post-processor the request asked for, if any.
+func extractMode(ctx context.Context) string {
+	mode, _ := ctx.Value(extractContextKey{}).(string)
+	return mode
+}
+
+// extractBlock returns the contents of the first fenced code block in
+// response that mode accepts. A block cut off before its closing fence runs
+// to the end of the response.
+func extractBlock(response, mode string) (string, bool) {
+	lines := strings.Split(response, "\n")
+	for i := 0; i < len(lines); i++ {
+		fence, lang, ok := openingFence(lines[i])
+		if !ok {
+			continue
+		}
+		end := i + 1
+		for end < len(lines) && strings.TrimSpace(lines[end]) != fence {
+			end++
+		}
+		if mode == ExtractJSON && lang != "" && lang != "json" {
+			i = end
+			continue
+		}
+		return strings.Join(lines[i+1:end], "\n"), true
+	}
+	return "", false
+}
+
+// openingFence parses a line opening a fenced code block, such as
+// "```json", and returns its fence and lowercased language.
+func openingFence(line string) (fence, lang string, ok bool) {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		return "", "", false
+	}
+	n := len(trimmed) - len(strings.TrimLeft(trimmed, "`"))
+	if n < 3 {
+		return "", "", false
+	}
+	info := strings.Fields(trimmed[n:])
+	if len(info) > 0 {
+		lang = strings.ToLower(info[0])
+	}
+	return trimmed[:n], lang, true
+}
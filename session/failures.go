@@ -0,0 +1,155 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Default retention of the failure log.
+const (
+	defaultMaxFailures = 1000
+	defaultFailureTTL  = 7 * 24 * time.Hour
+)
+
+// maxFailurePrompt is the longest prompt, in bytes, kept in a failure record.
+const maxFailurePrompt = 16 << 10
+
+// Failure records an a2a-server call that failed, for later review.
+type Failure struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	SessionID string    `json:"session_id"`
+	Backend   string    `json:"backend,omitempty"`
+	// Call is "prompt" for RunPrompt and "stream" for RunPromptStream.
+	Call   string `json:"call"`
+	Prompt string `json:"prompt"`
+	Error  string `json:"error"`
+}
+
+// failureLog keeps one JSON file per failure under dir, dropping the oldest
+// beyond max records and those older than ttl.
+type failureLog struct {
+	mu  sync.Mutex
+	dir string
+	max int           // 0 disables the log
+	ttl time.Duration // 0 keeps records until max is reached
+}
+
+// recordFailure adds a failed call to the failure log. Errors writing it are
+// only logged, so they never mask the failure itself.
+func (m *Manager) recordFailure(s *Session, call, prompt string, callErr error) {
+	f := m.failures
+	if f == nil || f.max <= 0 {
+		return
+	}
+	now := time.Now()
+	if len(prompt) > maxFailurePrompt {
+		cut := maxFailurePrompt
+		for cut > 0 && !utf8.RuneStart(prompt[cut]) {
+			cut--
+		}
+		prompt = prompt[:cut] + fmt.Sprintf(" [%d bytes truncated]", len(prompt)-cut)
+	}
+	rec := Failure{
+		ID:        fmt.Sprintf("%019d-%s", now.UnixNano(), uuid.New().String()[:8]),
+		Time:      now,
+		SessionID: s.ID,
+		Backend:   s.Backend,
+		Call:      call,
+		Prompt:    prompt,
+		Error:     callErr.Error(),
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		fmt.Printf("Error encoding failure record: %v\n", err)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := os.WriteFile(filepath.Join(f.dir, rec.ID+".json"), data, 0644); err != nil {
+		fmt.Printf("Error writing failure record: %v\n", err)
+		return
+	}
+	f.prune(now)
+}
+
+// ids returns the IDs of the stored records, oldest first. f.mu must be held.
+func (f *failureLog) ids() ([]string, error) {
+	files, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, file := range files {
+		if id, ok := strings.CutSuffix(file.Name(), ".json"); ok && !file.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// prune removes records beyond the retention limits. f.mu must be held.
+func (f *failureLog) prune(now time.Time) {
+	ids, err := f.ids()
+	if err != nil {
+		fmt.Printf("Error reading failures directory: %v\n", err)
+		return
+	}
+	for i, id := range ids {
+		expired := false
+		if f.ttl > 0 {
+			ns, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+			expired = err == nil && now.Sub(time.Unix(0, ns)) > f.ttl
+		}
+		if len(ids)-i <= f.max && !expired {
+			break
+		}
+		if err := os.Remove(filepath.Join(f.dir, id+".json")); err != nil {
+			fmt.Printf("Error removing failure record %s: %v\n", id, err)
+		}
+	}
+}
+
+// Failures returns up to limit of the most recent failed a2a-server calls,
+// newest first. A limit of 0 or less returns all of them.
+func (m *Manager) Failures(limit int) ([]Failure, error) {
+	failures := make([]Failure, 0)
+	f := m.failures
+	if f == nil {
+		return failures, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids, err := f.ids()
+	if err != nil {
+		return nil, fmt.Errorf("could not read failures directory: %w", err)
+	}
+	for i := len(ids) - 1; i >= 0 && (limit <= 0 || len(failures) < limit); i-- {
+		data, err := os.ReadFile(filepath.Join(f.dir, ids[i]+".json"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		var rec Failure
+		if err == nil {
+			err = json.Unmarshal(data, &rec)
+		}
+		if err != nil {
+			fmt.Printf("Warning: skipping failure record %s: %v\n", ids[i], err)
+			continue
+		}
+		failures = append(failures, rec)
+	}
+	return failures, nil
+}
@@ -0,0 +1,99 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+// ErrInvalidImport is returned when an imported conversation is malformed.
+var ErrInvalidImport = errors.New("invalid conversation")
+
+// ImportSession recreates a previously exported conversation, upgrading it
+// from an older format if needed. The original ID is kept when it is free,
+// otherwise the conversation gets a new one.
+func (m *Manager) ImportSession(data []byte) (*Session, error) {
+	var imported struct {
+		ID               string   `json:"id"`
+		Name             string   `json:"name"`
+		History          *[]Turn  `json:"history"`
+		WorkingDirectory string   `json:"working_directory"`
+		UserLabel        string   `json:"user_label"`
+		AssistantLabel   string   `json:"assistant_label"`
+		Backend          string   `json:"backend"`
+		Tags             []string `json:"tags"`
+		Pinned           bool     `json:"pinned"`
+	}
+	data, _, err := migrate(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	if err := json.Unmarshal(data, &imported); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	if imported.History == nil {
+		return nil, fmt.Errorf("%w: missing history", ErrInvalidImport)
+	}
+	if _, err := m.client(&Session{Backend: imported.Backend}); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	for i, turn := range *imported.History {
+		if turn.Role != RoleUser && turn.Role != RoleAssistant {
+			return nil, fmt.Errorf("%w: history entry %d is neither a user nor an assistant turn", ErrInvalidImport, i)
+		}
+	}
+
+	if imported.WorkingDirectory != "" {
+		if err := m.checkSandbox(imported.WorkingDirectory); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+		}
+	}
+
+	tags, err := normalizeTags(imported.Tags)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := imported.ID
+	if !ValidID(id) || m.exists(id) {
+		id = uuid.New().String()
+	}
+	name := imported.Name
+	if name == "" {
+		name = DefaultName
+	}
+	session := &Session{
+		ID:               id,
+		Name:             name,
+		History:          *imported.History,
+		WorkingDirectory: imported.WorkingDirectory,
+		UserLabel:        imported.UserLabel,
+		AssistantLabel:   imported.AssistantLabel,
+		Backend:          imported.Backend,
+		Tags:             tags,
+		Pinned:           imported.Pinned,
+	}
+	if err := session.save(m.files); err != nil {
+		return nil, err
+	}
+	m.sessions[id] = session
+	return session, nil
+}
+
+// exists reports whether a conversation with the given ID is loaded or
+// stored on disk. m.mu must be held.
+func (m *Manager) exists(id string) bool {
+	if _, ok := m.sessions[id]; ok {
+		return true
+	}
+	_, err := os.Stat(m.files.path(id))
+	return err == nil
+}
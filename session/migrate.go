@@ -0,0 +1,90 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// formatVersion is the version of the session file format written by save.
+// Files of older versions are upgraded by the migrations when loaded.
+const formatVersion = 1
+
+// ErrUnsupportedVersion is returned for session files written by a newer
+// version of the server.
+var ErrUnsupportedVersion = errors.New("unsupported session file version")
+
+// migration upgrades a session document from one format version to the next.
+type migration func(doc map[string]json.RawMessage) error
+
+// migrations[v] upgrades a version v document to version v+1. Append to it,
+// and bump formatVersion, to change the format.
+var migrations = []migration{
+	migrateStringHistory,
+}
+
+// migrate upgrades a session document to formatVersion. It reports whether
+// anything changed.
+func migrate(data []byte) ([]byte, bool, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, false, err
+	}
+	version := 0
+	if raw, ok := doc["version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, false, fmt.Errorf("invalid version: %w", err)
+		}
+	}
+	if version == formatVersion {
+		return data, false, nil
+	}
+	if version < 0 || version > formatVersion {
+		return nil, false, fmt.Errorf("%w %d", ErrUnsupportedVersion, version)
+	}
+	for v := version; v < formatVersion; v++ {
+		if err := migrations[v](doc); err != nil {
+			return nil, false, fmt.Errorf("could not upgrade from version %d: %w", v, err)
+		}
+	}
+	doc["version"], _ = json.Marshal(formatVersion)
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// migrateStringHistory turns the "Label: text" strings of a version 0 history
+// into turns, using the session's labels to tell the roles apart.
+func migrateStringHistory(doc map[string]json.RawMessage) error {
+	raw, ok := doc["history"]
+	if !ok || string(raw) == "null" {
+		return nil
+	}
+	var lines []string
+	if err := json.Unmarshal(raw, &lines); err != nil {
+		return fmt.Errorf("history must be a list of strings: %w", err)
+	}
+	userLabel, assistantLabel := DefaultUserLabel, DefaultAssistantLabel
+	for key, label := range map[string]*string{"user_label": &userLabel, "assistant_label": &assistantLabel} {
+		var s string
+		if v, ok := doc[key]; ok && json.Unmarshal(v, &s) == nil && s != "" {
+			*label = s
+		}
+	}
+	turns := make([]Turn, 0, len(lines))
+	for i, line := range lines {
+		if text, ok := strings.CutPrefix(line, userLabel+": "); ok {
+			turns = append(turns, Turn{Role: RoleUser, Text: text})
+		} else if text, ok := strings.CutPrefix(line, assistantLabel+": "); ok {
+			turns = append(turns, Turn{Role: RoleAssistant, Text: text})
+		} else {
+			return fmt.Errorf("history entry %d is neither a user nor an assistant turn", i)
+		}
+	}
+	var err error
+	doc["history"], err = json.Marshal(turns)
+	return err
+}
@@ -0,0 +1,156 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"trpc.group/trpc-go/trpc-a2a-go/protocol"
+)
+
+// DefaultName is the name of a conversation until it is named after its
+// prompts.
+const DefaultName = "New Conversation"
+
+// namingPrompt asks the a2a-server for the title of a conversation starting
+// with the prompts appended to it.
+const namingPrompt = "Reply with only a short title, at most six words, for a conversation that starts like this:\n\n"
+
+// maxNamingPromptLength caps the part of the prompts sent to be named, in
+// bytes.
+const maxNamingPromptLength = 2000
+
+// namingPrompts returns the user prompts to name a session after if adding
+// prompt to its history makes it due for a name: it still has DefaultName and
+// prompt is at least its m.namingTurns-th user turn. The prompts are those in
+// its history followed by prompt.
+func (m *Manager) namingPrompts(s *Session, prompt string) ([]string, bool) {
+	if s.Name != DefaultName {
+		return nil, false
+	}
+	var prompts []string
+	for _, turn := range s.History {
+		if turn.Role == RoleUser {
+			prompts = append(prompts, turn.Text)
+		}
+	}
+	prompts = append(prompts, prompt)
+	if len(prompts) < m.namingTurns {
+		return nil, false
+	}
+	return prompts, true
+}
+
+// nameFromPrompts names a conversation after the first words of its longest
+// prompt, the likeliest to say what it is about.
+func nameFromPrompts(prompts []string) string {
+	longest := ""
+	for _, prompt := range prompts {
+		if len(strings.TrimSpace(prompt)) > len(strings.TrimSpace(longest)) {
+			longest = prompt
+		}
+	}
+	return generateNameFromPrompt(longest)
+}
+
+// defaultNamingTimeout bounds the naming call when the Manager has no prompt
+// timeout.
+const defaultNamingTimeout = time.Minute
+
+// suggestName asks the a2a-server, in the background, to name a session
+// that got the placeholder name from its prompts. The name replaces the
+// placeholder unless the session was renamed in the meantime. It does
+// nothing unless the Manager was created WithLLMNaming.
+func (m *Manager) suggestName(s *Session, prompts []string, placeholder string) {
+	if !m.llmNaming {
+		return
+	}
+	go func() {
+		name, err := m.requestName(s, strings.Join(prompts, "\n\n"))
+		if err != nil {
+			fmt.Printf("Could not generate a name for session %s: %v\n", s.ID, err)
+			return
+		}
+		// Take a turn in the session's prompt queue, so the name isn't
+		// changed and saved while a prompt updates the session.
+		release, _ := m.enqueue(context.Background(), s)
+		defer release()
+		m.mu.Lock()
+		if s.Name != placeholder {
+			m.mu.Unlock()
+			return
+		}
+		s.Name = name
+		m.mu.Unlock()
+		if err := m.persist(s); err != nil {
+			fmt.Printf("Could not save the generated name of session %s: %v\n", s.ID, err)
+		}
+	}()
+}
+
+// requestName asks the session's a2a-server for a title for a conversation
+// starting with the given text. The request gets a context of its own, so it doesn't
+// become part of the conversation.
+func (m *Manager) requestName(s *Session, prompt string) (string, error) {
+	client, err := m.client(s)
+	if err != nil {
+		return "", err
+	}
+	timeout := m.promptTimeout
+	if timeout <= 0 {
+		timeout = defaultNamingTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	release, err := m.acquire()
+	if err != nil {
+		return "", err
+	}
+	if len(prompt) > maxNamingPromptLength {
+		prompt = prompt[:maxNamingPromptLength]
+	}
+	request := namingPrompt + prompt
+	contextID := uuid.New().String()
+	startTime := time.Now()
+	response, err := client.SendMessage(ctx, protocol.SendMessageParams{
+		Message: protocol.Message{
+			ContextID: &contextID,
+			Parts:     []protocol.Part{protocol.NewTextPart(request)},
+		},
+	})
+	latency := time.Since(startTime)
+	release()
+	if err != nil {
+		return "", err
+	}
+	var text string
+	if msg, ok := response.Result.(*protocol.Message); ok {
+		text = extractTextFromMessage(msg)
+	}
+	m.stats.RecordCall(latency, len(request), len(text))
+	name := cleanName(text)
+	if name == "" {
+		return "", errors.New("empty title")
+	}
+	return name, nil
+}
+
+// cleanName turns a suggested title into a conversation name: its first
+// non-empty line, without quotes or markdown emphasis, cut to the length of
+// names made from prompts.
+func cleanName(title string) string {
+	for _, line := range strings.Split(title, "\n") {
+		line = strings.Trim(strings.TrimSpace(line), "\"'`*#_“”‘’ ")
+		if line == "" {
+			continue
+		}
+		if len(line) > 50 {
+			line = strings.TrimSpace(line[:50])
+		}
+		return line
+	}
+	return ""
+}
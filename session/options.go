@@ -0,0 +1,177 @@
+package session
+
+import (
+	"os"
+	"time"
+)
+
+// Option configures optional Manager behaviour.
+type Option func(*Manager)
+
+// WithMaxConcurrent caps the number of a2a-server calls in flight at once.
+// When the cap is reached, calls wait for a free slot, or fail with ErrBusy
+// if reject is set. A max of 0 or less leaves calls unlimited.
+func WithMaxConcurrent(max int, reject bool) Option {
+	return func(m *Manager) {
+		if max > 0 {
+			m.slots = make(chan struct{}, max)
+			m.rejectWhenBusy = reject
+		}
+	}
+}
+
+// WithRetryOnEmpty makes RunPrompt retry once when the a2a-server replies
+// without any text, before giving up with ErrEmptyResponse.
+func WithRetryOnEmpty(retry bool) Option {
+	return func(m *Manager) {
+		m.retryOnEmpty = retry
+	}
+}
+
+// WithMaxHistory caps the number of history entries kept per conversation.
+// Once reached, new prompts fail with ErrHistoryFull, or the oldest entries
+// are dropped if autoCompact is set. A max of 0 or less leaves it unlimited.
+func WithMaxHistory(max int, autoCompact bool) Option {
+	return func(m *Manager) {
+		m.maxHistory = max
+		m.autoCompact = autoCompact
+	}
+}
+
+// WithMaxResponseSize caps the bytes of a response kept in the history and
+// returned to the caller. Longer responses are cut off with a marker. A max
+// of 0 or less leaves responses unlimited.
+func WithMaxResponseSize(max int) Option {
+	return func(m *Manager) {
+		m.maxResponseSize = max
+	}
+}
+
+// WithPromptTimeout bounds how long RunPrompt waits for the a2a-server before
+// failing with ErrTimeout. A timeout of 0 or less waits indefinitely.
+func WithPromptTimeout(d time.Duration) Option {
+	return func(m *Manager) {
+		m.promptTimeout = d
+	}
+}
+
+// WithFailureRetention bounds the log of failed a2a-server calls kept under
+// data/failures to the newest max records, none older than ttl. A max of 0
+// disables the log and a ttl of 0 keeps records until max is reached.
+func WithFailureRetention(max int, ttl time.Duration) Option {
+	return func(m *Manager) {
+		if max >= 0 {
+			m.failures.max = max
+		}
+		if ttl >= 0 {
+			m.failures.ttl = ttl
+		}
+	}
+}
+
+// WithSaveRetry sets how many times a failed session save is retried and the
+// delay before the first retry, which doubles on each further attempt.
+func WithSaveRetry(retries int, backoff time.Duration) Option {
+	return func(m *Manager) {
+		if retries >= 0 {
+			m.saveRetries = retries
+		}
+		if backoff > 0 {
+			m.saveBackoff = backoff
+		}
+	}
+}
+
+// WithResponseCache keeps up to size responses for ttl and answers repeated
+// prompts from it. Only requests made with WithCache use the cache, unless
+// all is set. A size of 0 or less disables the cache.
+func WithResponseCache(size int, ttl time.Duration, all bool) Option {
+	return func(m *Manager) {
+		if size > 0 && ttl > 0 {
+			m.cache = newResponseCache(size, ttl)
+			m.cacheAll = all
+		}
+	}
+}
+
+// WithDefaultWorkingDir sets the working directory used for conversations
+// created without one. NewManager fails if dir is not an existing directory.
+func WithDefaultWorkingDir(dir string) Option {
+	return func(m *Manager) {
+		m.defaultWorkDir = dir
+	}
+}
+
+// WithSandboxRoot confines the working directories of conversations to root:
+// after resolving symlinks, they must be root or a directory below it. New
+// conversations, working directory changes and imports are checked, and
+// NewManager fails if root is not an existing directory. An empty root
+// leaves working directories unrestricted.
+func WithSandboxRoot(root string) Option {
+	return func(m *Manager) {
+		m.sandboxRoot = root
+	}
+}
+
+// WithSessionFiles sets how session files are stored: with shard set, each
+// in a subdirectory named after the first two characters of its ID, which
+// keeps directories small with many conversations. Files in the other
+// layout are moved over by NewManager. mode sets the permissions of the
+// files, and of shard directories, where it also allows searching whatever
+// it allows reading; 0 keeps the default of 0644.
+func WithSessionFiles(shard bool, mode os.FileMode) Option {
+	return func(m *Manager) {
+		m.files.shard = shard
+		if mode != 0 {
+			m.files.mode = mode
+		}
+	}
+}
+
+// WithLLMNaming has the a2a-server suggest a title for each conversation
+// once it is due for a name, see WithNamingAfter. The conversation is named
+// after the first words of its longest prompt right away, so the response
+// isn't delayed, and renamed once the title arrives, unless it was renamed
+// in the meantime.
+func WithLLMNaming(enabled bool) Option {
+	return func(m *Manager) {
+		m.llmNaming = enabled
+	}
+}
+
+// WithNamingAfter defers naming conversations until they have the given
+// number of user turns, so a trivial first prompt such as "hi" doesn't name
+// them. Until then they keep DefaultName. The name is taken from all their
+// prompts so far. Values below 1 name them after their first prompt.
+func WithNamingAfter(turns int) Option {
+	return func(m *Manager) {
+		m.namingTurns = max(turns, 1)
+	}
+}
+
+// WithStreamReconnects sets how many times RunPromptStream resumes a stream
+// that was cut off before the response was complete. 0 disables resuming.
+func WithStreamReconnects(n int) Option {
+	return func(m *Manager) {
+		if n >= 0 {
+			m.streamReconnects = n
+		}
+	}
+}
+
+// WithHistoryLabels sets the labels of user and assistant turns in the
+// history of new conversations. Empty labels keep the defaults.
+func WithHistoryLabels(user, assistant string) Option {
+	return func(m *Manager) {
+		m.userLabel = user
+		m.assistantLabel = assistant
+	}
+}
+
+// WithBackends adds named a2a-server clients sessions can select with
+// WithBackend. Sessions without a backend use the Manager's default client.
+func WithBackends(clients map[string]A2AClient) Option {
+	return func(m *Manager) {
+		m.backends = clients
+	}
+}
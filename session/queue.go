@@ -0,0 +1,74 @@
+package session
+
+import "context"
+
+// promptQueue orders the prompts of one session: each waits for the ones
+// submitted before it to finish.
+type promptQueue struct {
+	// turns holds a channel per prompt not yet finished, in submission
+	// order. The first one's channel is closed: it is running.
+	turns []chan struct{}
+}
+
+// enqueue waits until the prompts submitted to s before this one finished,
+// so prompts of a session run one at a time in submission order while other
+// sessions' run concurrently. The returned func lets the next prompt run. It
+// returns ctx's error if ctx is done first.
+func (m *Manager) enqueue(ctx context.Context, s *Session) (func(), error) {
+	turn := make(chan struct{})
+	m.mu.Lock()
+	q, ok := m.queues[s.ID]
+	if !ok {
+		q = &promptQueue{}
+		m.queues[s.ID] = q
+	}
+	q.turns = append(q.turns, turn)
+	if len(q.turns) == 1 {
+		close(turn)
+	}
+	m.mu.Unlock()
+
+	release := func() { m.dequeue(s.ID, turn) }
+	select {
+	case <-turn:
+		return release, nil
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+// dequeue removes turn from the session's queue, letting the next prompt run
+// if turn was running.
+func (m *Manager) dequeue(id string, turn chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q, ok := m.queues[id]
+	if !ok {
+		return
+	}
+	for i, t := range q.turns {
+		if t != turn {
+			continue
+		}
+		q.turns = append(q.turns[:i], q.turns[i+1:]...)
+		if i == 0 && len(q.turns) > 0 {
+			close(q.turns[0])
+		}
+		break
+	}
+	if len(q.turns) == 0 {
+		delete(m.queues, id)
+	}
+}
+
+// QueueDepth returns the number of prompts of the session that are running or
+// waiting for their turn.
+func (m *Manager) QueueDepth(id string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if q, ok := m.queues[id]; ok {
+		return len(q.turns)
+	}
+	return 0
+}
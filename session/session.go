@@ -3,65 +3,294 @@ package session
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
+	"gemini-srv/internal/sandbox"
 	"gemini-srv/internal/stats"
+	"gemini-srv/internal/tracing"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
-	"trpc.group/trpc-go/trpc-a2a-go/client"
 	"trpc.group/trpc-go/trpc-a2a-go/protocol"
 )
 
+// A2AClient is the subset of the a2a client used by the Manager.
+type A2AClient interface {
+	SendMessage(ctx context.Context, params protocol.SendMessageParams) (*protocol.MessageResult, error)
+	StreamMessage(ctx context.Context, params protocol.SendMessageParams) (<-chan protocol.StreamingMessageEvent, error)
+	GetTasks(ctx context.Context, params protocol.TaskQueryParams) (*protocol.Task, error)
+	ResubscribeTask(ctx context.Context, params protocol.TaskIDParams) (<-chan protocol.StreamingMessageEvent, error)
+}
+
+// ErrBusy is returned when the concurrency limit is reached and the Manager
+// is configured to reject calls instead of queueing them.
+var ErrBusy = errors.New("too many concurrent a2a-server requests")
+
+// ErrHistoryFull is returned when a conversation reached the maximum history
+// length and auto-compaction is disabled.
+var ErrHistoryFull = errors.New("conversation history is full; compact it or start a new conversation")
+
+// ErrInvalidID is returned for conversation IDs that can't safely be used as
+// file names.
+var ErrInvalidID = errors.New("invalid conversation id")
+
+// ValidID reports whether id is safe to use as a file name: UUIDs and other
+// non-empty strings of letters, digits, '-' and '_'.
+func ValidID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrStreamInterrupted is returned when a streamed response was cut off and
+// could not be resumed.
+var ErrStreamInterrupted = errors.New("a2a-server stream interrupted")
+
+// ErrUnknownBackend is returned for a session naming a backend the Manager
+// was not configured with.
+var ErrUnknownBackend = errors.New("unknown backend")
+
+// ErrInvalidWorkingDirectory is returned when a session's working directory
+// is set to something other than an existing directory.
+var ErrInvalidWorkingDirectory = errors.New("working directory is not an existing directory")
+
+// ErrOutsideSandbox is returned for a working directory that doesn't resolve
+// to a directory within the Manager's sandbox root.
+var ErrOutsideSandbox = errors.New("working directory is outside the sandbox root")
+
+// ErrTimeout is returned when the a2a-server doesn't answer a prompt within
+// the Manager's prompt timeout.
+var ErrTimeout = errors.New("a2a-server did not respond in time")
+
+// ErrEmptyResponse is returned when the a2a-server answers without any text.
+var ErrEmptyResponse = errors.New("empty response from a2a-server")
+
 // Session represents a single user's conversational history.
 type Session struct {
 	ID               string    `json:"id"`
-	a2aTaskID        string    `json:"task_id"`
-	a2aContextID     string    `json:"context_id"`
 	Name             string    `json:"name"`
-	History          []string  `json:"history"`
+	History          []Turn    `json:"history"`
 	LastAccess       time.Time `json:"last_access"`
 	WorkingDirectory string    `json:"working_directory"`
 	ContextID        string    `json:"context_id"`
 	TaskID           string    `json:"task_id"`
+	// UserLabel and AssistantLabel name the user and assistant turns in
+	// History when shown. Empty means DefaultUserLabel and
+	// DefaultAssistantLabel.
+	UserLabel      string `json:"user_label,omitempty"`
+	AssistantLabel string `json:"assistant_label,omitempty"`
+	// Backend names the a2a-server the session talks to. Empty means the
+	// default one.
+	Backend string `json:"backend,omitempty"`
+	// Tags organize sessions; see SetTags.
+	Tags []string `json:"tags,omitempty"`
+	// Pinned sessions are listed first.
+	Pinned bool `json:"pinned,omitempty"`
+	// Version is the format version of the session file; see migrate.
+	Version int `json:"version"`
+}
+
+// Default labels of the turns in a session's history.
+const (
+	DefaultUserLabel      = "User"
+	DefaultAssistantLabel = "Gemini"
+)
+
+// Roles of the turns in a session's history.
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// Turn is one entry of a session's history.
+type Turn struct {
+	Role string `json:"role"`
+	Text string `json:"text"`
+	// Raw is the full response of an assistant turn whose Text was
+	// extracted from it with WithExtract.
+	Raw string `json:"raw,omitempty"`
+}
+
+// metadata returns the message metadata pointing the a2a-server's agent at
+// the session's working directory, or nil if it has none.
+func (s *Session) metadata() map[string]interface{} {
+	if s.WorkingDirectory == "" {
+		return nil
+	}
+	return map[string]interface{}{
+		"coderAgent": map[string]interface{}{
+			"kind":          "agent-settings",
+			"workspacePath": s.WorkingDirectory,
+		},
+	}
+}
+
+// SessionOption configures a session created by CreateSession.
+type SessionOption func(*Session)
+
+// WithLabels overrides the Manager's history labels for a new session. Empty
+// labels keep the Manager's.
+func WithLabels(user, assistant string) SessionOption {
+	return func(s *Session) {
+		if user != "" {
+			s.UserLabel = user
+		}
+		if assistant != "" {
+			s.AssistantLabel = assistant
+		}
+	}
 }
 
 // Manager handles all active sessions.
 type Manager struct {
 	sessions        map[string]*Session
 	mu              sync.Mutex
-	sessionDataPath string
-	a2aClient       *client.A2AClient
+	files           sessionFiles
+	a2aClient       A2AClient
+	backends        map[string]A2AClient // backend name -> client, besides the default
 	stats           *stats.Stats
+	pendingTasks    map[string]string // a2a task ID -> session ID
+	slots           chan struct{}
+	rejectWhenBusy  bool
+	retryOnEmpty    bool
+	maxHistory      int
+	maxResponseSize int // bytes, 0 for unlimited
+	autoCompact     bool
+	store           store
+	saveRetries     int
+	saveBackoff     time.Duration
+	cache           *responseCache
+	cacheAll        bool
+	defaultWorkDir  string
+	// llmNaming has the a2a-server name conversations after their first
+	// prompts.
+	llmNaming bool
+	// namingTurns is the number of user turns after which a conversation
+	// is named.
+	namingTurns int
+	// sandboxRoot confines working directories, "" for no restriction.
+	sandboxRoot string
+	// streamReconnects is how many times an interrupted stream is resumed.
+	streamReconnects int
+	// statsInterval is the minimum time between stats events in StreamDeltas.
+	statsInterval  time.Duration
+	userLabel      string
+	assistantLabel string
+	// promptTimeout bounds RunPrompt's a2a-server calls, 0 for no limit.
+	promptTimeout time.Duration
+	failures      *failureLog
+	// queues orders the prompts of each session with prompts in flight.
+	queues map[string]*promptQueue
+	// eventStreams holds each session's latest resumable stream.
+	eventStreams map[string]*EventStream
 }
 
 // NewManager creates a new session manager.
-func NewManager(baseDir string, client *client.A2AClient, stats *stats.Stats) (*Manager, error) {
+func NewManager(baseDir string, client A2AClient, stats *stats.Stats, opts ...Option) (*Manager, error) {
 	fmt.Println("Creating new session manager...")
 	dataPath := filepath.Join(baseDir, "data/conversations")
 	if err := os.MkdirAll(dataPath, 0755); err != nil {
 		return nil, fmt.Errorf("could not create session data directory: %w", err)
 	}
+	failuresPath := filepath.Join(baseDir, "data/failures")
+	if err := os.MkdirAll(failuresPath, 0755); err != nil {
+		return nil, fmt.Errorf("could not create failures directory: %w", err)
+	}
 	m := &Manager{
-		sessions:        make(map[string]*Session),
-		sessionDataPath: dataPath,
-		a2aClient:       client,
-		stats:           stats,
+		sessions:         make(map[string]*Session),
+		files:            sessionFiles{dir: dataPath, mode: defaultSessionFileMode},
+		a2aClient:        client,
+		stats:            stats,
+		pendingTasks:     make(map[string]string),
+		queues:           make(map[string]*promptQueue),
+		eventStreams:     make(map[string]*EventStream),
+		saveRetries:      2,
+		saveBackoff:      100 * time.Millisecond,
+		streamReconnects: 3,
+		statsInterval:    time.Second,
+		namingTurns:      1,
+		failures:         &failureLog{dir: failuresPath, max: defaultMaxFailures, ttl: defaultFailureTTL},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.store = fileStore{files: m.files}
+	if err := m.files.migrate(); err != nil {
+		return nil, fmt.Errorf("could not migrate session files: %w", err)
+	}
+	if m.sandboxRoot != "" {
+		if err := sandbox.CheckRoot(m.sandboxRoot); err != nil {
+			return nil, err
+		}
+	}
+	if m.defaultWorkDir != "" {
+		if info, err := os.Stat(m.defaultWorkDir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("default working directory %q is not an existing directory", m.defaultWorkDir)
+		}
+		if err := m.checkSandbox(m.defaultWorkDir); err != nil {
+			return nil, fmt.Errorf("default working directory: %w", err)
+		}
 	}
 	return m, nil
 }
 
-// save persists the session state to a JSON file.
-func (s *Session) save(dataPath string) error {
+// checkSandbox returns ErrOutsideSandbox unless dir resolves to a directory
+// within the sandbox root.
+func (m *Manager) checkSandbox(dir string) error {
+	if err := sandbox.Check(m.sandboxRoot, dir); err != nil {
+		return fmt.Errorf("%w: %q", ErrOutsideSandbox, dir)
+	}
+	return nil
+}
+
+// acquire reserves a slot for an a2a-server call. The returned func releases it.
+func (m *Manager) acquire() (func(), error) {
+	if m.slots != nil {
+		if m.rejectWhenBusy {
+			select {
+			case m.slots <- struct{}{}:
+			default:
+				return nil, ErrBusy
+			}
+		} else {
+			m.slots <- struct{}{}
+		}
+	}
+	m.stats.CallStarted()
+	return func() {
+		m.stats.CallFinished()
+		if m.slots != nil {
+			<-m.slots
+		}
+	}, nil
+}
+
+// save persists the session state to its JSON file.
+func (s *Session) save(files sessionFiles) error {
+	if !ValidID(s.ID) {
+		return ErrInvalidID
+	}
+	s.Version = formatVersion
 	s.LastAccess = time.Now()
-	path := filepath.Join(dataPath, s.ID+".json")
-	file, err := os.Create(path)
+	file, err := files.create(s.ID)
 	if err != nil {
 		return fmt.Errorf("could not create session file: %w", err)
 	}
@@ -71,18 +300,30 @@ func (s *Session) save(dataPath string) error {
 	return encoder.Encode(s)
 }
 
-// load retrieves a session from a JSON file.
+// load retrieves a session from a JSON file. Files in an older format are
+// upgraded and saved again.
 func (m *Manager) load(sessionID string) (*Session, error) {
-	path := filepath.Join(m.sessionDataPath, sessionID+".json")
-	file, err := os.Open(path)
+	if !ValidID(sessionID) {
+		return nil, ErrInvalidID
+	}
+	data, err := os.ReadFile(m.files.path(sessionID))
 	if err != nil {
 		return nil, fmt.Errorf("could not open session file: %w", err)
 	}
-	defer file.Close()
+	data, migrated, err := migrate(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode session file: %w", err)
+	}
 	var s Session
-	if err := json.NewDecoder(file).Decode(&s); err != nil {
+	if err := json.Unmarshal(data, &s); err != nil {
 		return nil, fmt.Errorf("could not decode session file: %w", err)
 	}
+	if migrated {
+		fmt.Printf("Upgraded session %s to format version %d\n", sessionID, formatVersion)
+		if err := s.save(m.files); err != nil {
+			return nil, err
+		}
+	}
 	return &s, nil
 }
 
@@ -102,26 +343,192 @@ func (m *Manager) AcquireSession(sessionID string) (*Session, error) {
 	return session, nil
 }
 
-// CreateSession creates a new session and saves it.
-func (m *Manager) CreateSession(sessionID, workingDir string) (*Session, error) {
+// WithBackend makes a new session talk to the named backend instead of the
+// default one.
+func WithBackend(name string) SessionOption {
+	return func(s *Session) {
+		s.Backend = name
+	}
+}
+
+// client returns the a2a-server client of the session's backend.
+func (m *Manager) client(s *Session) (A2AClient, error) {
+	if s.Backend == "" {
+		return m.a2aClient, nil
+	}
+	c, ok := m.backends[s.Backend]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownBackend, s.Backend)
+	}
+	return c, nil
+}
+
+// CreateSession creates a new session and saves it. An empty workingDir falls
+// back to the Manager's default working directory.
+func (m *Manager) CreateSession(sessionID, workingDir string, opts ...SessionOption) (*Session, error) {
+	if !ValidID(sessionID) {
+		return nil, ErrInvalidID
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if workingDir == "" {
+		workingDir = m.defaultWorkDir
+	} else if err := m.checkSandbox(workingDir); err != nil {
+		return nil, err
+	}
 	session := &Session{
 		ID:               sessionID,
-		Name:             "New Conversation",
-		History:          make([]string, 0),
+		Name:             DefaultName,
+		History:          make([]Turn, 0),
 		LastAccess:       time.Now(),
 		WorkingDirectory: workingDir,
+		UserLabel:        m.userLabel,
+		AssistantLabel:   m.assistantLabel,
+	}
+	for _, opt := range opts {
+		opt(session)
+	}
+	if _, err := m.client(session); err != nil {
+		return nil, err
 	}
-	if err := session.save(m.sessionDataPath); err != nil {
+	if err := session.save(m.files); err != nil {
 		return nil, err
 	}
 	m.sessions[sessionID] = session
 	return session, nil
 }
 
-// RunPrompt sends a prompt to the a2a-server.
-func (m *Manager) RunPrompt(s *Session, prompt string) (string, error) {
+// checkHistory makes room for one more exchange in the session history. When
+// the history is full it either drops the oldest entries, if auto-compaction
+// is enabled, or returns ErrHistoryFull.
+func (m *Manager) checkHistory(s *Session) error {
+	if m.maxHistory <= 0 || len(s.History)+2 <= m.maxHistory {
+		return nil
+	}
+	if !m.autoCompact {
+		return ErrHistoryFull
+	}
+	// Keep whole exchanges so the history still starts with a user turn.
+	drop := len(s.History) + 2 - m.maxHistory
+	drop += drop % 2
+	if drop > len(s.History) {
+		drop = len(s.History)
+	}
+	fmt.Printf("Compacting session %s: dropping %d oldest history entries\n", s.ID, drop)
+	s.History = append([]Turn(nil), s.History[drop:]...)
+	return nil
+}
+
+// RunPrompt sends a prompt to the a2a-server. Prompts of a session run one
+// at a time, in the order they were submitted.
+func (m *Manager) RunPrompt(ctx context.Context, s *Session, prompt string) (string, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "session.RunPrompt",
+		trace.WithAttributes(attribute.String("session.id", s.ID)))
+	defer span.End()
+
+	release, err := m.enqueue(ctx, s)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	if err := m.checkHistory(s); err != nil {
+		return "", err
+	}
+	if _, err := m.client(s); err != nil {
+		return "", err
+	}
+	if m.promptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.promptTimeout)
+		defer cancel()
+	}
+	responseText, cached := m.cachedResponse(ctx, s, prompt)
+	if !cached {
+		responseText, err = m.sendPrompt(ctx, s, prompt)
+	}
+	if errors.Is(err, ErrBusy) {
+		return "", err
+	}
+	if err == nil && responseText == "" && m.retryOnEmpty {
+		fmt.Printf("Empty response for session %s, retrying once\n", s.ID)
+		responseText, err = m.sendPrompt(ctx, s, prompt)
+		if errors.Is(err, ErrBusy) {
+			return "", err
+		}
+	}
+	if err != nil {
+		m.recordFailure(s, "prompt", prompt, err)
+	}
+	if isTimeout(err) {
+		// Nothing to store; the caller can try again.
+		fmt.Printf("Prompt for session %s timed out: %v\n", s.ID, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	if err == nil && responseText == "" {
+		// Don't store a blank assistant turn; the caller can try again.
+		m.recordFailure(s, "prompt", prompt, ErrEmptyResponse)
+		return "", ErrEmptyResponse
+	}
+	responseText = m.limitResponse(s, responseText)
+	if err == nil && !cached && m.useCache(ctx) {
+		m.cache.put(s.Backend, prompt, responseText)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	reply := Turn{Role: RoleAssistant, Text: responseText}
+	if mode := extractMode(ctx); mode != "" {
+		if block, ok := extractBlock(responseText, mode); ok {
+			reply.Text, reply.Raw = block, responseText
+			responseText = block
+		}
+	}
+
+	if prompts, ok := m.namingPrompts(s, prompt); ok {
+		s.Name = nameFromPrompts(prompts)
+		defer m.suggestName(s, prompts, s.Name)
+	}
+
+	s.History = append(s.History, Turn{Role: RoleUser, Text: prompt})
+	s.History = append(s.History, reply)
+
+	if saveErr := m.persist(s); saveErr != nil {
+		return responseText, errors.Join(err, saveErr)
+	}
+
+	return responseText, err
+}
+
+// isTimeout reports whether err comes from a deadline running out, either
+// the context's or the HTTP client's.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr interface{ Timeout() bool }
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// PromptTimeout returns how long RunPrompt waits for the a2a-server, or 0 if
+// it waits indefinitely.
+func (m *Manager) PromptTimeout() time.Duration {
+	return m.promptTimeout
+}
+
+// sendPrompt makes a single blocking call to the a2a-server and returns the
+// text of the reply.
+func (m *Manager) sendPrompt(ctx context.Context, s *Session, prompt string) (string, error) {
+	client, err := m.client(s)
+	if err != nil {
+		return "", err
+	}
+	release, err := m.acquire()
+	if err != nil {
+		return "", err
+	}
 	startTime := time.Now()
 	params := protocol.SendMessageParams{
 		Message: protocol.Message{
@@ -129,40 +536,49 @@ func (m *Manager) RunPrompt(s *Session, prompt string) (string, error) {
 			Parts: []protocol.Part{
 				protocol.NewTextPart(prompt),
 			},
+			Metadata: s.metadata(),
 		},
 	}
-	response, err := m.a2aClient.SendMessage(context.Background(), params)
+	response, err := client.SendMessage(ctx, params)
 	latency := time.Since(startTime)
+	release()
 
 	var responseText string
 	if response != nil {
 		if msg, ok := response.Result.(*protocol.Message); ok {
-			for _, part := range msg.Parts {
-				if textPart, ok := part.(protocol.TextPart); ok {
-					responseText += textPart.Text
-				}
-			}
+			responseText = extractTextFromMessage(msg)
 		}
 	}
 
 	m.stats.RecordCall(latency, len(prompt), len(responseText))
-
-	if len(s.History) == 0 {
-		s.Name = generateNameFromPrompt(prompt)
-	}
-
-	s.History = append(s.History, "User: "+prompt)
-	s.History = append(s.History, "Gemini: "+responseText)
-
-	if saveErr := s.save(m.sessionDataPath); saveErr != nil {
-		return responseText, fmt.Errorf("original error: %v, failed to save session: %w", err, saveErr)
-	}
-
 	return responseText, err
 }
 
 // RunPromptAsTask sends a prompt to the a2a-server and creates a new task.
-func (m *Manager) RunPromptAsTask(s *Session, prompt string) (string, error) {
+// Like RunPrompt, it waits for the prompts submitted to the session before
+// it, and gives up on the a2a-server after the prompt timeout.
+func (m *Manager) RunPromptAsTask(ctx context.Context, s *Session, prompt string) (string, error) {
+	dequeue, err := m.enqueue(ctx, s)
+	if err != nil {
+		return "", err
+	}
+	defer dequeue()
+	if err := m.checkHistory(s); err != nil {
+		return "", err
+	}
+	client, err := m.client(s)
+	if err != nil {
+		return "", err
+	}
+	if m.promptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.promptTimeout)
+		defer cancel()
+	}
+	release, err := m.acquire()
+	if err != nil {
+		return "", err
+	}
 	startTime := time.Now()
 	params := protocol.SendMessageParams{
 		Message: protocol.Message{
@@ -170,13 +586,20 @@ func (m *Manager) RunPromptAsTask(s *Session, prompt string) (string, error) {
 			Parts: []protocol.Part{
 				protocol.NewTextPart(prompt),
 			},
+			Metadata: s.metadata(),
 		},
 		Configuration: &protocol.SendMessageConfiguration{
 			AcceptedOutputModes: []string{"task"},
 		},
 	}
-	response, err := m.a2aClient.SendMessage(context.Background(), params)
+	response, err := client.SendMessage(ctx, params)
 	latency := time.Since(startTime)
+	release()
+	if isTimeout(err) {
+		// Nothing to store; the caller can try again.
+		fmt.Printf("Prompt for session %s timed out: %v\n", s.ID, err)
+		return "", fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
 
 	var taskID string
 	if response != nil {
@@ -187,20 +610,42 @@ func (m *Manager) RunPromptAsTask(s *Session, prompt string) (string, error) {
 
 	m.stats.RecordCall(latency, len(prompt), 0)
 
-	if len(s.History) == 0 {
-		s.Name = generateNameFromPrompt(prompt)
+	if prompts, ok := m.namingPrompts(s, prompt); ok {
+		s.Name = nameFromPrompts(prompts)
+		defer m.suggestName(s, prompts, s.Name)
 	}
 
-	s.History = append(s.History, "User: "+prompt)
-	s.History = append(s.History, "Gemini: (task "+taskID+")")
+	s.History = append(s.History, Turn{Role: RoleUser, Text: prompt})
+	s.History = append(s.History, taskPlaceholder(taskID))
+	if taskID != "" {
+		m.mu.Lock()
+		m.pendingTasks[taskID] = s.ID
+		m.mu.Unlock()
+	}
 
-	if saveErr := s.save(m.sessionDataPath); saveErr != nil {
-		return taskID, fmt.Errorf("original error: %v, failed to save session: %w", err, saveErr)
+	if saveErr := m.persist(s); saveErr != nil {
+		return taskID, errors.Join(err, saveErr)
 	}
 
 	return taskID, err
 }
 
+// truncatedMarker is appended to responses cut off at the maximum size.
+const truncatedMarker = "\n\n[response truncated]"
+
+// limitResponse cuts text down to the Manager's maximum response size.
+func (m *Manager) limitResponse(s *Session, text string) string {
+	if m.maxResponseSize <= 0 || len(text) <= m.maxResponseSize {
+		return text
+	}
+	log.Printf("Warning: response of %d bytes in session %s exceeds the maximum of %d bytes, truncating\n", len(text), s.ID, m.maxResponseSize)
+	cut := m.maxResponseSize
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + truncatedMarker
+}
+
 func extractTextFromMessage(msg *protocol.Message) string {
 	var text strings.Builder
 	for _, part := range msg.Parts {
@@ -211,8 +656,42 @@ func extractTextFromMessage(msg *protocol.Message) string {
 	return text.String()
 }
 
+// eventText returns the response text carried by a streaming event, if any.
+func eventText(event protocol.StreamingMessageEvent) string {
+	switch result := event.Result.(type) {
+	case *protocol.Message:
+		return extractTextFromMessage(result)
+	case *protocol.TaskStatusUpdateEvent:
+		// Gemini-CLI seems to respond on status updates...
+		if result.Status.Message != nil && result.Status.Message.Kind == protocol.KindMessage {
+			return extractTextFromMessage(result.Status.Message)
+		}
+	}
+	return ""
+}
+
 // RunPromptStream sends a prompt to the a2a-server and streams the response.
-func (m *Manager) RunPromptStream(s *Session, prompt string, eventChan chan<- protocol.StreamingMessageEvent) error {
+// Cancelling ctx stops the stream early; the partial response received so far
+// is still recorded in the history. Like RunPrompt, it waits for the prompts
+// submitted to the session before it to finish.
+func (m *Manager) RunPromptStream(ctx context.Context, s *Session, prompt string, eventChan chan<- protocol.StreamingMessageEvent) error {
+	dequeue, err := m.enqueue(ctx, s)
+	if err != nil {
+		return err
+	}
+	defer dequeue()
+	if err := m.checkHistory(s); err != nil {
+		return err
+	}
+	client, err := m.client(s)
+	if err != nil {
+		return err
+	}
+	release, err := m.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
 	startTime := time.Now()
 	var responseText strings.Builder
 
@@ -224,100 +703,356 @@ func (m *Manager) RunPromptStream(s *Session, prompt string, eventChan chan<- pr
 			Parts: []protocol.Part{
 				protocol.NewTextPart(prompt),
 			},
+			Metadata: s.metadata(),
 		},
 	}
 
-	internalChan, err := m.a2aClient.StreamMessage(context.Background(), params)
+	internalChan, err := client.StreamMessage(ctx, params)
 	if err != nil {
+		m.recordFailure(s, "stream", prompt, err)
 		return err
 	}
+	if started := streamStart(ctx); started != nil {
+		started()
+	}
+
+	// A stream that closes before the task finished was interrupted; resume
+	// it from the captured task ID, skipping messages already relayed.
+	seen := make(map[string]bool)
+	for attempt := 0; ; attempt++ {
+		if m.relayStream(ctx, s, internalChan, eventChan, &responseText, seen) || ctx.Err() != nil || s.TaskID == "" {
+			break
+		}
+		if attempt >= m.streamReconnects {
+			err = ErrStreamInterrupted
+			break
+		}
+		log.Printf("Stream for session %s interrupted, resuming task %s (attempt %d)\n", s.ID, s.TaskID, attempt+1)
+		internalChan, err = client.ResubscribeTask(ctx, protocol.TaskIDParams{ID: s.TaskID})
+		if err != nil {
+			err = fmt.Errorf("%w: %v", ErrStreamInterrupted, err)
+			break
+		}
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
+	if err != nil {
+		m.recordFailure(s, "stream", prompt, err)
+	}
 
-	go func() {
-		defer wg.Done()
-		for event := range internalChan {
-			// Process the received event
-			switch event.Result.GetKind() {
-			case protocol.KindMessage:
-				msg := event.Result.(*protocol.Message)
-				text := extractTextFromMessage(msg)
-				log.Printf("Received Message - MessageID: %s\n", msg.MessageID)
-				log.Printf("  Message Text: %s\n", text)
-				responseText.WriteString(text)
+	latency := time.Since(startTime)
+	m.stats.RecordCall(latency, len(prompt), responseText.Len())
+	m.stats.RecordThroughput(responseText.Len(), latency)
+	response := m.limitResponse(s, responseText.String())
+
+	if prompts, ok := m.namingPrompts(s, prompt); ok {
+		s.Name = nameFromPrompts(prompts)
+		defer m.suggestName(s, prompts, s.Name)
+	}
+
+	s.History = append(s.History, Turn{Role: RoleUser, Text: prompt})
+	s.History = append(s.History, Turn{Role: RoleAssistant, Text: response})
+
+	if saveErr := m.persist(s); saveErr != nil {
+		return errors.Join(err, saveErr)
+	}
+
+	return err
+}
+
+// relayStream records the events of one a2a-server stream in the session and
+// passes them on to eventChan until the stream closes or ctx is cancelled.
+// Text of messages in seen is not appended again. It reports whether the
+// stream reached the end of the response. Once responseText exceeds the
+// maximum response size, further text is only relayed.
+func (m *Manager) relayStream(ctx context.Context, s *Session, internalChan <-chan protocol.StreamingMessageEvent, eventChan chan<- protocol.StreamingMessageEvent, responseText *strings.Builder, seen map[string]bool) bool {
+	appendText := func(msg *protocol.Message) {
+		if seen[msg.MessageID] {
+			return
+		}
+		seen[msg.MessageID] = true
+		text := extractTextFromMessage(msg)
+		log.Printf("  Message Text: %s\n", text)
+		if m.maxResponseSize > 0 && responseText.Len() > m.maxResponseSize {
+			return
+		}
+		responseText.WriteString(text)
+	}
+
+	finished := false
+	for event := range internalChan {
+		if ctx.Err() != nil {
+			log.Println("Stream stopped by the client")
+			break
+		}
+		// Process the received event
+		switch event.Result.GetKind() {
+		case protocol.KindMessage:
+			msg := event.Result.(*protocol.Message)
+			log.Printf("Received Message - MessageID: %s\n", msg.MessageID)
+			appendText(msg)
+			if msg.ContextID != nil {
 				s.ContextID = *msg.ContextID
+			}
+			if msg.TaskID != nil {
 				s.TaskID = *msg.TaskID
-			case protocol.KindTaskArtifactUpdate:
-				artifact := event.Result.(*protocol.TaskArtifactUpdateEvent)
-				log.Printf("Received Artifact Update - TaskID: %s, ArtifactID: %s\n", artifact.TaskID, artifact.Artifact.ArtifactID)
-				for _, part := range artifact.Artifact.Parts {
-					if textPart, ok := part.(*protocol.TextPart); ok {
-						log.Printf("  Artifact Text (Reversed Text): %s\n", textPart.Text)
-					}
+			}
+			finished = true
+		case protocol.KindTaskArtifactUpdate:
+			artifact := event.Result.(*protocol.TaskArtifactUpdateEvent)
+			log.Printf("Received Artifact Update - TaskID: %s, ArtifactID: %s\n", artifact.TaskID, artifact.Artifact.ArtifactID)
+			for _, part := range artifact.Artifact.Parts {
+				if textPart, ok := part.(*protocol.TextPart); ok {
+					log.Printf("  Artifact Text (Reversed Text): %s\n", textPart.Text)
 				}
+			}
 
-				// For artifact updates, we note it's the final artifact,
-				// but we don't exit yet - per A2A spec, we should wait for the final status update
-				if artifact.LastChunk != nil && *artifact.LastChunk {
-					log.Printf("Received final artifact update, waiting for final status.\n")
-				}
-				s.ContextID = artifact.ContextID
-				s.TaskID = artifact.TaskID
-			case protocol.KindTask:
-				task := event.Result.(*protocol.Task)
-				log.Printf("Received Task - TaskID: %s, State: %s\n", task.ID, task.Status.State)
-				s.ContextID = task.ContextID
-				s.TaskID = task.ID
-			case protocol.KindTaskStatusUpdate:
-				statusUpdate := event.Result.(*protocol.TaskStatusUpdateEvent)
-				log.Printf("Received Task Status Update - TaskID: %s, State: %s\n", statusUpdate.TaskID, statusUpdate.Status.State)
-				// Gemini-CLI seems to respond on status updates...
-				msg := statusUpdate.Status.Message
-				if msg != nil && msg.Kind == protocol.KindMessage {
-					text := extractTextFromMessage(msg)
-					log.Printf("  Message Text: %s\n", text)
-					responseText.WriteString(text)
-				}
-				s.ContextID = statusUpdate.ContextID
-				s.TaskID = statusUpdate.TaskID
-			default:
-				log.Printf("Received unknown event type: %T %v\n", event, event)
+			// For artifact updates, we note it's the final artifact,
+			// but we don't exit yet - per A2A spec, we should wait for the final status update
+			if artifact.LastChunk != nil && *artifact.LastChunk {
+				log.Printf("Received final artifact update, waiting for final status.\n")
 			}
-			eventChan <- event
+			s.ContextID = artifact.ContextID
+			s.TaskID = artifact.TaskID
+		case protocol.KindTask:
+			task := event.Result.(*protocol.Task)
+			log.Printf("Received Task - TaskID: %s, State: %s\n", task.ID, task.Status.State)
+			s.ContextID = task.ContextID
+			s.TaskID = task.ID
+			finished = finished || terminalState(task.Status.State)
+		case protocol.KindTaskStatusUpdate:
+			statusUpdate := event.Result.(*protocol.TaskStatusUpdateEvent)
+			log.Printf("Received Task Status Update - TaskID: %s, State: %s\n", statusUpdate.TaskID, statusUpdate.Status.State)
+			// Gemini-CLI seems to respond on status updates...
+			msg := statusUpdate.Status.Message
+			if msg != nil && msg.Kind == protocol.KindMessage {
+				appendText(msg)
+			}
+			s.ContextID = statusUpdate.ContextID
+			s.TaskID = statusUpdate.TaskID
+			finished = finished || statusUpdate.Final || terminalState(statusUpdate.Status.State)
+		default:
+			log.Printf("Received unknown event type: %T %v\n", event, event)
 		}
-		fmt.Println("a2aClient channel closed")
-	}()
+		select {
+		case eventChan <- event:
+		case <-ctx.Done():
+		}
+	}
+	fmt.Println("a2aClient channel closed")
+	return finished
+}
+
+// terminalState reports whether a task in the given state won't produce any
+// more output.
+func terminalState(state protocol.TaskState) bool {
+	switch state {
+	case protocol.TaskStateCompleted, protocol.TaskStateFailed, protocol.TaskStateCanceled, protocol.TaskStateRejected:
+		return true
+	}
+	return false
+}
 
-	wg.Wait()
+type streamStartContextKey struct{}
 
-	latency := time.Since(startTime)
-	m.stats.RecordCall(latency, len(prompt), responseText.Len())
+// WithStreamStart makes RunPromptStream call started once the a2a-server
+// accepted the prompt and opened its stream, before any event is relayed.
+func WithStreamStart(ctx context.Context, started func()) context.Context {
+	return context.WithValue(ctx, streamStartContextKey{}, started)
+}
+
+// streamStart returns the function to call when the stream opens, if any.
+func streamStart(ctx context.Context) func() {
+	started, _ := ctx.Value(streamStartContextKey{}).(func())
+	return started
+}
+
+// Delta event types emitted by StreamDeltas.
+const (
+	// DeltaTypeStart is sent as soon as the a2a-server opened the stream,
+	// before any text.
+	DeltaTypeStart = "start"
+	DeltaTypeDelta = "delta"
+	DeltaTypeDone  = "done"
+	DeltaTypeError = "error"
+	// DeltaTypeStats carries the throughput so far, see StreamStats.
+	DeltaTypeStats = "stats"
+)
+
+// DeltaEvent is a normalized streaming event carrying incremental response text,
+// independent of the A2A event kinds the backend produced.
+type DeltaEvent struct {
+	Type    string       `json:"type"`
+	Text    string       `json:"text,omitempty"`
+	Message string       `json:"message,omitempty"`
+	Stats   *StreamStats `json:"stats,omitempty"`
+}
+
+// StreamStats is the cumulative size of a streamed response and the time
+// since the prompt was sent, for clients to show the generation speed.
+type StreamStats struct {
+	Chars       int     `json:"chars"`
+	ElapsedMs   int64   `json:"elapsed_ms"`
+	CharsPerSec float64 `json:"chars_per_sec"`
+}
 
-	if len(s.History) == 0 {
-		s.Name = generateNameFromPrompt(prompt)
+func newStreamStats(chars int, elapsed time.Duration) *StreamStats {
+	st := &StreamStats{Chars: chars, ElapsedMs: elapsed.Milliseconds()}
+	if elapsed > 0 {
+		st.CharsPerSec = float64(chars) / elapsed.Seconds()
 	}
+	return st
+}
 
-	s.History = append(s.History, "User: "+prompt)
-	s.History = append(s.History, "Gemini: "+responseText.String())
+// StreamDeltas runs the prompt through RunPromptStream and relays the response
+// as delta events, starting with a start event once the stream is open and
+// finishing with a done or an error event. deltaChan is closed
+// once the stream is over. A stats event follows a delta at most every
+// statsInterval, and once more before the final event if any text arrived.
+func (m *Manager) StreamDeltas(ctx context.Context, s *Session, prompt string, deltaChan chan<- DeltaEvent) {
+	defer close(deltaChan)
 
-	if saveErr := s.save(m.sessionDataPath); saveErr != nil {
-		if err != nil {
-			return fmt.Errorf("stream error: %v, failed to save session: %w", err, saveErr)
+	eventChan := make(chan protocol.StreamingMessageEvent)
+	errChan := make(chan error, 1)
+	go func() {
+		// The start event is sent before RunPromptStream relays any event,
+		// so it precedes every delta.
+		started := WithStreamStart(ctx, func() { deltaChan <- DeltaEvent{Type: DeltaTypeStart} })
+		errChan <- m.RunPromptStream(started, s, prompt, eventChan)
+		close(eventChan)
+	}()
+
+	start := time.Now()
+	var lastStats time.Time
+	chars := 0
+	for event := range eventChan {
+		if text := eventText(event); text != "" {
+			deltaChan <- DeltaEvent{Type: DeltaTypeDelta, Text: text}
+			chars += len(text)
+			if now := time.Now(); now.Sub(lastStats) >= m.statsInterval {
+				lastStats = now
+				deltaChan <- DeltaEvent{Type: DeltaTypeStats, Stats: newStreamStats(chars, now.Sub(start))}
+			}
 		}
-		return fmt.Errorf("failed to save session: %w", saveErr)
 	}
+	if chars > 0 {
+		deltaChan <- DeltaEvent{Type: DeltaTypeStats, Stats: newStreamStats(chars, time.Since(start))}
+	}
+
+	if err := <-errChan; err != nil {
+		deltaChan <- DeltaEvent{Type: DeltaTypeError, Message: err.Error()}
+		return
+	}
+	deltaChan <- DeltaEvent{Type: DeltaTypeDone}
+}
+
+// ClearHistory empties the history of a session and resets its A2A context
+// and task IDs so the next prompt starts a fresh context. The session itself,
+// its name and working directory are kept.
+func (m *Manager) ClearHistory(sessionID string) error {
+	s, err := m.AcquireSession(sessionID)
+	if err != nil {
+		return err
+	}
+	err = m.update(s, func() {
+		s.History = make([]Turn, 0)
+		s.ContextID = ""
+		s.TaskID = ""
+	})
+	if err == nil {
+		fmt.Printf("Cleared history of session %s\n", sessionID)
+	}
+	return err
+}
+
+// update applies change to the session and saves it, in a turn of the
+// session's prompt queue so a prompt in progress can't undo the change when
+// it saves the session.
+func (m *Manager) update(s *Session, change func()) error {
+	release, err := m.enqueue(context.Background(), s)
+	if err != nil {
+		return err
+	}
+	defer release()
+	m.mu.Lock()
+	change()
+	m.mu.Unlock()
+	return m.persist(s)
+}
+
+// GetHistoryPage returns up to limit turns of a session's history, starting
+// at offset (0 is the oldest turn), and the total number of turns. A
+// negative offset counts from the end, so -limit returns the latest turns.
+func (m *Manager) GetHistoryPage(sessionID string, offset, limit int) ([]Turn, int, error) {
+	s, err := m.AcquireSession(sessionID)
+	if err != nil {
+		return nil, 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	total := len(s.History)
+	if offset < 0 {
+		offset = max(total+offset, 0)
+	}
+	start := min(offset, total)
+	end := min(start+max(limit, 0), total)
+	return append(make([]Turn, 0, end-start), s.History[start:end]...), total, nil
+}
 
+// SetWorkingDirectory points a session at a new working directory, which
+// must be an existing directory. Later prompts are sent with it.
+func (m *Manager) SetWorkingDirectory(sessionID, path string) error {
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return fmt.Errorf("%w: %q", ErrInvalidWorkingDirectory, path)
+	}
+	if err := m.checkSandbox(path); err != nil {
+		return err
+	}
+	s, err := m.AcquireSession(sessionID)
+	if err != nil {
+		return err
+	}
+	err = m.update(s, func() {
+		s.WorkingDirectory = filepath.Clean(path)
+	})
+	if err == nil {
+		fmt.Printf("Set working directory of session %s to %s\n", sessionID, path)
+	}
 	return err
 }
 
+// Rename changes the name of a session.
+func (m *Manager) Rename(sessionID, name string) error {
+	s, err := m.AcquireSession(sessionID)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	s.Name = name
+	m.mu.Unlock()
+	return m.persist(s)
+}
+
+// SetPinned pins a session to the top of ListConversations, or unpins it.
+func (m *Manager) SetPinned(sessionID string, pinned bool) error {
+	s, err := m.AcquireSession(sessionID)
+	if err != nil {
+		return err
+	}
+	return m.update(s, func() {
+		s.Pinned = pinned
+	})
+}
+
 // DeleteSession deletes the session file.
 func (m *Manager) DeleteSession(sessionID string) error {
+	if !ValidID(sessionID) {
+		return ErrInvalidID
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	delete(m.sessions, sessionID)
-	path := filepath.Join(m.sessionDataPath, sessionID+".json")
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+	delete(m.eventStreams, sessionID)
+	if err := os.Remove(m.files.path(sessionID)); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("could not delete session file: %w", err)
 	}
 	fmt.Printf("Deleted session %s\n", sessionID)
@@ -325,29 +1060,36 @@ func (m *Manager) DeleteSession(sessionID string) error {
 }
 
 type ConversationInfo struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Tags   []string `json:"tags"`
+	Pinned bool     `json:"pinned"`
 }
 
-// ListConversations returns the IDs and names of all persisted conversations.
+// ListConversations returns the IDs, names and tags of all persisted
+// conversations, pinned ones first.
 func (m *Manager) ListConversations() ([]ConversationInfo, error) {
-	files, err := os.ReadDir(m.sessionDataPath)
+	ids, err := m.files.ids()
 	if err != nil {
 		return nil, fmt.Errorf("could not read sessions directory: %w", err)
 	}
 	var conversations []ConversationInfo
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
-			sessionID := strings.TrimSuffix(file.Name(), ".json")
-			session, err := m.AcquireSession(sessionID)
-			if err != nil {
-				// Log the error and skip the conversation
-				fmt.Printf("Error loading conversation %s: %v\n", sessionID, err)
-				continue
-			}
-			conversations = append(conversations, ConversationInfo{ID: session.ID, Name: session.Name})
+	for _, sessionID := range ids {
+		session, err := m.AcquireSession(sessionID)
+		if err != nil {
+			// Log the error and skip the conversation
+			fmt.Printf("Error loading conversation %s: %v\n", sessionID, err)
+			continue
 		}
+		m.mu.Lock()
+		tags := append(make([]string, 0, len(session.Tags)), session.Tags...)
+		pinned := session.Pinned
+		m.mu.Unlock()
+		conversations = append(conversations, ConversationInfo{ID: session.ID, Name: session.Name, Tags: tags, Pinned: pinned})
 	}
+	sort.SliceStable(conversations, func(i, j int) bool {
+		return conversations[i].Pinned && !conversations[j].Pinned
+	})
 	return conversations, nil
 }
 
@@ -1,30 +1,184 @@
 package session
 
 import (
-	"gemini-srv/internal/a2aclient"
+	"context"
+	"errors"
+	"fmt"
 	"gemini-srv/internal/stats"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"trpc.group/trpc-go/trpc-a2a-go/protocol"
 )
 
-type mockA2AClient struct{}
+type mockA2AClient struct {
+	response  string // reply to SendMessage, "mock response" if empty
+	chunks    []string
+	taskState protocol.TaskState
+	delay     time.Duration
+	err       error // returned by SendMessage and StreamMessage, if set
+
+	dropAfter    int // events streamed before the connection drops, if set
+	updates      []protocol.StreamingMessageEvent
+	resubscribes int32
+
+	emptyReplies int32 // number of calls answered without any text
+	calls        int32
+	active       int32
+	maxActive    int32
+
+	mu        sync.Mutex
+	workspace string // workspacePath of the last message sent
 
-func (c *mockA2AClient) SendPrompt(prompt string) (string, error) {
-	return "mock response", nil
+	// nameReply answers naming requests, once nameGate is closed if set.
+	nameReply string
+	nameGate  chan struct{}
+	// nameRequest is the text of the last naming request.
+	nameRequest string
 }
 
-func (c *mockA2AClient) SendPromptAsTask(prompt string) (string, error) {
-	return "mock-task-id", nil
+// messageText returns the text of a message sent to the mock.
+func messageText(msg protocol.Message) string {
+	var text strings.Builder
+	for _, part := range msg.Parts {
+		switch p := part.(type) {
+		case protocol.TextPart:
+			text.WriteString(p.Text)
+		case *protocol.TextPart:
+			text.WriteString(p.Text)
+		}
+	}
+	return text.String()
 }
 
-func (c *mockA2AClient) SendPromptStream(prompt string, eventChan chan<- a2aclient.StreamEvent) error {
-	defer close(eventChan)
-	eventChan <- a2aclient.StreamEvent{Kind: "text", Text: "mock response"}
-	return nil
+// lastWorkspace returns the workspacePath the last message was sent with.
+func (c *mockA2AClient) lastWorkspace() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.workspace
+}
+
+func (c *mockA2AClient) SendMessage(ctx context.Context, params protocol.SendMessageParams) (*protocol.MessageResult, error) {
+	if text := messageText(params.Message); strings.HasPrefix(text, namingPrompt) {
+		c.mu.Lock()
+		c.nameRequest = text
+		c.mu.Unlock()
+		if c.nameGate != nil {
+			<-c.nameGate
+		}
+		text := protocol.NewTextPart(c.nameReply)
+		msg := protocol.NewMessage(protocol.MessageRoleAgent, []protocol.Part{&text})
+		return &protocol.MessageResult{Result: &msg}, nil
+	}
+	active := atomic.AddInt32(&c.active, 1)
+	defer atomic.AddInt32(&c.active, -1)
+	for {
+		max := atomic.LoadInt32(&c.maxActive)
+		if active <= max || atomic.CompareAndSwapInt32(&c.maxActive, max, active) {
+			break
+		}
+	}
+	select {
+	case <-time.After(c.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	c.mu.Lock()
+	c.workspace = ""
+	if settings, ok := params.Message.Metadata["coderAgent"].(map[string]interface{}); ok {
+		c.workspace, _ = settings["workspacePath"].(string)
+	}
+	c.mu.Unlock()
+
+	if params.Configuration != nil {
+		return &protocol.MessageResult{Result: protocol.NewTask("mock-task-id", *params.Message.ContextID)}, nil
+	}
+	if atomic.AddInt32(&c.calls, 1) <= c.emptyReplies {
+		msg := protocol.NewMessage(protocol.MessageRoleAgent, nil)
+		return &protocol.MessageResult{Result: &msg}, nil
+	}
+	reply := c.response
+	if reply == "" {
+		reply = "mock response"
+	}
+	text := protocol.NewTextPart(reply)
+	msg := protocol.NewMessage(protocol.MessageRoleAgent, []protocol.Part{&text})
+	return &protocol.MessageResult{Result: &msg}, nil
+}
+
+func (c *mockA2AClient) StreamMessage(ctx context.Context, params protocol.SendMessageParams) (<-chan protocol.StreamingMessageEvent, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	chunks := c.chunks
+	if chunks == nil {
+		chunks = []string{"mock response"}
+	}
+	c.updates = nil
+	for i, chunk := range chunks {
+		text := protocol.NewTextPart(chunk)
+		msg := protocol.NewMessage(protocol.MessageRoleAgent, []protocol.Part{&text})
+		status := protocol.TaskStatus{State: protocol.TaskStateWorking, Message: &msg}
+		update := protocol.NewTaskStatusUpdateEvent("mock-task-id", "mock-context-id", status, i == len(chunks)-1)
+		c.updates = append(c.updates, protocol.StreamingMessageEvent{Result: &update})
+	}
+	sent := c.updates
+	if c.dropAfter > 0 {
+		sent = sent[:c.dropAfter]
+	}
+	return c.send(ctx, sent), nil
+}
+
+// send streams the events, closing the channel after the last one.
+func (c *mockA2AClient) send(ctx context.Context, updates []protocol.StreamingMessageEvent) <-chan protocol.StreamingMessageEvent {
+	events := make(chan protocol.StreamingMessageEvent)
+	go func() {
+		defer close(events)
+		for _, update := range updates {
+			select {
+			case events <- update:
+			case <-ctx.Done():
+				return
+			}
+			time.Sleep(c.delay)
+		}
+	}()
+	return events
 }
 
-var _ a2aclient.A2AClient = &mockA2AClient{}
+// ResubscribeTask replays all events of the last stream, including the ones
+// already delivered before it was dropped.
+func (c *mockA2AClient) ResubscribeTask(ctx context.Context, params protocol.TaskIDParams) (<-chan protocol.StreamingMessageEvent, error) {
+	atomic.AddInt32(&c.resubscribes, 1)
+	if params.ID != "mock-task-id" {
+		return nil, fmt.Errorf("unknown task %s", params.ID)
+	}
+	return c.send(ctx, c.updates), nil
+}
+
+func (c *mockA2AClient) GetTasks(ctx context.Context, params protocol.TaskQueryParams) (*protocol.Task, error) {
+	task := protocol.NewTask(params.ID, "mock-context-id")
+	task.Status.State = c.taskState
+	if c.taskState == "" {
+		task.Status.State = protocol.TaskStateCompleted
+	}
+	text := protocol.NewTextPart("mock task output")
+	task.Artifacts = []protocol.Artifact{{ArtifactID: "mock-artifact", Parts: []protocol.Part{&text}}}
+	return task, nil
+}
+
+var _ A2AClient = &mockA2AClient{}
 
 const testDataBaseDir = "test_session_data_"
 
@@ -84,6 +238,115 @@ func TestSessionFileManagement(t *testing.T) {
 	}
 }
 
+func TestCreateSessionDefaultWorkingDir(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	if _, err := NewManager(baseDir, nil, stats.New(), WithDefaultWorkingDir(baseDir+"/missing")); err == nil {
+		t.Error("Expected NewManager to reject a missing default working directory")
+	}
+
+	manager, err := NewManager(baseDir, nil, stats.New(), WithDefaultWorkingDir(os.TempDir()))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("default-dir", "")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if session.WorkingDirectory != os.TempDir() {
+		t.Errorf("Expected default working directory %q, got %q", os.TempDir(), session.WorkingDirectory)
+	}
+
+	session, err = manager.CreateSession("explicit-dir", "/srv")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if session.WorkingDirectory != "/srv" {
+		t.Errorf("Expected working directory /srv, got %q", session.WorkingDirectory)
+	}
+}
+
+func TestClearHistory(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("clear-me", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if _, err := manager.RunPrompt(context.Background(), session, "Hello"); err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	session.ContextID = "ctx-1"
+	session.TaskID = "task-1"
+	name := session.Name
+
+	if err := manager.ClearHistory("clear-me"); err != nil {
+		t.Fatalf("ClearHistory failed: %v", err)
+	}
+
+	// Check what was persisted, not just the cached session.
+	loaded, err := manager.load("clear-me")
+	if err != nil {
+		t.Fatalf("Session no longer exists after clearing: %v", err)
+	}
+	if len(loaded.History) != 0 {
+		t.Errorf("Expected empty history, got %v", loaded.History)
+	}
+	if loaded.ContextID != "" || loaded.TaskID != "" {
+		t.Errorf("Expected context and task IDs to be reset, got %q and %q", loaded.ContextID, loaded.TaskID)
+	}
+	if loaded.Name != name || loaded.WorkingDirectory != "/tmp" {
+		t.Errorf("Expected name %q and working directory /tmp to be kept, got %q and %q", name, loaded.Name, loaded.WorkingDirectory)
+	}
+
+	if err := manager.ClearHistory("missing"); err == nil {
+		t.Error("Expected an error clearing a missing session")
+	}
+}
+
+func TestSessionRejectsTraversal(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	secret := baseDir + "/data/secret.json"
+	if err := os.WriteFile(secret, []byte(`{"id":"secret","history":[]}`), 0644); err != nil {
+		t.Fatalf("Failed to write secret file: %v", err)
+	}
+
+	for _, id := range []string{"../secret", "..", "a/b", "a\\b", "", "x.json"} {
+		if _, err := manager.CreateSession(id, ""); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("CreateSession(%q): expected ErrInvalidID, got %v", id, err)
+		}
+		if _, err := manager.AcquireSession(id); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("AcquireSession(%q): expected ErrInvalidID, got %v", id, err)
+		}
+		if err := manager.DeleteSession(id); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("DeleteSession(%q): expected ErrInvalidID, got %v", id, err)
+		}
+		if err := manager.ClearHistory(id); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("ClearHistory(%q): expected ErrInvalidID, got %v", id, err)
+		}
+	}
+	if _, err := os.Stat(secret); err != nil {
+		t.Errorf("File outside the conversations directory was removed: %v", err)
+	}
+	for _, id := range []string{"0b6f3c1e-9a57-4c1e-8f0e-2d7f1c9b4a11", "test-session", "my_chat"} {
+		if !ValidID(id) {
+			t.Errorf("Expected %q to be a valid id", id)
+		}
+	}
+}
+
 func TestGenerateNameFromPrompt(t *testing.T) {
 	prompt := "hello world this is a test"
 	name := generateNameFromPrompt(prompt)
@@ -121,17 +384,17 @@ func TestRunPromptAndLoad(t *testing.T) {
 	}
 
 	prompt := "test prompt"
-	response, err := manager.RunPrompt(session, prompt)
+	response, err := manager.RunPrompt(context.Background(), session, prompt)
 	if err != nil {
 		t.Fatalf("RunPrompt failed: %v", err)
 	}
 	if response != "mock response" {
 		t.Errorf("Expected 'mock response', got '%s'", response)
 	}
-	if session.History[0] != "User: "+prompt {
+	if session.History[0] != (Turn{Role: RoleUser, Text: prompt}) {
 		t.Errorf("Expected user prompt in history, got '%s'", session.History[0])
 	}
-	if session.History[1] != "Gemini: mock response" {
+	if session.History[1] != (Turn{Role: RoleAssistant, Text: "mock response"}) {
 		t.Errorf("Expected gemini response in history, got '%s'", session.History[1])
 	}
 	if session.Name != "test prompt" {
@@ -148,11 +411,219 @@ func TestRunPromptAndLoad(t *testing.T) {
 	if loadedSession.ID != id {
 		t.Errorf("Acquired session has incorrect ID")
 	}
-	if loadedSession.History[0] != "User: "+prompt {
+	if loadedSession.History[0] != (Turn{Role: RoleUser, Text: prompt}) {
 		t.Errorf("Expected user prompt in history, got '%s'", loadedSession.History[0])
 	}
 }
 
+func TestRunPromptEmptyResponse(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	cases := []struct {
+		emptyReplies int32
+		retry        bool
+		wantErr      bool
+		wantCalls    int32
+	}{
+		{emptyReplies: 1, retry: true, wantErr: false, wantCalls: 2},
+		{emptyReplies: 2, retry: true, wantErr: true, wantCalls: 2},
+		{emptyReplies: 1, retry: false, wantErr: true, wantCalls: 1},
+	}
+	for i, c := range cases {
+		client := &mockA2AClient{emptyReplies: c.emptyReplies}
+		manager, err := NewManager(baseDir, client, stats.New(), WithRetryOnEmpty(c.retry))
+		if err != nil {
+			t.Fatalf("NewManager failed: %v", err)
+		}
+		session, err := manager.CreateSession(fmt.Sprintf("empty-%d", i), "/tmp")
+		if err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+
+		response, err := manager.RunPrompt(context.Background(), session, "test prompt")
+		if c.wantErr {
+			if !errors.Is(err, ErrEmptyResponse) {
+				t.Errorf("case %d: expected ErrEmptyResponse, got %v", i, err)
+			}
+			if len(session.History) != 0 {
+				t.Errorf("case %d: expected nothing stored in history, got %v", i, session.History)
+			}
+		} else if err != nil || response != "mock response" {
+			t.Errorf("case %d: expected 'mock response', got %q, %v", i, response, err)
+		}
+		if client.calls != c.wantCalls {
+			t.Errorf("case %d: expected %d calls, got %d", i, c.wantCalls, client.calls)
+		}
+	}
+}
+
+func TestImportSession(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	exported := []byte(`{"id":"imported","name":"Old chat","history":["User: hi","Gemini: hello"],"working_directory":"/tmp"}`)
+
+	session, err := manager.ImportSession(exported)
+	if err != nil {
+		t.Fatalf("ImportSession failed: %v", err)
+	}
+	if session.ID != "imported" || session.Name != "Old chat" || len(session.History) != 2 {
+		t.Errorf("Unexpected imported session: %+v", session)
+	}
+
+	// Importing again must not overwrite the first copy.
+	second, err := manager.ImportSession(exported)
+	if err != nil {
+		t.Fatalf("ImportSession failed: %v", err)
+	}
+	if second.ID == "imported" {
+		t.Errorf("Expected a new ID when the original one is taken")
+	}
+
+	manager.sessions = make(map[string]*Session)
+	loaded, err := manager.AcquireSession("imported")
+	if err != nil || loaded.History[1] != (Turn{Role: RoleAssistant, Text: "hello"}) {
+		t.Errorf("Expected the imported history to be persisted, got %+v, %v", loaded, err)
+	}
+
+	for _, payload := range []string{
+		`not json`,
+		`{"id":"no-history"}`,
+		`{"history":["System: hi"]}`,
+		`{"history":"User: hi"}`,
+		`{"version":1,"history":[{"role":"system","text":"hi"}]}`,
+		`{"version":2,"history":[]}`,
+	} {
+		if _, err := manager.ImportSession([]byte(payload)); !errors.Is(err, ErrInvalidImport) {
+			t.Errorf("Expected ErrInvalidImport for %s, got %v", payload, err)
+		}
+	}
+
+	traversal, err := manager.ImportSession([]byte(`{"id":"../evil","history":[]}`))
+	if err != nil || traversal.ID == "../evil" {
+		t.Errorf("Expected an unsafe ID to be replaced, got %+v, %v", traversal, err)
+	}
+}
+
+func TestLoadMigratesStringHistory(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	v0 := `{"id":"old","name":"Old chat","history":["Me: hi","Bot: Note: two\nlines","Me: run it","Bot: (task t-1)"],` +
+		`"working_directory":"/tmp","context_id":"ctx-1","user_label":"Me","assistant_label":"Bot"}`
+	path := manager.files.path("old")
+	if err := os.WriteFile(path, []byte(v0), 0644); err != nil {
+		t.Fatalf("Failed to write session file: %v", err)
+	}
+
+	s, err := manager.load("old")
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	want := []Turn{
+		{Role: RoleUser, Text: "hi"},
+		{Role: RoleAssistant, Text: "Note: two\nlines"},
+		{Role: RoleUser, Text: "run it"},
+		{Role: RoleAssistant, Text: "(task t-1)"},
+	}
+	if !reflect.DeepEqual(s.History, want) {
+		t.Errorf("Expected history %+v, got %+v", want, s.History)
+	}
+	if s.Version != formatVersion || s.Name != "Old chat" || s.WorkingDirectory != "/tmp" || s.ContextID != "ctx-1" || s.UserLabel != "Me" || s.AssistantLabel != "Bot" {
+		t.Errorf("Expected the other fields to be kept, got %+v", s)
+	}
+	if taskID, ok := placeholderTaskID(s.History[3]); !ok || taskID != "t-1" {
+		t.Errorf("Expected the task placeholder to be recognised, got %q", taskID)
+	}
+
+	// The upgraded session is written back, and loads unchanged.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read session file: %v", err)
+	}
+	if !strings.Contains(string(data), `"version": 1`) {
+		t.Errorf("Expected the session file to be re-saved as version 1, got %s", data)
+	}
+	reloaded, err := manager.load("old")
+	if err != nil || !reflect.DeepEqual(reloaded.History, want) {
+		t.Errorf("Expected the re-saved history to load unchanged, got %+v, %v", reloaded, err)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"id":"old","history":["System: hi"]}`), 0644); err != nil {
+		t.Fatalf("Failed to write session file: %v", err)
+	}
+	if _, err := manager.load("old"); err == nil {
+		t.Error("Expected an error for a history entry with an unknown label")
+	}
+}
+
+func TestFailureLog(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	client := &mockA2AClient{err: errors.New("connection refused")}
+	manager, err := NewManager(baseDir, client, stats.New(), WithFailureRetention(2, 0))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("failing", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if _, err := manager.RunPrompt(context.Background(), session, "first"); err == nil {
+		t.Fatal("Expected RunPrompt to fail")
+	}
+	failures, err := manager.Failures(0)
+	if err != nil {
+		t.Fatalf("Failures failed: %v", err)
+	}
+	if len(failures) != 1 {
+		t.Fatalf("Expected one failure record, got %+v", failures)
+	}
+	f := failures[0]
+	if f.SessionID != "failing" || f.Call != "prompt" || f.Prompt != "first" || !strings.Contains(f.Error, "connection refused") || f.Time.IsZero() {
+		t.Errorf("Unexpected failure record %+v", f)
+	}
+
+	events := make(chan protocol.StreamingMessageEvent, 10)
+	if err := manager.RunPromptStream(context.Background(), session, "second", events); err == nil {
+		t.Fatal("Expected RunPromptStream to fail")
+	}
+	if _, err := manager.RunPrompt(context.Background(), session, "third"); err == nil {
+		t.Fatal("Expected RunPrompt to fail")
+	}
+
+	// Only the newest two records are kept.
+	failures, err = manager.Failures(0)
+	if err != nil {
+		t.Fatalf("Failures failed: %v", err)
+	}
+	if len(failures) != 2 || failures[0].Prompt != "third" || failures[1].Prompt != "second" || failures[1].Call != "stream" {
+		t.Errorf("Expected the two newest failures, newest first, got %+v", failures)
+	}
+	if failures, _ := manager.Failures(1); len(failures) != 1 || failures[0].Prompt != "third" {
+		t.Errorf("Expected the limit to apply, got %+v", failures)
+	}
+
+	// Successful prompts aren't recorded.
+	client.err = nil
+	if _, err := manager.RunPrompt(context.Background(), session, "fourth"); err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	if failures, _ := manager.Failures(0); len(failures) != 2 || failures[0].Prompt != "third" {
+		t.Errorf("Expected no record for a successful prompt, got %+v", failures)
+	}
+}
+
 func TestRunPromptAsTask(t *testing.T) {
 	baseDir := setup(t)
 	defer teardown(t)
@@ -170,21 +641,71 @@ func TestRunPromptAsTask(t *testing.T) {
 	}
 
 	prompt := "test prompt"
-	taskID, err := manager.RunPromptAsTask(session, prompt)
+	taskID, err := manager.RunPromptAsTask(context.Background(), session, prompt)
 	if err != nil {
 		t.Fatalf("RunPromptAsTask failed: %v", err)
 	}
 	if taskID != "mock-task-id" {
 		t.Errorf("Expected 'mock-task-id', got '%s'", taskID)
 	}
-	if session.History[0] != "User: "+prompt {
+	if session.History[0] != (Turn{Role: RoleUser, Text: prompt}) {
 		t.Errorf("Expected user prompt in history, got '%s'", session.History[0])
 	}
-	if session.History[1] != "Gemini: (task mock-task-id)" {
+	if session.History[1] != (Turn{Role: RoleAssistant, Text: "(task mock-task-id)"}) {
 		t.Errorf("Expected gemini response in history, got '%s'", session.History[1])
 	}
 }
 
+func TestRunPromptAsTaskQueued(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	client := &mockA2AClient{delay: 20 * time.Millisecond}
+	manager, err := NewManager(baseDir, client, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("test-session", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	// A task prompt waits for the prompt submitted before it.
+	done := make(chan error, 1)
+	go func() {
+		_, err := manager.RunPrompt(context.Background(), session, "first")
+		done <- err
+	}()
+	for manager.QueueDepth(session.ID) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := manager.RunPromptAsTask(context.Background(), session, "second"); err != nil {
+		t.Fatalf("RunPromptAsTask failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	if len(session.History) != 4 || session.History[0].Text != "first" || session.History[2].Text != "second" {
+		t.Errorf("Expected the prompts in submission order, got %+v", session.History)
+	}
+
+	// A backend that doesn't answer times out instead of holding a slot.
+	client.delay = time.Hour
+	timed, err := NewManager(baseDir, client, stats.New(), WithPromptTimeout(20*time.Millisecond), WithMaxConcurrent(1, true))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	other, _ := timed.CreateSession("other-session", "/tmp")
+	for i := 0; i < 2; i++ {
+		if _, err := timed.RunPromptAsTask(context.Background(), other, "hello"); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("Expected ErrTimeout, got %v", err)
+		}
+	}
+	if len(other.History) != 0 {
+		t.Errorf("Expected nothing stored for a timed out prompt, got %+v", other.History)
+	}
+}
+
 func TestRunPromptStream(t *testing.T) {
 	baseDir := setup(t)
 	defer teardown(t)
@@ -202,19 +723,20 @@ func TestRunPromptStream(t *testing.T) {
 	}
 
 	prompt := "test prompt"
-	eventChan := make(chan a2aclient.StreamEvent)
+	eventChan := make(chan protocol.StreamingMessageEvent)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err := manager.RunPromptStream(session, prompt, eventChan)
+		err := manager.RunPromptStream(context.Background(), session, prompt, eventChan)
 		if err != nil {
 			t.Errorf("RunPromptStream failed: %v", err)
 		}
+		close(eventChan)
 	}()
 
-	var events []a2aclient.StreamEvent
+	var events []protocol.StreamingMessageEvent
 	for event := range eventChan {
 		events = append(events, event)
 	}
@@ -224,14 +746,1351 @@ func TestRunPromptStream(t *testing.T) {
 	if len(events) != 1 {
 		t.Fatalf("Expected 1 event, got %d", len(events))
 	}
-	if events[0].Kind != "text" || events[0].Text != "mock response" {
+	if text := eventText(events[0]); text != "mock response" {
 		t.Errorf("unexpected event received: %+v", events[0])
 	}
 
-	if session.History[0] != "User: "+prompt {
+	if session.History[0] != (Turn{Role: RoleUser, Text: prompt}) {
 		t.Errorf("Expected user prompt in history, got '%s'", session.History[0])
 	}
-	if session.History[1] != "Gemini: mock response" {
+	if session.History[1] != (Turn{Role: RoleAssistant, Text: "mock response"}) {
 		t.Errorf("Expected gemini response in history, got '%s'", session.History[1])
 	}
 }
+
+func TestRunPromptStreamResume(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	for _, reconnects := range []int{1, 0} {
+		client := &mockA2AClient{chunks: []string{"Hello", ", ", "world"}, dropAfter: 1}
+		manager, err := NewManager(baseDir, client, stats.New(), WithStreamReconnects(reconnects))
+		if err != nil {
+			t.Fatalf("NewManager failed: %v", err)
+		}
+		session, err := manager.CreateSession(fmt.Sprintf("resume-%d", reconnects), "/tmp")
+		if err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+
+		eventChan := make(chan protocol.StreamingMessageEvent)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- manager.RunPromptStream(context.Background(), session, "Say hello", eventChan)
+			close(eventChan)
+		}()
+		for range eventChan {
+		}
+		err = <-errChan
+
+		if reconnects == 0 {
+			// The cut-off response is kept, but the caller learns it's partial.
+			if !errors.Is(err, ErrStreamInterrupted) {
+				t.Errorf("Expected ErrStreamInterrupted without reconnects, got %v", err)
+			}
+			if session.History[1] != (Turn{Role: RoleAssistant, Text: "Hello"}) {
+				t.Errorf("Expected the partial response in history, got %q", session.History[1])
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("RunPromptStream failed: %v", err)
+		}
+		if n := atomic.LoadInt32(&client.resubscribes); n != 1 {
+			t.Errorf("Expected 1 resubscribe, got %d", n)
+		}
+		// The replayed first chunk must not be appended twice.
+		if session.History[1] != (Turn{Role: RoleAssistant, Text: "Hello, world"}) {
+			t.Errorf("Expected the full response in history, got %q", session.History[1])
+		}
+	}
+}
+
+func TestStreamDeltas(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	statsManager := stats.New()
+	manager, err := NewManager(baseDir, &mockA2AClient{chunks: []string{"Hello", ", ", "world"}}, statsManager)
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+
+	session, err := manager.CreateSession("test-session", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	manager.statsInterval = 0
+
+	deltaChan := make(chan DeltaEvent)
+	go manager.StreamDeltas(context.Background(), session, "test prompt", deltaChan)
+
+	var deltas []DeltaEvent
+	var throughput []*StreamStats
+	for delta := range deltaChan {
+		if delta.Type == DeltaTypeStats {
+			throughput = append(throughput, delta.Stats)
+			continue
+		}
+		deltas = append(deltas, delta)
+	}
+
+	// One stats event after each delta and a final one.
+	if len(throughput) != 4 {
+		t.Fatalf("Expected 4 stats events, got %d", len(throughput))
+	}
+	for i, want := range []int{5, 7, 12, 12} {
+		if throughput[i].Chars != want {
+			t.Errorf("Stats %d: expected %d chars, got %d", i, want, throughput[i].Chars)
+		}
+	}
+	if got := statsManager.Get()["stream_chars_per_sec"].(float64); got <= 0 {
+		t.Errorf("Expected the stream throughput to be recorded, got %v", got)
+	}
+
+	expected := []DeltaEvent{
+		{Type: DeltaTypeStart},
+		{Type: DeltaTypeDelta, Text: "Hello"},
+		{Type: DeltaTypeDelta, Text: ", "},
+		{Type: DeltaTypeDelta, Text: "world"},
+		{Type: DeltaTypeDone},
+	}
+	if len(deltas) != len(expected) {
+		t.Fatalf("Expected %d delta events, got %d: %+v", len(expected), len(deltas), deltas)
+	}
+	for i := range expected {
+		if deltas[i] != expected[i] {
+			t.Errorf("Delta %d: expected %+v, got %+v", i, expected[i], deltas[i])
+		}
+	}
+
+	if session.History[1] != (Turn{Role: RoleAssistant, Text: "Hello, world"}) {
+		t.Errorf("Expected assembled response in history, got '%s'", session.History[1])
+	}
+}
+
+func TestHistoryLabels(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New(), WithHistoryLabels("", "Assistant"))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("labelled", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if _, err := manager.RunPrompt(context.Background(), session, "Hello"); err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	loaded, err := manager.load("labelled")
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if loaded.History[0] != (Turn{Role: RoleUser, Text: "Hello"}) || loaded.History[1] != (Turn{Role: RoleAssistant, Text: "mock response"}) {
+		t.Errorf("Expected the exchange in stored history, got %v", loaded.History)
+	}
+	if loaded.UserLabel != "" || loaded.AssistantLabel != "Assistant" {
+		t.Errorf("Expected the custom assistant label to be stored, got %q and %q", loaded.UserLabel, loaded.AssistantLabel)
+	}
+
+	// A per-session label wins, including for task results.
+	persona, err := manager.CreateSession("persona", "/tmp", WithLabels("Me", "Bot"))
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if _, err := manager.RunPromptAsTask(context.Background(), persona, "Hello"); err != nil {
+		t.Fatalf("RunPromptAsTask failed: %v", err)
+	}
+	if persona.History[1] != (Turn{Role: RoleAssistant, Text: "(task mock-task-id)"}) {
+		t.Errorf("Expected a labelled task placeholder, got %q", persona.History[1])
+	}
+	manager.pollPendingTasks()
+	if persona.History[0] != (Turn{Role: RoleUser, Text: "Hello"}) || persona.History[1] != (Turn{Role: RoleAssistant, Text: "mock task output"}) {
+		t.Errorf("Expected the session's labels in history, got %v", persona.History)
+	}
+}
+
+func TestPendingTaskResolution(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("test-session", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if _, err := manager.RunPromptAsTask(context.Background(), session, "test prompt"); err != nil {
+		t.Fatalf("RunPromptAsTask failed: %v", err)
+	}
+
+	manager.pollPendingTasks()
+
+	if session.History[1] != (Turn{Role: RoleAssistant, Text: "mock task output"}) {
+		t.Errorf("Expected task output in history, got '%s'", session.History[1])
+	}
+	if len(manager.pendingTasks) != 0 {
+		t.Errorf("Expected no pending tasks, got %d", len(manager.pendingTasks))
+	}
+}
+
+func TestPendingTaskFailure(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{taskState: protocol.TaskStateFailed}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("test-session", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if _, err := manager.RunPromptAsTask(context.Background(), session, "test prompt"); err != nil {
+		t.Fatalf("RunPromptAsTask failed: %v", err)
+	}
+
+	manager.pollPendingTasks()
+
+	if session.History[1] != (Turn{Role: RoleAssistant, Text: "(task mock-task-id failed)"}) {
+		t.Errorf("Expected failure marker in history, got '%s'", session.History[1])
+	}
+}
+
+func TestPendingTaskRestore(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{taskState: protocol.TaskStateWorking}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("test-session", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if _, err := manager.RunPromptAsTask(context.Background(), session, "test prompt"); err != nil {
+		t.Fatalf("RunPromptAsTask failed: %v", err)
+	}
+	manager.pollPendingTasks()
+	if session.History[1] != (Turn{Role: RoleAssistant, Text: "(task mock-task-id)"}) {
+		t.Fatalf("Expected placeholder to remain while the task is working, got '%s'", session.History[1])
+	}
+
+	// Simulate a restart with a fresh manager over the same data directory.
+	restarted, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	if err := restarted.restorePendingTasks(); err != nil {
+		t.Fatalf("restorePendingTasks failed: %v", err)
+	}
+	if restarted.pendingTasks["mock-task-id"] != "test-session" {
+		t.Fatalf("Expected pending task to be restored, got %v", restarted.pendingTasks)
+	}
+
+	restarted.pollPendingTasks()
+
+	loaded, err := restarted.AcquireSession("test-session")
+	if err != nil {
+		t.Fatalf("AcquireSession failed: %v", err)
+	}
+	if loaded.History[1] != (Turn{Role: RoleAssistant, Text: "mock task output"}) {
+		t.Errorf("Expected task output in history, got '%s'", loaded.History[1])
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	client := &mockA2AClient{delay: 20 * time.Millisecond}
+	manager, err := NewManager(baseDir, client, stats.New(), WithMaxConcurrent(2, false))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		session, err := manager.CreateSession(fmt.Sprintf("test-session-%d", i), "/tmp")
+		if err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := manager.RunPrompt(context.Background(), session, "test prompt"); err != nil {
+				t.Errorf("RunPrompt failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if client.maxActive > 2 {
+		t.Errorf("Expected at most 2 concurrent calls, got %d", client.maxActive)
+	}
+	if calls := manager.stats.Get()["total_calls"]; calls != 6 {
+		t.Errorf("Expected 6 calls to complete, got %v", calls)
+	}
+	if inFlight := manager.stats.Get()["in_flight"]; inFlight != 0 {
+		t.Errorf("Expected no calls in flight, got %v", inFlight)
+	}
+}
+
+func TestConcurrencyLimitReject(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	client := &mockA2AClient{delay: 50 * time.Millisecond}
+	manager, err := NewManager(baseDir, client, stats.New(), WithMaxConcurrent(1, true))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	first, _ := manager.CreateSession("first", "/tmp")
+	second, _ := manager.CreateSession("second", "/tmp")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		manager.RunPrompt(context.Background(), first, "test prompt")
+	}()
+	for atomic.LoadInt32(&client.active) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := manager.RunPrompt(context.Background(), second, "test prompt"); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected ErrBusy, got %v", err)
+	}
+	if len(second.History) != 0 {
+		t.Errorf("Expected rejected prompt to leave history untouched, got %v", second.History)
+	}
+	<-done
+}
+
+func TestSessionChangesWaitForPrompt(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{delay: 20 * time.Millisecond}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("busy", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	// during runs change while a prompt is in progress.
+	during := func(change func() error) {
+		t.Helper()
+		done := make(chan error, 1)
+		go func() {
+			_, err := manager.RunPrompt(context.Background(), session, "hello")
+			done <- err
+		}()
+		for manager.QueueDepth(session.ID) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		if err := change(); err != nil {
+			t.Fatalf("Changing the session failed: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("RunPrompt failed: %v", err)
+		}
+	}
+
+	// The history is cleared after the prompt, not before it's stored.
+	during(func() error { return manager.ClearHistory("busy") })
+	loaded, err := manager.load("busy")
+	if err != nil || len(loaded.History) != 0 || len(session.History) != 0 {
+		t.Errorf("Expected the history to stay cleared, got %+v, %v", loaded, err)
+	}
+
+	dir := t.TempDir()
+	during(func() error { return manager.SetWorkingDirectory("busy", dir) })
+	if loaded, err := manager.load("busy"); err != nil || loaded.WorkingDirectory != dir {
+		t.Errorf("Expected the new working directory to be saved, got %+v, %v", loaded, err)
+	}
+
+	during(func() error { return manager.SetPinned("busy", true) })
+	if loaded, err := manager.load("busy"); err != nil || !loaded.Pinned {
+		t.Errorf("Expected the pin to be saved, got %+v, %v", loaded, err)
+	}
+}
+
+func TestPromptQueue(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	client := &mockA2AClient{delay: 20 * time.Millisecond}
+	manager, err := NewManager(baseDir, client, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("test-session", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	other, err := manager.CreateSession("other-session", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	const prompts = 5
+	var wg sync.WaitGroup
+	for i := 0; i < prompts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := manager.RunPrompt(context.Background(), session, fmt.Sprintf("prompt %d", i)); err != nil {
+				t.Errorf("RunPrompt failed: %v", err)
+			}
+		}()
+		// Submit the next prompt only once this one is queued.
+		for manager.QueueDepth(session.ID) < i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// Another conversation doesn't wait for this one's queue.
+	if _, err := manager.RunPrompt(context.Background(), other, "other prompt"); err != nil {
+		t.Errorf("RunPrompt failed: %v", err)
+	}
+	if depth := manager.QueueDepth(session.ID); depth == 0 {
+		t.Errorf("Expected prompts still queued after the other conversation's prompt ran")
+	}
+	wg.Wait()
+
+	if len(session.History) != 2*prompts {
+		t.Fatalf("Expected %d turns, got %d", 2*prompts, len(session.History))
+	}
+	for i := 0; i < prompts; i++ {
+		if want := fmt.Sprintf("prompt %d", i); session.History[2*i].Text != want {
+			t.Errorf("Expected turn %d to be %q, got %q", 2*i, want, session.History[2*i].Text)
+		}
+		if session.History[2*i+1].Role != RoleAssistant {
+			t.Errorf("Expected turn %d to be the reply, got %+v", 2*i+1, session.History[2*i+1])
+		}
+	}
+	if client.maxActive != 2 {
+		t.Errorf("Expected the two conversations' prompts to overlap, got at most %d concurrent calls", client.maxActive)
+	}
+	if depth := manager.QueueDepth(session.ID); depth != 0 {
+		t.Errorf("Expected an empty queue, got depth %d", depth)
+	}
+}
+
+func TestPromptQueueCancelled(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	client := &mockA2AClient{delay: 50 * time.Millisecond}
+	manager, err := NewManager(baseDir, client, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("test-session", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		manager.RunPrompt(context.Background(), session, "first prompt")
+	}()
+	for manager.QueueDepth(session.ID) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := manager.RunPrompt(ctx, session, "second prompt"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the queued prompt to give up with its context, got %v", err)
+	}
+	<-done
+	if len(session.History) != 2 || session.History[0].Text != "first prompt" {
+		t.Errorf("Expected only the first prompt in the history, got %+v", session.History)
+	}
+	if depth := manager.QueueDepth(session.ID); depth != 0 {
+		t.Errorf("Expected an empty queue, got depth %d", depth)
+	}
+}
+
+func TestRunPromptStreamStopped(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	client := &mockA2AClient{chunks: []string{"Hello", ", ", "world"}, delay: 50 * time.Millisecond}
+	manager, err := NewManager(baseDir, client, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("test-session", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	deltaChan := make(chan DeltaEvent)
+	go manager.StreamDeltas(ctx, session, "test prompt", deltaChan)
+
+	var deltas []DeltaEvent
+	for delta := range deltaChan {
+		deltas = append(deltas, delta)
+		if delta.Type == DeltaTypeDelta {
+			cancel()
+		}
+	}
+
+	if last := deltas[len(deltas)-1]; last.Type != DeltaTypeDone {
+		t.Errorf("Expected the stopped stream to end cleanly, got %+v", last)
+	}
+	if session.History[1] != (Turn{Role: RoleAssistant, Text: "Hello"}) {
+		t.Errorf("Expected partial response in history, got '%s'", session.History[1])
+	}
+
+	manager.sessions = make(map[string]*Session)
+	loaded, err := manager.AcquireSession("test-session")
+	if err != nil {
+		t.Fatalf("AcquireSession failed: %v", err)
+	}
+	if loaded.History[1] != (Turn{Role: RoleAssistant, Text: "Hello"}) {
+		t.Errorf("Expected partial response to be persisted, got '%s'", loaded.History[1])
+	}
+}
+
+func TestMaxHistory(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New(), WithMaxHistory(4, false))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("full", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := manager.RunPrompt(context.Background(), session, fmt.Sprintf("prompt %d", i)); err != nil {
+			t.Fatalf("RunPrompt %d failed: %v", i, err)
+		}
+	}
+	if _, err := manager.RunPrompt(context.Background(), session, "one too many"); !errors.Is(err, ErrHistoryFull) {
+		t.Errorf("expected ErrHistoryFull, got %v", err)
+	}
+	if len(session.History) != 4 {
+		t.Errorf("expected history to be left alone, got %d entries", len(session.History))
+	}
+
+	manager, err = NewManager(baseDir, &mockA2AClient{}, stats.New(), WithMaxHistory(4, true))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err = manager.CreateSession("compact", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := manager.RunPrompt(context.Background(), session, fmt.Sprintf("prompt %d", i)); err != nil {
+			t.Fatalf("RunPrompt %d failed: %v", i, err)
+		}
+	}
+	if len(session.History) != 4 || session.History[0] != (Turn{Role: RoleUser, Text: "prompt 1"}) {
+		t.Errorf("expected oldest exchange to be dropped, got %v", session.History)
+	}
+}
+
+type failingStore struct {
+	failures int
+	calls    int
+}
+
+func (f *failingStore) save(s *Session) error {
+	f.calls++
+	if f.calls <= f.failures {
+		return errors.New("disk full")
+	}
+	return nil
+}
+
+func TestRunPromptSaveRetry(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	cases := []struct {
+		failures  int
+		wantErr   bool
+		wantCalls int
+	}{
+		{failures: 2, wantErr: false, wantCalls: 3},
+		{failures: 5, wantErr: true, wantCalls: 3},
+	}
+	for i, c := range cases {
+		manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New(), WithSaveRetry(2, time.Millisecond))
+		if err != nil {
+			t.Fatalf("NewManager failed: %v", err)
+		}
+		store := &failingStore{failures: c.failures}
+		manager.store = store
+		session, err := manager.CreateSession(fmt.Sprintf("save-%d", i), "/tmp")
+		if err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+
+		response, err := manager.RunPrompt(context.Background(), session, "test prompt")
+		if c.wantErr != errors.Is(err, ErrSaveFailed) {
+			t.Errorf("case %d: unexpected error %v", i, err)
+		}
+		if response != "mock response" {
+			t.Errorf("case %d: expected the response to be returned, got %q", i, response)
+		}
+		if store.calls != c.wantCalls {
+			t.Errorf("case %d: expected %d save attempts, got %d", i, c.wantCalls, store.calls)
+		}
+		if len(session.History) != 2 {
+			t.Errorf("case %d: expected the exchange to be kept in memory, got %v", i, session.History)
+		}
+	}
+}
+
+func TestRunPromptResponseCache(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	client := &mockA2AClient{}
+	st := stats.New()
+	manager, err := NewManager(baseDir, client, st, WithResponseCache(10, time.Minute, false))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("cached", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	ctx := WithCache(context.Background())
+	for i := 0; i < 2; i++ {
+		response, err := manager.RunPrompt(ctx, session, "same prompt")
+		if err != nil || response != "mock response" {
+			t.Fatalf("RunPrompt %d: got %q, %v", i, response, err)
+		}
+	}
+	if client.calls != 1 {
+		t.Errorf("Expected the second prompt to be answered from the cache, got %d backend calls", client.calls)
+	}
+	if hits := st.Get()["cache_hits"]; hits != 1 {
+		t.Errorf("Expected 1 cache hit in stats, got %v", hits)
+	}
+	if len(session.History) != 4 {
+		t.Errorf("Expected cached exchanges in the history too, got %v", session.History)
+	}
+
+	// Requests that don't opt in skip the cache.
+	if _, err := manager.RunPrompt(context.Background(), session, "same prompt"); err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	if client.calls != 2 {
+		t.Errorf("Expected a backend call without opting in, got %d calls", client.calls)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	defaultClient, flash := &mockA2AClient{}, &mockA2AClient{}
+	manager, err := NewManager(baseDir, defaultClient, stats.New(), WithBackends(map[string]A2AClient{"flash": flash}))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+
+	if _, err := manager.CreateSession("unknown", "/tmp", WithBackend("missing")); !errors.Is(err, ErrUnknownBackend) {
+		t.Errorf("Expected ErrUnknownBackend, got %v", err)
+	}
+
+	session, err := manager.CreateSession("flash-session", "/tmp", WithBackend("flash"))
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if _, err := manager.RunPrompt(context.Background(), session, "hi"); err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	if flash.calls != 1 || defaultClient.calls != 0 {
+		t.Errorf("Expected the prompt to go to the flash backend, got %d calls there and %d to the default", flash.calls, defaultClient.calls)
+	}
+
+	plain, _ := manager.CreateSession("plain-session", "/tmp")
+	if _, err := manager.RunPrompt(context.Background(), plain, "hi"); err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	if defaultClient.calls != 1 {
+		t.Errorf("Expected a session without backend to use the default client, got %d calls", defaultClient.calls)
+	}
+
+	// A session whose backend was removed from the configuration.
+	session.Backend = "removed"
+	if _, err := manager.RunPrompt(context.Background(), session, "hi"); !errors.Is(err, ErrUnknownBackend) {
+		t.Errorf("Expected ErrUnknownBackend, got %v", err)
+	}
+	if len(session.History) != 2 {
+		t.Errorf("Expected the failed prompt to leave the history alone, got %d entries", len(session.History))
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	huge := strings.Repeat("x", 4<<20)
+	chunks := make([]string, 16)
+	for i := range chunks {
+		chunks[i] = strings.Repeat("y", 256<<10)
+	}
+	manager, err := NewManager(baseDir, &mockA2AClient{response: huge, chunks: chunks}, stats.New(), WithMaxResponseSize(1000))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("test-session", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	response, err := manager.RunPrompt(context.Background(), session, "big")
+	if err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	if want := strings.Repeat("x", 1000) + truncatedMarker; response != want {
+		t.Errorf("Expected the response truncated to 1000 bytes, got %d bytes", len(response))
+	}
+
+	eventChan := make(chan protocol.StreamingMessageEvent)
+	go func() {
+		for range eventChan {
+		}
+	}()
+	if err := manager.RunPromptStream(context.Background(), session, "bigger", eventChan); err != nil {
+		t.Fatalf("RunPromptStream failed: %v", err)
+	}
+	close(eventChan)
+	if want := strings.Repeat("y", 1000) + truncatedMarker; session.History[3].Text != want {
+		t.Errorf("Expected the streamed response truncated to 1000 bytes, got %d bytes", len(session.History[3].Text))
+	}
+
+	info, err := os.Stat(filepath.Join(baseDir, "data/conversations/test-session.json"))
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size() > 10000 {
+		t.Errorf("Expected a small session file, got %d bytes", info.Size())
+	}
+}
+
+func TestSetWorkingDirectory(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	client := &mockA2AClient{}
+	manager, err := NewManager(baseDir, client, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("move-me", os.TempDir())
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if _, err := manager.RunPrompt(context.Background(), session, "Hello"); err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	if got := client.lastWorkspace(); got != os.TempDir() {
+		t.Errorf("Expected the prompt to be sent with workspace %q, got %q", os.TempDir(), got)
+	}
+
+	if err := manager.SetWorkingDirectory("move-me", filepath.Join(baseDir, "missing")); !errors.Is(err, ErrInvalidWorkingDirectory) {
+		t.Errorf("Expected ErrInvalidWorkingDirectory for a missing directory, got %v", err)
+	}
+	if err := manager.SetWorkingDirectory("missing", baseDir); err == nil {
+		t.Error("Expected an error for a missing session")
+	}
+
+	if err := manager.SetWorkingDirectory("move-me", baseDir); err != nil {
+		t.Fatalf("SetWorkingDirectory failed: %v", err)
+	}
+	if _, err := manager.RunPrompt(context.Background(), session, "Hello again"); err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	if got := client.lastWorkspace(); got != baseDir {
+		t.Errorf("Expected the next prompt to be sent with workspace %q, got %q", baseDir, got)
+	}
+
+	loaded, err := manager.load("move-me")
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if loaded.WorkingDirectory != baseDir {
+		t.Errorf("Expected working directory %q to be persisted, got %q", baseDir, loaded.WorkingDirectory)
+	}
+}
+
+func TestTags(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	for _, id := range []string{"work-1", "work-2", "other"} {
+		if _, err := manager.CreateSession(id, "/tmp"); err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+	}
+
+	tags, err := manager.SetTags("work-1", []string{" Work", "research", "work"})
+	if err != nil {
+		t.Fatalf("SetTags failed: %v", err)
+	}
+	if !reflect.DeepEqual(tags, []string{"research", "work"}) {
+		t.Errorf("Expected tags to be normalized, got %v", tags)
+	}
+	if _, err := manager.AddTags("work-2", "work"); err != nil {
+		t.Fatalf("AddTags failed: %v", err)
+	}
+	if tags, err := manager.AddTags("work-2", "urgent"); err != nil || !reflect.DeepEqual(tags, []string{"urgent", "work"}) {
+		t.Errorf("Expected AddTags to keep the existing tags, got %v, %v", tags, err)
+	}
+	if tags, err := manager.RemoveTags("work-2", "URGENT", "missing"); err != nil || !reflect.DeepEqual(tags, []string{"work"}) {
+		t.Errorf("Expected only the urgent tag to be removed, got %v, %v", tags, err)
+	}
+	for _, bad := range []string{"", "two words", "a/b", strings.Repeat("x", 51)} {
+		if _, err := manager.AddTags("other", bad); !errors.Is(err, ErrInvalidTag) {
+			t.Errorf("Expected ErrInvalidTag for %q, got %v", bad, err)
+		}
+	}
+	if _, err := manager.SetTags("missing", []string{"work"}); err == nil {
+		t.Error("Expected an error tagging a missing session")
+	}
+
+	// Tags are persisted and survive a restart.
+	manager, err = NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	tagged, err := manager.ListConversationsByTag("Work")
+	if err != nil {
+		t.Fatalf("ListConversationsByTag failed: %v", err)
+	}
+	var ids []string
+	for _, c := range tagged {
+		ids = append(ids, c.ID)
+	}
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"work-1", "work-2"}) {
+		t.Errorf("Expected the two work conversations, got %v", ids)
+	}
+	if tagged, _ := manager.ListConversationsByTag("none"); len(tagged) != 0 {
+		t.Errorf("Expected no conversations for an unused tag, got %v", tagged)
+	}
+	all, err := manager.ListConversations()
+	if err != nil {
+		t.Fatalf("ListConversations failed: %v", err)
+	}
+	for _, c := range all {
+		if c.ID == "other" && (c.Tags == nil || len(c.Tags) != 0) {
+			t.Errorf("Expected an empty tag list for an untagged conversation, got %#v", c.Tags)
+		}
+	}
+}
+
+func TestSetPinned(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	for _, id := range []string{"a-first", "b-second", "c-third"} {
+		if _, err := manager.CreateSession(id, "/tmp"); err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+	}
+	if err := manager.SetPinned("c-third", true); err != nil {
+		t.Fatalf("SetPinned failed: %v", err)
+	}
+	if err := manager.SetPinned("missing", true); err == nil {
+		t.Error("Expected an error pinning a missing session")
+	}
+
+	ids := func() []string {
+		conversations, err := manager.ListConversations()
+		if err != nil {
+			t.Fatalf("ListConversations failed: %v", err)
+		}
+		var ids []string
+		for _, c := range conversations {
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+	if got := ids(); !reflect.DeepEqual(got, []string{"c-third", "a-first", "b-second"}) {
+		t.Errorf("Expected the pinned conversation first, got %v", got)
+	}
+	loaded, err := manager.load("c-third")
+	if err != nil || !loaded.Pinned {
+		t.Errorf("Expected the pin to be persisted, got %+v, %v", loaded, err)
+	}
+
+	if err := manager.SetPinned("c-third", false); err != nil {
+		t.Fatalf("SetPinned failed: %v", err)
+	}
+	if got := ids(); !reflect.DeepEqual(got, []string{"a-first", "b-second", "c-third"}) {
+		t.Errorf("Expected the original order after unpinning, got %v", got)
+	}
+}
+
+func TestGetHistoryPage(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	session, err := manager.CreateSession("paged", "/tmp")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	for i := 0; i < 7; i++ {
+		session.History = append(session.History, Turn{Role: RoleUser, Text: fmt.Sprintf("turn %d", i)})
+	}
+
+	texts := func(turns []Turn) []string {
+		out := make([]string, 0, len(turns))
+		for _, turn := range turns {
+			out = append(out, turn.Text)
+		}
+		return out
+	}
+	// Page backwards from the latest turns, as a client loading older
+	// messages would.
+	latest, total, err := manager.GetHistoryPage("paged", -3, 3)
+	if err != nil {
+		t.Fatalf("GetHistoryPage failed: %v", err)
+	}
+	if total != 7 {
+		t.Errorf("Expected a total of 7 turns, got %d", total)
+	}
+	pages := [][]string{texts(latest)}
+	for end := total - 3; end > 0; end -= 3 {
+		start := max(end-3, 0)
+		turns, _, err := manager.GetHistoryPage("paged", start, end-start)
+		if err != nil {
+			t.Fatalf("GetHistoryPage failed: %v", err)
+		}
+		pages = append(pages, texts(turns))
+	}
+	want := [][]string{{"turn 4", "turn 5", "turn 6"}, {"turn 1", "turn 2", "turn 3"}, {"turn 0"}}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("Expected pages %v, got %v", want, pages)
+	}
+
+	for _, tt := range []struct {
+		offset, limit int
+		want          []string
+	}{
+		{0, 2, []string{"turn 0", "turn 1"}},
+		{5, 10, []string{"turn 5", "turn 6"}},
+		{7, 2, []string{}},
+		{-100, 1, []string{"turn 0"}},
+		{0, 0, []string{}},
+	} {
+		turns, _, err := manager.GetHistoryPage("paged", tt.offset, tt.limit)
+		if err != nil || !reflect.DeepEqual(texts(turns), tt.want) {
+			t.Errorf("GetHistoryPage(%d, %d) = %v, %v; want %v", tt.offset, tt.limit, texts(turns), err, tt.want)
+		}
+	}
+	if _, _, err := manager.GetHistoryPage("missing", 0, 10); err == nil {
+		t.Error("Expected an error for a missing session")
+	}
+}
+
+func TestSandboxRoot(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	root := t.TempDir()
+	outside := t.TempDir()
+	inside := filepath.Join(root, "project")
+	os.Mkdir(inside, 0755)
+	escape := filepath.Join(root, "escape")
+	os.Symlink(outside, escape)
+
+	if _, err := NewManager(baseDir, &mockA2AClient{}, stats.New(), WithSandboxRoot(root), WithDefaultWorkingDir(outside)); !errors.Is(err, ErrOutsideSandbox) {
+		t.Errorf("Expected a default working directory outside the sandbox to be rejected, got %v", err)
+	}
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New(), WithSandboxRoot(root))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+
+	if _, err := manager.CreateSession("in-root", inside); err != nil {
+		t.Errorf("Expected a working directory in the sandbox to be accepted, got %v", err)
+	}
+	for _, dir := range []string{outside, escape, filepath.Join(inside, "..", "..")} {
+		if _, err := manager.CreateSession("out-of-root", dir); !errors.Is(err, ErrOutsideSandbox) {
+			t.Errorf("CreateSession(%q) = %v, want ErrOutsideSandbox", dir, err)
+		}
+	}
+	if err := manager.SetWorkingDirectory("in-root", escape); !errors.Is(err, ErrOutsideSandbox) {
+		t.Errorf("Expected SetWorkingDirectory through an escaping symlink to fail, got %v", err)
+	}
+	if _, err := manager.ImportSession([]byte(`{"history":[],"working_directory":"` + outside + `"}`)); !errors.Is(err, ErrInvalidImport) {
+		t.Errorf("Expected an import outside the sandbox to be rejected, got %v", err)
+	}
+}
+
+func TestRunPromptExtract(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	tests := []struct {
+		name, mode, response, want string
+	}{
+		{"fenced json", ExtractJSON, "Here you go:\n```json\n{\"a\": 1}\n```\nAnything else?", `{"a": 1}`},
+		{"untagged fence", ExtractJSON, "```\n[1, 2]\n```", "[1, 2]"},
+		{"skips other languages", ExtractJSON, "```python\nprint(1)\n```\n```JSON\n{}\n```", "{}"},
+		{"unclosed fence", ExtractJSON, "```json\n{\"a\":", `{"a":`},
+		{"longer fence", ExtractCode, "````go\nx := \"```\"\n````", "x := \"```\""},
+		{"unfenced", ExtractJSON, `{"a": 1}`, `{"a": 1}`},
+		{"no matching block", ExtractJSON, "```python\nprint(1)\n```", "```python\nprint(1)\n```"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager, err := NewManager(baseDir, &mockA2AClient{response: tt.response}, stats.New())
+			if err != nil {
+				t.Fatalf("NewManager failed: %v", err)
+			}
+			s, err := manager.CreateSession(fmt.Sprintf("extract-%d", i), "")
+			if err != nil {
+				t.Fatalf("CreateSession failed: %v", err)
+			}
+			got, err := manager.RunPrompt(WithExtract(context.Background(), tt.mode), s, "Give me JSON")
+			if err != nil {
+				t.Fatalf("RunPrompt failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("RunPrompt returned %q, want %q", got, tt.want)
+			}
+			reply := s.History[len(s.History)-1]
+			wantRaw := ""
+			if tt.want != tt.response {
+				wantRaw = tt.response
+			}
+			if reply.Text != tt.want || reply.Raw != wantRaw {
+				t.Errorf("Stored turn %+v, want text %q and raw %q", reply, tt.want, wantRaw)
+			}
+		})
+	}
+
+	// Without WithExtract the response is kept as is.
+	manager, _ := NewManager(baseDir, &mockA2AClient{response: "```json\n{}\n```"}, stats.New())
+	s, _ := manager.CreateSession("no-extract", "")
+	if got, _ := manager.RunPrompt(context.Background(), s, "hi"); got != "```json\n{}\n```" {
+		t.Errorf("Expected the response untouched without WithExtract, got %q", got)
+	}
+}
+
+func TestLLMNaming(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	gate := make(chan struct{})
+	client := &mockA2AClient{nameReply: "\"**Planning a Trip to Lisbon**\"\n", nameGate: gate}
+	manager, err := NewManager(baseDir, client, stats.New(), WithLLMNaming(true))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	s, err := manager.CreateSession("named", "")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	// The naming call is blocked, so RunPrompt only returns if it doesn't
+	// wait for it.
+	done := make(chan error, 1)
+	go func() {
+		_, err := manager.RunPrompt(context.Background(), s, "help me plan a week in Lisbon please")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("RunPrompt failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RunPrompt waited for the generated name")
+	}
+	name := func() string {
+		manager.mu.Lock()
+		defer manager.mu.Unlock()
+		return s.Name
+	}
+	if got := name(); got != "help me plan a week" {
+		t.Errorf("Expected the placeholder name, got %q", got)
+	}
+
+	close(gate)
+	for i := 0; i < 200 && name() != "Planning a Trip to Lisbon"; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := name(); got != "Planning a Trip to Lisbon" {
+		t.Fatalf("Expected the generated name, got %q", got)
+	}
+	for i := 0; i < 200; i++ {
+		if loaded, err := manager.load("named"); err == nil && loaded.Name == "Planning a Trip to Lisbon" {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if loaded, err := manager.load("named"); err != nil || loaded.Name != "Planning a Trip to Lisbon" {
+		t.Errorf("Expected the generated name to be saved, got %+v, %v", loaded, err)
+	}
+	if len(s.History) != 2 {
+		t.Errorf("Expected the naming request to stay out of the history, got %+v", s.History)
+	}
+
+	// A conversation renamed before the name arrives keeps its name.
+	gate = make(chan struct{})
+	client.nameGate = gate
+	s2, _ := manager.CreateSession("renamed", "")
+	if _, err := manager.RunPrompt(context.Background(), s2, "another question"); err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	if err := manager.Rename("renamed", "My name"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	close(gate)
+	time.Sleep(50 * time.Millisecond)
+	manager.mu.Lock()
+	got := s2.Name
+	manager.mu.Unlock()
+	if got != "My name" {
+		t.Errorf("Expected the generated name not to replace a user's, got %q", got)
+	}
+}
+
+func TestLLMNamingWhilePrompting(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	gate := make(chan struct{})
+	client := &mockA2AClient{nameReply: "Lisbon Trip", nameGate: gate, delay: 10 * time.Millisecond}
+	manager, err := NewManager(baseDir, client, stats.New(), WithLLMNaming(true))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	s, err := manager.CreateSession("busy", "")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if _, err := manager.RunPrompt(context.Background(), s, "help me plan a week in Lisbon"); err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+
+	// The name arrives while the next prompts update and save the session.
+	const prompts = 5
+	var wg sync.WaitGroup
+	for i := 0; i < prompts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := manager.RunPrompt(context.Background(), s, "and then?"); err != nil {
+				t.Errorf("RunPrompt failed: %v", err)
+			}
+		}()
+	}
+	time.Sleep(15 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+
+	var loaded *Session
+	for i := 0; i < 200; i++ {
+		if loaded, err = manager.load("busy"); err == nil && loaded.Name == "Lisbon Trip" && manager.QueueDepth("busy") == 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err != nil || loaded.Name != "Lisbon Trip" || len(loaded.History) != 2*(prompts+1) {
+		t.Errorf("Expected the name and every turn to be saved, got %+v, %v", loaded, err)
+	}
+}
+
+func TestNamingAfter(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+
+	gate := make(chan struct{})
+	client := &mockA2AClient{nameReply: "Alps Hiking Packing List", nameGate: gate}
+	manager, err := NewManager(baseDir, client, stats.New(), WithLLMNaming(true), WithNamingAfter(3))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	s, err := manager.CreateSession("deferred", "")
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	name := func() string {
+		manager.mu.Lock()
+		defer manager.mu.Unlock()
+		return s.Name
+	}
+
+	for _, prompt := range []string{"hi", "I need a packing list for a hiking trip in the Alps"} {
+		if _, err := manager.RunPrompt(context.Background(), s, prompt); err != nil {
+			t.Fatalf("RunPrompt failed: %v", err)
+		}
+		if got := name(); got != DefaultName {
+			t.Errorf("Expected %q before the third prompt, got %q", DefaultName, got)
+		}
+	}
+
+	if _, err := manager.RunPrompt(context.Background(), s, "thanks"); err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	if got := name(); got != "I need a packing list" {
+		t.Errorf("Expected the placeholder from the longest prompt, got %q", got)
+	}
+	close(gate)
+	for i := 0; i < 200 && name() != "Alps Hiking Packing List"; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := name(); got != "Alps Hiking Packing List" {
+		t.Fatalf("Expected the generated name, got %q", got)
+	}
+	client.mu.Lock()
+	request := client.nameRequest
+	client.mu.Unlock()
+	for _, prompt := range []string{"hi", "hiking trip in the Alps", "thanks"} {
+		if !strings.Contains(request, prompt) {
+			t.Errorf("Expected the naming request to include %q, got %q", prompt, request)
+		}
+	}
+
+	// Without the a2a-server's help, the placeholder stays, and once named
+	// later prompts don't rename the conversation.
+	plain, err := NewManager(baseDir, client, stats.New(), WithNamingAfter(2))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	s2, _ := plain.CreateSession("plain", "")
+	for i, prompt := range []string{"hello", "compare rust and go for a cli", "and for a web server with many users"} {
+		if _, err := plain.RunPrompt(context.Background(), s2, prompt); err != nil {
+			t.Fatalf("RunPrompt failed: %v", err)
+		}
+		want := "compare rust and go for"
+		if i == 0 {
+			want = DefaultName
+		}
+		if s2.Name != want {
+			t.Errorf("Expected %q after prompt %d, got %q", want, i+1, s2.Name)
+		}
+	}
+}
+
+func TestShardedSessionFiles(t *testing.T) {
+	baseDir := setup(t)
+	defer teardown(t)
+	dataDir := filepath.Join(baseDir, "data/conversations")
+
+	flat, err := NewManager(baseDir, &mockA2AClient{}, stats.New())
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	for _, id := range []string{"abc-1", "x"} {
+		if _, err := flat.CreateSession(id, "/tmp"); err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "abc-1.json")); err != nil {
+		t.Fatalf("Expected a flat session file: %v", err)
+	}
+
+	// Existing flat files are moved into shards.
+	manager, err := NewManager(baseDir, &mockA2AClient{}, stats.New(), WithSessionFiles(true, 0600))
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	for _, path := range []string{"ab/abc-1.json", "x/x.json"} {
+		if _, err := os.Stat(filepath.Join(dataDir, path)); err != nil {
+			t.Errorf("Expected %s after migration: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "abc-1.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected the flat file to be moved, got %v", err)
+	}
+
+	if _, err := manager.CreateSession("abd-2", "/tmp"); err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dataDir, "ab/abd-2.json"))
+	if err != nil {
+		t.Fatalf("Expected a sharded session file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+	if info, err := os.Stat(filepath.Join(dataDir, "ab")); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Expected a shard directory with mode 0700, got %v, %v", info, err)
+	}
+	// Files are given the configured mode when next saved.
+	s, err := manager.load("abc-1")
+	if err != nil || s.ID != "abc-1" {
+		t.Fatalf("load failed: %v, %v", s, err)
+	}
+	if err := manager.persist(s); err != nil {
+		t.Fatalf("persist failed: %v", err)
+	}
+	if info, _ := os.Stat(filepath.Join(dataDir, "ab/abc-1.json")); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600 after saving, got %v", info.Mode().Perm())
+	}
+
+	conversations, err := manager.ListConversations()
+	if err != nil {
+		t.Fatalf("ListConversations failed: %v", err)
+	}
+	var ids []string
+	for _, c := range conversations {
+		ids = append(ids, c.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"abc-1", "abd-2", "x"}) {
+		t.Errorf("Unexpected conversations: %v", ids)
+	}
+
+	if err := manager.DeleteSession("abc-1"); err != nil {
+		t.Fatalf("DeleteSession failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "ab/abc-1.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected the session file to be deleted, got %v", err)
+	}
+	if _, err := manager.AcquireSession("abc-1"); err == nil {
+		t.Error("Expected the deleted session to be gone")
+	}
+
+	// Going back to the flat layout moves the files back.
+	if _, err := NewManager(baseDir, &mockA2AClient{}, stats.New()); err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	for _, path := range []string{"abd-2.json", "x.json"} {
+		if _, err := os.Stat(filepath.Join(dataDir, path)); err != nil {
+			t.Errorf("Expected %s after migrating back: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "ab")); !os.IsNotExist(err) {
+		t.Errorf("Expected the empty shard directory to be removed, got %v", err)
+	}
+}
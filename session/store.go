@@ -0,0 +1,194 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrSaveFailed is returned when a session could not be written to disk even
+// after retrying. The in-memory session still holds the latest exchange, so
+// it is written out with the next successful save.
+var ErrSaveFailed = errors.New("failed to save conversation")
+
+// store persists sessions.
+type store interface {
+	save(s *Session) error
+}
+
+// fileStore keeps each session in a JSON file.
+type fileStore struct {
+	files sessionFiles
+}
+
+func (f fileStore) save(s *Session) error {
+	return s.save(f.files)
+}
+
+// defaultSessionFileMode is the permissions of session files unless set
+// WithSessionFiles.
+const defaultSessionFileMode os.FileMode = 0644
+
+// sessionFiles is the layout of the session files under dir: each session is
+// dir/<id>.json or, when sharded, dir/<first two characters of id>/<id>.json.
+type sessionFiles struct {
+	dir   string
+	shard bool
+	mode  os.FileMode
+}
+
+// path returns the file the session with the given ID is kept in.
+func (f sessionFiles) path(id string) string {
+	if f.shard {
+		return filepath.Join(f.dir, shardOf(id), id+".json")
+	}
+	return filepath.Join(f.dir, id+".json")
+}
+
+// shardOf returns the subdirectory holding the session with the given ID in
+// the sharded layout.
+func shardOf(id string) string {
+	return id[:min(len(id), 2)]
+}
+
+// dirMode returns the permissions of shard directories: those of the files,
+// plus search permission wherever they can be read.
+func (f sessionFiles) dirMode() os.FileMode {
+	return f.mode | (f.mode&0444)>>2
+}
+
+// create opens the file of the session with the given ID for writing,
+// creating its shard directory if needed, and gives it the configured
+// permissions.
+func (f sessionFiles) create(id string) (*os.File, error) {
+	path := f.path(id)
+	if f.shard {
+		if err := os.MkdirAll(filepath.Dir(path), f.dirMode()); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.mode)
+	if err != nil {
+		return nil, err
+	}
+	// Files created before the permissions changed, or under a restrictive
+	// umask, get them too.
+	if err := file.Chmod(f.mode); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// ids lists the IDs of the stored sessions, in either layout, sorted.
+func (f sessionFiles) ids() ([]string, error) {
+	located, err := f.locate()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(located))
+	for id := range located {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// locate finds the stored session files, flat or in shard directories, by
+// session ID.
+func (f sessionFiles) locate() (map[string]string, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	located := make(map[string]string)
+	add := func(dir string, entries []os.DirEntry) {
+		for _, entry := range entries {
+			id, ok := strings.CutSuffix(entry.Name(), ".json")
+			if ok && !entry.IsDir() && ValidID(id) {
+				located[id] = filepath.Join(dir, entry.Name())
+			}
+		}
+	}
+	add(f.dir, entries)
+	for _, entry := range entries {
+		if !entry.IsDir() || len(entry.Name()) > 2 || !ValidID(entry.Name()) {
+			continue
+		}
+		dir := filepath.Join(f.dir, entry.Name())
+		shard, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		add(dir, shard)
+	}
+	return located, nil
+}
+
+// migrate moves session files stored in the other layout to where this one
+// expects them, and removes shard directories left empty.
+func (f sessionFiles) migrate() error {
+	located, err := f.locate()
+	if err != nil {
+		return err
+	}
+	moved := 0
+	for id, path := range located {
+		want := f.path(id)
+		if path == want {
+			continue
+		}
+		if f.shard {
+			if err := os.MkdirAll(filepath.Dir(want), f.dirMode()); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(path, want); err != nil {
+			return fmt.Errorf("could not move session file %s: %w", path, err)
+		}
+		if !f.shard {
+			// Fails, harmlessly, while the shard holds other sessions.
+			os.Remove(filepath.Dir(path))
+		}
+		moved++
+	}
+	if moved > 0 {
+		layout := "flat"
+		if f.shard {
+			layout = "sharded"
+		}
+		fmt.Printf("Moved %d session file(s) to the %s layout\n", moved, layout)
+	}
+	return nil
+}
+
+// persist saves the session, retrying with exponential backoff on failure.
+// It saves a copy taken under m.mu, so other goroutines can keep reading and
+// touching the session while it is written.
+func (m *Manager) persist(s *Session) error {
+	m.mu.Lock()
+	snapshot := *s
+	snapshot.History = slices.Clone(s.History)
+	snapshot.Tags = slices.Clone(s.Tags)
+	m.mu.Unlock()
+	s = &snapshot
+
+	backoff := m.saveBackoff
+	var err error
+	for attempt := 0; attempt <= m.saveRetries; attempt++ {
+		if attempt > 0 {
+			fmt.Printf("Failed to save session %s, retrying in %v: %v\n", s.ID, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = m.store.save(s); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %s: %v", ErrSaveFailed, s.ID, err)
+}
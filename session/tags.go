@@ -0,0 +1,106 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// maxTagLength is the longest tag accepted, in bytes.
+const maxTagLength = 50
+
+// ErrInvalidTag is returned for a tag that is empty, too long or contains
+// characters other than letters, digits, '-', '_', '.' and ':'.
+var ErrInvalidTag = errors.New("invalid tag")
+
+// normalizeTags lowercases and trims the tags, and returns them sorted
+// without duplicates.
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !validTag(tag) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidTag, tag)
+		}
+		normalized = append(normalized, tag)
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized), nil
+}
+
+func validTag(tag string) bool {
+	if tag == "" || len(tag) > maxTagLength {
+		return false
+	}
+	for _, r := range tag {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetTags replaces the tags of a session and returns them as stored:
+// lowercased, sorted and without duplicates.
+func (m *Manager) SetTags(sessionID string, tags []string) ([]string, error) {
+	return m.updateTags(sessionID, func([]string) []string { return tags })
+}
+
+// AddTags adds tags to a session and returns all of its tags.
+func (m *Manager) AddTags(sessionID string, tags ...string) ([]string, error) {
+	return m.updateTags(sessionID, func(current []string) []string {
+		return append(slices.Clone(current), tags...)
+	})
+}
+
+// RemoveTags removes tags from a session and returns the remaining ones.
+// Tags the session doesn't have are ignored.
+func (m *Manager) RemoveTags(sessionID string, tags ...string) ([]string, error) {
+	remove, err := normalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	return m.updateTags(sessionID, func(current []string) []string {
+		return slices.DeleteFunc(slices.Clone(current), func(tag string) bool {
+			return slices.Contains(remove, tag)
+		})
+	})
+}
+
+// updateTags sets the session's tags to what update returns for its
+// current ones, and saves it.
+func (m *Manager) updateTags(sessionID string, update func([]string) []string) ([]string, error) {
+	s, err := m.AcquireSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	tags, err := normalizeTags(update(s.Tags))
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	s.Tags = tags
+	m.mu.Unlock()
+	if err := m.persist(s); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// ListConversationsByTag returns the conversations tagged with tag.
+func (m *Manager) ListConversationsByTag(tag string) ([]ConversationInfo, error) {
+	conversations, err := m.ListConversations()
+	if err != nil {
+		return nil, err
+	}
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	tagged := make([]ConversationInfo, 0)
+	for _, c := range conversations {
+		if slices.Contains(c.Tags, tag) {
+			tagged = append(tagged, c)
+		}
+	}
+	return tagged, nil
+}
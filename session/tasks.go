@@ -0,0 +1,163 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"strings"
+	"time"
+
+	"trpc.group/trpc-go/trpc-a2a-go/protocol"
+)
+
+// taskPlaceholder is the history entry recorded while a task is still running.
+func taskPlaceholder(taskID string) Turn {
+	return Turn{Role: RoleAssistant, Text: "(task " + taskID + ")"}
+}
+
+// placeholderTaskID returns the task ID referenced by a placeholder history entry.
+func placeholderTaskID(entry Turn) (string, bool) {
+	if entry.Role != RoleAssistant || !strings.HasPrefix(entry.Text, "(task ") || !strings.HasSuffix(entry.Text, ")") {
+		return "", false
+	}
+	taskID := strings.TrimSuffix(strings.TrimPrefix(entry.Text, "(task "), ")")
+	if taskID == "" || strings.ContainsAny(taskID, " ()") {
+		return "", false
+	}
+	return taskID, true
+}
+
+// WatchTasks restores the tasks still pending in persisted sessions and starts
+// polling the a2a-server every interval, replacing each task's placeholder in
+// the history once it reaches a final state.
+func (m *Manager) WatchTasks(interval time.Duration) error {
+	if err := m.restorePendingTasks(); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			m.pollPendingTasks()
+		}
+	}()
+	return nil
+}
+
+// restorePendingTasks scans the persisted sessions for task placeholders.
+func (m *Manager) restorePendingTasks() error {
+	ids, err := m.files.ids()
+	if err != nil {
+		return fmt.Errorf("could not read sessions directory: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, sessionID := range ids {
+		s, ok := m.sessions[sessionID]
+		if !ok {
+			if s, err = m.load(sessionID); err != nil {
+				fmt.Printf("Error loading conversation %s: %v\n", sessionID, err)
+				continue
+			}
+		}
+		for _, entry := range s.History {
+			if taskID, ok := placeholderTaskID(entry); ok {
+				m.pendingTasks[taskID] = sessionID
+			}
+		}
+	}
+	if len(m.pendingTasks) > 0 {
+		log.Printf("Watching %d pending task(s)\n", len(m.pendingTasks))
+	}
+	return nil
+}
+
+// pollPendingTasks checks every pending task once and resolves the finished ones.
+func (m *Manager) pollPendingTasks() {
+	m.mu.Lock()
+	pending := make(map[string]string, len(m.pendingTasks))
+	for taskID, sessionID := range m.pendingTasks {
+		pending[taskID] = sessionID
+	}
+	m.mu.Unlock()
+
+	for taskID, sessionID := range pending {
+		s, err := m.AcquireSession(sessionID)
+		if err != nil {
+			log.Printf("Error loading conversation %s of task %s: %v\n", sessionID, taskID, err)
+			continue
+		}
+		client, err := m.client(s)
+		if err != nil {
+			log.Printf("Error polling task %s: %v\n", taskID, err)
+			continue
+		}
+		task, err := client.GetTasks(context.Background(), protocol.TaskQueryParams{ID: taskID})
+		if err != nil {
+			log.Printf("Error polling task %s: %v\n", taskID, err)
+			continue
+		}
+		var entry string
+		switch task.Status.State {
+		case protocol.TaskStateCompleted:
+			entry = taskText(task)
+		case protocol.TaskStateFailed, protocol.TaskStateCanceled, protocol.TaskStateRejected:
+			entry = fmt.Sprintf("(task %s %s", taskID, task.Status.State)
+			if task.Status.Message != nil {
+				if text := extractTextFromMessage(task.Status.Message); text != "" {
+					entry += ": " + text
+				}
+			}
+			entry += ")"
+		default:
+			continue
+		}
+		if err := m.resolveTask(sessionID, taskID, entry); err != nil {
+			log.Printf("Error resolving task %s: %v\n", taskID, err)
+		}
+	}
+}
+
+// resolveTask replaces the task's placeholder with an assistant entry holding
+// text and persists the session.
+func (m *Manager) resolveTask(sessionID, taskID, text string) error {
+	s, err := m.AcquireSession(sessionID)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			m.mu.Lock()
+			delete(m.pendingTasks, taskID)
+			m.mu.Unlock()
+		}
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pendingTasks, taskID)
+	placeholder := taskPlaceholder(taskID)
+	for i, h := range s.History {
+		if h == placeholder {
+			s.History[i] = Turn{Role: RoleAssistant, Text: text}
+			return s.save(m.files)
+		}
+	}
+	return nil
+}
+
+// taskText collects the response text of a finished task from its artifacts,
+// falling back to its final status message.
+func taskText(task *protocol.Task) string {
+	var text strings.Builder
+	for _, artifact := range task.Artifacts {
+		for _, part := range artifact.Parts {
+			if textPart, ok := part.(*protocol.TextPart); ok {
+				text.WriteString(textPart.Text)
+			}
+		}
+	}
+	if text.Len() == 0 && task.Status.Message != nil {
+		return extractTextFromMessage(task.Status.Message)
+	}
+	return text.String()
+}
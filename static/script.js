@@ -65,7 +65,7 @@ document.addEventListener('DOMContentLoaded', () => {
         conversationsList.innerHTML = '';
         conversations.forEach(conv => {
             const li = document.createElement('li');
-            li.textContent = conv.name;
+            li.textContent = conv.pinned ? `📌 ${conv.name}` : conv.name;
             li.dataset.id = conv.id;
             li.addEventListener('click', () => selectConversation(conv.id));
             conversationsList.appendChild(li);
@@ -75,24 +75,32 @@ document.addEventListener('DOMContentLoaded', () => {
     const renderTasks = async () => {
         const tasks = await api.getTasks();
         tasksList.innerHTML = '';
-        tasks.forEach(taskName => {
+        tasks.forEach(task => {
             const li = document.createElement('li');
-            li.textContent = taskName;
-            li.dataset.name = taskName;
-            li.addEventListener('click', () => selectTask(taskName));
+            li.textContent = task.name;
+            li.dataset.name = task.name;
+            if (task.next_run) {
+                li.title = `Next run: ${new Date(task.next_run).toLocaleString()}`;
+                if (task.zone && task.next_run_utc) {
+                    li.title += ` (${new Date(task.next_run).toLocaleString([], { timeZone: task.zone })} ${task.zone}, ${task.next_run_utc})`;
+                }
+            }
+            if (task.schedule_error) {
+                li.textContent += ' (not scheduled)';
+                li.title = `Not scheduled: ${task.schedule_error}`;
+            }
+            li.addEventListener('click', () => selectTask(task.name));
             tasksList.appendChild(li);
         });
     };
 
     const renderChatHistory = (history) => {
         chatHistory.innerHTML = '';
-        history.forEach(line => {
-            const parts = line.split(': ');
-            const type = parts[0];
-            const content = parts.slice(1).join(': ');
+        history.forEach(turn => {
+            const type = turn.role === 'user' ? 'user' : 'gemini';
             const messageDiv = document.createElement('div');
-            messageDiv.className = `message ${type.toLowerCase()}`;
-            messageDiv.textContent = content;
+            messageDiv.className = `message ${type}`;
+            messageDiv.textContent = turn.text;
             chatHistory.appendChild(messageDiv);
         });
         chatHistory.scrollTop = chatHistory.scrollHeight;
@@ -125,12 +133,28 @@ document.addEventListener('DOMContentLoaded', () => {
         taskForm.elements.name.value = task.name;
         taskForm.elements.description.value = task.description;
         taskForm.elements.schedule.value = task.schedule;
+        taskForm.elements.run_at.value = task.run_at || '';
+        taskForm.elements.run_if_past.checked = !!task.run_if_past;
+        taskForm.dataset.runAt = task.run_at || '';
+        taskForm.dataset.completedAt = task.completed_at || '';
+        taskForm.elements.depends_on.value = task.depends_on || '';
+        taskForm.elements.timezone.value = task.timezone || '';
+        taskForm.elements.catch_up.checked = !!task.catch_up;
+        taskForm.elements.overlap_policy.value = task.overlap_policy || (task.allow_overlap ? 'allow' : 'skip');
+        taskForm.elements.proceed_on_error.checked = !!task.proceed_on_error;
+        taskForm.elements.webhook_url.value = task.webhook_url || '';
+        taskForm.elements.slack_webhook.value = task.slack_webhook || '';
+        taskForm.elements.discord_webhook.value = task.discord_webhook || '';
+        taskForm.elements.notify_on.value = task.notify_on || 'always';
+        taskForm.elements.email_to.value = (task.email_to || []).join(', ');
+        taskForm.elements.email_on.value = task.email_on || 'always';
         taskForm.elements.context_path.value = task.context_path;
         taskForm.elements.data_command.value = task.data_command;
         taskForm.elements.prompt.value = task.prompt;
+        taskForm.elements.output_command.value = task.output_command || '';
 
         const logs = await api.getTaskLogs(taskName);
-        taskLogs.textContent = logs.join('\n\n---\n\n');
+        taskLogs.textContent = logs.map(log => log.content).join('\n\n---\n\n');
         taskLogsView.style.display = 'block';
         
         showView(taskView);
@@ -344,9 +368,25 @@ document.addEventListener('DOMContentLoaded', () => {
                 name: taskName,
                 description: taskForm.elements.description.value,
                 schedule: taskForm.elements.schedule.value,
+                run_at: taskForm.elements.run_at.value,
+                run_if_past: taskForm.elements.run_if_past.checked,
+                // Changing run_at arms a completed one-shot task again.
+                completed_at: taskForm.elements.run_at.value === taskForm.dataset.runAt ? taskForm.dataset.completedAt : '',
+                depends_on: taskForm.elements.depends_on.value,
+                timezone: taskForm.elements.timezone.value,
+                catch_up: taskForm.elements.catch_up.checked,
+                overlap_policy: taskForm.elements.overlap_policy.value,
+                proceed_on_error: taskForm.elements.proceed_on_error.checked,
+                webhook_url: taskForm.elements.webhook_url.value,
+                slack_webhook: taskForm.elements.slack_webhook.value,
+                discord_webhook: taskForm.elements.discord_webhook.value,
+                notify_on: taskForm.elements.notify_on.value,
+                email_to: taskForm.elements.email_to.value.split(',').map(s => s.trim()).filter(s => s),
+                email_on: taskForm.elements.email_on.value,
                 context_path: taskForm.elements.context_path.value,
                 data_command: taskForm.elements.data_command.value,
                 prompt: taskForm.elements.prompt.value,
+                output_command: taskForm.elements.output_command.value,
             };
             await api.updateTask(taskName, task);
             alert('Task saved!');